@@ -0,0 +1,106 @@
+package esec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mscno/esec/pkg/blob"
+	"github.com/mscno/esec/pkg/crypto"
+	"github.com/mscno/esec/pkg/fileutils"
+	"github.com/mscno/esec/pkg/format"
+)
+
+// BlobExtension is appended to the name of a file encrypted as an opaque blob,
+// so that "tls.key" is encrypted to "tls.key.esec".
+const BlobExtension = ".esec"
+
+// EncryptBlob encrypts everything read from in as a single opaque blob to
+// publicKey, and writes the blob to out. Unlike Encrypt, it works on any data,
+// binary or unstructured, and streams it, so the data does not need to fit in
+// memory. See the blob package for the format.
+func EncryptBlob(in io.Reader, out io.Writer, publicKey string) error {
+	return blob.Encrypt(out, in, publicKey)
+}
+
+// EncryptFileToBlob encrypts the file at filePath as an opaque blob to
+// publicKey, writing it next to the file with BlobExtension appended to its
+// name. The blob is written atomically, so a failure never leaves a partial
+// blob behind. It returns the path of the blob.
+func EncryptFileToBlob(filePath, publicKey string) (string, error) {
+	in, err := os.Open(filePath) //nolint:gosec // File path is user-provided
+	if err != nil {
+		return "", err
+	}
+	defer in.Close() //nolint:errcheck // Read-only file
+
+	blobPath := filePath + BlobExtension
+	err = fileutils.WriteAtomic(blobPath, 0o644, func(w io.Writer) error {
+		return blob.Encrypt(w, in, publicKey)
+	})
+	if err != nil {
+		return "", err
+	}
+	return blobPath, nil
+}
+
+// IsBlobFile reports whether the file at filePath is an opaque blob, judging
+// by its header rather than its name.
+func IsBlobFile(filePath string) (bool, error) {
+	f, err := os.Open(filePath) //nolint:gosec // File path is user-provided
+	if err != nil {
+		return false, err
+	}
+	defer f.Close() //nolint:errcheck // Read-only file
+
+	start := make([]byte, len(blob.Magic))
+	n, err := io.ReadFull(f, start)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	return blob.IsBlob(start[:n]), nil
+}
+
+// DecryptBlob decrypts an opaque blob read from in and writes the data to out.
+// The private key is looked up for envName as DecryptFile does, unless
+// userSuppliedPrivateKey is set. The data is written as it is authenticated,
+// so if an error is returned, what was written to out must be discarded.
+func DecryptBlob(in io.Reader, out io.Writer, envName, keydir, userSuppliedPrivateKey string) error {
+	privkey, err := findPrivateKey(keydir, envName, userSuppliedPrivateKey)
+	if err != nil {
+		return err
+	}
+	defer privkey.Destroy()
+	return DecryptBlobWithKey(in, out, privkey)
+}
+
+// DecryptBlobWithKey is like DecryptBlob, but decrypts with the private key held
+// by key instead of looking one up. The handle is left for the caller to Destroy.
+func DecryptBlobWithKey(in io.Reader, out io.Writer, key *crypto.KeyHandle) error {
+	r := bufio.NewReader(in)
+	header, err := blob.ReadHeader(r)
+	if err != nil {
+		return err
+	}
+
+	decrypter, err := crypto.NewDecrypter(key)
+	if err != nil {
+		return err
+	}
+	defer decrypter.Wipe()
+
+	// Check the key up front for a clearer error than a failed decryption
+	if !crypto.IsHybridPublicKey(header.PublicKey) {
+		pub, err := format.ParsePublicKey(header.PublicKey)
+		if err != nil {
+			return err
+		}
+		if pub != decrypter.Keypair.Public {
+			return fmt.Errorf("private key does not match the blob's public key (fingerprint %s)", crypto.Fingerprint(pub))
+		}
+	}
+
+	return blob.Decrypt(out, r, header, decrypter)
+}
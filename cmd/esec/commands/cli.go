@@ -2,11 +2,15 @@
 package commands
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 
 	"github.com/alecthomas/kong"
@@ -16,10 +20,13 @@ import (
 type cliCtx struct {
 	Logger *slog.Logger
 	Ctx    context.Context //nolint:containedctx // CLI context needs to pass context to subcommands
+	// Naming is the naming template environment names are resolved with.
+	Naming fileutils.NamingTemplate
 }
 
 type cli struct {
 	Keygen  KeygenCmd  `cmd:"" help:"Generate key"`
+	Key     KeyCmd     `cmd:"" help:"Manage private keys"`
 	Encrypt EncryptCmd `cmd:"" help:"Encrypt a secret"`
 	Decrypt DecryptCmd `cmd:"" help:"Decrypt a secret"`
 	Get     GetCmd     `cmd:"" help:"Decrypt a secret and extract a specific key"`
@@ -27,6 +34,7 @@ type cli struct {
 
 	Version kong.VersionFlag `help:"Show version"`
 	Debug   bool             `help:"Enable debug mode"`
+	Naming  string           `help:"Naming template of environment files, such as '{dir}/secrets/{env}{ext}'" env:"ESEC_NAMING_TEMPLATE" placeholder:"TEMPLATE"`
 }
 
 // Execute runs the CLI with the given version string.
@@ -50,11 +58,14 @@ func Execute(version string) {
 		Level: logLevel,
 	}))
 
-	err := ctx.Run(&cliCtx{Ctx: context.Background(), Logger: logger})
+	naming := fileutils.NamingTemplate(cli.Naming)
+	ctx.FatalIfErrorf(naming.Validate())
+
+	err := ctx.Run(&cliCtx{Ctx: context.Background(), Logger: logger, Naming: naming})
 	ctx.FatalIfErrorf(err)
 }
 
-func processFileOrEnv(input string, defaultFileFormat fileutils.FileFormat) (filename string, err error) {
+func processFileOrEnv(input string, defaultFileFormat fileutils.FileFormat, naming fileutils.NamingTemplate) (filename string, err error) {
 	// This is a helper function, so we can't use the context logger directly
 	// Debug logs for this function will be handled by the calling functions
 
@@ -87,6 +98,19 @@ func processFileOrEnv(input string, defaultFileFormat fileutils.FileFormat) (fil
 		}
 	}
 
+	// Names following a custom naming template are files too
+	if !isFile && naming != "" && naming != fileutils.DefaultNamingTemplate {
+		_, _, isFile = naming.Match(input)
+	}
+
+	// Any other existing file is taken as it is, its format detected from its
+	// content. Environment names have no dots or separators, so they never clash.
+	if !isFile && strings.ContainsAny(input, "./\\") {
+		if info, err := os.Stat(input); err == nil && info.Mode().IsRegular() {
+			isFile = true
+		}
+	}
+
 	if isFile {
 		return input, nil
 	}
@@ -104,7 +128,62 @@ func processFileOrEnv(input string, defaultFileFormat fileutils.FileFormat) (fil
 		}
 	}
 
-	// Generate filename using the default format (.env)
-	filename = fileutils.GenerateFilename(defaultFileFormat, environment)
-	return path.Clean(filename), nil
+	// Generate filename using the default format and the naming template
+	return filepath.FromSlash(naming.Filename(".", defaultFileFormat, environment)), nil
+}
+
+// parseFormatFlag parses the --format flag. It returns "" if the flag is not
+// set, leaving the format of files to be detected.
+func parseFormatFlag(flag string) (fileutils.FileFormat, error) {
+	if flag == "" {
+		return "", nil
+	}
+	format, err := fileutils.ParseFormat(flag)
+	if err != nil {
+		return "", fmt.Errorf("error parsing format flag %q: %v", flag, err)
+	}
+	return format, nil
+}
+
+// resolveFormat returns override if it is set, and otherwise the format of the
+// file, from its name under the naming template or its content.
+func resolveFormat(fileName string, override fileutils.FileFormat, naming fileutils.NamingTemplate) (fileutils.FileFormat, error) {
+	if override != "" {
+		return override, nil
+	}
+	if format, _, ok := naming.Match(fileName); ok {
+		return format, nil
+	}
+	data, err := os.ReadFile(fileName) //nolint:gosec // File path is user-provided
+	if err != nil {
+		return "", err
+	}
+	format, err := fileutils.DetectFormat(fileName, data)
+	if err != nil {
+		return "", withFormatHint(fmt.Errorf("cannot determine the format of %s: %w", fileName, err))
+	}
+	return format, nil
+}
+
+// withFormatHint points to the --format flag if err is about detecting the
+// format of a file.
+func withFormatHint(err error) error {
+	if errors.Is(err, fileutils.ErrAmbiguousFormat) || errors.Is(err, fileutils.ErrUnknownFormat) {
+		return fmt.Errorf("%w; set the format with --format", err)
+	}
+	return err
+}
+
+// writeOutput calls write with stdout if output is empty, and otherwise with
+// the file at output, which is replaced atomically once write succeeds. A new
+// file gets the permissions perm.
+func writeOutput(output string, perm os.FileMode, write func(w io.Writer) error) error {
+	if output != "" {
+		return fileutils.WriteAtomic(output, perm, write)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err := write(w); err != nil {
+		return err
+	}
+	return w.Flush()
 }
@@ -29,6 +29,85 @@ func TestKeygenCmd(t *testing.T) {
 	assert.Contains(t, out, "Private Key:")
 }
 
+func TestKeygenCmdPQ(t *testing.T) {
+	cmd := &KeygenCmd{PQ: true}
+
+	out, err := captureOutput(func() error {
+		return cmd.Run(&cliCtx{Logger: slog.Default()})
+	})
+
+	assert.Equal(t, err, "")
+	assert.Contains(t, out, "Public Key:\nesec-pq1-pub-")
+	assert.Contains(t, out, "Private Key:\nesec-pq1-priv-")
+}
+
+func TestKeygenCmdAge(t *testing.T) {
+	cmd := &KeygenCmd{Age: true}
+
+	out, err := captureOutput(func() error {
+		return cmd.Run(&cliCtx{Logger: slog.Default()})
+	})
+
+	assert.Equal(t, err, "")
+	assert.Contains(t, out, "Public Key:\nage1")
+	assert.Contains(t, out, "Private Key:\nAGE-SECRET-KEY-1")
+}
+
+func TestKeygenCmdDerive(t *testing.T) {
+	t.Setenv("ESEC_MASTER_KEY", "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	cmd := &KeygenCmd{Derive: "prod"}
+
+	out, err := captureOutput(func() error {
+		return cmd.Run(&cliCtx{Logger: slog.Default()})
+	})
+
+	assert.Equal(t, err, "")
+	assert.Equal(t, out, "Public Key:\nd73f459445f2e1000c6eb17306e0509291fb16fc2ced88638d472196ac67cc1b\nPrivate Key:\n44087fbe24bfa7649139f1e084df22d26cef7d4aba266d093092f22ea08b46ee\n")
+}
+
+func TestKeygenCmdDeriveWithoutMasterKey(t *testing.T) {
+	t.Setenv("ESEC_MASTER_KEY", "")
+	os.Unsetenv("ESEC_MASTER_KEY")
+	cmd := &KeygenCmd{Derive: "prod"}
+
+	_, err := captureOutput(func() error {
+		return cmd.Run(&cliCtx{Logger: slog.Default()})
+	})
+
+	assert.Contains(t, err, "ESEC_MASTER_KEY must be set")
+}
+
+func TestKeySplitAndCombineCmd(t *testing.T) {
+	t.Setenv("ESEC_PRIVATE_KEY", "24ab5041def8c84077bacce66524cc2ad37266ada17429e8e3c1db534dd2c2c5")
+
+	split := &KeySplitCmd{Shares: 3, Threshold: 2, KeyDir: t.TempDir()}
+	out, err := captureOutput(func() error {
+		return split.Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, err, "")
+	assert.Contains(t, out, "Share 3 of 3")
+
+	shares, readErr := readShares(strings.NewReader(out))
+	assert.NoError(t, readErr)
+	assert.Equal(t, 3, len(shares))
+
+	combine := &KeyCombineCmd{
+		Shares: shares[1:],
+		Pubkey: "493ffcfba776a045fba526acb0baff44c9639b98b9f27123cca67c808d4e171d",
+	}
+	out, err = captureOutput(func() error {
+		return combine.Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, err, "")
+	assert.Equal(t, out, "Private Key:\n24ab5041def8c84077bacce66524cc2ad37266ada17429e8e3c1db534dd2c2c5\n")
+
+	combine.Pubkey = "8d8647e2eeb6d2e31228e6df7da3df921ec3b799c3f66a171cd37a1ed3004e7d"
+	_, err = captureOutput(func() error {
+		return combine.Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Contains(t, err, "does not match")
+}
+
 //nolint:dupl // Test functions have similar structure but test different scenarios
 func TestEncryptCmd(t *testing.T) {
 	// Create a temporary file
@@ -175,6 +254,62 @@ func TestGetCmdMissing(t *testing.T) {
 	assert.Equal(t, errString, `key "missing" not found in decrypted content`)
 }
 
+func TestGetCmdDetectedFormat(t *testing.T) {
+	t.Setenv("ESEC_PRIVATE_KEY", "24ab5041def8c84077bacce66524cc2ad37266ada17429e8e3c1db534dd2c2c5")
+	dir := t.TempDir()
+
+	// The name gives no format, so it is detected from the content
+	jsonPath := filepath.Join(dir, "secrets.prod.json")
+	assert.NoError(t, os.WriteFile(jsonPath, []byte(`{"_ESEC_PUBLIC_KEY": "493ffcfba776a045fba526acb0baff44c9639b98b9f27123cca67c808d4e171d", "secret": "hello"}`), 0o600))
+	_, errString := captureOutput(func() error {
+		return (&EncryptCmd{File: jsonPath}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, errString, "")
+
+	out, errString := captureOutput(func() error {
+		return (&GetCmd{File: jsonPath, Key: "secret"}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, errString, "")
+	assert.Equal(t, out, "hello")
+
+	// Content valid as both dotenv and TOML needs --format
+	envPath := filepath.Join(dir, "secrets")
+	assert.NoError(t, os.WriteFile(envPath, []byte("ESEC_PUBLIC_KEY=\"493ffcfba776a045fba526acb0baff44c9639b98b9f27123cca67c808d4e171d\"\nsecret=\"hello\"\n"), 0o600))
+	_, errString = captureOutput(func() error {
+		return (&EncryptCmd{File: envPath}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Contains(t, errString, "ambiguous content: could be .env or .etoml; set the format with --format")
+
+	_, errString = captureOutput(func() error {
+		return (&EncryptCmd{File: envPath, Format: ".env"}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, errString, "")
+}
+
+func TestGetCmdEnvExtractor(t *testing.T) {
+	t.Setenv("ESEC_PRIVATE_KEY", "24ab5041def8c84077bacce66524cc2ad37266ada17429e8e3c1db534dd2c2c5")
+	dir := t.TempDir()
+
+	// Formats other than JSON are read as their env extractor reads them
+	iniPath := filepath.Join(dir, ".eini")
+	assert.NoError(t, os.WriteFile(iniPath, []byte("ESEC_PUBLIC_KEY = 493ffcfba776a045fba526acb0baff44c9639b98b9f27123cca67c808d4e171d\nSECRET = hello\n\n[database]\npassword = secret\n"), 0o600))
+	_, errString := captureOutput(func() error {
+		return (&EncryptCmd{File: iniPath}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, errString, "")
+
+	out, errString := captureOutput(func() error {
+		return (&GetCmd{File: iniPath, Key: "SECRET"}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, errString, "")
+	assert.Equal(t, out, "hello")
+
+	_, errString = captureOutput(func() error {
+		return (&GetCmd{File: iniPath, Key: "database.password"}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Contains(t, errString, "not found")
+}
+
 func TestProcessFileOrEnv(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -268,7 +403,7 @@ func TestProcessFileOrEnv(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotFilename, err := processFileOrEnv(tt.input, fileutils.Ejson)
+			gotFilename, err := processFileOrEnv(tt.input, fileutils.Ejson, "")
 
 			// Check error cases
 			if tt.wantErr {
@@ -299,6 +434,193 @@ func TestProcessFileOrEnv(t *testing.T) {
 	}
 }
 
+func TestProcessFileOrEnvNamingTemplate(t *testing.T) {
+	naming := fileutils.NamingTemplate("{dir}/secrets/{env}{ext}")
+	tests := []struct {
+		input        string
+		wantFilename string
+	}{
+		{"prod", filepath.Join("secrets", "prod.ejson")},
+		{"", filepath.Join("secrets", ".ejson")},
+		{"services/api/secrets/dev.eyaml", "services/api/secrets/dev.eyaml"},
+		{".ejson.dev", ".ejson.dev"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			gotFilename, err := processFileOrEnv(tt.input, fileutils.Ejson, naming)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantFilename, gotFilename)
+		})
+	}
+}
+
+func TestDecryptCmdNamingTemplate(t *testing.T) {
+	t.Setenv("ESEC_PRIVATE_KEY_DEV", "24ab5041def8c84077bacce66524cc2ad37266ada17429e8e3c1db534dd2c2c5")
+	dir := filepath.Join(t.TempDir(), "secrets")
+	assert.NoError(t, os.Mkdir(dir, 0o700))
+	file := filepath.Join(dir, "dev.ejson")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"_ESEC_PUBLIC_KEY":"493ffcfba776a045fba526acb0baff44c9639b98b9f27123cca67c808d4e171d","secret": "ESEC[1:HMvqzjm4wFgQzL0qo6fDsgfiS1e7y1knsTvgskUEvRo=:gwjm0ng6DE3FlL8F617cRMb8cBeJ2v1b:KryYDmzxT0OxjuLlIgZHx73DhNvE]"}`), 0o600))
+
+	// The environment, and so the key, comes from the name under the template
+	out, errString := captureOutput(func() error {
+		return (&DecryptCmd{File: file}).Run(&cliCtx{Logger: slog.Default(), Naming: "{dir}/secrets/{env}{ext}"})
+	})
+	assert.Equal(t, errString, "")
+	assert.Contains(t, out, `"secret": "hello"`)
+}
+
+func TestEncryptDecryptCmdStdin(t *testing.T) {
+	pub := "493ffcfba776a045fba526acb0baff44c9639b98b9f27123cca67c808d4e171d"
+	t.Setenv("ESEC_PRIVATE_KEY_PROD", "24ab5041def8c84077bacce66524cc2ad37266ada17429e8e3c1db534dd2c2c5")
+	dir := t.TempDir()
+
+	// The public key is embedded, as the exported secrets have none
+	withStdin(t, `{"secret": "hello"}`)
+	encrypted, errString := captureOutput(func() error {
+		return (&EncryptCmd{File: "-", Format: "ejson", PubKey: pub}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, errString, "")
+	assert.Contains(t, encrypted, pub)
+	assert.NotContains(t, encrypted, "hello")
+
+	withStdin(t, encrypted)
+	out := filepath.Join(dir, "secrets.json")
+	_, errString = captureOutput(func() error {
+		return (&DecryptCmd{File: "-", Format: ".ejson", Env: "prod", Output: out}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, errString, "")
+	decrypted, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"_ESEC_PUBLIC_KEY": "`+pub+`", "secret": "hello"}`, string(decrypted))
+	info, err := os.Stat(out)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// The file and environment must be given, as there is no name to take them from
+	withStdin(t, encrypted)
+	_, errString = captureOutput(func() error {
+		return (&DecryptCmd{File: "-", Format: ".ejson"}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Contains(t, errString, "requires --format and --env")
+	_, errString = captureOutput(func() error {
+		return (&EncryptCmd{File: "-", PubKey: pub}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Contains(t, errString, "requires --format")
+}
+
+func TestEncryptCmdOutput(t *testing.T) {
+	dir := t.TempDir()
+	in := `{"_ESEC_PUBLIC_KEY": "493ffcfba776a045fba526acb0baff44c9639b98b9f27123cca67c808d4e171d", "secret": "hello"}`
+	file := filepath.Join(dir, "secrets.json")
+	assert.NoError(t, os.WriteFile(file, []byte(in), 0o600))
+
+	out := filepath.Join(dir, ".ejson.prod")
+	_, errString := captureOutput(func() error {
+		return (&EncryptCmd{File: file, Format: ".ejson", Output: out}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, errString, "")
+
+	unchanged, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, in, string(unchanged))
+	encrypted, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "hello")
+}
+
+func TestEncryptDecryptCmdDetached(t *testing.T) {
+	pub := "493ffcfba776a045fba526acb0baff44c9639b98b9f27123cca67c808d4e171d"
+	t.Setenv("ESEC_PRIVATE_KEY_PROD", "24ab5041def8c84077bacce66524cc2ad37266ada17429e8e3c1db534dd2c2c5")
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, ".ejson.prod")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"secret": "hello"}`), 0o600))
+
+	_, errString := captureOutput(func() error {
+		return (&EncryptCmd{File: file, PubKey: pub, Detached: true}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, errString, "")
+	encrypted, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "hello")
+	assert.NotContains(t, string(encrypted), pub)
+
+	_, errString = captureOutput(func() error {
+		return (&DecryptCmd{File: file, KeyDir: dir}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Contains(t, errString, "public key")
+
+	out, errString := captureOutput(func() error {
+		return (&DecryptCmd{File: file, KeyDir: dir, PubKey: pub}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, errString, "")
+	assert.Contains(t, out, `"secret": "hello"`)
+}
+
+func TestEncryptCmdRecursive(t *testing.T) {
+	pub := "493ffcfba776a045fba526acb0baff44c9639b98b9f27123cca67c808d4e171d"
+	dir := t.TempDir()
+	files := map[string]string{
+		".ejson.dev":            `{"_ESEC_PUBLIC_KEY": "` + pub + `", "secret": "hello"}`,
+		"services/api/.env.dev": "ESEC_PUBLIC_KEY=" + pub + "\nSECRET=hello\n",
+		"services/web/.ejson":   `{"secret": "hello"}`,
+		"vendor/.ejson":         `{"secret": "hello"}`,
+		".esecignore":           "vendor/\n",
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0o700))
+		assert.NoError(t, os.WriteFile(p, []byte(data), 0o600))
+	}
+
+	out, errString := captureOutput(func() error {
+		return (&EncryptCmd{File: dir, Recursive: true, DryRun: true}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Equal(t, errString, "")
+	assert.Equal(t, strings.Join([]string{
+		filepath.Join(dir, ".ejson.dev"),
+		filepath.Join(dir, "services/api/.env.dev"),
+		filepath.Join(dir, "services/web/.ejson"),
+	}, "\n")+"\n", out)
+
+	// The file without a public key fails, without stopping the others
+	_, errString = captureOutput(func() error {
+		return (&EncryptCmd{File: dir, Recursive: true}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Contains(t, errString, "failed to encrypt 1 of 3 files")
+	for name, encrypted := range map[string]bool{
+		".ejson.dev":            true,
+		"services/api/.env.dev": true,
+		"services/web/.ejson":   false,
+		"vendor/.ejson":         false,
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, encrypted, !strings.Contains(string(data), "hello"), name)
+	}
+
+	_, errString = captureOutput(func() error {
+		return (&EncryptCmd{File: dir, Recursive: true, Output: "out"}).Run(&cliCtx{Logger: slog.Default()})
+	})
+	assert.Contains(t, errString, "--recursive cannot be used with")
+}
+
+// withStdin replaces stdin with data for the rest of the test.
+func withStdin(t *testing.T, data string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "stdin")
+	assert.NoError(t, os.WriteFile(file, []byte(data), 0o600))
+	f, err := os.Open(file)
+	assert.NoError(t, err)
+	oldIn := os.Stdin
+	os.Stdin = f
+	t.Cleanup(func() {
+		os.Stdin = oldIn
+		f.Close()
+	})
+}
+
 // Helper function to capture CLI output
 func captureOutput(f func() error) (string, string) {
 	// Save original stdout and stderr
@@ -1,26 +1,36 @@
 package commands
 
 import (
+	"bufio"
+	"cmp"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 
 	"github.com/mscno/esec"
+	"github.com/mscno/esec/pkg/blob"
 	"github.com/mscno/esec/pkg/fileutils"
 )
 
 // DecryptCmd decrypts a secrets file.
 type DecryptCmd struct {
 	File         string `arg:"" help:"File or Environment to decrypt" default:""`
-	Format       string `help:"File format" default:".ejson" short:"f"`
+	Format       string `help:"File format, overriding the one given by the file's name or detected from its content (.ejson for environment names)" short:"f"`
 	KeyFromStdin bool   `help:"Read the key from stdin" short:"k"`
 	KeyDir       string `help:"Directory containing the '.esec_keyring' file" default:"." short:"d"`
+	Env          string `help:"Environment whose private key decrypts stdin or an opaque blob, whose name does not give one; required for stdin" short:"e"`
+	Output       string `help:"Write the decrypted file to this path, with owner-only permissions, rather than to stdout" short:"o"`
+	PubKey       string `help:"Public key of files that do not embed one, instead of ESEC_PUBLIC_KEY_<ENV>, the public_keys of .esec.yaml or a header comment" name:"pubkey"`
 }
 
 // Run executes the decrypt command.
 func (c *DecryptCmd) Run(ctx *cliCtx) error {
-	ctx.Logger.Debug("decrypting secret", "file", c.File, "format", c.Format, "key_dir", c.KeyDir, "key_from_stdin", c.KeyFromStdin)
+	ctx.Logger.Debug("decrypting secret", "file", c.File, "format", c.Format, "key_dir", c.KeyDir, "key_from_stdin", c.KeyFromStdin, "output", c.Output)
+
+	if c.File == "-" {
+		return c.decryptStdin(ctx)
+	}
 
 	var key string
 	if c.KeyFromStdin {
@@ -36,14 +46,19 @@ func (c *DecryptCmd) Run(ctx *cliCtx) error {
 		ctx.Logger.Debug("using key from keyring", "key_dir", c.KeyDir)
 	}
 
-	format, err := fileutils.ParseFormat(c.Format)
+	// Opaque blobs are recognized by their header, whatever their name
+	if isBlob, _ := esec.IsBlobFile(c.File); isBlob {
+		return c.decryptBlob(ctx, key)
+	}
+
+	format, err := parseFormatFlag(c.Format)
 	if err != nil {
 		ctx.Logger.Debug("format parsing failed", "format", c.Format, "error", err)
-		return fmt.Errorf("error parsing format flag %q: %v", c.Format, err)
+		return err
 	}
 	ctx.Logger.Debug("parsed format", "format_type", format)
 
-	fileName, err := processFileOrEnv(c.File, format)
+	fileName, err := processFileOrEnv(c.File, cmp.Or(format, fileutils.Ejson), ctx.Naming)
 	if err != nil {
 		ctx.Logger.Debug("file/env processing failed", "input", c.File, "error", err)
 		return fmt.Errorf("error processing file or env: %v", err)
@@ -63,13 +78,91 @@ func (c *DecryptCmd) Run(ctx *cliCtx) error {
 	ctx.Logger.Debug("file details", "path", fileName, "size", fileInfo.Size(), "mode", fileInfo.Mode())
 
 	ctx.Logger.Debug("decrypting file", "path", fileName)
-	data, err := esec.DecryptFile(fileName, c.KeyDir, key)
+	data, err := esec.DecryptFileWithConfig(fileName, esec.DecryptFileConfig{
+		KeyDir:         c.KeyDir,
+		PrivateKey:     key,
+		Format:         esec.FileFormat(format),
+		NamingTemplate: string(ctx.Naming),
+		PublicKey:      c.PubKey,
+	})
 	if err != nil {
 		ctx.Logger.Debug("decryption failed", "path", fileName, "error", err)
-		return fmt.Errorf("error decrypting file %s: %v", fileName, err)
+		return fmt.Errorf("error decrypting file %s: %v", fileName, withFormatHint(err))
 	}
 
 	ctx.Logger.Debug("decryption successful", "path", fileName, "bytes", len(data))
+	if c.Output != "" {
+		if err := fileutils.WriteFileAtomic(c.Output, data, 0o600); err != nil {
+			return fmt.Errorf("error writing %s: %v", c.Output, err)
+		}
+		return nil
+	}
 	fmt.Println(string(data))
 	return nil
 }
+
+// decryptStdin decrypts the data read from stdin, an opaque blob or a file in
+// the given format, and writes it as it is to stdout or the output file.
+func (c *DecryptCmd) decryptStdin(ctx *cliCtx) error {
+	if c.KeyFromStdin {
+		return fmt.Errorf("cannot read both the key and the file to decrypt from stdin")
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	start, _ := in.Peek(len(blob.Magic))
+	if blob.IsBlob(start) {
+		ctx.Logger.Debug("decrypting blob from stdin", "env", c.Env)
+		err := writeOutput(c.Output, 0o600, func(w io.Writer) error {
+			return esec.DecryptBlob(in, w, c.Env, c.KeyDir, "")
+		})
+		if err != nil {
+			ctx.Logger.Debug("decryption failed", "error", err)
+			return fmt.Errorf("error decrypting stdin, discard any output: %v", err)
+		}
+		return nil
+	}
+
+	format, err := parseFormatFlag(c.Format)
+	if err != nil {
+		ctx.Logger.Debug("format parsing failed", "format", c.Format, "error", err)
+		return err
+	}
+	if format == "" || c.Env == "" {
+		return fmt.Errorf("reading from stdin requires --format and --env, which the file name gives otherwise")
+	}
+
+	ctx.Logger.Debug("decrypting stdin", "format", format, "env", c.Env)
+	err = writeOutput(c.Output, 0o600, func(w io.Writer) error {
+		_, err := esec.DecryptWithConfig(in, w, c.Env, esec.DecryptFileConfig{
+			KeyDir:    c.KeyDir,
+			Format:    esec.FileFormat(format),
+			PublicKey: c.PubKey,
+		})
+		return err
+	})
+	if err != nil {
+		ctx.Logger.Debug("decryption failed", "error", err)
+		return fmt.Errorf("error decrypting stdin: %v", err)
+	}
+	return nil
+}
+
+// decryptBlob decrypts an opaque blob to stdout, or to the output file, as it
+// is, without a trailing newline.
+func (c *DecryptCmd) decryptBlob(ctx *cliCtx, key string) error {
+	ctx.Logger.Debug("decrypting blob", "path", c.File, "env", c.Env)
+	f, err := os.Open(c.File) //nolint:gosec // File path is user-provided
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %v", c.File, err)
+	}
+	defer f.Close() //nolint:errcheck // Read-only file
+
+	err = writeOutput(c.Output, 0o600, func(w io.Writer) error {
+		return esec.DecryptBlob(f, w, c.Env, c.KeyDir, key)
+	})
+	if err != nil {
+		ctx.Logger.Debug("decryption failed", "path", c.File, "error", err)
+		return fmt.Errorf("error decrypting file %s, discard any output: %v", c.File, err)
+	}
+	return nil
+}
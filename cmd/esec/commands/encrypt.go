@@ -1,8 +1,13 @@
 package commands
 
 import (
+	"cmp"
 	"fmt"
+	"io"
 	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 
 	"github.com/mscno/esec"
 	"github.com/mscno/esec/pkg/fileutils"
@@ -10,23 +15,55 @@ import (
 
 // EncryptCmd encrypts a secrets file.
 type EncryptCmd struct {
-	File   string `arg:"" help:"File or Environment to encrypt" default:""`
-	Format string `help:"File format" default:".ejson" short:"f"`
-	DryRun bool   `help:"Print the encrypted message without writing to file" short:"d"`
+	File       string `arg:"" help:"File or Environment to encrypt, '-' to read from stdin, or the directory to search with --recursive" default:""`
+	Format     string `help:"File format, overriding the one given by the file's name or detected from its content (.ejson for environment names); required for stdin" short:"f"`
+	Output     string `help:"Write the encrypted file to this path, rather than in place or to stdout for stdin" short:"o"`
+	DryRun     bool   `help:"Print the encrypted message without writing to file; with --recursive, list the files that would be encrypted instead" short:"d"`
+	AllScalars bool   `help:"Also encrypt numbers, booleans and dates, restoring their type on decryption" name:"all-scalars"`
+	Binary     bool   `help:"Encrypt the whole file as an opaque blob, written to <file>.esec" name:"binary"`
+	PubKey     string `help:"Public key to encrypt to, embedded in files that have none; required with --binary. Files without one otherwise use ESEC_PUBLIC_KEY_<ENV> or the public_keys of .esec.yaml, without embedding it" name:"pubkey"`
+	Detached   bool   `help:"Do not embed --pubkey in files that have none, only record it in a header comment where the format has comments"`
+	Env        string `help:"Environment whose public key encrypts stdin data that has none, when --pubkey is not given" short:"e"`
+	Recursive  bool   `help:"Encrypt every file under the directory, or the current one, named after the naming template; .gitignore and .esecignore files are respected" short:"r"`
+	Examples   bool   `help:"With --recursive, also encrypt templates such as .env.example or .ejson.sample" name:"include-examples"`
 }
 
 // Run executes the encrypt command.
 func (c *EncryptCmd) Run(ctx *cliCtx) error {
-	ctx.Logger.Debug("encrypting secret", "file", c.File, "format", c.Format, "dry_run", c.DryRun)
+	ctx.Logger.Debug("encrypting secret", "file", c.File, "format", c.Format, "output", c.Output, "dry_run", c.DryRun, "all_scalars", c.AllScalars, "binary", c.Binary, "detached", c.Detached, "recursive", c.Recursive, "include_examples", c.Examples)
 
-	format, err := fileutils.ParseFormat(c.Format)
+	if c.Recursive && (c.Binary || c.File == "-" || c.Output != "" || c.Format != "") {
+		return fmt.Errorf("--recursive cannot be used with stdin, --output, --format or --binary, as files are found by their names")
+	}
+
+	if c.Binary {
+		return c.encryptBlob(ctx)
+	}
+
+	format, err := parseFormatFlag(c.Format)
 	if err != nil {
 		ctx.Logger.Debug("format parsing failed", "format", c.Format, "error", err)
-		return fmt.Errorf("error parsing format flag %q: %v", c.Format, err)
+		return err
 	}
 	ctx.Logger.Debug("parsed format", "format_type", format)
 
-	filePath, err := processFileOrEnv(c.File, format)
+	config := esec.EncryptConfig{
+		AllScalars:      c.AllScalars,
+		Format:          esec.FileFormat(format),
+		NamingTemplate:  string(ctx.Naming),
+		PublicKey:       c.PubKey,
+		DetachPublicKey: c.Detached,
+		EnvName:         c.Env,
+	}
+
+	if c.File == "-" {
+		return c.encryptStdin(ctx, config)
+	}
+	if c.Recursive {
+		return c.encryptRecursive(ctx, config)
+	}
+
+	filePath, err := processFileOrEnv(c.File, cmp.Or(format, fileutils.Ejson), ctx.Naming)
 	if err != nil {
 		ctx.Logger.Debug("file/env processing failed", "input", c.File, "error", err)
 		return fmt.Errorf("error processing file or env %q: %v", c.File, err)
@@ -47,14 +84,150 @@ func (c *EncryptCmd) Run(ctx *cliCtx) error {
 		ctx.Logger.Debug("file details", "path", filePath, "size", fileInfo.Size(), "mode", fileInfo.Mode())
 	}
 
+	if c.Output != "" {
+		ctx.Logger.Debug("encrypting file", "path", filePath, "output", c.Output)
+		n, err := esec.EncryptFileTo(filePath, c.Output, config)
+		if err != nil {
+			ctx.Logger.Debug("encryption failed", "path", filePath, "error", err)
+			return fmt.Errorf("error encrypting file %s: %v", filePath, withFormatHint(err))
+		}
+		ctx.Logger.Debug("encryption successful", "path", c.Output, "bytes", n)
+		fmt.Printf("Encrypted %d bytes to %s\n", n, c.Output)
+		return nil
+	}
+
 	ctx.Logger.Debug("encrypting file", "path", filePath)
-	n, err := esec.EncryptFileInPlace(filePath)
+	n, err := esec.EncryptFileInPlaceWithConfig(filePath, config)
 	if err != nil {
 		ctx.Logger.Debug("encryption failed", "path", filePath, "error", err)
-		return fmt.Errorf("error encrypting file %s: %v", filePath, err)
+		return fmt.Errorf("error encrypting file %s: %v", filePath, withFormatHint(err))
 	}
 
 	ctx.Logger.Debug("encryption successful", "path", filePath, "bytes", n)
 	fmt.Printf("Encrypted %d bytes\n", n)
 	return nil
 }
+
+// encryptStdin encrypts the data read from stdin to stdout, or to the output
+// file.
+func (c *EncryptCmd) encryptStdin(ctx *cliCtx, config esec.EncryptConfig) error {
+	if config.Format == "" {
+		return fmt.Errorf("reading from stdin requires --format")
+	}
+
+	ctx.Logger.Debug("encrypting stdin", "format", config.Format, "env", config.EnvName, "output", c.Output)
+	err := writeOutput(c.Output, 0o644, func(w io.Writer) error {
+		_, err := esec.EncryptWithConfig(os.Stdin, w, config)
+		return err
+	})
+	if err != nil {
+		ctx.Logger.Debug("encryption failed", "error", err)
+		return fmt.Errorf("error encrypting stdin: %v", err)
+	}
+	return nil
+}
+
+// encryptRecursive encrypts the files found under the directory in parallel,
+// reporting the outcome of each, or lists them in dry run mode. It fails if
+// any file failed.
+func (c *EncryptCmd) encryptRecursive(ctx *cliCtx, config esec.EncryptConfig) error {
+	dir := cmp.Or(c.File, ".")
+	files, err := fileutils.FindFiles(dir, ctx.Naming, c.Examples)
+	if err != nil {
+		ctx.Logger.Debug("file search failed", "dir", dir, "error", err)
+		return fmt.Errorf("error finding files in %s: %v", dir, err)
+	}
+	ctx.Logger.Debug("found files", "dir", dir, "count", len(files))
+
+	if c.DryRun {
+		for _, file := range files {
+			fmt.Println(file)
+		}
+		return nil
+	}
+
+	sizes := make([]int, len(files))
+	errs := make([]error, len(files))
+	var (
+		next atomic.Int64
+		wg   sync.WaitGroup
+	)
+	workers := min(runtime.GOMAXPROCS(0), len(files))
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(files) {
+					return
+				}
+				sizes[i], errs[i] = esec.EncryptFileInPlaceWithConfig(files[i], config)
+			}
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, file := range files {
+		if errs[i] != nil {
+			ctx.Logger.Debug("encryption failed", "path", file, "error", errs[i])
+			fmt.Fprintf(os.Stderr, "error encrypting file %s: %v\n", file, withFormatHint(errs[i]))
+			failed++
+			continue
+		}
+		fmt.Printf("Encrypted %d bytes: %s\n", sizes[i], file)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to encrypt %d of %d files", failed, len(files))
+	}
+	if len(files) == 0 {
+		fmt.Printf("No files to encrypt in %s\n", dir)
+	}
+	return nil
+}
+
+// encryptBlob encrypts the file as an opaque blob, or prints the blob in dry
+// run mode. The blob of stdin is written to stdout, or to the output file.
+func (c *EncryptCmd) encryptBlob(ctx *cliCtx) error {
+	if c.File == "" {
+		return fmt.Errorf("--binary requires a file to encrypt")
+	}
+	if c.PubKey == "" {
+		return fmt.Errorf("--binary requires --pubkey, as the file has no public key of its own")
+	}
+
+	if c.File == "-" || c.DryRun || c.Output != "" {
+		in := os.Stdin
+		if c.File != "-" {
+			f, err := os.Open(c.File) //nolint:gosec // File path is user-provided
+			if err != nil {
+				return fmt.Errorf("error opening file %s: %v", c.File, err)
+			}
+			defer f.Close() //nolint:errcheck // Read-only file
+			in = f
+		}
+		output := c.Output
+		if c.DryRun {
+			output = ""
+		}
+		err := writeOutput(output, 0o644, func(w io.Writer) error {
+			return esec.EncryptBlob(in, w, c.PubKey)
+		})
+		if err != nil {
+			return fmt.Errorf("error encrypting file %s: %v", c.File, err)
+		}
+		return nil
+	}
+
+	ctx.Logger.Debug("encrypting file as blob", "path", c.File)
+	blobPath, err := esec.EncryptFileToBlob(c.File, c.PubKey)
+	if err != nil {
+		ctx.Logger.Debug("encryption failed", "path", c.File, "error", err)
+		return fmt.Errorf("error encrypting file %s: %v", c.File, err)
+	}
+
+	ctx.Logger.Debug("encryption successful", "path", blobPath)
+	fmt.Printf("Encrypted %s to %s\n", c.File, blobPath)
+	return nil
+}
@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"cmp"
 	gojson "encoding/json"
 	"fmt"
 	"io"
@@ -9,13 +10,14 @@ import (
 
 	"github.com/mscno/esec"
 	"github.com/mscno/esec/pkg/fileutils"
+	"github.com/mscno/esec/pkg/json"
 )
 
 // GetCmd decrypts a secrets file and extracts a specific key.
 type GetCmd struct {
 	File         string `arg:"" help:"File or Environment to decrypt" default:""`
 	Key          string `arg:"" help:"Key to extract from decrypted content" default:""`
-	Format       string `help:"File format" default:".ejson" short:"f"`
+	Format       string `help:"File format, overriding the one given by the file's name or detected from its content (.ejson for environment names)" short:"f"`
 	KeyFromStdin bool   `help:"Read the key from stdin" short:"k"`
 	KeyDir       string `help:"Directory containing the '.esec_keyring' file" default:"." short:"d"`
 }
@@ -38,22 +40,20 @@ func (c *GetCmd) Run(ctx *cliCtx) error {
 		ctx.Logger.Debug("using key from keyring", "key_dir", c.KeyDir)
 	}
 
-	format, err := fileutils.ParseFormat(c.Format)
+	format, err := parseFormatFlag(c.Format)
 	if err != nil {
 		ctx.Logger.Debug("format parsing failed", "format", c.Format, "error", err)
-		return fmt.Errorf("error parsing format flag %q: %v", c.Format, err)
+		return err
 	}
 	ctx.Logger.Debug("parsed format", "format_type", format)
 
-	fileName, err := processFileOrEnv(c.File, format)
+	fileName, err := processFileOrEnv(c.File, cmp.Or(format, fileutils.Ejson), ctx.Naming)
 	if err != nil {
 		ctx.Logger.Debug("file/env processing failed", "input", c.File, "error", err)
 		return fmt.Errorf("error processing file or env: %v", err)
 	}
 	ctx.Logger.Debug("resolved file path", "path", fileName)
 
-	format, _ = fileutils.ParseFormat(fileName)
-
 	// Check if file exists
 	fileInfo, err := os.Stat(fileName)
 	if err != nil {
@@ -66,8 +66,19 @@ func (c *GetCmd) Run(ctx *cliCtx) error {
 	}
 	ctx.Logger.Debug("file details", "path", fileName, "size", fileInfo.Size(), "mode", fileInfo.Mode())
 
-	ctx.Logger.Debug("decrypting file", "path", fileName)
-	data, err := esec.DecryptFile(fileName, c.KeyDir, key)
+	format, err = resolveFormat(fileName, format, ctx.Naming)
+	if err != nil {
+		ctx.Logger.Debug("format detection failed", "path", fileName, "error", err)
+		return err
+	}
+
+	ctx.Logger.Debug("decrypting file", "path", fileName, "format", format)
+	data, err := esec.DecryptFileWithConfig(fileName, esec.DecryptFileConfig{
+		KeyDir:         c.KeyDir,
+		PrivateKey:     key,
+		Format:         esec.FileFormat(format),
+		NamingTemplate: string(ctx.Naming),
+	})
 	if err != nil {
 		ctx.Logger.Debug("decryption failed", "path", fileName, "error", err)
 		return fmt.Errorf("error decrypting file %s: %v", fileName, err)
@@ -75,16 +86,24 @@ func (c *GetCmd) Run(ctx *cliCtx) error {
 
 	ctx.Logger.Debug("decryption successful", "path", fileName, "bytes", len(data))
 
-	// Parse the data based on format and extract the key
+	// JSON is read with nested key paths; every other format is read with
+	// the env extractor it is registered with
 	var value string
-
-	switch format {
-	case fileutils.Env:
-		// Parse .env format
-		envVars, err := esec.DotEnvToEnv(data)
+	if format == fileutils.Ejson || format == fileutils.Ejsonc {
+		value, err = lookupJSONKey(data, c.Key)
 		if err != nil {
-			ctx.Logger.Debug("env parsing failed", "error", err)
-			return fmt.Errorf("error parsing decrypted .env: %v", err)
+			ctx.Logger.Debug("json lookup failed", "key", c.Key, "error", err)
+			return err
+		}
+	} else {
+		_, toEnv, _ := esec.LookupFormat(esec.FileFormat(format))
+		if toEnv == nil {
+			return fmt.Errorf("unsupported format for get command: %s", format)
+		}
+		envVars, err := toEnv(data)
+		if err != nil {
+			ctx.Logger.Debug("env extraction failed", "format", format, "error", err)
+			return fmt.Errorf("error parsing decrypted %s file: %v", format, err)
 		}
 		val, exists := envVars[c.Key]
 		if !exists {
@@ -92,58 +111,49 @@ func (c *GetCmd) Run(ctx *cliCtx) error {
 			return fmt.Errorf("key %q not found in decrypted content", c.Key)
 		}
 		value = val
+	}
 
-	case fileutils.Ejson:
-		// Parse JSON format
-		var jsonData map[string]interface{}
-		if err := gojson.Unmarshal(data, &jsonData); err != nil {
-			ctx.Logger.Debug("json parsing failed", "error", err)
-			return fmt.Errorf("error parsing decrypted JSON: %v", err)
-		}
+	// Output just the value without newline
+	fmt.Print(value)
+	return nil
+}
 
-		// Handle nested keys with dot notation
-		keys := strings.Split(c.Key, ".")
-		current := jsonData
-
-		// Navigate through nested objects
-		for i, k := range keys[:len(keys)-1] {
-			nextObj, ok := current[k].(map[string]interface{})
-			if !ok {
-				ctx.Logger.Debug("invalid key path", "key", c.Key, "failed_at", strings.Join(keys[:i+1], "."))
-				return fmt.Errorf("key path %q is invalid at %q", c.Key, strings.Join(keys[:i+1], "."))
-			}
-			current = nextObj
-		}
+// lookupJSONKey returns the value of a dot-separated key path in decrypted
+// JSON data, with the comments and trailing commas JSONC allows. Objects and
+// arrays are returned as JSON.
+func lookupJSONKey(data []byte, key string) (string, error) {
+	var jsonData map[string]interface{}
+	if err := gojson.Unmarshal(json.Standardize(data), &jsonData); err != nil {
+		return "", fmt.Errorf("error parsing decrypted JSON: %v", err)
+	}
 
-		// Get the final value
-		lastKey := keys[len(keys)-1]
-		val, exists := current[lastKey]
-		if !exists {
-			ctx.Logger.Debug("key not found", "key", c.Key)
-			return fmt.Errorf("key %q not found in decrypted content", c.Key)
+	// Navigate through nested objects
+	keys := strings.Split(key, ".")
+	current := jsonData
+	for i, k := range keys[:len(keys)-1] {
+		nextObj, ok := current[k].(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("key path %q is invalid at %q", key, strings.Join(keys[:i+1], "."))
 		}
+		current = nextObj
+	}
 
-		// Convert the value to string based on type
-		switch v := val.(type) {
-		case string:
-			value = v
-		case float64, int, bool:
-			value = fmt.Sprintf("%v", v)
-		default:
-			// For complex objects, return as JSON
-			valueBytes, err := gojson.Marshal(v)
-			if err != nil {
-				ctx.Logger.Debug("json marshaling failed", "key", c.Key, "error", err)
-				return fmt.Errorf("error serializing value for key %q: %v", c.Key, err)
-			}
-			value = string(valueBytes)
-		}
+	val, exists := current[keys[len(keys)-1]]
+	if !exists {
+		return "", fmt.Errorf("key %q not found in decrypted content", key)
+	}
 
+	// Convert the value to string based on type
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	case float64, int, bool:
+		return fmt.Sprintf("%v", v), nil
 	default:
-		return fmt.Errorf("unsupported format for get command: %s", format)
+		valueBytes, err := gojson.Marshal(v)
+		if err != nil {
+			return "", fmt.Errorf("error serializing value for key %q: %v", key, err)
+		}
+		return string(valueBytes), nil
 	}
-
-	// Output just the value without newline
-	fmt.Print(value)
-	return nil
 }
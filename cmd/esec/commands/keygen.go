@@ -2,19 +2,41 @@ package commands
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/mscno/esec"
+	"github.com/mscno/esec/pkg/format"
 )
 
 // KeygenCmd generates a new keypair for encryption.
 type KeygenCmd struct {
+	Derive  string `help:"Derive the keypair for this environment from ESEC_MASTER_KEY instead of generating a random one" placeholder:"ENV"`
+	Service string `help:"Service name to scope the derived keypair to (requires --derive)"`
+	PQ      bool   `help:"Generate a hybrid post-quantum (X25519 + ML-KEM-768) keypair" name:"pq"`
+	Age     bool   `help:"Output the keypair as an age recipient and identity"`
 }
 
 // Run executes the keygen command.
 func (c *KeygenCmd) Run(ctx *cliCtx) error {
-	ctx.Logger.Debug("generating new keypair")
+	if c.Derive != "" || c.Service != "" {
+		if c.PQ {
+			return fmt.Errorf("--pq cannot be combined with --derive")
+		}
+		return c.runDerive(ctx)
+	}
+
+	generate := esec.GenerateKeypair
+	switch {
+	case c.PQ && c.Age:
+		return fmt.Errorf("--pq cannot be combined with --age")
+	case c.PQ:
+		generate = esec.GenerateHybridKeypair
+	case c.Age:
+		generate = esec.GenerateAgeKeypair
+	}
 
-	pub, priv, err := esec.GenerateKeypair()
+	ctx.Logger.Debug("generating new keypair", "pq", c.PQ, "age", c.Age)
+	pub, priv, err := generate()
 	if err != nil {
 		ctx.Logger.Debug("keypair generation failed", "error", err)
 		return err
@@ -22,6 +44,47 @@ func (c *KeygenCmd) Run(ctx *cliCtx) error {
 
 	ctx.Logger.Debug("keypair generated successfully")
 	fmt.Printf("Public Key:\n%s\nPrivate Key:\n%s\n", pub, priv)
+	return nil
+}
+
+func (c *KeygenCmd) runDerive(ctx *cliCtx) error {
+	if c.Derive == "" {
+		return fmt.Errorf("--service requires --derive")
+	}
+
+	masterKey, exists := os.LookupEnv(esec.EsecMasterKey)
+	if !exists {
+		return fmt.Errorf("%s must be set to derive a keypair", esec.EsecMasterKey)
+	}
+
+	ctx.Logger.Debug("deriving keypair from master key", "env", c.Derive, "service", c.Service)
+	pub, priv, err := esec.DeriveKeypair(masterKey, c.Derive, c.Service)
+	if err != nil {
+		ctx.Logger.Debug("keypair derivation failed", "error", err)
+		return err
+	}
+
+	if c.Age {
+		pub, priv, err = toAgeKeypair(pub, priv)
+		if err != nil {
+			return err
+		}
+	}
 
+	ctx.Logger.Debug("keypair derived successfully")
+	fmt.Printf("Public Key:\n%s\nPrivate Key:\n%s\n", pub, priv)
 	return nil
 }
+
+// toAgeKeypair re-encodes a hex-encoded keypair as an age recipient and identity.
+func toAgeKeypair(pub, priv string) (string, string, error) {
+	pubKey, err := format.ParseKey(pub)
+	if err != nil {
+		return "", "", err
+	}
+	privKey, err := format.ParseKey(priv)
+	if err != nil {
+		return "", "", err
+	}
+	return format.EncodeAgeRecipient(pubKey), format.EncodeAgeIdentity(privKey), nil
+}
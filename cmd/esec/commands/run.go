@@ -1,6 +1,8 @@
 package commands
 
 import (
+	"bytes"
+	"cmp"
 	"fmt"
 	"io"
 	"os"
@@ -11,16 +13,20 @@ import (
 	"syscall"
 
 	"github.com/mscno/esec"
+	"github.com/mscno/esec/pkg/crypto"
 	"github.com/mscno/esec/pkg/fileutils"
+	"github.com/mscno/esec/pkg/format"
 )
 
 // RunCmd decrypts a secrets file and runs a command with the environment variables.
 type RunCmd struct {
-	File         string   `arg:"" help:"File or Environment to decrypt" default:""`
-	Format       string   `help:"File format" default:".ejson" short:"f"`
-	KeyFromStdin bool     `help:"Read the key from stdin" short:"k"`
-	KeyDir       string   `help:"Directory containing the '.esec_keyring' file" default:"." short:"d"`
-	Command      []string `arg:"" optional:"" name:"command" help:"Command to run with the decrypted environment variables"`
+	File            string   `arg:"" help:"File or Environment to decrypt" default:""`
+	Format          string   `help:"File format, overriding the one given by the file's name or detected from its content (.ejson for environment names)" short:"f"`
+	KeyFromStdin    bool     `help:"Read the key from stdin" short:"k"`
+	KeyDir          string   `help:"Directory containing the '.esec_keyring' file" default:"." short:"d"`
+	StripUnderscore bool     `help:"Export keys starting with '_' without the underscore, e.g. _LOG_LEVEL as LOG_LEVEL" name:"strip-underscore"`
+	StripKeyEnv     bool     `help:"Remove ESEC_PRIVATE_KEY* and ESEC_MASTER_KEY from the command's environment, for commands that do not run esec themselves" name:"strip-key-env"`
+	Command         []string `arg:"" optional:"" name:"command" help:"Command to run with the decrypted environment variables"`
 }
 
 // Run executes the run command, decrypting secrets and running the specified command.
@@ -41,24 +47,29 @@ func (c *RunCmd) Run(ctx *cliCtx) error {
 	ctx.Logger.Debug("preparing to run command", "command", strings.Join(c.Command, " "))
 
 	// Read the private key from stdin if requested
-	var key string
+	var key *crypto.KeyHandle
 	if c.KeyFromStdin {
 		data, err := io.ReadAll(os.Stdin)
 		if err != nil {
 			return err
 		}
-		key = strings.TrimSpace(string(data))
+		key, err = format.ParsePrivateKey(bytes.TrimSpace(data))
+		crypto.Wipe(data)
+		if err != nil {
+			return fmt.Errorf("invalid private key read from stdin: %v", err)
+		}
+		defer key.Destroy()
 		ctx.Logger.Debug("read private key from stdin")
 	}
 
 	// Parse the file format
-	format, err := fileutils.ParseFormat(c.Format)
+	fileFormat, err := parseFormatFlag(c.Format)
 	if err != nil {
-		return fmt.Errorf("error parsing format flag %q: %v", c.Format, err)
+		return err
 	}
 
 	// Process the file or environment name to get the actual filename
-	fileName, err := processFileOrEnv(c.File, format)
+	fileName, err := processFileOrEnv(c.File, cmp.Or(fileFormat, fileutils.Ejson), ctx.Naming)
 	if err != nil {
 		return fmt.Errorf("error processing file or env: %v", err)
 	}
@@ -70,35 +81,48 @@ func (c *RunCmd) Run(ctx *cliCtx) error {
 		return fmt.Errorf("secrets file %s does not exist", fileName)
 	}
 
-	// Decrypt the file
-	ctx.Logger.Debug("decrypting file", "file", fileName)
+	// The format of the file, rather than of the flag, selects the extractor
+	fileFormat, err = resolveFormat(fileName, fileFormat, ctx.Naming)
+	if err != nil {
+		return err
+	}
 
-	data, err := esec.DecryptFile(fileName, c.KeyDir, key)
+	// Decrypt the file
+	ctx.Logger.Debug("decrypting file", "file", fileName, "format", fileFormat)
+
+	data, err := esec.DecryptFileWithConfig(fileName, esec.DecryptFileConfig{
+		KeyDir:         c.KeyDir,
+		Key:            key,
+		Format:         esec.FileFormat(fileFormat),
+		NamingTemplate: string(ctx.Naming),
+	})
 	if err != nil {
 		return fmt.Errorf("failed to decrypt file: %v", err)
 	}
 
+	// The key is no longer needed, so drop it before the child is started
+	key.Destroy()
+
 	ctx.Logger.Debug("successfully decrypted secrets file")
 
-	// Convert decrypted data to environment variables
-	var envVars map[string]string
-	switch format {
-	case fileutils.Env:
-		envVars, err = esec.DotEnvToEnv(data)
-		if err != nil {
-			return fmt.Errorf("error parsing decrypted .env: %v", err)
-		}
-		// Sanitize variables to prevent injection (after error check)
-		envVars = sanitizeEnvVars(envVars)
-	case fileutils.Ejson:
-		envVars, err = esec.EjsonToEnv(data)
+	// Convert decrypted data to environment variables with the format's extractor
+	_, toEnv, _ := esec.LookupFormat(esec.FileFormat(fileFormat))
+	if toEnv == nil {
+		return fmt.Errorf("unsupported format for run command: %s", fileFormat)
+	}
+	envVars, err := toEnv(data)
+	if err != nil {
+		return fmt.Errorf("error parsing decrypted %s file: %v", fileFormat, err)
+	}
+	// Sanitize variables to prevent injection (after error check)
+	envVars = sanitizeEnvVars(envVars)
+
+	// Export plaintext keys under their unprefixed names if requested
+	if c.StripUnderscore {
+		envVars, err = esec.StripUnderscorePrefix(envVars)
 		if err != nil {
-			return fmt.Errorf("error parsing decrypted EJSON: %v", err)
+			return err
 		}
-		// Sanitize variables to prevent injection (after error check)
-		envVars = sanitizeEnvVars(envVars)
-	default:
-		return fmt.Errorf("unsupported format for run command: %s", format)
 	}
 
 	// Validate we have environment variables
@@ -113,8 +137,12 @@ func (c *RunCmd) Run(ctx *cliCtx) error {
 	// Create a command to run
 	cmd := exec.Command(c.Command[0], c.Command[1:]...)
 
-	// Set up environment variables
-	cmd.Env = os.Environ() // Start with current environment
+	// Set up environment variables, starting with the current environment,
+	// minus any private key material if requested
+	cmd.Env = os.Environ()
+	if c.StripKeyEnv {
+		cmd.Env = stripKeyEnv(cmd.Env)
+	}
 	for k, v := range envVars {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
 	}
@@ -228,6 +256,20 @@ func validateCommand(command []string) error {
 	return nil
 }
 
+// stripKeyEnv removes the private and master key variables from an environment,
+// so key material is not passed on to the child process.
+func stripKeyEnv(environ []string) []string {
+	stripped := make([]string, 0, len(environ))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if name == esec.EsecPrivateKey || strings.HasPrefix(name, esec.EsecPrivateKey+"_") || name == esec.EsecMasterKey {
+			continue
+		}
+		stripped = append(stripped, kv)
+	}
+	return stripped
+}
+
 // sanitizeEnvVars removes potentially dangerous environment variables
 func sanitizeEnvVars(vars map[string]string) map[string]string {
 	for k := range vars {
@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"reflect"
 	"runtime"
 	"testing"
 )
@@ -248,6 +249,24 @@ func TestSanitizeEnvVars(t *testing.T) {
 	}
 }
 
+func TestStripKeyEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"ESEC_PRIVATE_KEY=aaaa",
+		"ESEC_PRIVATE_KEY_PROD=bbbb",
+		"ESEC_MASTER_KEY=cccc",
+		"ESEC_PRIVATE_KEYS_NOTE=keep",
+		"ESEC_SERVICE=api",
+	}
+
+	got := stripKeyEnv(environ)
+
+	want := []string{"PATH=/usr/bin", "ESEC_PRIVATE_KEYS_NOTE=keep", "ESEC_SERVICE=api"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stripKeyEnv() = %v, want %v", got, want)
+	}
+}
+
 func containsString(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || len(substr) == 0 ||
 		(len(s) > 0 && len(substr) > 0 && findSubstring(s, substr)))
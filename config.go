@@ -0,0 +1,209 @@
+package esec
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mscno/esec/pkg/format"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFilename is the name of the per-repository configuration file. It is
+// looked up in the directory of the file being encrypted or decrypted, and
+// then in each parent directory.
+const ConfigFilename = ".esec.yaml"
+
+// Config is the contents of a ConfigFilename file, for example:
+//
+//	rules:
+//	  - path: ".ejson.prod"
+//	    encrypted_regex: "^(password|token)$"
+//	  - path: "config/*.eyaml*"
+//	    unencrypted_regex: "^public_"
+//	    encrypted_paths:
+//	      - database.password
+//	public_keys:
+//	  default: "493ffcfba776a045fba526acb0baff44c9639b98b9f27123cca67c808d4e171d"
+//	  prod: "age1..."
+type Config struct {
+	// Rules select which values are encrypted in the files matching their
+	// Path. The first matching rule applies, and files matched by none have
+	// every value encrypted as usual.
+	Rules []ConfigRule `yaml:"rules"`
+	// PublicKeys are the public keys of environments, for the files that do
+	// not embed one (see LookupPublicKey). The key of the default environment
+	// is under DefaultEnvironmentKey.
+	PublicKeys map[string]string `yaml:"public_keys"`
+
+	// dir is the directory the config file was found in, which rule paths
+	// are relative to.
+	dir string
+}
+
+// DefaultEnvironmentKey is the key of the default environment in
+// Config.PublicKeys, as its name is empty.
+const DefaultEnvironmentKey = "default"
+
+// ConfigRule selects the values that are encrypted in the files matching Path.
+// See format.Rules for how the selectors combine.
+type ConfigRule struct {
+	// Path is a pattern, as used by path.Match, matched against the slash-
+	// separated path of a file relative to the config file. A pattern without
+	// a slash is matched against the file name alone. An empty Path matches
+	// every file.
+	Path string `yaml:"path"`
+	// EncryptedRegex limits encryption to the values under matching keys.
+	EncryptedRegex string `yaml:"encrypted_regex"`
+	// UnencryptedRegex leaves the values under matching keys in plaintext.
+	UnencryptedRegex string `yaml:"unencrypted_regex"`
+	// EncryptedPaths limits encryption to the values under the given
+	// dot-separated key paths, alongside EncryptedRegex.
+	EncryptedPaths []string `yaml:"encrypted_paths"`
+
+	rules *format.Rules
+}
+
+// ParseConfig parses and validates the contents of a ConfigFilename file.
+// Unknown fields are rejected, so misspelled selectors do not silently leave
+// secrets in plaintext.
+func ParseConfig(data []byte) (*Config, error) {
+	var config Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid %s: %v", ConfigFilename, err)
+	}
+
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s: rule %d: invalid path %q: %v", ConfigFilename, i+1, rule.Path, err)
+		}
+		rules := &format.Rules{EncryptedPaths: rule.EncryptedPaths}
+		var err error
+		if rules.EncryptedRegex, err = compileOptional(rule.EncryptedRegex); err != nil {
+			return nil, fmt.Errorf("invalid %s: rule %d: invalid encrypted_regex: %v", ConfigFilename, i+1, err)
+		}
+		if rules.UnencryptedRegex, err = compileOptional(rule.UnencryptedRegex); err != nil {
+			return nil, fmt.Errorf("invalid %s: rule %d: invalid unencrypted_regex: %v", ConfigFilename, i+1, err)
+		}
+		if err := rules.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid %s: rule %d: %v", ConfigFilename, i+1, err)
+		}
+		rule.rules = rules
+	}
+	for env, key := range config.PublicKeys {
+		if err := validatePublicKey(key); err != nil {
+			return nil, fmt.Errorf("invalid %s: public key of %s: %v", ConfigFilename, env, err)
+		}
+	}
+	return &config, nil
+}
+
+// LoadConfig finds the ConfigFilename file in dir or its closest parent and
+// parses it. It returns nil if there is none.
+func LoadConfig(dir string) (*Config, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		data, err := os.ReadFile(filepath.Join(dir, ConfigFilename)) //nolint:gosec // Config path is derived from the user-provided file path
+		if err == nil {
+			config, err := ParseConfig(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", filepath.Join(dir, ConfigFilename), err)
+			}
+			config.dir = dir
+			return config, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// RulesFor returns the rules of the first rule whose Path matches filePath, or
+// nil if there is none. A relative filePath is taken to be relative to the
+// config file.
+func (c *Config) RulesFor(filePath string) *format.Rules {
+	if c == nil {
+		return nil
+	}
+	rel := filePath
+	if c.dir != "" && filepath.IsAbs(filePath) {
+		if r, err := filepath.Rel(c.dir, filePath); err == nil {
+			rel = r
+		}
+	}
+	rel = filepath.ToSlash(rel)
+
+	for _, rule := range c.Rules {
+		name := rel
+		if !strings.Contains(rule.Path, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(rule.Path, name); ok || rule.Path == "" {
+			return rule.rules
+		}
+	}
+	return nil
+}
+
+// PublicKeyFor returns the public key of envName, or "" if there is none.
+// The default environment, whose name is empty, has the key under
+// DefaultEnvironmentKey.
+func (c *Config) PublicKeyFor(envName string) string {
+	if c == nil {
+		return ""
+	}
+	return c.PublicKeys[cmp.Or(envName, DefaultEnvironmentKey)]
+}
+
+// rulesForFile returns the rules that apply to the file at filePath, from the
+// closest ConfigFilename file.
+func rulesForFile(filePath string) (*format.Rules, error) {
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	config, err := LoadConfig(filepath.Dir(abs))
+	if err != nil {
+		return nil, err
+	}
+	return config.RulesFor(abs), nil
+}
+
+// configFromFS parses the ConfigFilename file at the root of fsys. It returns
+// nil if there is none.
+func configFromFS(fsys fs.FS) (*Config, error) {
+	data, err := fs.ReadFile(fsys, ConfigFilename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+func compileOptional(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
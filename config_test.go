@@ -0,0 +1,279 @@
+package esec
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+rules:
+  - path: ".ejson.prod"
+    encrypted_regex: "^(password|token)$"
+  - path: "config/*"
+    unencrypted_regex: "^public_"
+    encrypted_paths:
+      - database.password
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(config.Rules))
+	assert.Equal(t, "^(password|token)$", config.Rules[0].rules.EncryptedRegex.String())
+	assert.Equal(t, "^public_", config.Rules[1].rules.UnencryptedRegex.String())
+	assert.Equal(t, []string{"database.password"}, config.Rules[1].rules.EncryptedPaths)
+
+	config, err = ParseConfig(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(config.Rules))
+
+	for _, in := range []string{
+		"rules:\n  - path: x\n    encrypted_regexp: a\n",
+		"rules:\n  - encrypted_regex: \"(\"\n",
+		"rules:\n  - unencrypted_regex: \"(\"\n",
+		"rules:\n  - path: \"[\"\n",
+		"rules:\n  - encrypted_paths: [\"a.[\"]\n",
+		"public_keys:\n  prod: abc\n",
+		"public_keys:\n  prod: AGE-SECRET-KEY-19K97YGJWN8UQ2DCL3MM0K2FQQDSEZ8S68NEWP8K359XSPDDQAQUQD9YJLS\n",
+	} {
+		_, err := ParseConfig([]byte(in))
+		assert.Error(t, err, in)
+	}
+}
+
+func TestConfigRulesFor(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+rules:
+  - path: "config/*.eyaml*"
+    encrypted_regex: "^config$"
+  - path: ".ejson.prod"
+    encrypted_regex: "^prod$"
+  - path: ".ejson.*"
+    encrypted_regex: "^other$"
+`))
+	assert.NoError(t, err)
+	config.dir = filepath.FromSlash("/repo")
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"/repo/.ejson.prod", "^prod$"},
+		{"/repo/services/api/.ejson.prod", "^prod$"},
+		{"/repo/.ejson.dev", "^other$"},
+		{"/repo/config/.eyaml.dev", "^config$"},
+		{"/repo/other/.eyaml.dev", ""},
+		{"/repo/.env", ""},
+		{".ejson.prod", "^prod$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			rules := config.RulesFor(filepath.FromSlash(tt.file))
+			if tt.want == "" {
+				assert.Zero(t, rules)
+				return
+			}
+			assert.NotZero(t, rules)
+			assert.Equal(t, tt.want, rules.EncryptedRegex.String())
+		})
+	}
+
+	var none *Config
+	assert.Zero(t, none.RulesFor("/repo/.ejson"))
+}
+
+func TestLoadConfig(t *testing.T) {
+	root := t.TempDir()
+	nested := filepath.Join(root, "a", "b")
+	assert.NoError(t, os.MkdirAll(nested, 0o755))
+
+	config, err := LoadConfig(nested)
+	assert.NoError(t, err)
+	assert.Zero(t, config)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(root, ConfigFilename), []byte("rules:\n  - path: \"a/b/*\"\n    encrypted_regex: x\n"), 0o600))
+	config, err = LoadConfig(nested)
+	assert.NoError(t, err)
+	assert.NotZero(t, config.RulesFor(filepath.Join(nested, ".ejson")))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(nested, ConfigFilename), []byte("rules: [\n"), 0o600))
+	_, err = LoadConfig(nested)
+	assert.Error(t, err)
+}
+
+func TestEncryptFileInPlaceWithConfig(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ConfigFilename), []byte(`
+rules:
+  - path: ".ejson.*"
+    encrypted_regex: "^(password|token)$"
+    encrypted_paths: ["api.key"]
+`), 0o600))
+	in := fmt.Sprintf(`{"_ESEC_PUBLIC_KEY": "%s", "host": "db.internal", "password": "secret", "token": {"value": "abc"}, "api": {"key": "k", "url": "u"}}`, pub)
+	file := filepath.Join(dir, ".ejson.prod")
+	assert.NoError(t, os.WriteFile(file, []byte(in), 0o600))
+
+	_, err = EncryptFileInPlace(file)
+	assert.NoError(t, err)
+	encrypted, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(encrypted), `"host": "db.internal"`)
+	assert.Contains(t, string(encrypted), `"url": "u"`)
+	assert.Equal(t, 3, strings.Count(string(encrypted), `"ESEC[1:`))
+
+	decrypted, err := DecryptFile(file, dir, priv)
+	assert.NoError(t, err)
+	assert.Equal(t, in, string(decrypted))
+}
+
+func TestLookupPublicKey(t *testing.T) {
+	defaultPub, _, err := GenerateKeypair()
+	assert.NoError(t, err)
+	prodPub, prodPriv, err := GenerateKeypair()
+	assert.NoError(t, err)
+	stagingPub, _, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ConfigFilename), []byte(fmt.Sprintf(`
+public_keys:
+  default: %s
+  prod: %s
+`, defaultPub, prodPub)), 0o600))
+	t.Setenv("ESEC_PUBLIC_KEY_STAGING", stagingPub)
+
+	for env, want := range map[string]string{"": defaultPub, "prod": prodPub, "staging": stagingPub, "dev": ""} {
+		pub, err := LookupPublicKey(dir, env)
+		assert.NoError(t, err)
+		assert.Equal(t, want, pub, env)
+	}
+
+	// Files without a key of their own are encrypted to that of their
+	// environment, which is not embedded
+	in := `{"password": "secret"}`
+	file := filepath.Join(dir, ".ejson.prod")
+	assert.NoError(t, os.WriteFile(file, []byte(in), 0o600))
+	_, err = EncryptFileInPlace(file)
+	assert.NoError(t, err)
+	encrypted, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "secret")
+	assert.NotContains(t, string(encrypted), prodPub)
+
+	decrypted, err := DecryptFile(file, dir, prodPriv)
+	assert.NoError(t, err)
+	assert.Equal(t, in, string(decrypted))
+
+	t.Setenv("ESEC_PUBLIC_KEY_PROD", stagingPub)
+	_, err = DecryptFile(file, dir, prodPriv)
+	assert.IsError(t, err, ErrKeyMismatch)
+}
+
+func TestDecryptIgnoresRules(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	files := map[string]struct {
+		in    string
+		lines []string
+	}{
+		".ejson":       {`{"host": "db.internal", "password": "secret"}`, []string{`"host": "db.internal"`, `"password": "secret"`}},
+		".ejsonc":      {"{\n  // comment\n  \"host\": \"db.internal\",\n  \"password\": \"secret\",\n}", []string{`"host": "db.internal",`, `"password": "secret",`}},
+		".eyaml":       {"host: db.internal\npassword: secret\n", []string{"host: db.internal", `password: "secret"`}},
+		".etoml":       {"host = \"db.internal\"\npassword = \"secret\"\n", []string{`host = "db.internal"`, `password = "secret"`}},
+		".env":         {"HOST=db.internal\nPASSWORD=secret\n", []string{"HOST=db.internal", "PASSWORD=secret"}},
+		".eproperties": {"host=db.internal\npassword=secret\n", []string{"host=db.internal", "password=secret"}},
+		".eini":        {"host = db.internal\npassword = secret\n", []string{"host = db.internal", "password = secret"}},
+		".ehcl":        {"host = \"db.internal\"\npassword = \"secret\"\n", []string{`host = "db.internal"`, `password = "secret"`}},
+	}
+	configs := []string{
+		// Rules given when encrypting
+		"encrypted_regex: \"(?i)^password$\"",
+		// Widened and narrowed afterwards
+		"encrypted_regex: \"(?i)^(host|password)$\"",
+		"encrypted_regex: \"^nothing$\"",
+	}
+
+	for name, tt := range files {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeConfig := func(rule string) {
+				config := fmt.Sprintf("public_keys:\n  default: %s\nrules:\n  - %s\n", pub, rule)
+				assert.NoError(t, os.WriteFile(filepath.Join(dir, ConfigFilename), []byte(config), 0o600))
+			}
+			file := filepath.Join(dir, name)
+			assert.NoError(t, os.WriteFile(file, []byte(tt.in), 0o600))
+
+			writeConfig(configs[0])
+			_, err := EncryptFileInPlace(file)
+			assert.NoError(t, err)
+			encrypted, err := os.ReadFile(file)
+			assert.NoError(t, err)
+			assert.Contains(t, string(encrypted), tt.lines[0])
+			assert.NotContains(t, string(encrypted), "secret")
+
+			for _, rule := range configs {
+				writeConfig(rule)
+				decrypted, err := DecryptFile(file, dir, priv)
+				assert.NoError(t, err, rule)
+				assert.NotContains(t, string(decrypted), "ESEC[", rule)
+				for _, line := range tt.lines {
+					assert.Contains(t, string(decrypted), line, rule)
+				}
+			}
+
+			// Streams have no config at all
+			var out bytes.Buffer
+			_, err = DecryptWithConfig(bytes.NewReader(encrypted), &out, "", DecryptFileConfig{Format: FileFormat(name), PrivateKey: priv, PublicKey: pub, KeyDir: dir})
+			assert.NoError(t, err)
+			for _, line := range tt.lines {
+				assert.Contains(t, out.String(), line)
+			}
+		})
+	}
+}
+
+func TestDecryptKeepsPlaintextValues(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	// The values under underscored keys, and those the rules leave out, are
+	// written back exactly as they were, whatever their escapes or quoting
+	files := map[string]string{
+		".ejson":  `{"_a": "x\u0041", "host": "db\u002einternal", "password": "secret"}`,
+		".ejsonc": "{\n  // comment\n  \"_a\": \"x\\u0041\",\n  \"host\": \"db\\/internal\",\n  \"password\": \"secret\",\n}",
+		".etoml":  "_a = 'lit'\nhost = 'db.internal'\nnote = \"\"\"\nmulti\"\"\"\npassword = \"secret\"\n",
+		".ehcl":   "_b = <<EOT\nline1\nline2\nEOT\nhost = \"db\\u002einternal\"\npassword = \"secret\"\n",
+	}
+	for name, in := range files {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			config := fmt.Sprintf("public_keys:\n  default: %s\nrules:\n  - encrypted_regex: \"^password$\"\n", pub)
+			assert.NoError(t, os.WriteFile(filepath.Join(dir, ConfigFilename), []byte(config), 0o600))
+			file := filepath.Join(dir, name)
+			assert.NoError(t, os.WriteFile(file, []byte(in), 0o600))
+
+			_, err := EncryptFileInPlace(file)
+			assert.NoError(t, err)
+			encrypted, err := os.ReadFile(file)
+			assert.NoError(t, err)
+			assert.NotContains(t, string(encrypted), "secret")
+
+			decrypted, err := DecryptFile(file, dir, priv)
+			assert.NoError(t, err)
+			// Formats with comments record the public key in a header
+			got := string(decrypted)
+			if _, rest, ok := strings.Cut(got, "esec:public-key="+pub+"\n\n"); ok {
+				got = rest
+			}
+			assert.Equal(t, in, got)
+		})
+	}
+}
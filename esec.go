@@ -19,31 +19,34 @@ package esec
 import (
 	"bytes"
 	"embed"
+	"encoding/hex"
 	gojson "encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"sort"
 	"strings"
 
 	"github.com/joho/godotenv"
 	"github.com/mscno/esec/pkg/crypto"
-	"github.com/mscno/esec/pkg/dotenv"
 	"github.com/mscno/esec/pkg/fileutils"
 	"github.com/mscno/esec/pkg/format"
+	"github.com/mscno/esec/pkg/hcl"
+	"github.com/mscno/esec/pkg/ini"
 	"github.com/mscno/esec/pkg/json"
-	"github.com/mscno/esec/pkg/toml"
-	"github.com/mscno/esec/pkg/yaml"
+	"github.com/mscno/esec/pkg/properties"
 )
 
 const (
 	// EsecPublicKey is the key name used to store the public key in encrypted files.
+	// It is also the base name of the environment variables giving the public keys
+	// of files that do not embed one: ESEC_PUBLIC_KEY_<ENV> (see LookupPublicKey).
 	EsecPublicKey = "ESEC_PUBLIC_KEY"
 	// EsecPrivateKey is the base name for private key environment variables.
 	// For environment-specific keys, use ESEC_PRIVATE_KEY_<ENV> (e.g., ESEC_PRIVATE_KEY_PROD).
@@ -52,6 +55,13 @@ const (
 	DefaultKeyringFilename = ".esec-keyring"
 	// EsecKeyringPath is the environment variable for the full keyring file path.
 	EsecKeyringPath = "ESEC_KEYRING_PATH"
+	// EsecMasterKey is the environment variable (or keyring entry) holding the master
+	// key from which per-environment private keys are derived when no explicit
+	// ESEC_PRIVATE_KEY_<ENV> is available.
+	EsecMasterKey = "ESEC_MASTER_KEY"
+	// EsecService is the environment variable naming the service whose keys are
+	// derived from the master key. It is optional; see crypto.DerivationPath.
+	EsecService = "ESEC_SERVICE"
 )
 
 // resolveKeyringPath returns the keyring path, checking ESEC_KEYRING_PATH first.
@@ -72,6 +82,50 @@ func GenerateKeypair() (pub string, priv string, err error) {
 	return kp.PublicString(), kp.PrivateString(), nil
 }
 
+// GenerateAgeKeypair generates a new Curve25519 keypair encoded as an age X25519
+// recipient ("age1...") and identity ("AGE-SECRET-KEY-1..."). The identity can
+// decrypt both esec files and files encrypted to the recipient with age.
+func GenerateAgeKeypair() (pub string, priv string, err error) {
+	var kp crypto.Keypair
+	if err := kp.Generate(); err != nil {
+		return "", "", err
+	}
+	return format.EncodeAgeRecipient(kp.Public), format.EncodeAgeIdentity(kp.Private), nil
+}
+
+// GenerateHybridKeypair generates a new hybrid X25519 + ML-KEM-768 keypair.
+// Values encrypted to the public key are protected against future quantum
+// attacks on X25519, and can only be decrypted with the hybrid private key.
+// It returns the public and private keys in their printable forms
+// (see crypto.HybridPublicKeyPrefix and crypto.HybridPrivateKeyPrefix).
+func GenerateHybridKeypair() (pub string, priv string, err error) {
+	k, err := crypto.GenerateHybridKey()
+	if err != nil {
+		return "", "", err
+	}
+	pk, err := k.Public()
+	if err != nil {
+		return "", "", err
+	}
+	return pk.String(), k.String(), nil
+}
+
+// DeriveKeypair derives the keypair for an environment (and optional service) from
+// a hex-encoded master key. The same inputs always produce the same keypair, so the
+// public key can be recomputed anywhere the master key is available.
+// It returns the public and private keys as hex-encoded strings (64 characters each).
+func DeriveKeypair(masterKey, envName, service string) (pub string, priv string, err error) {
+	master, err := format.ParseKey(masterKey)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid master key: %w", err)
+	}
+	var kp crypto.Keypair
+	if err := kp.Derive(master, crypto.DerivationPath(service, envName)); err != nil {
+		return "", "", err
+	}
+	return kp.PublicString(), kp.PrivateString(), nil
+}
+
 // FileFormat represents the supported encrypted file formats.
 type FileFormat string
 
@@ -81,47 +135,165 @@ const (
 	FileFormatEnv FileFormat = ".env"
 	// FileFormatEjson represents the .ejson (encrypted JSON) file format.
 	FileFormatEjson FileFormat = ".ejson"
+	// FileFormatEjsonc represents the .ejsonc (encrypted JSON with comments and
+	// trailing commas) file format.
+	FileFormatEjsonc FileFormat = ".ejsonc"
 	// FileFormatEyaml represents the .eyaml (encrypted YAML) file format (not yet implemented).
 	FileFormatEyaml FileFormat = ".eyaml"
 	// FileFormatEyml represents the .eyml (encrypted YAML) file format (not yet implemented).
 	FileFormatEyml FileFormat = ".eyml"
 	// FileFormatEtoml represents the .etoml (encrypted TOML) file format (not yet implemented).
 	FileFormatEtoml FileFormat = ".etoml"
+	// FileFormatEproperties represents the .eproperties (encrypted Java properties) file format.
+	FileFormatEproperties FileFormat = ".eproperties"
+	// FileFormatEini represents the .eini (encrypted INI) file format.
+	FileFormatEini FileFormat = ".eini"
+	// FileFormatEhcl represents the .ehcl (encrypted HCL) file format.
+	FileFormatEhcl FileFormat = ".ehcl"
+	// FileFormatEtfvars represents the .etfvars (encrypted Terraform variable
+	// definitions) file format.
+	FileFormatEtfvars FileFormat = ".etfvars"
 )
 
+// DefaultNamingTemplate is the naming convention of esec files, ".ejson" for
+// the default environment and ".ejson.prod" for prod. See
+// fileutils.NamingTemplate for the templates that replace it.
+const DefaultNamingTemplate = string(fileutils.DefaultNamingTemplate)
+
 // EncryptFileInPlace takes a path to a file on disk, which must be a valid ecfg file
 // (see README.md for more on what constitutes a valid ecfg file). Any
 // encryptable-but-unencrypted fields in the file will be encrypted using the
 // public key embdded in the file, and the resulting text will be written over
-// the file present on disk.
+// the file present on disk. The rules of the closest ConfigFilename file
+// select which fields are encrypted.
 func EncryptFileInPlace(filePath string) (int, error) {
-	data, err := os.ReadFile(filePath) //nolint:gosec // File path is user-provided
+	return EncryptFileInPlaceWithConfig(filePath, EncryptConfig{})
+}
+
+// EncryptConfig defines the configuration options for EncryptFileInPlaceWithConfig.
+type EncryptConfig struct {
+	// AllScalars also encrypts numbers, booleans and dates, rather than only
+	// strings. Their type is encrypted with them, so decrypting restores them
+	// as they were written. Dotenv files only have strings, so it makes no
+	// difference to them.
+	AllScalars bool
+	// Format overrides the format of the file, which is otherwise taken from
+	// its name, or detected from its content if the name does not give one.
+	Format FileFormat
+	// NamingTemplate gives the format and environment of a file by its name, as described by
+	// fileutils.NamingTemplate, such as "{dir}/secrets/{env}{ext}". Defaults
+	// to DefaultNamingTemplate if empty.
+	NamingTemplate string
+	// PublicKey is the public key to encrypt to, instead of the one embedded
+	// in the data. It is embedded in data that has none, so that the result
+	// can be decrypted, and must match the key of data that has one. If
+	// empty, files that have no key are encrypted to the one LookupPublicKey
+	// returns for their environment, as with DetachPublicKey.
+	PublicKey string
+	// DetachPublicKey leaves PublicKey out of data that has none, for files
+	// shared with tools that reject unknown keys. Instead, it is recorded in a
+	// format.PublicKeyDirective comment at the top of the file in formats that
+	// have comments, and must be given again to decrypt the others, such as
+	// JSON files, with LookupPublicKey or DecryptFileConfig.PublicKey.
+	DetachPublicKey bool
+	// EnvName is the environment of the data EncryptWithConfig reads, whose
+	// public key LookupPublicKey looks up in the current directory if
+	// PublicKey is empty. Files take theirs from their name.
+	EnvName string
+}
+
+// EncryptFileInPlaceWithConfig is like EncryptFileInPlace, with the given
+// configuration options.
+//
+// The file is replaced atomically, keeping its permissions and owner, so a
+// crash or full disk never leaves it truncated. An advisory lock on the file
+// (see fileutils.LockFile) serializes concurrent encryptions of it.
+func EncryptFileInPlaceWithConfig(filePath string, config EncryptConfig) (int, error) {
+	unlock, err := fileutils.LockFile(filePath)
 	if err != nil {
 		return -1, err
 	}
+	defer unlock()
 
-	fileMode, err := os.Stat(filePath)
+	newdata, err := encryptFile(filePath, config)
 	if err != nil {
 		return -1, err
 	}
 
-	formatType, err := fileutils.ParseFormat(filePath)
+	if err := fileutils.WriteFileAtomic(filePath, newdata, 0o600); err != nil {
+		return -1, err
+	}
+
+	return len(newdata), nil
+}
+
+// EncryptFileTo is like EncryptFileInPlaceWithConfig, but writes the result to
+// outPath and leaves the file at filePath as it is. The result is written
+// atomically, so a failure never leaves a partial file behind. A new file gets
+// the permissions of the file at filePath.
+func EncryptFileTo(filePath, outPath string, config EncryptConfig) (int, error) {
+	fileMode, err := os.Stat(filePath)
 	if err != nil {
 		return -1, err
 	}
 
-	newdata, err := encryptData(data, FileFormat(formatType))
+	newdata, err := encryptFile(filePath, config)
 	if err != nil {
 		return -1, err
 	}
 
-	if err := os.WriteFile(filePath, newdata, fileMode.Mode()); err != nil {
+	if err := fileutils.WriteFileAtomic(outPath, newdata, fileMode.Mode().Perm()); err != nil {
 		return -1, err
 	}
 
 	return len(newdata), nil
 }
 
+// encryptFile returns the encrypted contents of the file at filePath.
+func encryptFile(filePath string, config EncryptConfig) ([]byte, error) {
+	data, err := os.ReadFile(filePath) //nolint:gosec // File path is user-provided
+	if err != nil {
+		return nil, err
+	}
+
+	formatType, err := fileFormat(filePath, data, config.Format, config.NamingTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := rulesForFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if config.AllScalars {
+		rules = withAllScalars(rules)
+	}
+
+	publicKey, detach := config.PublicKey, config.DetachPublicKey
+	if publicKey == "" {
+		_, envName, _ := fileutils.NamingTemplate(config.NamingTemplate).Match(filePath)
+		if publicKey, err = externalPublicKey(filepath.Dir(filePath), envName, data, formatType); err != nil {
+			return nil, err
+		}
+		detach = true
+	}
+
+	return encryptData(data, formatType, rules, publicKey, detach)
+}
+
+// externalPublicKey returns the public key LookupPublicKey gives for dir and
+// envName, if data is not tied to one itself, or "".
+func externalPublicKey(dir, envName string, data []byte, fileFormat FileFormat) (string, error) {
+	formatter, err := getFormatter(fileFormat)
+	if err != nil {
+		return "", err
+	}
+	if _, err := dataPublicKey(formatter, data); !errors.Is(err, format.ErrPublicKeyMissing) {
+		return "", nil
+	}
+	return LookupPublicKey(dir, envName)
+}
+
 // Encrypt reads data from the input reader, encrypts all encryptable values using the
 // public key embedded in the data, and writes the encrypted result to the output writer.
 // The fileFormat parameter determines how the data is parsed and which fields are encrypted.
@@ -133,21 +305,87 @@ func Encrypt(in io.Reader, out io.Writer, fileFormat FileFormat) (int, error) {
 		return -1, err
 	}
 
-	encryptedData, err := encryptData(data, fileFormat)
+	encryptedData, err := encryptData(data, fileFormat, nil, "", false)
 	if err != nil {
 		return -1, err
 	}
 	return out.Write(encryptedData)
 }
 
-func encryptData(data []byte, fileFormat FileFormat) ([]byte, error) {
+// EncryptWithConfig is like Encrypt, with the given configuration options.
+// The data has no name to take its format and environment from, so
+// config.Format must be set, config.NamingTemplate is not used, and data
+// without a key of its own is encrypted to config.PublicKey, or else to the
+// one LookupPublicKey returns for config.EnvName in the current directory.
+func EncryptWithConfig(in io.Reader, out io.Writer, config EncryptConfig) (int, error) {
+	if config.Format == "" {
+		return -1, fmt.Errorf("the format of the data to encrypt must be set")
+	}
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return -1, err
+	}
+
+	var rules *format.Rules
+	if config.AllScalars {
+		rules = withAllScalars(rules)
+	}
+
+	publicKey, detach := config.PublicKey, config.DetachPublicKey
+	if publicKey == "" {
+		if publicKey, err = externalPublicKey(".", config.EnvName, data, config.Format); err != nil {
+			return -1, err
+		}
+		detach = true
+	}
+
+	encryptedData, err := encryptData(data, config.Format, rules, publicKey, detach)
+	if err != nil {
+		return -1, err
+	}
+	return out.Write(encryptedData)
+}
+
+// encryptData encrypts the values of data selected by rules, which may be nil,
+// to the public key data is tied to (see dataPublicKey). If publicKey is set,
+// it is embedded first, unless data already has it, or with detach, only
+// recorded where the format allows (see recordPublicKey).
+func encryptData(data []byte, fileFormat FileFormat, rules *format.Rules, publicKey string, detach bool) ([]byte, error) {
 	// Get the formatter for the file format
 	formatter, err := getFormatter(fileFormat)
 	if err != nil {
 		return nil, err
 	}
-	// Extract the public key
-	pubkey, err := formatter.ExtractPublicKey(data)
+	if publicKey != "" {
+		if err := validatePublicKey(publicKey); err != nil {
+			return nil, err
+		}
+		if detach {
+			data, err = recordPublicKey(formatter, data, publicKey)
+		} else {
+			data, err = embedPublicKey(formatter, data, publicKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The key a detached key was not recorded for in data is used as it is
+	raw, err := dataPublicKey(formatter, data)
+	if errors.Is(err, format.ErrPublicKeyMissing) && publicKey != "" {
+		raw, err = publicKey, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Hybrid public keys get the post-quantum encrypter
+	if crypto.IsHybridPublicKey(raw) {
+		return encryptDataHybrid(formatter, raw, data, rules)
+	}
+
+	pubkey, err := format.ParsePublicKey(raw)
 	if err != nil {
 		return nil, err
 	}
@@ -162,13 +400,133 @@ func encryptData(data []byte, fileFormat FileFormat) ([]byte, error) {
 	// Create an encrypter using the public key extracted from the input data
 	enc := kp.Encrypter(pubkey)
 
-	formattedData, err := formatter.TransformScalarValues(data, enc.Encrypt)
+	formattedData, err := format.TransformScalarValues(formatter, data, rules, enc.Encrypt)
 	if err != nil {
 		return nil, err
 	}
 	return formattedData, nil
 }
 
+// embedPublicKey returns data with publicKey embedded, or data as it is if it
+// already has publicKey (see dataPublicKey). It is an error for data to have
+// another key.
+func embedPublicKey(formatter format.Handler, data []byte, publicKey string) ([]byte, error) {
+	if ok, err := hasPublicKey(formatter, data, publicKey); ok || err != nil {
+		return data, err
+	}
+
+	embedder, ok := formatter.(format.PublicKeyEmbedder)
+	if !ok {
+		return nil, fmt.Errorf("%T cannot embed a public key, add %s to the data instead", formatter, format.UnderscoredPublicKeyField)
+	}
+	return embedder.EmbedPublicKey(data, publicKey)
+}
+
+// recordPublicKey returns data with publicKey recorded in a
+// format.PublicKeyDirective comment at its top, if the format has comments,
+// or data as it is if it already has publicKey (see dataPublicKey) or cannot
+// record it. It is an error for data to have another key.
+func recordPublicKey(formatter format.Handler, data []byte, publicKey string) ([]byte, error) {
+	if ok, err := hasPublicKey(formatter, data, publicKey); ok || err != nil {
+		return data, err
+	}
+
+	commenter, ok := formatter.(format.LineCommenter)
+	if !ok {
+		return data, nil
+	}
+	comment, ok := commenter.LineComment(format.PublicKeyDirective + "=" + publicKey)
+	if !ok {
+		return data, nil
+	}
+	return format.PrependLine(data, comment), nil
+}
+
+// hasPublicKey reports whether data has publicKey (see dataPublicKey), and
+// returns an error if it has another key.
+func hasPublicKey(formatter format.Handler, data []byte, publicKey string) (bool, error) {
+	existing, err := dataPublicKey(formatter, data)
+	switch {
+	case errors.Is(err, format.ErrPublicKeyMissing):
+		return false, nil
+	case err != nil:
+		return false, err
+	case !samePublicKey(existing, publicKey):
+		return false, fmt.Errorf("data is encrypted to public key %s, not %s", existing, publicKey)
+	}
+	return true, nil
+}
+
+// dataPublicKey returns the public key data is tied to: the one it embeds
+// (see rawPublicKey), or else the one recorded by a format.PublicKeyDirective
+// at its top. It returns format.ErrPublicKeyMissing if there is neither.
+func dataPublicKey(formatter format.Handler, data []byte) (string, error) {
+	key, err := rawPublicKey(formatter, data)
+	if errors.Is(err, format.ErrPublicKeyMissing) {
+		return format.ExtractHeaderPublicKey(data)
+	}
+	return key, err
+}
+
+// rawPublicKey returns the public key embedded in data as it is written, or as
+// hex for handlers that only parse it.
+func rawPublicKey(formatter format.Handler, data []byte) (string, error) {
+	if rawFormatter, ok := formatter.(format.RawPublicKeyExtractor); ok {
+		return rawFormatter.ExtractRawPublicKey(data)
+	}
+	key, err := formatter.ExtractPublicKey(data)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key[:]), nil
+}
+
+// samePublicKey reports whether a and b are the same public key, written the
+// same way or as hex and age recipient.
+func samePublicKey(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ka, errA := format.ParsePublicKey(a)
+	kb, errB := format.ParsePublicKey(b)
+	return errA == nil && errB == nil && ka == kb
+}
+
+// validatePublicKey checks that key is a public key, hybrid or not, rather
+// than a private key or anything else.
+func validatePublicKey(key string) error {
+	if crypto.IsHybridPublicKey(key) {
+		_, err := crypto.ParseHybridPublicKey(key)
+		return err
+	}
+	_, err := format.ParsePublicKey(key)
+	return err
+}
+
+// withAllScalars returns a copy of rules, which may be nil, with AllScalars set.
+func withAllScalars(rules *format.Rules) *format.Rules {
+	all := &format.Rules{}
+	if rules != nil {
+		*all = *rules
+	}
+	all.AllScalars = true
+	return all
+}
+
+func encryptDataHybrid(formatter format.Handler, pubkey string, data []byte, rules *format.Rules) ([]byte, error) {
+	peer, err := crypto.ParseHybridPublicKey(pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", format.ErrPublicKeyInvalid, err)
+	}
+
+	enc, err := crypto.NewHybridEncrypter(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return format.TransformScalarValues(formatter, data, rules, enc.Encrypt)
+}
+
 // EnvironmentLookupFn is a function type that attempts to find an environment name
 // Returns the environment name (empty string for default environment) and any error encountered
 type EnvironmentLookupFn func() (string, error)
@@ -191,6 +549,10 @@ type DecryptFromEmbedConfig struct {
 	// UserSuppliedPrivateKey allows passing the private key directly as a hex string.
 	// If set, this takes precedence over environment variables and keyring file.
 	UserSuppliedPrivateKey string
+	// NamingTemplate lays out the files of environments, as described by
+	// fileutils.NamingTemplate, such as "{dir}/secrets/{env}{ext}". Defaults
+	// to DefaultNamingTemplate if empty.
+	NamingTemplate string
 }
 
 // CombineLookupers creates a single environment lookup function from multiple functions
@@ -253,6 +615,10 @@ func DecryptFromEmbedFSWithConfig(v embed.FS, config DecryptFromEmbedConfig) ([]
 		config.Format = FileFormatEjson
 	}
 
+	if err := fileutils.NamingTemplate(config.NamingTemplate).Validate(); err != nil {
+		return nil, err
+	}
+
 	if config.Logger == nil {
 		config.Logger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{
 			AddSource:   false,
@@ -286,7 +652,7 @@ func DecryptFromEmbedFSWithConfig(v embed.FS, config DecryptFromEmbedConfig) ([]
 	}
 
 	// Generate the filename based on the format and environment name
-	fileName := fileutils.GenerateFilename(fileutils.FileFormat(config.Format), envName)
+	fileName := fileutils.NamingTemplate(config.NamingTemplate).Filename(".", fileutils.FileFormat(config.Format), envName)
 	config.Logger.Debug("reading file from vault", "file", fileName)
 
 	// Attempt to read the file from the embedded filesystem
@@ -295,14 +661,21 @@ func DecryptFromEmbedFSWithConfig(v embed.FS, config DecryptFromEmbedConfig) ([]
 		return nil, fmt.Errorf("error reading file from vault: %v", err)
 	}
 
+	// Apply the public keys of an embedded config file
+	vaultConfig, err := configFromFS(v)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s from vault: %v", ConfigFilename, err)
+	}
+
 	// Find the private key
 	privkey, err := findPrivateKey(config.Keydir, envName, config.UserSuppliedPrivateKey)
 	if err != nil {
 		return nil, err
 	}
+	defer privkey.Destroy()
 
 	// Decrypt the file data and return the decrypted bytes
-	return decryptData(privkey, data, config.Format)
+	return decryptData(privkey, data, config.Format, publicKeyFor(vaultConfig, envName))
 }
 
 // DecryptFromEmbedFS is a convenience function that decrypts an embedded file.
@@ -327,14 +700,21 @@ func DecryptFromEmbedFS(v embed.FS, envName string, format FileFormat) ([]byte,
 		return nil, fmt.Errorf("error reading file from vault: %v", err)
 	}
 
+	// Apply the public keys of an embedded config file
+	vaultConfig, err := configFromFS(v)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s from vault: %v", ConfigFilename, err)
+	}
+
 	// Find the private key
 	privkey, err := findPrivateKey("", envName, "")
 	if err != nil {
 		return nil, err
 	}
+	defer privkey.Destroy()
 
 	// Decrypt the file data and return the decrypted bytes
-	return decryptData(privkey, data, format)
+	return decryptData(privkey, data, format, publicKeyFor(vaultConfig, envName))
 }
 
 // DecryptFromEmbedOption is a functional option for configuring DecryptFromEmbedFSWithOptions.
@@ -437,48 +817,135 @@ func DecryptFromEmbedFSWithOptions(v embed.FS, opts ...DecryptFromEmbedOption) (
 }
 
 // DecryptFile reads an encrypted file from disk, decrypts it, and returns the decrypted data.
+// The format is taken from the file's name, or detected from its content if the
+// name does not give one, in which case the default private key is used.
 func DecryptFile(filePath string, keydir string, userSuppliedPrivateKey string) ([]byte, error) {
-	envName, err := parseEnvironment(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing env from file: %w", err)
-	}
+	return DecryptFileWithConfig(filePath, DecryptFileConfig{KeyDir: keydir, PrivateKey: userSuppliedPrivateKey})
+}
+
+// DecryptFileWithKey is like DecryptFile, but decrypts with the private key held by
+// key instead of looking one up. The handle is left for the caller to Destroy.
+func DecryptFileWithKey(filePath string, key *crypto.KeyHandle) ([]byte, error) {
+	return DecryptFileWithConfig(filePath, DecryptFileConfig{Key: key})
+}
 
+// DecryptFileConfig defines the configuration options for DecryptFileWithConfig
+// and DecryptWithConfig.
+type DecryptFileConfig struct {
+	// KeyDir is the directory of the keyring the private key is looked up in.
+	KeyDir string
+	// PrivateKey is the private key to decrypt with, instead of looking one up.
+	PrivateKey string
+	// Key holds the private key to decrypt with, instead of looking one up.
+	// The handle is left for the caller to Destroy.
+	Key *crypto.KeyHandle
+	// Format overrides the format of the file, which is otherwise taken from
+	// its name, or detected from its content if the name does not give one.
+	Format FileFormat
+	// NamingTemplate gives the format and environment of a file by its name, as described by
+	// fileutils.NamingTemplate, such as "{dir}/secrets/{env}{ext}". Defaults
+	// to DefaultNamingTemplate if empty.
+	NamingTemplate string
+	// PublicKey is the public key of files encrypted without embedding one,
+	// which the private key must belong to. If empty, the one LookupPublicKey
+	// returns is used.
+	PublicKey string
+}
+
+// DecryptFileWithConfig is like DecryptFile, with the given configuration options.
+func DecryptFileWithConfig(filePath string, config DecryptFileConfig) ([]byte, error) {
 	data, err := os.ReadFile(filePath) //nolint:gosec // File path is user-provided
 	if err != nil {
 		return nil, err
 	}
 
-	fileFormat, err := fileutils.ParseFormat(filePath)
+	fileFormat, err := fileFormat(filePath, data, config.Format, config.NamingTemplate)
 	if err != nil {
 		return nil, err
 	}
 
-	privkey, err := findPrivateKey(keydir, envName, userSuppliedPrivateKey)
-	if err != nil {
-		return nil, err
+	// A name that does not follow the template gives no environment either
+	var envName string
+	if _, env, ok := fileutils.NamingTemplate(config.NamingTemplate).Match(filePath); ok {
+		envName = env
 	}
 
-	decryptedData, err := decryptData(privkey, data, FileFormat(fileFormat))
+	publicKey := config.PublicKey
+	if publicKey == "" {
+		if publicKey, err = LookupPublicKey(filepath.Dir(filePath), envName); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Key != nil {
+		return decryptData(config.Key, data, fileFormat, publicKey)
+	}
+
+	privkey, err := findPrivateKey(config.KeyDir, envName, config.PrivateKey)
 	if err != nil {
 		return nil, err
 	}
+	defer privkey.Destroy()
 
-	return decryptedData, nil
+	return decryptData(privkey, data, fileFormat, publicKey)
+}
+
+// fileFormat returns override if it is set, and otherwise the format of the
+// file at filePath holding data, from its name under template or its content.
+func fileFormat(filePath string, data []byte, override FileFormat, template string) (FileFormat, error) {
+	if err := fileutils.NamingTemplate(template).Validate(); err != nil {
+		return "", err
+	}
+	if override != "" {
+		return override, nil
+	}
+	if format, _, ok := fileutils.NamingTemplate(template).Match(filePath); ok {
+		return FileFormat(format), nil
+	}
+	format, err := fileutils.DetectFormat(filePath, data)
+	if err != nil {
+		return "", fmt.Errorf("cannot determine the format of %s: %w", filePath, err)
+	}
+	return FileFormat(format), nil
 }
 
 // Decrypt reads encrypted data from the input reader, decrypts it, and writes the decrypted data to the output writer.
 func Decrypt(in io.Reader, out io.Writer, envName string, fileFormat FileFormat, keydir string, userSuppliedPrivateKey string) (int, error) {
+	return DecryptWithConfig(in, out, envName, DecryptFileConfig{Format: fileFormat, KeyDir: keydir, PrivateKey: userSuppliedPrivateKey})
+}
+
+// DecryptWithConfig is like Decrypt, with the given configuration options.
+// The data has no name to take its format and environment from, so
+// config.Format must be set, envName selects the keys, and
+// config.NamingTemplate is not used. Keys given outside of files are looked
+// up with LookupPublicKey in the current directory.
+func DecryptWithConfig(in io.Reader, out io.Writer, envName string, config DecryptFileConfig) (int, error) {
+	if config.Format == "" {
+		return -1, fmt.Errorf("the format of the data to decrypt must be set")
+	}
+
 	data, err := io.ReadAll(in)
 	if err != nil {
 		return -1, err
 	}
 
-	privkey, err := findPrivateKey(keydir, envName, userSuppliedPrivateKey)
-	if err != nil {
-		return -1, err
+	publicKey := config.PublicKey
+	if publicKey == "" {
+		if publicKey, err = LookupPublicKey(".", envName); err != nil {
+			return -1, err
+		}
 	}
 
-	decryptedData, err := decryptData(privkey, data, fileFormat)
+	privkey := config.Key
+	if privkey == nil {
+		privkey, err = findPrivateKey(config.KeyDir, envName, config.PrivateKey)
+		if err != nil {
+			return -1, err
+		}
+		defer privkey.Destroy()
+	}
+
+	decryptedData, err := decryptData(privkey, data, config.Format, publicKey)
 	if err != nil {
 		return -1, err
 	}
@@ -486,44 +953,92 @@ func Decrypt(in io.Reader, out io.Writer, envName string, fileFormat FileFormat,
 	return out.Write(decryptedData)
 }
 
-func decryptData(privkey [32]byte, data []byte, fileFormat FileFormat) ([]byte, error) {
+// encryptedValuePrefix starts every encrypted value.
+const encryptedValuePrefix = "ESEC["
+
+// decryptData decrypts every encrypted value of data, whatever rules it was
+// encrypted with, and leaves the other values as they are. publicKey, which
+// may be empty, is the key data is encrypted to if it is not tied to one
+// itself.
+func decryptData(privkey *crypto.KeyHandle, data []byte, fileFormat FileFormat, publicKey string) ([]byte, error) {
 	// Get the formatter for the file format
 	formatter, err := getFormatter(fileFormat)
 	if err != nil {
 		return nil, err
 	}
 
-	// Extract the public key
-	pubkey, err := formatter.ExtractPublicKey(data)
+	// Create a decrypter using the private key
+	decrypter, err := newDecrypter(privkey, data, formatter, publicKey)
 	if err != nil {
 		return nil, err
 	}
+	defer decrypter.Wipe()
 
-	// Create a keypair using the extracted public and provided private keys
-	myKP := crypto.Keypair{
-		Public:  pubkey,
-		Private: privkey,
+	// Rules only choose what is encrypted: every encrypted value is decrypted,
+	// whatever the rules are now, and the others are left as they are. Values
+	// that look encrypted but are malformed are still an error.
+	decrypt := func(value []byte) ([]byte, error) {
+		if !bytes.HasPrefix(value, []byte(encryptedValuePrefix)) {
+			return value, nil
+		}
+		return decrypter.Decrypt(value)
 	}
+	decryptedData, err := format.TransformScalarValues(formatter, data, &format.Rules{All: true}, decrypt)
+	if err != nil {
+		return nil, err
+	}
+	return decryptedData, nil
+}
 
-	// Create a decrypter using the private key
-	decrypter := myKP.Decrypter()
+// newDecrypter creates a decrypter for a private key. Hybrid private keys decrypt
+// both hybrid and classic values; classic keys require the data to be tied to a
+// public key (see dataPublicKey), or else publicKey to be set. A public key that
+// data does not embed must belong to the private key.
+func newDecrypter(privkey *crypto.KeyHandle, data []byte, formatter format.Handler, publicKey string) (*crypto.Decrypter, error) {
+	if privkey.Len() == crypto.HybridPrivateKeySize {
+		return crypto.NewDecrypter(privkey)
+	}
 
-	// Decrypt the data
-	decryptedData, err := formatter.TransformScalarValues(data, decrypter.Decrypt)
+	var detached string
+	if _, err := rawPublicKey(formatter, data); errors.Is(err, format.ErrPublicKeyMissing) {
+		detached, err = format.ExtractHeaderPublicKey(data)
+		if errors.Is(err, format.ErrPublicKeyMissing) && publicKey != "" {
+			detached, err = publicKey, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if _, err := formatter.ExtractPublicKey(data); err != nil {
+		return nil, err
+	}
+
+	decrypter, err := crypto.NewDecrypter(privkey)
 	if err != nil {
 		return nil, err
 	}
-	return decryptedData, nil
+	if detached != "" {
+		pub, err := format.ParsePublicKey(detached)
+		if err != nil {
+			decrypter.Wipe()
+			return nil, err
+		}
+		if pub != decrypter.Keypair.Public {
+			decrypter.Wipe()
+			return nil, fmt.Errorf("%w %s (fingerprint %s)", ErrKeyMismatch, detached, crypto.Fingerprint(pub))
+		}
+	}
+	return decrypter, nil
 }
 
 // findPrivateKey retrieves a private key from user input, environment variables, or keyring file.
-// It prioritizes user-supplied keys, then environment variables, and finally the keyring file.
-func findPrivateKey(keyPath, envName, userSuppliedPrivateKey string) ([32]byte, error) {
-	var privKey [32]byte
-
+// It prioritizes user-supplied keys, then environment variables, and then the keyring file.
+// If no explicit key is found, it derives one from ESEC_MASTER_KEY (environment variable
+// first, then keyring entry) using the derivation path for envName and ESEC_SERVICE.
+// The key is returned in a KeyHandle, which the caller must Destroy.
+func findPrivateKey(keyPath, envName, userSuppliedPrivateKey string) (*crypto.KeyHandle, error) {
 	// If the user supplied a private key, use it directly.
 	if userSuppliedPrivateKey != "" {
-		return format.ParseKey(userSuppliedPrivateKey)
+		return parsePrivateKeyString(userSuppliedPrivateKey)
 	}
 
 	// Determine the key name to look up.
@@ -534,11 +1049,11 @@ func findPrivateKey(keyPath, envName, userSuppliedPrivateKey string) ([32]byte,
 
 	// Check if the private key is in environment variables.
 	if privKeyString, exists := os.LookupEnv(keyToLookup); exists {
-		return format.ParseKey(privKeyString)
+		return parsePrivateKeyString(privKeyString)
 	}
 	// Validate keyPath to prevent directory traversal attacks
 	if err := validateKeyPath(keyPath); err != nil {
-		return privKey, err
+		return nil, err
 	}
 
 	// If not found in env vars, try reading from the keyring file.
@@ -549,41 +1064,84 @@ func findPrivateKey(keyPath, envName, userSuppliedPrivateKey string) ([32]byte,
 	privateKeyFile, err := os.ReadFile(keyringPath) //nolint:gosec // File path is constructed from user-provided keyPath
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return privKey, fmt.Errorf("private key %q not found in environment variables, and keyring file does not exist at %q", keyToLookup, keyringPath)
+			// Without a keyring, a master key in the environment is the last resort.
+			if masterKey, exists := os.LookupEnv(EsecMasterKey); exists {
+				return deriveFromMasterKey([]byte(masterKey), envName)
+			}
+			return nil, fmt.Errorf("private key %q not found in environment variables, and keyring file does not exist at %q", keyToLookup, keyringPath)
 		}
-		return privKey, fmt.Errorf("failed to read keyring file at %q: %w", keyringPath, err)
+		return nil, fmt.Errorf("failed to read keyring file at %q: %w", keyringPath, err)
 	}
+	// The keyring holds private keys, so wipe it once the key has been decoded.
+	defer crypto.Wipe(privateKeyFile)
 
 	// Parse the keyring file as environment variables.
-	privateKeyEnvs, err := godotenv.Parse(bytes.NewBuffer(privateKeyFile))
+	privateKeyEnvs, err := parseKeyring(privateKeyFile)
 	if err != nil {
-		return privKey, fmt.Errorf("failed to parse keyring file %q: %w", keyringPath, err)
+		return nil, fmt.Errorf("failed to parse keyring file at %q: %w", keyringPath, err)
 	}
 
 	// Retrieve the private key from the parsed keyring file.
-	privKeyString, found := privateKeyEnvs[keyToLookup]
-	if !found {
-		return privKey, fmt.Errorf("private key %q not found in keyring file %q", keyToLookup, keyringPath)
-	}
-
-	// Parse and return the private key.
-	return format.ParseKey(privKeyString)
-}
-
-// getFormatter returns the appropriate Handler based on the given file format.
-func getFormatter(fileFormat FileFormat) (format.Handler, error) {
-	switch fileFormat {
-	case FileFormatEnv:
-		return &dotenv.Formatter{}, nil
-	case FileFormatEjson:
-		return &json.Formatter{}, nil
-	case FileFormatEyaml, FileFormatEyml:
-		return &yaml.Formatter{}, nil
-	case FileFormatEtoml:
-		return &toml.Formatter{}, nil
-	default:
-		return nil, fmt.Errorf("unsupported format: %s", fileFormat)
+	if privKey, found := lookupKeyring(privateKeyEnvs, keyToLookup); found {
+		return format.ParsePrivateKey(privKey)
+	}
+
+	// Fall back to deriving the key from a master key.
+	if masterKey, exists := os.LookupEnv(EsecMasterKey); exists {
+		return deriveFromMasterKey([]byte(masterKey), envName)
+	}
+	if masterKey, exists := lookupKeyring(privateKeyEnvs, EsecMasterKey); exists {
+		return deriveFromMasterKey(masterKey, envName)
 	}
+
+	return nil, fmt.Errorf("private key %q not found in keyring file %q", keyToLookup, keyringPath)
+}
+
+// LookupPublicKey returns the public key of envName given outside of its
+// files, for files that do not embed one: the ESEC_PUBLIC_KEY_<ENV>
+// environment variable, or ESEC_PUBLIC_KEY for the default environment, or
+// else the Config.PublicKeys of the ConfigFilename file closest to dir. It
+// returns "" if there is none.
+func LookupPublicKey(dir, envName string) (string, error) {
+	config, err := LoadConfig(dir)
+	if err != nil {
+		return "", err
+	}
+	return publicKeyFor(config, envName), nil
+}
+
+// publicKeyFor returns the public key of envName from the environment
+// variables, or else from config, which may be nil, as LookupPublicKey does.
+func publicKeyFor(config *Config, envName string) string {
+	keyToLookup := EsecPublicKey
+	if envName != "" {
+		keyToLookup = fmt.Sprintf("%s_%s", EsecPublicKey, strings.ToUpper(envName))
+	}
+	if key, exists := os.LookupEnv(keyToLookup); exists {
+		return strings.TrimSpace(key)
+	}
+	return config.PublicKeyFor(envName)
+}
+
+// parsePrivateKeyString decodes a private key that is only available as a string,
+// wiping the temporary byte copy made for decoding.
+func parsePrivateKeyString(privKey string) (*crypto.KeyHandle, error) {
+	b := []byte(privKey)
+	defer crypto.Wipe(b)
+	return format.ParsePrivateKey(b)
+}
+
+// deriveFromMasterKey derives the private key for envName from the given master key,
+// scoped to the service named by ESEC_SERVICE (if set). The master key bytes are
+// wiped before returning.
+func deriveFromMasterKey(masterKey []byte, envName string) (*crypto.KeyHandle, error) {
+	defer crypto.Wipe(masterKey)
+	master, err := format.ParsePrivateKey(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", EsecMasterKey, err)
+	}
+	defer master.Destroy()
+	return crypto.DeriveKey(master, crypto.DerivationPath(os.Getenv(EsecService), envName))
 }
 
 func sniffEnvName(logger *slog.Logger) (string, error) {
@@ -640,15 +1198,18 @@ func sniffFromKeyring(logger *slog.Logger, keyPath string, envName string) (stri
 		return "", fmt.Errorf("failed to read keyring file at %q: %w", keyringPath, err)
 	}
 
+	defer crypto.Wipe(privateKeyFile)
+
 	// Parse the keyring file as environment variables.
-	privateKeyEnvs, err := godotenv.Parse(bytes.NewBuffer(privateKeyFile))
+	privateKeyEnvs, err := parseKeyring(privateKeyFile)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse keyring file %q: %w", keyringPath, err)
+		return "", fmt.Errorf("failed to parse keyring file at %q: %w", keyringPath, err)
 	}
 
 	// Check if both ACTIVE_KEY and ACTIVE_ENVIRONMENT are set (conflict)
-	activeKey, hasActiveKey := privateKeyEnvs[ActiveKey]
-	activeEnv, hasActiveEnv := privateKeyEnvs[ActiveEnvironment]
+	activeKeyValue, hasActiveKey := lookupKeyring(privateKeyEnvs, ActiveKey)
+	activeEnvValue, hasActiveEnv := lookupKeyring(privateKeyEnvs, ActiveEnvironment)
+	activeKey, activeEnv := string(activeKeyValue), string(activeEnvValue)
 
 	if hasActiveKey && hasActiveEnv {
 		return "", fmt.Errorf("conflicting configuration: both %s and %s are set in keyring file",
@@ -694,9 +1255,9 @@ func sniffFromKeyring(logger *slog.Logger, keyPath string, envName string) (stri
 
 	// As a fallback, look for any ESEC_PRIVATE_KEY_* variables
 	var envKeys []string
-	for key := range privateKeyEnvs {
-		if strings.HasPrefix(key, "ESEC_PRIVATE_KEY") {
-			envKeys = append(envKeys, key)
+	for _, entry := range privateKeyEnvs {
+		if strings.HasPrefix(entry.name, "ESEC_PRIVATE_KEY") && !slices.Contains(envKeys, entry.name) {
+			envKeys = append(envKeys, entry.name)
 		}
 	}
 
@@ -714,7 +1275,7 @@ func sniffFromKeyring(logger *slog.Logger, keyPath string, envName string) (stri
 	}
 
 	// Check if there's a default key
-	if _, hasDefault := privateKeyEnvs["ESEC_PRIVATE_KEY"]; hasDefault {
+	if _, hasDefault := lookupKeyring(privateKeyEnvs, "ESEC_PRIVATE_KEY"); hasDefault {
 		logger.Debug("using default environment from keyring")
 		return "", nil
 	}
@@ -723,37 +1284,13 @@ func sniffFromKeyring(logger *slog.Logger, keyPath string, envName string) (stri
 	return "", fmt.Errorf("no environment keys found in keyring")
 }
 
-// Helper functions from before
-func parseEnvironment(filename string) (string, error) {
-	filename = path.Base(filename)
-
-	validPrefixes := []string{string(FileFormatEnv), string(FileFormatEjson), string(FileFormatEyaml), string(FileFormatEyml), string(FileFormatEtoml)}
-	isValidPrefix := false
-	for _, prefix := range validPrefixes {
-		if strings.HasPrefix(filename, prefix) {
-			isValidPrefix = true
-			break
-		}
-	}
-
-	if !isValidPrefix {
-		return "", fmt.Errorf("invalid file type: %s", filename)
-	}
-
-	parts := strings.Split(filename, ".")
-	if len(parts) <= 2 {
-		return "", nil
-	}
-
-	return parts[len(parts)-1], nil
-}
-
 // EjsonToEnv parses decrypted EJSON data and returns a map of environment variables.
 // It extracts all top-level string values, excluding the ESEC_PUBLIC_KEY field.
-// Non-string values (numbers, booleans, objects, arrays) are skipped.
+// Non-string values (numbers, booleans, objects, arrays) are skipped. Comments
+// and trailing commas are accepted, so it parses .ejsonc data too.
 func EjsonToEnv(payload []byte) (map[string]string, error) {
 	var data map[string]interface{}
-	err := gojson.Unmarshal(payload, &data)
+	err := gojson.Unmarshal(json.Standardize(payload), &data)
 	if err != nil {
 		return nil, err
 	}
@@ -767,6 +1304,67 @@ func DotEnvToEnv(payload []byte) (map[string]string, error) {
 	return godotenv.Parse(bytes.NewBuffer(payload))
 }
 
+// PropertiesToEnv parses decrypted properties data and returns a map of
+// environment variables. Like EjsonToEnv, it rejects keys that are not valid
+// environment variable names, such as dotted keys.
+func PropertiesToEnv(payload []byte) (map[string]string, error) {
+	values, err := properties.Parse(payload)
+	if err != nil {
+		return nil, err
+	}
+	return extractEnv(toInterfaceMap(values))
+}
+
+// IniToEnv parses decrypted INI data and returns a map of environment
+// variables from the keys before the first section header. Sections are
+// skipped, as nested objects are by EjsonToEnv.
+func IniToEnv(payload []byte) (map[string]string, error) {
+	sections, err := ini.Parse(payload)
+	if err != nil {
+		return nil, err
+	}
+	return extractEnv(toInterfaceMap(sections[""]))
+}
+
+// HclToEnv parses decrypted HCL data and returns a map of environment
+// variables from the top-level attributes holding string literals. Blocks and
+// attributes with other values are skipped, as nested objects are by
+// EjsonToEnv.
+func HclToEnv(payload []byte) (map[string]string, error) {
+	values, err := hcl.Parse(payload)
+	if err != nil {
+		return nil, err
+	}
+	return extractEnv(toInterfaceMap(values))
+}
+
+func toInterfaceMap(values map[string]string) map[string]interface{} {
+	out := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		out[key] = value
+	}
+	return out
+}
+
+// StripUnderscorePrefix returns env with one leading underscore removed from
+// each key that has one, so plaintext values such as _LOG_LEVEL can be exported
+// as LOG_LEVEL. _ESEC_PUBLIC_KEY and a bare "_" are kept as they are. It is an
+// error for a stripped key to collide with another key of env.
+func StripUnderscorePrefix(env map[string]string) (map[string]string, error) {
+	stripped := make(map[string]string, len(env))
+	for key, value := range env {
+		name := key
+		if len(key) > 1 && key[0] == '_' && key != format.UnderscoredPublicKeyField {
+			name = key[1:]
+			if _, exists := env[name]; exists {
+				return nil, fmt.Errorf("key %q collides with %q once its underscore is stripped", key, name)
+			}
+		}
+		stripped[name] = value
+	}
+	return stripped, nil
+}
+
 var validIdentifierPattern = regexp.MustCompile(`\A[a-zA-Z_][a-zA-Z0-9_]*\z`)
 
 func extractEnv(envMap map[string]interface{}) (map[string]string, error) {
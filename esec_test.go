@@ -9,9 +9,14 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
+	"github.com/mscno/esec/pkg/crypto"
+	"github.com/mscno/esec/pkg/dotenv"
+	"github.com/mscno/esec/pkg/fileutils"
+	"github.com/mscno/esec/pkg/format"
 	"github.com/mscno/esec/testdata"
 )
 
@@ -43,6 +48,323 @@ func TestEncryptFileInPlace(t *testing.T) {
 	})
 }
 
+func TestEncryptFileInPlaceConcurrent(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	in := fmt.Sprintf(`{"_ESEC_PUBLIC_KEY": "%s", "secret": "hunter2"}`, pub)
+	file := filepath.Join(t.TempDir(), ".ejson")
+	assert.NoError(t, os.WriteFile(file, []byte(in), 0o640))
+
+	// Each encryption sees the whole file, encrypted or not, and so leaves
+	// values already encrypted as they are
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := EncryptFileInPlace(file)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	decrypted, err := DecryptFile(file, t.TempDir(), priv)
+	assert.NoError(t, err)
+	assert.Equal(t, in, string(decrypted))
+	info, err := os.Stat(file)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+}
+
+func TestEncryptFileInPlaceSymlink(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "real"), 0o700))
+	target := filepath.Join(dir, "real", ".ejson")
+	in := fmt.Sprintf(`{"_ESEC_PUBLIC_KEY": "%s", "secret": "hunter2"}`, pub)
+	assert.NoError(t, os.WriteFile(target, []byte(in), 0o600))
+	link := filepath.Join(dir, ".ejson")
+	if err := os.Symlink(filepath.Join("real", ".ejson"), link); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+
+	_, err = EncryptFileInPlace(link)
+	assert.NoError(t, err)
+
+	info, err := os.Lstat(link)
+	assert.NoError(t, err)
+	assert.True(t, info.Mode()&os.ModeSymlink != 0)
+	encrypted, err := os.ReadFile(target)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "hunter2")
+
+	decrypted, err := DecryptFile(link, dir, priv)
+	assert.NoError(t, err)
+	assert.Equal(t, in, string(decrypted))
+}
+
+func TestEncryptFileInPlaceAllScalars(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	files := map[string]string{
+		".ejson": fmt.Sprintf(`{"_ESEC_PUBLIC_KEY": "%s", "port": 8080, "debug": true, "ratio": 0.5}`, pub),
+		".eyaml": fmt.Sprintf("_ESEC_PUBLIC_KEY: %s\nport: 8080\ndebug: true\nratio: 0.5\n", pub),
+		".etoml": fmt.Sprintf("_ESEC_PUBLIC_KEY = \"%s\"\nport = 8080\ndebug = true\nstart = 1979-05-27\n", pub),
+	}
+	for name, in := range files {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), name)
+			assert.NoError(t, os.WriteFile(file, []byte(in), 0o600))
+
+			_, err := EncryptFileInPlaceWithConfig(file, EncryptConfig{AllScalars: true})
+			assert.NoError(t, err)
+			encrypted, err := os.ReadFile(file)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, strings.Count(string(encrypted), "ESEC[1:"))
+			assert.NotContains(t, string(encrypted), "8080")
+
+			decrypted, err := DecryptFile(file, t.TempDir(), priv)
+			assert.NoError(t, err)
+			assert.Equal(t, in, string(decrypted))
+		})
+	}
+}
+
+func TestEncryptFileInPlaceJSONC(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	in := fmt.Sprintf(`{
+  "_ESEC_PUBLIC_KEY": "%s", // dev key
+  /* Database */
+  "DB_PASSWORD": "hunter2",
+  "_LOG_LEVEL": "debug",
+}
+`, pub)
+	file := filepath.Join(t.TempDir(), ".ejsonc.dev")
+	assert.NoError(t, os.WriteFile(file, []byte(in), 0o600))
+
+	_, err = EncryptFileInPlace(file)
+	assert.NoError(t, err)
+	encrypted, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(encrypted), "// dev key\n  /* Database */\n  \"DB_PASSWORD\": \"ESEC[1:")
+	assert.NotContains(t, string(encrypted), "hunter2")
+
+	decrypted, err := DecryptFile(file, t.TempDir(), priv)
+	assert.NoError(t, err)
+	assert.Equal(t, in, string(decrypted))
+
+	env, err := EjsonToEnv(decrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", env["DB_PASSWORD"])
+	assert.Equal(t, "debug", env["_LOG_LEVEL"])
+}
+
+func TestEncryptFileInPlacePropertiesAndIni(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	files := map[string]struct {
+		in    string
+		toEnv func([]byte) (map[string]string, error)
+	}{
+		".eproperties": {
+			in:    fmt.Sprintf("# app settings\n_ESEC_PUBLIC_KEY=%s\nDB_PASSWORD = hunter2\nGREETING=caf\\u00e9 \\\n    au lait\n", pub),
+			toEnv: PropertiesToEnv,
+		},
+		".eini": {
+			in:    fmt.Sprintf("; app settings\n_ESEC_PUBLIC_KEY = %s\nDB_PASSWORD = hunter2 ; rotated\nGREETING = \"café au lait\"\n[extra]\nTOKEN = t0k3n\n", pub),
+			toEnv: IniToEnv,
+		},
+	}
+	for name, tc := range files {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), name+".dev")
+			assert.NoError(t, os.WriteFile(file, []byte(tc.in), 0o600))
+
+			_, err := EncryptFileInPlace(file)
+			assert.NoError(t, err)
+			encrypted, err := os.ReadFile(file)
+			assert.NoError(t, err)
+			assert.NotContains(t, string(encrypted), "hunter2")
+			assert.Contains(t, string(encrypted), "app settings")
+
+			decrypted, err := DecryptFile(file, t.TempDir(), priv)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.in, string(decrypted))
+
+			env, err := tc.toEnv(decrypted)
+			assert.NoError(t, err)
+			assert.Equal(t, "hunter2", env["DB_PASSWORD"])
+			assert.Equal(t, "café au lait", env["GREETING"])
+			_, hasToken := env["TOKEN"]
+			assert.False(t, hasToken)
+		})
+	}
+}
+
+func TestEncryptFileInPlaceHCL(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	in := fmt.Sprintf(`# app settings
+_ESEC_PUBLIC_KEY = "%s"
+DB_PASSWORD      = "hunter2"
+replicas         = ["db1", "db2"]
+tags = {
+  owner = "ops" # esec:plaintext
+}
+`, pub)
+	for _, name := range []string{".ehcl", ".etfvars"} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), name+".dev")
+			assert.NoError(t, os.WriteFile(file, []byte(in), 0o600))
+
+			_, err := EncryptFileInPlace(file)
+			assert.NoError(t, err)
+			encrypted, err := os.ReadFile(file)
+			assert.NoError(t, err)
+			assert.NotContains(t, string(encrypted), "hunter2")
+			assert.NotContains(t, string(encrypted), "db1")
+			assert.Contains(t, string(encrypted), `owner = "ops" # esec:plaintext`)
+
+			decrypted, err := DecryptFile(file, t.TempDir(), priv)
+			assert.NoError(t, err)
+			assert.Equal(t, in, string(decrypted))
+
+			env, err := HclToEnv(decrypted)
+			assert.NoError(t, err)
+			assert.Equal(t, "hunter2", env["DB_PASSWORD"])
+			_, hasReplicas := env["replicas"]
+			assert.False(t, hasReplicas)
+		})
+	}
+}
+
+func TestEncryptFileDetectedFormat(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+	t.Setenv("ESEC_PRIVATE_KEY", priv)
+
+	in := fmt.Sprintf("_ESEC_PUBLIC_KEY: %s\ndb:\n  password: \"hunter2\"\n", pub)
+	file := filepath.Join(t.TempDir(), "secrets.prod.yaml")
+	assert.NoError(t, os.WriteFile(file, []byte(in), 0o600))
+
+	_, err = EncryptFileInPlace(file)
+	assert.NoError(t, err)
+	encrypted, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "hunter2")
+
+	// The name gives no environment, so the default key decrypts it
+	decrypted, err := DecryptFile(file, t.TempDir(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, in, string(decrypted))
+
+	// An overriding format is used as it is
+	_, err = DecryptFileWithConfig(file, DecryptFileConfig{Format: FileFormatEtoml})
+	assert.Error(t, err)
+
+	ambiguous := filepath.Join(t.TempDir(), "secrets")
+	assert.NoError(t, os.WriteFile(ambiguous, []byte(fmt.Sprintf("ESEC_PUBLIC_KEY=%q\n", pub)), 0o600))
+	_, err = EncryptFileInPlace(ambiguous)
+	assert.IsError(t, err, fileutils.ErrAmbiguousFormat)
+	_, err = EncryptFileInPlaceWithConfig(ambiguous, EncryptConfig{Format: FileFormatEnv})
+	assert.NoError(t, err)
+}
+
+func TestRegisterFormat(t *testing.T) {
+	assert.Error(t, RegisterFormat(".ejson", &dotenv.Formatter{}, nil))
+	assert.Error(t, RegisterFormat(".ekv", nil, nil))
+	assert.Error(t, RegisterFormat("ekv", &dotenv.Formatter{}, nil))
+
+	// Formats stay registered, so only register once when tests are repeated
+	if _, _, ok := LookupFormat(".ekv"); !ok {
+		assert.NoError(t, RegisterFormat(".ekv", &dotenv.Formatter{}, DotEnvToEnv))
+	}
+	assert.Error(t, RegisterFormat(".ekv", &dotenv.Formatter{}, DotEnvToEnv))
+
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+	in := fmt.Sprintf("ESEC_PUBLIC_KEY=%s\nDB_PASSWORD=hunter2\n", pub)
+	file := filepath.Join(t.TempDir(), ".ekv.prod")
+	assert.NoError(t, os.WriteFile(file, []byte(in), 0o600))
+
+	format, envName, ok := fileutils.DefaultNamingTemplate.Match(file)
+	assert.True(t, ok)
+	assert.Equal(t, ".ekv", format)
+	assert.Equal(t, "prod", envName)
+
+	_, err = EncryptFileInPlace(file)
+	assert.NoError(t, err)
+	encrypted, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "hunter2")
+
+	decrypted, err := DecryptFile(file, t.TempDir(), priv)
+	assert.NoError(t, err)
+	assert.Equal(t, in, string(decrypted))
+
+	_, toEnv, ok := LookupFormat(".ekv")
+	assert.True(t, ok)
+	env, err := toEnv(decrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", env["DB_PASSWORD"])
+}
+
+func TestEncryptFileToBlob(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	plaintext := []byte("\x00\x01binary keystore\xff")
+	file := filepath.Join(t.TempDir(), "keystore.p12")
+	assert.NoError(t, os.WriteFile(file, plaintext, 0o600))
+
+	blobPath, err := EncryptFileToBlob(file, pub)
+	assert.NoError(t, err)
+	assert.Equal(t, file+BlobExtension, blobPath)
+	isBlob, err := IsBlobFile(blobPath)
+	assert.NoError(t, err)
+	assert.True(t, isBlob)
+	isBlob, err = IsBlobFile(file)
+	assert.NoError(t, err)
+	assert.False(t, isBlob)
+
+	decrypt := func(envName, key string) ([]byte, error) {
+		f, err := os.Open(blobPath)
+		assert.NoError(t, err)
+		defer f.Close()
+		var out bytes.Buffer
+		err = DecryptBlob(f, &out, envName, t.TempDir(), key)
+		return out.Bytes(), err
+	}
+
+	decrypted, err := decrypt("", priv)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	t.Setenv("ESEC_PRIVATE_KEY_PROD", priv)
+	decrypted, err = decrypt("prod", "")
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	_, otherPriv, err := GenerateKeypair()
+	assert.NoError(t, err)
+	_, err = decrypt("", otherPriv)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match")
+}
+
 func TestEncrypt(t *testing.T) {
 	t.Run("invalid json file", func(t *testing.T) {
 		_, err := Encrypt(bytes.NewBufferString(`{"a": "b"]`), bytes.NewBuffer(nil), FileFormatEjson)
@@ -75,6 +397,176 @@ func TestEncrypt(t *testing.T) {
 	})
 }
 
+func TestEncryptWithConfigPublicKey(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	inputs := map[FileFormat]string{
+		FileFormatEnv:         "SECRET=hunter2\n",
+		FileFormatEjson:       `{"secret": "hunter2"}`,
+		FileFormatEjsonc:      "{\n  // comment\n  \"secret\": \"hunter2\",\n}",
+		FileFormatEyaml:       "secret: \"hunter2\"\n",
+		FileFormatEtoml:       "secret = \"hunter2\"\n",
+		FileFormatEproperties: "SECRET=hunter2\n",
+		FileFormatEini:        "SECRET = hunter2\n",
+		FileFormatEhcl:        "SECRET = \"hunter2\"\n",
+	}
+	for fileFormat, in := range inputs {
+		t.Run(string(fileFormat), func(t *testing.T) {
+			var encrypted bytes.Buffer
+			_, err := EncryptWithConfig(strings.NewReader(in), &encrypted, EncryptConfig{Format: fileFormat, PublicKey: pub})
+			assert.NoError(t, err)
+			assert.NotContains(t, encrypted.String(), "hunter2")
+			assert.Contains(t, encrypted.String(), pub)
+
+			// Encrypting again to the same key leaves the embedded key alone
+			var again bytes.Buffer
+			_, err = EncryptWithConfig(bytes.NewReader(encrypted.Bytes()), &again, EncryptConfig{Format: fileFormat, PublicKey: pub})
+			assert.NoError(t, err)
+			assert.Equal(t, 1, strings.Count(again.String(), pub))
+
+			var decrypted bytes.Buffer
+			_, err = Decrypt(bytes.NewReader(again.Bytes()), &decrypted, "", fileFormat, t.TempDir(), priv)
+			assert.NoError(t, err)
+			assert.Contains(t, decrypted.String(), "hunter2")
+		})
+	}
+
+	t.Run("different key", func(t *testing.T) {
+		other, _, err := GenerateKeypair()
+		assert.NoError(t, err)
+		in := fmt.Sprintf(`{"_ESEC_PUBLIC_KEY": "%s", "secret": "hunter2"}`, other)
+		_, err = EncryptWithConfig(strings.NewReader(in), io.Discard, EncryptConfig{Format: FileFormatEjson, PublicKey: pub})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "not "+pub)
+	})
+
+	t.Run("no format", func(t *testing.T) {
+		_, err := EncryptWithConfig(strings.NewReader(`{"secret": "hunter2"}`), io.Discard, EncryptConfig{PublicKey: pub})
+		assert.Error(t, err)
+	})
+
+	t.Run("age identity", func(t *testing.T) {
+		identity := "AGE-SECRET-KEY-19K97YGJWN8UQ2DCL3MM0K2FQQDSEZ8S68NEWP8K359XSPDDQAQUQD9YJLS"
+		_, err := EncryptWithConfig(strings.NewReader(`{"secret": "hunter2"}`), io.Discard, EncryptConfig{Format: FileFormatEjson, PublicKey: identity})
+		assert.IsError(t, err, format.ErrPublicKeyInvalid)
+
+		in := fmt.Sprintf(`{"_ESEC_PUBLIC_KEY": "%s", "secret": "hunter2"}`, identity)
+		_, err = EncryptWithConfig(strings.NewReader(in), io.Discard, EncryptConfig{Format: FileFormatEjson})
+		assert.IsError(t, err, format.ErrPublicKeyInvalid)
+	})
+}
+
+func TestEncryptFileTo(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	in := fmt.Sprintf(`{"_ESEC_PUBLIC_KEY": "%s", "secret": "hunter2"}`, pub)
+	file := filepath.Join(dir, "secrets.json")
+	assert.NoError(t, os.WriteFile(file, []byte(in), 0o640))
+
+	out := filepath.Join(dir, ".ejson.prod")
+	_, err = EncryptFileTo(file, out, EncryptConfig{})
+	assert.NoError(t, err)
+
+	// The input is left alone, and the output gets its permissions
+	unchanged, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, in, string(unchanged))
+	info, err := os.Stat(out)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+
+	decrypted, err := DecryptFile(out, dir, priv)
+	assert.NoError(t, err)
+	assert.Equal(t, in, string(decrypted))
+}
+
+func TestEncryptDetachedPublicKey(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+	other, _, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	inputs := map[FileFormat]string{
+		FileFormatEnv:    "SECRET=hunter2\n",
+		FileFormatEjson:  `{"secret": "hunter2"}`,
+		FileFormatEjsonc: "{\n  // comment\n  \"secret\": \"hunter2\",\n}",
+		FileFormatEyaml:  "secret: \"hunter2\"\n",
+		FileFormatEtoml:  "secret = \"hunter2\"\n",
+		FileFormatEini:   "SECRET = hunter2\n",
+	}
+	for fileFormat, in := range inputs {
+		t.Run(string(fileFormat), func(t *testing.T) {
+			var encrypted bytes.Buffer
+			_, err := EncryptWithConfig(strings.NewReader(in), &encrypted, EncryptConfig{Format: fileFormat, PublicKey: pub, DetachPublicKey: true})
+			assert.NoError(t, err)
+			assert.NotContains(t, encrypted.String(), "hunter2")
+			assert.NotContains(t, encrypted.String(), "ESEC_PUBLIC_KEY")
+
+			decrypt := func(publicKey string) (string, error) {
+				var decrypted bytes.Buffer
+				_, err := DecryptWithConfig(bytes.NewReader(encrypted.Bytes()), &decrypted, "", DecryptFileConfig{
+					Format:     fileFormat,
+					KeyDir:     t.TempDir(),
+					PrivateKey: priv,
+					PublicKey:  publicKey,
+				})
+				return decrypted.String(), err
+			}
+
+			// Strict JSON has no comments to record the key in
+			if fileFormat == FileFormatEjson {
+				assert.NotContains(t, encrypted.String(), pub)
+				_, err := decrypt("")
+				assert.IsError(t, err, format.ErrPublicKeyMissing)
+				_, err = decrypt(other)
+				assert.IsError(t, err, ErrKeyMismatch)
+			} else {
+				assert.Contains(t, encrypted.String(), format.PublicKeyDirective+"="+pub)
+				decrypted, err := decrypt("")
+				assert.NoError(t, err)
+				assert.Contains(t, decrypted, "hunter2")
+			}
+
+			decrypted, err := decrypt(pub)
+			assert.NoError(t, err)
+			assert.Contains(t, decrypted, "hunter2")
+		})
+	}
+}
+
+// Aliases refer to their anchor by name only, so editing them in an encrypted
+// file goes undetected, as documented in the README.
+func TestEncryptYAMLAliasesAuthenticated(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	assert.NoError(t, err)
+
+	in := fmt.Sprintf("_ESEC_PUBLIC_KEY: %s\nadmin: &admin s3cret\nguest: &guest welcome\nlogin: *guest\n", pub)
+	var encrypted bytes.Buffer
+	_, err = Encrypt(strings.NewReader(in), &encrypted, FileFormatEyaml)
+	assert.NoError(t, err)
+	assert.Contains(t, encrypted.String(), "login: *guest\n")
+
+	// Encrypting again leaves the encrypted values as they are
+	var again bytes.Buffer
+	_, err = Encrypt(bytes.NewReader(encrypted.Bytes()), &again, FileFormatEyaml)
+	assert.NoError(t, err)
+	assert.Equal(t, encrypted.String(), again.String())
+
+	var decrypted bytes.Buffer
+	_, err = Decrypt(bytes.NewReader(encrypted.Bytes()), &decrypted, "", FileFormatEyaml, t.TempDir(), priv)
+	assert.NoError(t, err)
+	assert.Contains(t, decrypted.String(), "guest: &guest \"welcome\"\nlogin: *guest\n")
+
+	// Pointing the alias at the admin password fails
+	tampered := strings.Replace(encrypted.String(), "login: *guest", "login: *admin", 1)
+	_, err = Decrypt(strings.NewReader(tampered), io.Discard, "", FileFormatEyaml, t.TempDir(), priv)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "aliases of encrypted values cannot be added")
+}
+
 func TestDecryptDotEnvFile(t *testing.T) {
 	t.Run("valid keypair", func(t *testing.T) {
 		// valid keypair and a corresponding entry in keydir
@@ -103,6 +595,26 @@ SECRET="my_secret"
 	})
 }
 
+func TestStripUnderscorePrefix(t *testing.T) {
+	env, err := DotEnvToEnv([]byte("_ESEC_PUBLIC_KEY=abc\n_LOG_LEVEL=debug\n__DOUBLE=x\nSECRET=s\n"))
+	assertNoError(t, err)
+
+	stripped, err := StripUnderscorePrefix(env)
+	assertNoError(t, err)
+	want := map[string]string{
+		"_ESEC_PUBLIC_KEY": "abc",
+		"LOG_LEVEL":        "debug",
+		"_DOUBLE":          "x",
+		"SECRET":           "s",
+	}
+	assert.Equal(t, want, stripped)
+
+	_, err = StripUnderscorePrefix(map[string]string{"_LOG_LEVEL": "debug", "LOG_LEVEL": "info"})
+	if err == nil || !strings.Contains(err.Error(), "collides") {
+		t.Errorf("expected a collision error, got %v", err)
+	}
+}
+
 func TestDecryptFile(t *testing.T) {
 	t.Run("invalid json file", func(t *testing.T) {
 		// invalid json file
@@ -135,12 +647,24 @@ func TestDecryptFile(t *testing.T) {
 	})
 
 	t.Run("invalid file and invalid message format", func(t *testing.T) {
-		// invalid json file
-		_, err := Decrypt(strings.NewReader(`{"_ESEC_PUBLIC_KEY": "8d8647e2eeb6d2e31228e6df7da3df921ec3b799c3f66a171cd37a1ed3004e7d", "a": "b"}`), bytes.NewBuffer(nil), "", FileFormatEjson, "", "c5caa31a5b8cb2be0074b37c56775f533b368b81d8fd33b94181f79bd6e47f87")
+		// A plaintext value is no longer an error: rules only choose what is
+		// encrypted, so decryption passes it through
+		var out bytes.Buffer
+		in := `{"_ESEC_PUBLIC_KEY": "8d8647e2eeb6d2e31228e6df7da3df921ec3b799c3f66a171cd37a1ed3004e7d", "a": "b"}`
+		_, err := Decrypt(strings.NewReader(in), &out, "", FileFormatEjson, "", "c5caa31a5b8cb2be0074b37c56775f533b368b81d8fd33b94181f79bd6e47f87")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if out.String() != in {
+			t.Errorf("wanted %s, but got %s", in, out.String())
+		}
+	})
+
+	t.Run("malformed encrypted value", func(t *testing.T) {
+		_, err := Decrypt(strings.NewReader(`{"_ESEC_PUBLIC_KEY": "8d8647e2eeb6d2e31228e6df7da3df921ec3b799c3f66a171cd37a1ed3004e7d", "a": "ESEC[1:b]"}`), bytes.NewBuffer(nil), "", FileFormatEjson, "", "c5caa31a5b8cb2be0074b37c56775f533b368b81d8fd33b94181f79bd6e47f87")
 		if err == nil {
 			t.Errorf("expected error, but none was received")
 		} else if !strings.Contains(err.Error(), "invalid message format") {
-			t.Errorf("wanted key error, but got %v", err)
+			t.Errorf("wanted message format error, but got %v", err)
 		}
 	})
 
@@ -182,6 +706,125 @@ func TestDecryptFile(t *testing.T) {
 	})
 }
 
+func TestHybridKeypair(t *testing.T) {
+	pub, priv, err := GenerateHybridKeypair()
+	assert.NoError(t, err)
+
+	// A classic value encrypted earlier to the X25519 half of the hybrid key
+	classicPub, err := crypto.ParseHybridPublicKey(pub)
+	assert.NoError(t, err)
+	var classic bytes.Buffer
+	_, err = Encrypt(bytes.NewBufferString(fmt.Sprintf(`{"_ESEC_PUBLIC_KEY": "%x", "old": "v1"}`, classicPub.X25519)), &classic, FileFormatEjson)
+	assert.NoError(t, err)
+	oldValue := regexp.MustCompile(`"old": "(ESEC\[1:[^"]+)"`).FindStringSubmatch(classic.String())
+	assert.Equal(t, 2, len(oldValue))
+
+	input := fmt.Sprintf(`{"_ESEC_PUBLIC_KEY": "%s", "old": "%s", "new": "v2"}`, pub, oldValue[1])
+	var encrypted bytes.Buffer
+	_, err = Encrypt(bytes.NewBufferString(input), &encrypted, FileFormatEjson)
+	assert.NoError(t, err)
+	assert.Contains(t, encrypted.String(), `"new": "ESEC[2:`)
+	assert.Contains(t, encrypted.String(), oldValue[1])
+
+	var decrypted bytes.Buffer
+	_, err = Decrypt(&encrypted, &decrypted, "", FileFormatEjson, t.TempDir(), priv)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(`{"_ESEC_PUBLIC_KEY": "%s", "old": "v1", "new": "v2"}`, pub), decrypted.String())
+}
+
+func TestAgeKeys(t *testing.T) {
+	// Generated with filippo.io/age v1.2.0.
+	identity := "AGE-SECRET-KEY-19K97YGJWN8UQ2DCL3MM0K2FQQDSEZ8S68NEWP8K359XSPDDQAQUQD9YJLS"
+	recipient := "age12y2arxyah6h6kl6xxnvphvcxrtuxg5s7mgqvm933k8yfvjtz0dqq3nu86j"
+
+	t.Run("identity matches recipient", func(t *testing.T) {
+		assert.NoError(t, VerifyPrivateKey(identity, recipient))
+	})
+
+	t.Run("roundtrips a file", func(t *testing.T) {
+		input := fmt.Sprintf(`{"_ESEC_PUBLIC_KEY": "%s", "secret": "hunter2"}`, recipient)
+		var encrypted bytes.Buffer
+		_, err := Encrypt(bytes.NewBufferString(input), &encrypted, FileFormatEjson)
+		assert.NoError(t, err)
+		assert.Contains(t, encrypted.String(), `"secret": "ESEC[1:`)
+
+		var decrypted bytes.Buffer
+		_, err = Decrypt(&encrypted, &decrypted, "", FileFormatEjson, t.TempDir(), identity)
+		assert.NoError(t, err)
+		assert.Equal(t, input, decrypted.String())
+	})
+
+	t.Run("generated keys match", func(t *testing.T) {
+		pub, priv, err := GenerateAgeKeypair()
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(pub, "age1"))
+		assert.True(t, strings.HasPrefix(priv, "AGE-SECRET-KEY-1"))
+		assert.NoError(t, VerifyPrivateKey(priv, pub))
+	})
+}
+
+func TestDeriveKeypair(t *testing.T) {
+	master := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+	t.Run("derives a stable keypair", func(t *testing.T) {
+		pub, priv, err := DeriveKeypair(master, "prod", "")
+		assert.NoError(t, err)
+		assert.Equal(t, "d73f459445f2e1000c6eb17306e0509291fb16fc2ced88638d472196ac67cc1b", pub)
+		assert.Equal(t, "44087fbe24bfa7649139f1e084df22d26cef7d4aba266d093092f22ea08b46ee", priv)
+	})
+
+	t.Run("scopes keys by service", func(t *testing.T) {
+		pub, _, err := DeriveKeypair(master, "prod", "api")
+		assert.NoError(t, err)
+		assert.Equal(t, "d388659d448c20fab7af93e76b3ba46c971d06cabbc839129e81823179db396b", pub)
+	})
+
+	t.Run("rejects an invalid master key", func(t *testing.T) {
+		_, _, err := DeriveKeypair("invalid", "prod", "")
+		assert.Error(t, err)
+	})
+}
+
+func TestFindPrivateKeyFromMasterKey(t *testing.T) {
+	master := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	derivedProd := "44087fbe24bfa7649139f1e084df22d26cef7d4aba266d093092f22ea08b46ee"
+	explicit := "c5caa31a5b8cb2be0074b37c56775f533b368b81d8fd33b94181f79bd6e47f87"
+
+	t.Run("derives from the environment when no keyring exists", func(t *testing.T) {
+		t.Setenv(EsecMasterKey, master)
+		key, err := findPrivateKey(t.TempDir(), "prod", "")
+		assert.NoError(t, err)
+		assert.Equal(t, derivedProd, fmt.Sprintf("%x", key.Bytes()))
+	})
+
+	t.Run("derives from the keyring master key", func(t *testing.T) {
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, DefaultKeyringFilename), []byte(EsecMasterKey+"="+master+"\n"), 0600)
+		assert.NoError(t, err)
+		key, err := findPrivateKey(dir, "prod", "")
+		assert.NoError(t, err)
+		assert.Equal(t, derivedProd, fmt.Sprintf("%x", key.Bytes()))
+	})
+
+	t.Run("prefers an explicit keyring entry", func(t *testing.T) {
+		t.Setenv(EsecMasterKey, master)
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, DefaultKeyringFilename), []byte("ESEC_PRIVATE_KEY_PROD="+explicit+"\n"), 0600)
+		assert.NoError(t, err)
+		key, err := findPrivateKey(dir, "prod", "")
+		assert.NoError(t, err)
+		assert.Equal(t, explicit, fmt.Sprintf("%x", key.Bytes()))
+	})
+
+	t.Run("honors ESEC_SERVICE", func(t *testing.T) {
+		t.Setenv(EsecMasterKey, master)
+		t.Setenv(EsecService, "api")
+		key, err := findPrivateKey(t.TempDir(), "prod", "")
+		assert.NoError(t, err)
+		assert.Equal(t, "170b6bcaaa4e46aead3903c291337b4484d6238e77e5253f8a4751df87ff54ad", fmt.Sprintf("%x", key.Bytes()))
+	})
+}
+
 func TestSniffEnvName(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -671,3 +1314,35 @@ func splitEnvVar(envVar string) []string {
 func containsPrefix(errMsg, prefix string) bool {
 	return len(errMsg) >= len(prefix) && errMsg[:len(prefix)] == prefix
 }
+
+func BenchmarkDecryptEyaml(b *testing.B) {
+	pub, priv, err := GenerateKeypair()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, n := range []int{100, 1000} {
+		var doc strings.Builder
+		fmt.Fprintf(&doc, "_ESEC_PUBLIC_KEY: %s\n", pub)
+		for i := 0; i < n/10; i++ {
+			fmt.Fprintf(&doc, "service_%d:\n", i)
+			for j := 0; j < 10; j++ {
+				fmt.Fprintf(&doc, "    secret_%d: value-%d-%d\n", j, i, j)
+			}
+		}
+		var encrypted bytes.Buffer
+		if _, err := Encrypt(strings.NewReader(doc.String()), &encrypted, FileFormatEyaml); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("values=%d", n), func(b *testing.B) {
+			b.SetBytes(int64(encrypted.Len()))
+			for i := 0; i < b.N; i++ {
+				var out bytes.Buffer
+				if _, err := Decrypt(bytes.NewReader(encrypted.Bytes()), &out, "", FileFormatEyaml, "", priv); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package esec
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mscno/esec/pkg/dotenv"
+	"github.com/mscno/esec/pkg/fileutils"
+	"github.com/mscno/esec/pkg/format"
+	"github.com/mscno/esec/pkg/hcl"
+	"github.com/mscno/esec/pkg/ini"
+	"github.com/mscno/esec/pkg/json"
+	"github.com/mscno/esec/pkg/properties"
+	"github.com/mscno/esec/pkg/toml"
+	"github.com/mscno/esec/pkg/yaml"
+)
+
+// EnvExtractor converts the decrypted data of a file format to environment
+// variables, as EjsonToEnv does for .ejson files. The esec run and get
+// commands use it.
+type EnvExtractor func(payload []byte) (map[string]string, error)
+
+// registeredFormat is the handler and env extractor of a file format.
+type registeredFormat struct {
+	handler format.Handler
+	toEnv   EnvExtractor
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = map[FileFormat]registeredFormat{
+		FileFormatEnv:         {&dotenv.Formatter{}, DotEnvToEnv},
+		FileFormatEjson:       {&json.Formatter{}, EjsonToEnv},
+		FileFormatEjsonc:      {&json.Formatter{JSONC: true}, EjsonToEnv},
+		FileFormatEyaml:       {&yaml.Formatter{}, nil},
+		FileFormatEyml:        {&yaml.Formatter{}, nil},
+		FileFormatEtoml:       {&toml.Formatter{}, nil},
+		FileFormatEproperties: {&properties.Formatter{}, PropertiesToEnv},
+		FileFormatEini:        {&ini.Formatter{}, IniToEnv},
+		FileFormatEhcl:        {&hcl.Formatter{}, HclToEnv},
+		FileFormatEtfvars:     {&hcl.Formatter{}, HclToEnv},
+	}
+)
+
+// RegisterFormat adds a file format, such as ".ecfg", so that files named
+// after it (".ecfg", ".ecfg.prod") are encrypted and decrypted with handler.
+// toEnv, if not nil, converts decrypted files to environment variables for
+// the esec run and get commands. handler may also implement
+// format.RulesHandler to support encryption rules and comment directives.
+//
+// The format must be a '.' followed by a name without dots or path
+// separators, and must not be supported already. RegisterFormat is usually
+// called from an init function, before any file is encrypted or decrypted.
+func RegisterFormat(ext FileFormat, handler format.Handler, toEnv EnvExtractor) error {
+	if handler == nil {
+		return fmt.Errorf("format %s: handler is nil", ext)
+	}
+
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	if err := fileutils.RegisterFormat(fileutils.FileFormat(ext)); err != nil {
+		return err
+	}
+	formats[ext] = registeredFormat{handler: handler, toEnv: toEnv}
+	return nil
+}
+
+// LookupFormat returns the handler and env extractor of a file format, built
+// in or added with RegisterFormat. toEnv is nil if the format has none. ok is
+// false if the format is not supported.
+func LookupFormat(ext FileFormat) (handler format.Handler, toEnv EnvExtractor, ok bool) {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	f, ok := formats[ext]
+	return f.handler, f.toEnv, ok
+}
+
+// getFormatter returns the appropriate Handler based on the given file format.
+func getFormatter(fileFormat FileFormat) (format.Handler, error) {
+	handler, _, ok := LookupFormat(fileFormat)
+	if !ok {
+		return nil, fmt.Errorf("unsupported format: %s", fileFormat)
+	}
+	return handler, nil
+}
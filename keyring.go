@@ -0,0 +1,88 @@
+package esec
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// keyringEntry is a single NAME=value line of a keyring file. The value aliases
+// the file contents rather than being copied into a string, so private keys
+// read from the keyring can be wiped along with the file buffer.
+type keyringEntry struct {
+	name  string
+	value []byte
+}
+
+// parseKeyring parses a dotenv-style keyring file. It understands blank lines,
+// comments, an optional "export " prefix, "NAME: value" lines, single- or
+// double-quoted values and trailing comments after unquoted values. As with
+// godotenv, lines that are not assignments and unterminated quotes are an
+// error, so a broken keyring is not taken for one without the key, while
+// assignments to names that are not identifiers are skipped. Errors only give
+// the line number, never its contents.
+func parseKeyring(data []byte) ([]keyringEntry, error) {
+	var entries []keyringEntry
+	for lineNo := 1; len(data) > 0; lineNo++ {
+		var line []byte
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			line, data = data, nil
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		line = bytes.TrimPrefix(line, []byte("export "))
+
+		eq := bytes.IndexAny(line, "=:")
+		if eq < 0 {
+			return nil, fmt.Errorf("keyring line %d is not a NAME=value assignment", lineNo)
+		}
+		name := bytes.TrimSpace(line[:eq])
+		if !isKeyringName(name) {
+			continue
+		}
+
+		value := bytes.TrimSpace(line[eq+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+			end := bytes.IndexByte(value[1:], value[0])
+			if end < 0 {
+				return nil, fmt.Errorf("keyring line %d has an unterminated quoted value", lineNo)
+			}
+			value = value[1 : end+1]
+		} else if i := bytes.Index(value, []byte(" #")); i >= 0 {
+			value = bytes.TrimSpace(value[:i])
+		}
+
+		entries = append(entries, keyringEntry{name: string(name), value: value})
+	}
+	return entries, nil
+}
+
+// lookupKeyring returns the value of the last entry with the given name.
+func lookupKeyring(entries []keyringEntry, name string) ([]byte, bool) {
+	var (
+		value []byte
+		found bool
+	)
+	for _, e := range entries {
+		if e.name == name {
+			value, found = e.value, true
+		}
+	}
+	return value, found
+}
+
+func isKeyringName(name []byte) bool {
+	for i, c := range name {
+		switch {
+		case c == '_', 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return len(name) > 0
+}
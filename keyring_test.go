@@ -0,0 +1,61 @@
+package esec
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestParseKeyring(t *testing.T) {
+	keyring := []byte(`# comment
+ESEC_ACTIVE_ENVIRONMENT=dev
+
+export ESEC_PRIVATE_KEY_DEV="dq"
+ESEC_PRIVATE_KEY_PROD='sq' # trailing
+ESEC_PRIVATE_KEY_STAGING = plain # trailing
+this is not valid===
+ESEC_PRIVATE_KEY_DEV=override
+not an identifier=skipped
+ESEC_PRIVATE_KEY_TEST: colon
+`)
+
+	entries, err := parseKeyring(keyring)
+	assert.NoError(t, err)
+
+	value, ok := lookupKeyring(entries, "ESEC_ACTIVE_ENVIRONMENT")
+	assert.True(t, ok)
+	assert.Equal(t, "dev", string(value))
+
+	value, ok = lookupKeyring(entries, "ESEC_PRIVATE_KEY_PROD")
+	assert.True(t, ok)
+	assert.Equal(t, "sq", string(value))
+
+	value, ok = lookupKeyring(entries, "ESEC_PRIVATE_KEY_STAGING")
+	assert.True(t, ok)
+	assert.Equal(t, "plain", string(value))
+
+	// Later entries win
+	value, ok = lookupKeyring(entries, "ESEC_PRIVATE_KEY_DEV")
+	assert.True(t, ok)
+	assert.Equal(t, "override", string(value))
+
+	value, ok = lookupKeyring(entries, "ESEC_PRIVATE_KEY_TEST")
+	assert.True(t, ok)
+	assert.Equal(t, "colon", string(value))
+
+	_, ok = lookupKeyring(entries, "ESEC_PRIVATE_KEY")
+	assert.False(t, ok)
+	assert.Equal(t, 6, len(entries))
+}
+
+func TestParseKeyringInvalid(t *testing.T) {
+	for _, keyring := range []string{
+		"ESEC_PRIVATE_KEY_DEV=abc\nthis is not valid\n",
+		"ESEC_PRIVATE_KEY_DEV=\"abc\n",
+		"ESEC_PRIVATE_KEY_DEV='abc\n",
+	} {
+		_, err := parseKeyring([]byte(keyring))
+		assert.Error(t, err, keyring)
+		assert.NotContains(t, err.Error(), "abc")
+	}
+}
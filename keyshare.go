@@ -0,0 +1,283 @@
+package esec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mscno/esec/pkg/crypto"
+	"github.com/mscno/esec/pkg/fileutils"
+	"github.com/mscno/esec/pkg/format"
+	"github.com/mscno/esec/pkg/shamir"
+)
+
+// KeySharePrefix starts every printable private key share.
+const KeySharePrefix = "esec-share-1"
+
+// ErrKeyMismatch means a private key does not belong to the expected public key.
+var ErrKeyMismatch = errors.New("private key does not match the expected public key")
+
+// SplitPrivateKey splits a private key, hex-encoded, an age identity or a
+// hybrid private key, into printable shares using Shamir's secret sharing,
+// such that any threshold of them can reconstruct it.
+//
+// Each share is a single line of the form:
+//
+//	esec-share-1:<fingerprint>:<threshold>:<index>:<share>:<checksum>
+//
+// where fingerprint identifies the public key (see crypto.Fingerprint), share is
+// the hex-encoded share data and checksum is the first 4 bytes of the SHA-256
+// hash of everything before it, hex-encoded, so transcription errors are caught.
+func SplitPrivateKey(privateKey string, shares, threshold int) ([]string, error) {
+	priv, err := parsePrivateKeyString(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	defer priv.Destroy()
+	_, fingerprint, err := publicKeyOf(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := shamir.Split(priv.Bytes(), shares, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, len(parts))
+	for i, part := range parts {
+		x := part[len(part)-1]
+		body := fmt.Sprintf("%s:%s:%d:%d:%s", KeySharePrefix, fingerprint, threshold, x, hex.EncodeToString(part[:len(part)-1]))
+		out[i] = body + ":" + shareChecksum(body)
+		crypto.Wipe(part)
+	}
+	return out, nil
+}
+
+// CombinePrivateKey reconstructs a private key from shares produced by
+// SplitPrivateKey, hex-encoded or as a hybrid private key. It verifies every
+// share's checksum, that all shares come from the same split, that at least
+// the threshold number of shares is present, and that the reconstructed key
+// matches the fingerprint recorded in the shares.
+func CombinePrivateKey(shares []string) (string, error) {
+	if len(shares) == 0 {
+		return "", fmt.Errorf("no shares supplied")
+	}
+
+	var (
+		fingerprint string
+		threshold   int
+		parts       [][]byte
+	)
+	for i, share := range shares {
+		parsed, err := parseKeyShare(share)
+		if err != nil {
+			return "", fmt.Errorf("share %d: %w", i+1, err)
+		}
+		if i == 0 {
+			fingerprint, threshold = parsed.fingerprint, parsed.threshold
+		} else if parsed.fingerprint != fingerprint || parsed.threshold != threshold {
+			return "", fmt.Errorf("share %d: %w", i+1, shamir.ErrMismatchedShares)
+		}
+		parts = append(parts, parsed.data)
+	}
+	if len(parts) < threshold {
+		return "", fmt.Errorf("need %d shares to reconstruct the key, got %d", threshold, len(parts))
+	}
+
+	secret, err := shamir.Combine(parts)
+	if err != nil {
+		return "", err
+	}
+	defer crypto.Wipe(secret)
+	if len(secret) != 32 && len(secret) != crypto.HybridPrivateKeySize {
+		return "", fmt.Errorf("reconstructed key has invalid length %d", len(secret))
+	}
+	priv, err := crypto.NewKeyHandle(len(secret))
+	if err != nil {
+		return "", err
+	}
+	defer priv.Destroy()
+	copy(priv.Bytes(), secret)
+
+	_, got, err := publicKeyOf(priv)
+	if err != nil {
+		return "", err
+	}
+	if got != fingerprint {
+		return "", fmt.Errorf("reconstructed key does not match fingerprint %s: %w", fingerprint, ErrKeyMismatch)
+	}
+	return encodePrivateKey(priv), nil
+}
+
+// VerifyPrivateKey checks that a private key belongs to the given public key,
+// both hex-encoded, age keys or hybrid keys.
+func VerifyPrivateKey(privateKey, publicKey string) error {
+	priv, err := parsePrivateKeyString(privateKey)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %w", err)
+	}
+	defer priv.Destroy()
+	if err := validatePublicKey(publicKey); err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	pub, _, err := publicKeyOf(priv)
+	if err != nil {
+		return err
+	}
+	if !samePublicKey(pub, publicKey) {
+		return ErrKeyMismatch
+	}
+	return nil
+}
+
+// VerifyPrivateKeyForFile checks that a hex-encoded private key belongs to the
+// public key of an encrypted file, embedded in it or else given as
+// LookupPublicKey returns, and that it decrypts the file. The format and
+// environment of the file are worked out as DecryptFile does, from its name
+// under namingTemplate, which defaults to DefaultNamingTemplate, or else from
+// its content.
+func VerifyPrivateKeyForFile(privateKey, filePath, namingTemplate string) error {
+	data, err := os.ReadFile(filePath) //nolint:gosec // File path is user-provided
+	if err != nil {
+		return err
+	}
+	fileFormat, err := fileFormat(filePath, data, "", namingTemplate)
+	if err != nil {
+		return err
+	}
+	formatter, err := getFormatter(fileFormat)
+	if err != nil {
+		return err
+	}
+	pub, err := dataPublicKey(formatter, data)
+	if errors.Is(err, format.ErrPublicKeyMissing) {
+		_, envName, _ := fileutils.NamingTemplate(namingTemplate).Match(filePath)
+		if pub, err = LookupPublicKey(filepath.Dir(filePath), envName); err == nil && pub == "" {
+			err = format.ErrPublicKeyMissing
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := VerifyPrivateKey(privateKey, pub); err != nil {
+		return err
+	}
+	priv, err := parsePrivateKeyString(privateKey)
+	if err != nil {
+		return err
+	}
+	defer priv.Destroy()
+	_, err = decryptData(priv, data, fileFormat, pub)
+	return err
+}
+
+// LookupPrivateKey returns the private key for an environment, using the
+// same lookup order as decryption: environment variables, the keyring file in keydir,
+// and finally derivation from ESEC_MASTER_KEY.
+func LookupPrivateKey(keydir, envName string) (string, error) {
+	priv, err := findPrivateKey(keydir, envName, "")
+	if err != nil {
+		return "", err
+	}
+	defer priv.Destroy()
+	return encodePrivateKey(priv), nil
+}
+
+// encodePrivateKey returns the private key held by priv, hex-encoded or as a
+// hybrid private key.
+func encodePrivateKey(priv *crypto.KeyHandle) string {
+	if priv.Len() == crypto.HybridPrivateKeySize {
+		k := hybridPrivateKey(priv)
+		defer wipeHybridPrivateKey(k)
+		return k.String()
+	}
+	return hex.EncodeToString(priv.Bytes())
+}
+
+// publicKeyOf returns the public key of the private key held by priv, in the
+// encoding of its kind, and its fingerprint.
+func publicKeyOf(priv *crypto.KeyHandle) (pub, fingerprint string, err error) {
+	switch priv.Len() {
+	case 32:
+		var k [32]byte
+		copy(k[:], priv.Bytes())
+		defer crypto.Wipe(k[:])
+		p, err := crypto.PublicKeyFromPrivate(k)
+		if err != nil {
+			return "", "", err
+		}
+		return hex.EncodeToString(p[:]), crypto.Fingerprint(p), nil
+	case crypto.HybridPrivateKeySize:
+		k := hybridPrivateKey(priv)
+		defer wipeHybridPrivateKey(k)
+		p, err := k.Public()
+		if err != nil {
+			return "", "", err
+		}
+		return p.String(), p.Fingerprint(), nil
+	default:
+		return "", "", fmt.Errorf("%w: private key has invalid length %d", crypto.ErrInvalidKeyFormat, priv.Len())
+	}
+}
+
+// hybridPrivateKey copies the hybrid private key held by priv, which the
+// caller must wipe with wipeHybridPrivateKey.
+func hybridPrivateKey(priv *crypto.KeyHandle) *crypto.HybridPrivateKey {
+	k := &crypto.HybridPrivateKey{}
+	copy(k.X25519[:], priv.Bytes()[:32])
+	copy(k.Seed[:], priv.Bytes()[32:])
+	return k
+}
+
+func wipeHybridPrivateKey(k *crypto.HybridPrivateKey) {
+	crypto.Wipe(k.X25519[:])
+	crypto.Wipe(k.Seed[:])
+}
+
+type keyShare struct {
+	fingerprint string
+	threshold   int
+	data        []byte
+}
+
+func parseKeyShare(share string) (*keyShare, error) {
+	share = strings.TrimSpace(share)
+	fields := strings.Split(share, ":")
+	if len(fields) != 6 || fields[0] != KeySharePrefix {
+		return nil, fmt.Errorf("not an %s share", KeySharePrefix)
+	}
+	body := strings.Join(fields[:5], ":")
+	if shareChecksum(body) != strings.ToLower(fields[5]) {
+		return nil, fmt.Errorf("checksum mismatch, the share is corrupted or mistyped")
+	}
+
+	threshold, err := strconv.Atoi(fields[2])
+	if err != nil || threshold < 2 {
+		return nil, fmt.Errorf("invalid threshold %q", fields[2])
+	}
+	x, err := strconv.Atoi(fields[3])
+	if err != nil || x < 1 || x > shamir.MaxShares {
+		return nil, fmt.Errorf("invalid share index %q", fields[3])
+	}
+	data, err := hex.DecodeString(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid share data: %w", err)
+	}
+
+	return &keyShare{
+		fingerprint: fields[1],
+		threshold:   threshold,
+		data:        append(data, byte(x)),
+	}, nil
+}
+
+func shareChecksum(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,112 @@
+package esec
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/mscno/esec/pkg/crypto"
+)
+
+func TestSplitAndCombinePrivateKey(t *testing.T) {
+	priv := "c5caa31a5b8cb2be0074b37c56775f533b368b81d8fd33b94181f79bd6e47f87"
+	pub := "8d8647e2eeb6d2e31228e6df7da3df921ec3b799c3f66a171cd37a1ed3004e7d"
+
+	shares, err := SplitPrivateKey(priv, 5, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(shares))
+	for _, share := range shares {
+		assert.True(t, strings.HasPrefix(share, KeySharePrefix+":"))
+	}
+
+	t.Run("threshold shares reconstruct the key", func(t *testing.T) {
+		got, err := CombinePrivateKey([]string{shares[4], shares[0], shares[2]})
+		assert.NoError(t, err)
+		assert.Equal(t, priv, got)
+		assert.NoError(t, VerifyPrivateKey(got, pub))
+	})
+
+	t.Run("too few shares are rejected", func(t *testing.T) {
+		_, err := CombinePrivateKey(shares[:2])
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "need 3 shares")
+	})
+
+	t.Run("corrupted shares are rejected", func(t *testing.T) {
+		corrupted := []rune(shares[1])
+		i := strings.LastIndex(shares[1], ":") - 1
+		if corrupted[i] == '0' {
+			corrupted[i] = '1'
+		} else {
+			corrupted[i] = '0'
+		}
+		_, err := CombinePrivateKey([]string{shares[0], string(corrupted), shares[2]})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "checksum mismatch")
+	})
+
+	t.Run("shares from different keys are rejected", func(t *testing.T) {
+		other, err := SplitPrivateKey("24ab5041def8c84077bacce66524cc2ad37266ada17429e8e3c1db534dd2c2c5", 5, 3)
+		assert.NoError(t, err)
+		_, err = CombinePrivateKey([]string{shares[0], shares[1], other[2]})
+		assert.Error(t, err)
+	})
+}
+
+func TestSplitAndCombineHybridPrivateKey(t *testing.T) {
+	key, err := crypto.GenerateHybridKey()
+	assert.NoError(t, err)
+	pub, err := key.Public()
+	assert.NoError(t, err)
+
+	shares, err := SplitPrivateKey(key.String(), 3, 2)
+	assert.NoError(t, err)
+	got, err := CombinePrivateKey([]string{shares[2], shares[0]})
+	assert.NoError(t, err)
+	assert.Equal(t, key.String(), got)
+	assert.NoError(t, VerifyPrivateKey(got, pub.String()))
+
+	other, err := crypto.GenerateHybridKey()
+	assert.NoError(t, err)
+	otherPub, err := other.Public()
+	assert.NoError(t, err)
+	assert.IsError(t, VerifyPrivateKey(got, otherPub.String()), ErrKeyMismatch)
+}
+
+func TestVerifyPrivateKeyForFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".ejson")
+	err := os.WriteFile(path, []byte(`{"_ESEC_PUBLIC_KEY": "8d8647e2eeb6d2e31228e6df7da3df921ec3b799c3f66a171cd37a1ed3004e7d", "a": "ESEC[1:KR1IxNZnTZQMP3OR1NdOpDQ1IcLD83FSuE7iVNzINDk=:XnYW1HOxMthBFMnxWULHlnY4scj5mNmX:ls1+kvwwu2ETz5C6apgWE7Q=]"}`), 0600)
+	assert.NoError(t, err)
+
+	assert.NoError(t, VerifyPrivateKeyForFile("c5caa31a5b8cb2be0074b37c56775f533b368b81d8fd33b94181f79bd6e47f87", path, ""))
+	assert.IsError(t, VerifyPrivateKeyForFile("24ab5041def8c84077bacce66524cc2ad37266ada17429e8e3c1db534dd2c2c5", path, ""), ErrKeyMismatch)
+}
+
+func TestVerifyPrivateKeyForFileFormat(t *testing.T) {
+	const (
+		privateKey = "c5caa31a5b8cb2be0074b37c56775f533b368b81d8fd33b94181f79bd6e47f87"
+		publicKey  = "8d8647e2eeb6d2e31228e6df7da3df921ec3b799c3f66a171cd37a1ed3004e7d"
+		value      = "ESEC[1:KR1IxNZnTZQMP3OR1NdOpDQ1IcLD83FSuE7iVNzINDk=:XnYW1HOxMthBFMnxWULHlnY4scj5mNmX:ls1+kvwwu2ETz5C6apgWE7Q=]"
+	)
+	dir := t.TempDir()
+
+	t.Run("detected from content", func(t *testing.T) {
+		path := filepath.Join(dir, "secrets")
+		err := os.WriteFile(path, []byte(`{"_ESEC_PUBLIC_KEY": "`+publicKey+`", "a": "`+value+`"}`), 0600)
+		assert.NoError(t, err)
+		assert.NoError(t, VerifyPrivateKeyForFile(privateKey, path, ""))
+	})
+
+	t.Run("environment from the naming template", func(t *testing.T) {
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, "vault"), 0700))
+		path := filepath.Join(dir, "vault", "prod.ejson")
+		err := os.WriteFile(path, []byte(`{"a": "`+value+`"}`), 0600)
+		assert.NoError(t, err)
+		t.Setenv("ESEC_PUBLIC_KEY", "")
+		t.Setenv("ESEC_PUBLIC_KEY_PROD", publicKey)
+		assert.NoError(t, VerifyPrivateKeyForFile(privateKey, path, "{dir}/vault/{env}{ext}"))
+		assert.Error(t, VerifyPrivateKeyForFile(privateKey, path, ""))
+	})
+}
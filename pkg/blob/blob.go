@@ -0,0 +1,199 @@
+// Package blob implements opaque esec files: whole files, such as TLS keys or
+// keystores, encrypted as a single authenticated blob rather than value by
+// value.
+//
+// A blob starts with a text header of three lines:
+//
+//	"esec-blob/" SchemaVersion ( "1" ) "\n"
+//	PublicKey :: the recipient public key, as in _ESEC_PUBLIC_KEY "\n"
+//	FileKey :: a random 32-byte key, boxed to PublicKey like a value "\n"
+//
+// followed by the file, encrypted in chunks under a key derived from FileKey
+// and the header (see encryptStream). Blobs are encrypted and decrypted as
+// streams, so files of any size are handled in constant memory.
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mscno/esec/pkg/crypto"
+	"github.com/mscno/esec/pkg/format"
+	"golang.org/x/crypto/hkdf"
+)
+
+// SchemaVersion is the schema version of the blobs written by Encrypt.
+const SchemaVersion = 1
+
+// Magic starts every blob, followed by its schema version.
+const Magic = "esec-blob/"
+
+// streamKDFInfo prefixes the header in the HKDF info the stream key is
+// derived with.
+const streamKDFInfo = "esec-blob-stream-v1"
+
+// maxHeaderLine bounds the length of a header line. Hybrid public keys and
+// the file keys boxed to them are the longest, at under 2KB.
+const maxHeaderLine = 4096
+
+// ErrCorrupt means the data is not a well-formed blob.
+var ErrCorrupt = errors.New("invalid blob")
+
+// Header is the header of a blob.
+type Header struct {
+	// SchemaVersion is the schema version of the blob.
+	SchemaVersion int
+	// PublicKey is the public key the blob is encrypted to.
+	PublicKey string
+	// boxedKey is the file key boxed to PublicKey.
+	boxedKey []byte
+}
+
+// IsBlob reports whether data, which may be only the start of a file, starts
+// like a blob.
+func IsBlob(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
+
+// Encrypt encrypts everything read from src to publicKey, which may be a
+// Curve25519, age or hybrid public key, and writes the blob to dst.
+func Encrypt(dst io.Writer, src io.Reader, publicKey string) error {
+	fileKey := make([]byte, 32)
+	defer crypto.Wipe(fileKey)
+	if _, err := rand.Read(fileKey); err != nil {
+		return err
+	}
+	boxedKey, err := boxKey(fileKey, publicKey)
+	if err != nil {
+		return err
+	}
+
+	h := Header{SchemaVersion: SchemaVersion, PublicKey: publicKey, boxedKey: boxedKey}
+	header := h.dump()
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	key, err := streamKey(fileKey, header)
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(key)
+	return encryptStream(dst, src, key)
+}
+
+// Decrypt decrypts the blob read from r with d and writes the file to dst. r
+// must be positioned after the header, which ReadHeader read from it. The file
+// is written as it is authenticated, chunk by chunk, so if an error is
+// returned, what was written to dst must be discarded.
+func Decrypt(dst io.Writer, r *bufio.Reader, h *Header, d *crypto.Decrypter) error {
+	fileKey, err := d.Decrypt(h.boxedKey)
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(fileKey)
+	if len(fileKey) != 32 {
+		return ErrCorrupt
+	}
+	key, err := streamKey(fileKey, h.dump())
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(key)
+	return decryptStream(dst, r, key)
+}
+
+// ReadHeader reads the header of a blob from r.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	var lines [3]string
+	for i := range lines {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		lines[i] = line
+	}
+	if !strings.HasPrefix(lines[0], Magic) {
+		return nil, ErrCorrupt
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(lines[0], Magic))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	if version != SchemaVersion {
+		return nil, fmt.Errorf("unsupported blob schema version %d, only version %d is supported", version, SchemaVersion)
+	}
+	if lines[1] == "" || !crypto.IsBoxedMessage([]byte(lines[2])) {
+		return nil, ErrCorrupt
+	}
+	return &Header{SchemaVersion: version, PublicKey: lines[1], boxedKey: []byte(lines[2])}, nil
+}
+
+// dump returns the header in the wire format.
+func (h *Header) dump() []byte {
+	return fmt.Appendf(nil, "%s%d\n%s\n%s\n", Magic, h.SchemaVersion, h.PublicKey, h.boxedKey)
+}
+
+// readLine reads a header line from r, without its line break.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		part, isPrefix, err := r.ReadLine()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return "", ErrCorrupt
+			}
+			return "", err
+		}
+		line = append(line, part...)
+		if len(line) > maxHeaderLine {
+			return "", ErrCorrupt
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// boxKey boxes the file key to publicKey with the encrypter for its kind.
+func boxKey(fileKey []byte, publicKey string) ([]byte, error) {
+	if crypto.IsHybridPublicKey(publicKey) {
+		peer, err := crypto.ParseHybridPublicKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", format.ErrPublicKeyInvalid, err)
+		}
+		enc, err := crypto.NewHybridEncrypter(peer)
+		if err != nil {
+			return nil, err
+		}
+		return enc.Encrypt(fileKey)
+	}
+
+	pub, err := format.ParsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	var kp crypto.Keypair
+	if err := kp.Generate(); err != nil {
+		return nil, err
+	}
+	defer kp.Wipe()
+	return kp.Encrypter(pub).Encrypt(fileKey)
+}
+
+// streamKey derives the key of the stream from the file key, bound to the
+// header so that it cannot be altered.
+func streamKey(fileKey, header []byte) ([]byte, error) {
+	info := append([]byte(streamKDFInfo), header...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, fileKey, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
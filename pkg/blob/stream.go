@@ -0,0 +1,111 @@
+package blob
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/mscno/esec/pkg/crypto"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// chunkSize is the size of the plaintext chunks of a stream. Only the last
+// chunk may be shorter, and it is empty only if the whole plaintext is.
+const chunkSize = 64 * 1024
+
+// The stream is the STREAM construction of Hoang, Reyhanitabar, Rogaway and
+// Vizár: each chunk is sealed with ChaCha20-Poly1305 under a nonce made of a
+// big-endian chunk counter and a final byte that is 1 for the last chunk and 0
+// otherwise. Chunks therefore cannot be reordered, dropped or duplicated, and
+// a stream truncated at a chunk boundary fails to decrypt as its last chunk
+// is not marked as such. The key is fresh for every blob, so the counter
+// nonces are never reused.
+
+// encryptStream seals src chunk by chunk under key and writes the chunks to dst.
+func encryptStream(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(src, chunkSize)
+	plaintext := make([]byte, chunkSize)
+	defer crypto.Wipe(plaintext)
+	var sealed []byte
+	for counter := uint64(0); ; counter++ {
+		n, last, err := readChunk(r, plaintext)
+		if err != nil {
+			return err
+		}
+		sealed = aead.Seal(sealed[:0], chunkNonce(aead, counter, last), plaintext[:n], nil)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptStream opens the chunks read from src under key and writes the
+// plaintext to dst. Each chunk is written once it is authenticated, so if an
+// error is returned, the plaintext written so far must be discarded.
+func decryptStream(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(src, chunkSize+aead.Overhead())
+	sealed := make([]byte, chunkSize+aead.Overhead())
+	var plaintext []byte
+	defer func() { crypto.Wipe(plaintext) }()
+	for counter := uint64(0); ; counter++ {
+		n, last, err := readChunk(r, sealed)
+		if err != nil {
+			return err
+		}
+		if n < aead.Overhead() || (last && n == aead.Overhead() && counter > 0) {
+			// Only the stream of an empty plaintext ends in an empty chunk
+			return ErrCorrupt
+		}
+		plaintext, err = aead.Open(plaintext[:0], chunkNonce(aead, counter, last), sealed[:n], nil)
+		if err != nil {
+			return crypto.ErrDecryptionFailed
+		}
+		if _, err := dst.Write(plaintext); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// readChunk fills buf from r, returning the number of bytes read and whether
+// they are the last of r.
+func readChunk(r *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return n, true, nil
+	case err != nil:
+		return 0, false, err
+	}
+	if _, err := r.Peek(1); errors.Is(err, io.EOF) {
+		return n, true, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return n, false, nil
+}
+
+// chunkNonce returns the nonce of the chunk with the given counter.
+func chunkNonce(aead cipher.AEAD, counter uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
@@ -1,16 +1,24 @@
 package crypto
 
 import (
+	"crypto/mlkem"
 	"encoding/base64"
 	"fmt"
 	"regexp"
 	"strconv"
 )
 
-// CurrentSchemaVersion is the only supported schema version for boxed messages
+// CurrentSchemaVersion is the default schema version for boxed messages
 const CurrentSchemaVersion = 1
 
-var messageParser = regexp.MustCompile(`\AESEC\[(\d):([A-Za-z0-9+=/]{44}):([A-Za-z0-9+=/]{32}):(.+)\]\z`)
+// HybridSchemaVersion is the schema version for boxed messages whose key is
+// wrapped with the hybrid X25519 + ML-KEM-768 KEM.
+const HybridSchemaVersion = 2
+
+var (
+	messageParser       = regexp.MustCompile(`\AESEC\[(\d):([A-Za-z0-9+=/]{44}):([A-Za-z0-9+=/]{32}):(.+)\]\z`)
+	hybridMessageParser = regexp.MustCompile(`\AESEC\[(2):([A-Za-z0-9+=/]{44}):([A-Za-z0-9+=/]+):([A-Za-z0-9+=/]{32}):(.+)\]\z`)
+)
 
 // boxedMessage dumps and loads the wire format for encrypted messages. The
 // schema is fairly simple:
@@ -24,9 +32,18 @@ var messageParser = regexp.MustCompile(`\AESEC\[(\d):([A-Za-z0-9+=/]{44}):([A-Za
 //	":"
 //	Box :: base64-encoded encrypted message
 //	"]"
+//
+// Hybrid (version 2) messages carry one more field after EncrypterPublic:
+//
+//	KEMCiphertext :: base64-encoded 1088-byte ML-KEM-768 ciphertext
+//	":"
+//
+// and the Box is sealed with nacl/secretbox under the key derived from both
+// the X25519 and ML-KEM shared secrets.
 type boxedMessage struct {
 	SchemaVersion   int
 	EncrypterPublic [32]byte
+	KEMCiphertext   []byte
 	Nonce           [24]byte
 	Box             []byte
 }
@@ -35,7 +52,7 @@ type boxedMessage struct {
 // format. This can be used to determine whether a string value requires
 // encryption or is already encrypted.
 func IsBoxedMessage(data []byte) bool {
-	return messageParser.Find(data) != nil
+	return messageParser.Find(data) != nil || hybridMessageParser.Find(data) != nil
 }
 
 // Dump dumps to the wire format
@@ -44,6 +61,12 @@ func (b *boxedMessage) Dump() []byte {
 	nonce := base64.StdEncoding.EncodeToString(b.Nonce[:])
 	box := base64.StdEncoding.EncodeToString(b.Box)
 
+	if b.SchemaVersion == HybridSchemaVersion {
+		ct := base64.StdEncoding.EncodeToString(b.KEMCiphertext)
+		return []byte(fmt.Sprintf("ESEC[%d:%s:%s:%s:%s]",
+			b.SchemaVersion, pub, ct, nonce, box))
+	}
+
 	str := fmt.Sprintf("ESEC[%d:%s:%s:%s]",
 		b.SchemaVersion, pub, nonce, box)
 	return []byte(str)
@@ -51,31 +74,39 @@ func (b *boxedMessage) Dump() []byte {
 
 // Load restores from the wire format.
 func (b *boxedMessage) Load(from []byte) error {
-	var ssver, spub, snonce, sbox string
+	var ssver, spub, sct, snonce, sbox string
 	var err error
 
-	allMatches := messageParser.FindAllStringSubmatch(string(from), -1) // -> [][][]byte
-	if len(allMatches) != 1 {
-		return fmt.Errorf("invalid message format")
-	}
-	matches := allMatches[0]
-	if len(matches) != 5 {
-		return fmt.Errorf("invalid message format")
+	if hybridMatches := hybridMessageParser.FindStringSubmatch(string(from)); hybridMatches != nil {
+		ssver = hybridMatches[1]
+		spub = hybridMatches[2]
+		sct = hybridMatches[3]
+		snonce = hybridMatches[4]
+		sbox = hybridMatches[5]
+	} else {
+		allMatches := messageParser.FindAllStringSubmatch(string(from), -1) // -> [][][]byte
+		if len(allMatches) != 1 {
+			return fmt.Errorf("invalid message format")
+		}
+		matches := allMatches[0]
+		if len(matches) != 5 {
+			return fmt.Errorf("invalid message format")
+		}
+
+		ssver = matches[1]
+		spub = matches[2]
+		snonce = matches[3]
+		sbox = matches[4]
 	}
 
-	ssver = matches[1]
-	spub = matches[2]
-	snonce = matches[3]
-	sbox = matches[4]
-
 	b.SchemaVersion, err = strconv.Atoi(ssver)
 	if err != nil {
 		return err
 	}
 
-	if b.SchemaVersion != CurrentSchemaVersion {
-		return fmt.Errorf("unsupported schema version %d, only version %d is supported",
-			b.SchemaVersion, CurrentSchemaVersion)
+	if b.SchemaVersion != CurrentSchemaVersion && b.SchemaVersion != HybridSchemaVersion {
+		return fmt.Errorf("unsupported schema version %d, only versions %d and %d are supported",
+			b.SchemaVersion, CurrentSchemaVersion, HybridSchemaVersion)
 	}
 
 	pub, err := base64.StdEncoding.DecodeString(spub)
@@ -90,6 +121,17 @@ func (b *boxedMessage) Load(from []byte) error {
 	copy(public[:], pubBytes[0:32])
 	b.EncrypterPublic = public
 
+	if sct != "" {
+		ct, err := base64.StdEncoding.DecodeString(sct)
+		if err != nil {
+			return err
+		}
+		if len(ct) != mlkem.CiphertextSize768 {
+			return fmt.Errorf("kem ciphertext invalid")
+		}
+		b.KEMCiphertext = ct
+	}
+
 	nnc, err := base64.StdEncoding.DecodeString(snonce)
 	if err != nil {
 		return err
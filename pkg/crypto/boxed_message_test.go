@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
@@ -37,3 +38,29 @@ func TestBoxedMessageRoundtripping(t *testing.T) {
 		assert.True(t, IsBoxedMessage([]byte("ESEC[1:12345678901234567890123456789012345678901234:12345678901234567890123456789012:a]")))
 	})
 }
+
+func TestHybridBoxedMessageRoundtripping(t *testing.T) {
+	bm := boxedMessage{
+		SchemaVersion:   HybridSchemaVersion,
+		EncrypterPublic: [32]byte{1},
+		KEMCiphertext:   make([]byte, 1088),
+		Nonce:           [24]byte{2},
+		Box:             []byte{3, 3, 3},
+	}
+	bm.KEMCiphertext[0] = 4
+
+	wire := bm.Dump()
+	assert.True(t, strings.HasPrefix(string(wire), "ESEC[2:"))
+	assert.True(t, IsBoxedMessage(wire))
+
+	var loaded boxedMessage
+	assert.NoError(t, loaded.Load(wire))
+	assert.Equal(t, bm, loaded)
+
+	t.Run("rejects a truncated KEM ciphertext", func(t *testing.T) {
+		short := bm
+		short.KEMCiphertext = []byte{4, 4, 4}
+		err := loaded.Load(short.Dump())
+		assert.Error(t, err)
+	})
+}
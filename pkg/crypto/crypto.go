@@ -3,19 +3,22 @@
 // don't care about authenticating the encryptor, so the nonce and encryption
 // public key are prepended to the encrypted message.
 //
-// Shared key precomputation is used when encrypting but not when decrypting.
-// This is not an inherent limitation, but it would complicate the
-// implementation a little bit to do precomputation during decryption also.
-// If performance becomes an issue (highly unlikely), it's completely feasible
-// to add.
+// Shared key precomputation is used both when encrypting and when decrypting.
+// An Encrypter computes its shared key once, and since every value in a file is
+// encrypted by the same Encrypter, they all carry the same ephemeral public key.
+// A Decrypter therefore caches the shared key per ephemeral public key, so a
+// file costs one Curve25519 operation to decrypt rather than one per value.
 package crypto
 
 import (
+	"crypto/mlkem"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -41,8 +44,15 @@ type Encrypter struct {
 // private key is stored in configuration management or otherwise), and used to
 // decrypt messages. It should normally be obtained by calling Decrypter() on a
 // Keypair instance.
+//
+// Decrypters obtained from a HybridPrivateKey can additionally open messages
+// encrypted with the hybrid post-quantum schema.
 type Decrypter struct {
 	Keypair *Keypair
+
+	key    *KeyHandle
+	kem    *mlkem.DecapsulationKey768
+	shared sharedKeyCache
 }
 
 // ErrDecryptionFailed means the decryption didn't work. This normally
@@ -72,6 +82,26 @@ func (k *Keypair) PrivateString() string {
 	return hex.EncodeToString(k.Private[:])
 }
 
+// PublicKeyFromPrivate computes the Curve25519 public key belonging to a
+// private key.
+func PublicKeyFromPrivate(private [32]byte) ([32]byte, error) {
+	var public [32]byte
+	pub, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		return public, err
+	}
+	copy(public[:], pub)
+	return public, nil
+}
+
+// Fingerprint returns a short, printable identifier for a public key: the
+// first 8 bytes of its SHA-256 hash, hex-encoded. It is meant for humans
+// matching keys up, not as a cryptographic commitment.
+func Fingerprint(public [32]byte) string {
+	sum := sha256.Sum256(public[:])
+	return hex.EncodeToString(sum[:8])
+}
+
 // Encrypter returns an Encrypter instance, given a public key, to encrypt
 // messages to the paired, unknown, private key.
 func (k *Keypair) Encrypter(peerPublic [32]byte) *Encrypter {
@@ -129,18 +159,33 @@ func (e *Encrypter) encrypt(message []byte) (*boxedMessage, error) {
 
 // Decrypt is passed an encrypted message or a particular format (the format
 // generated by (*Encrypter)Encrypt(), which includes the nonce and public key
-// used to create the ciphertext. It returns the decrypted string. Note that,
-// unlike with encryption, Shared-key-precomputation is not used for decryption.
+// used to create the ciphertext. It returns the decrypted string. The shared
+// key for each ephemeral public key is precomputed once and cached, so
+// decrypting many values from the same file is cheap.
 func (d *Decrypter) Decrypt(message []byte) ([]byte, error) {
 	var bm boxedMessage
 	if err := bm.Load(message); err != nil {
 		return nil, err
 	}
+	if bm.SchemaVersion == HybridSchemaVersion {
+		return d.decryptHybrid(&bm)
+	}
 	return d.decrypt(&bm)
 }
 
 func (d *Decrypter) decrypt(bm *boxedMessage) ([]byte, error) {
-	plaintext, ok := box.Open(nil, bm.Box, &bm.Nonce, &bm.EncrypterPublic, &d.Keypair.Private)
+	priv, err := d.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := d.shared.get(bm.EncrypterPublic, func(shared *[32]byte) error {
+		box.Precompute(shared, &bm.EncrypterPublic, priv)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	plaintext, ok := box.OpenAfterPrecomputation(nil, bm.Box, &bm.Nonce, shared)
 	if !ok {
 		return nil, ErrDecryptionFailed
 	}
@@ -2,9 +2,11 @@ package crypto
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
+	"golang.org/x/crypto/nacl/box"
 )
 
 func TestKeypairGeneration(t *testing.T) {
@@ -95,3 +97,85 @@ func exampleDecrypt(myPublic, myPrivate [32]byte, encrypted []byte) {
 	fmt.Println(plaintext, err)
 }
 */
+
+func TestDecrypterCachesSharedKeys(t *testing.T) {
+	var kp, ephemeral Keypair
+	assert.NoError(t, kp.Generate())
+	assert.NoError(t, ephemeral.Generate())
+	enc := ephemeral.Encrypter(kp.Public)
+	dec := kp.Decrypter()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			message := []byte(fmt.Sprintf("value %d", i))
+			ct, err := enc.Encrypt(message)
+			assert.NoError(t, err)
+			pt, err := dec.Decrypt(ct)
+			assert.NoError(t, err)
+			assert.Equal(t, message, pt)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, len(dec.shared.keys))
+
+	dec.Wipe()
+	assert.Equal(t, 0, len(dec.shared.keys))
+}
+
+// benchmarkMessages encrypts n values with a single Encrypter, as encrypting a
+// file does.
+func benchmarkMessages(b *testing.B, n int) (*Keypair, [][]byte) {
+	b.Helper()
+	var kp, ephemeral Keypair
+	if err := kp.Generate(); err != nil {
+		b.Fatal(err)
+	}
+	if err := ephemeral.Generate(); err != nil {
+		b.Fatal(err)
+	}
+	enc := ephemeral.Encrypter(kp.Public)
+	messages := make([][]byte, n)
+	for i := range messages {
+		ct, err := enc.Encrypt([]byte(fmt.Sprintf("secret value number %d", i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		messages[i] = ct
+	}
+	return &kp, messages
+}
+
+func BenchmarkDecryptFile(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		kp, messages := benchmarkMessages(b, n)
+
+		b.Run(fmt.Sprintf("values=%d/precomputed", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dec := kp.Decrypter()
+				for _, m := range messages {
+					if _, err := dec.Decrypt(m); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+
+		// The previous implementation: a full box.Open per value.
+		b.Run(fmt.Sprintf("values=%d/uncached", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, m := range messages {
+					var bm boxedMessage
+					if err := bm.Load(m); err != nil {
+						b.Fatal(err)
+					}
+					if _, ok := box.Open(nil, bm.Box, &bm.Nonce, &bm.EncrypterPublic, &kp.Private); !ok {
+						b.Fatal(ErrDecryptionFailed)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// derivationSalt is the fixed HKDF salt used for all derived keys. Changing it
+// would change every derived key, so it is part of the stable derivation scheme.
+const derivationSalt = "esec-hkdf-v1"
+
+// DerivationPath returns the canonical derivation path for an environment and
+// an optional service. The path is used as the HKDF info parameter, and has the
+// form:
+//
+//	"esec/v1/env/<env>"                    (no service)
+//	"esec/v1/service/<service>/env/<env>"  (with service)
+//
+// Both names are lowercased, so "PROD" and "prod" derive the same key. The
+// default (unnamed) environment uses an empty env segment.
+func DerivationPath(service, env string) string {
+	var sb strings.Builder
+	sb.WriteString("esec/v1")
+	if service != "" {
+		sb.WriteString("/service/")
+		sb.WriteString(strings.ToLower(service))
+	}
+	sb.WriteString("/env/")
+	sb.WriteString(strings.ToLower(env))
+	return sb.String()
+}
+
+// Derive deterministically derives a Curve25519 keypair from a 32-byte master
+// key and a derivation path (see DerivationPath) into a (presumably) empty
+// Keypair structure. The private key is the first 32 bytes of
+// HKDF-SHA256(master, salt "esec-hkdf-v1", info path), and the public key is
+// computed from it, so the same master key and path always yield the same
+// keypair.
+func (k *Keypair) Derive(master [32]byte, path string) error {
+	var priv [32]byte
+	if err := deriveInto(priv[:], master[:], path); err != nil {
+		return err
+	}
+	pub, err := PublicKeyFromPrivate(priv)
+	if err != nil {
+		return err
+	}
+	k.Private = priv
+	k.Public = pub
+	return nil
+}
+
+// DeriveKey is like (*Keypair).Derive, but reads the master key from a
+// KeyHandle and returns the derived private key in a new KeyHandle, which the
+// caller must Destroy.
+func DeriveKey(master *KeyHandle, path string) (*KeyHandle, error) {
+	if master.Len() != 32 {
+		return nil, ErrInvalidKeyFormat
+	}
+	key, err := NewKeyHandle(32)
+	if err != nil {
+		return nil, err
+	}
+	if err := deriveInto(key.Bytes(), master.Bytes(), path); err != nil {
+		key.Destroy()
+		return nil, err
+	}
+	return key, nil
+}
+
+func deriveInto(dst, master []byte, path string) error {
+	if path == "" {
+		return fmt.Errorf("derivation path must not be empty")
+	}
+	kdf := hkdf.New(sha256.New, master, []byte(derivationSalt), []byte(path))
+	_, err := io.ReadFull(kdf, dst)
+	return err
+}
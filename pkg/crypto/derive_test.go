@@ -0,0 +1,96 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestDerivationPath(t *testing.T) {
+	assert.Equal(t, "esec/v1/env/prod", DerivationPath("", "prod"))
+	assert.Equal(t, "esec/v1/env/prod", DerivationPath("", "PROD"))
+	assert.Equal(t, "esec/v1/service/api/env/prod", DerivationPath("api", "prod"))
+	assert.Equal(t, "esec/v1/env/", DerivationPath("", ""))
+}
+
+func TestKeypairDerivation(t *testing.T) {
+	var master [32]byte
+	for i := range master {
+		master[i] = byte(i)
+	}
+
+	t.Run("should match the pinned test vectors", func(t *testing.T) {
+		// These vectors pin the derivation scheme; changing them means every
+		// derived key in the wild changes too.
+		vectors := []struct {
+			path, pub, priv string
+		}{
+			{
+				path: "esec/v1/env/prod",
+				pub:  "d73f459445f2e1000c6eb17306e0509291fb16fc2ced88638d472196ac67cc1b",
+				priv: "44087fbe24bfa7649139f1e084df22d26cef7d4aba266d093092f22ea08b46ee",
+			},
+			{
+				path: "esec/v1/service/api/env/prod",
+				pub:  "d388659d448c20fab7af93e76b3ba46c971d06cabbc839129e81823179db396b",
+				priv: "170b6bcaaa4e46aead3903c291337b4484d6238e77e5253f8a4751df87ff54ad",
+			},
+		}
+		for _, v := range vectors {
+			var kp Keypair
+			assert.NoError(t, kp.Derive(master, v.path))
+			assert.Equal(t, v.pub, kp.PublicString())
+			assert.Equal(t, v.priv, kp.PrivateString())
+		}
+	})
+
+	t.Run("should be deterministic", func(t *testing.T) {
+		var a, b Keypair
+		assert.NoError(t, a.Derive(master, DerivationPath("", "dev")))
+		assert.NoError(t, b.Derive(master, DerivationPath("", "dev")))
+		assert.Equal(t, a, b)
+	})
+
+	t.Run("should separate environments", func(t *testing.T) {
+		var dev, prod Keypair
+		assert.NoError(t, dev.Derive(master, DerivationPath("", "dev")))
+		assert.NoError(t, prod.Derive(master, DerivationPath("", "prod")))
+		assert.NotEqual(t, dev.Public, prod.Public)
+	})
+
+	t.Run("should produce a usable keypair", func(t *testing.T) {
+		var derived, ephemeral Keypair
+		assert.NoError(t, derived.Derive(master, DerivationPath("", "prod")))
+		assert.NoError(t, ephemeral.Generate())
+
+		ct, err := ephemeral.Encrypter(derived.Public).Encrypt([]byte("secret"))
+		assert.NoError(t, err)
+		pt, err := derived.Decrypter().Decrypt(ct)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("secret"), pt)
+	})
+
+	t.Run("should reject an empty path", func(t *testing.T) {
+		var kp Keypair
+		assert.Error(t, kp.Derive(master, ""))
+	})
+}
+
+func TestDeriveKey(t *testing.T) {
+	master, err := NewKeyHandle(32)
+	assert.NoError(t, err)
+	defer master.Destroy()
+	var raw [32]byte
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+	copy(master.Bytes(), raw[:])
+
+	var kp Keypair
+	assert.NoError(t, kp.Derive(raw, "esec/v1/env/prod"))
+
+	key, err := DeriveKey(master, "esec/v1/env/prod")
+	assert.NoError(t, err)
+	defer key.Destroy()
+	assert.Equal(t, kp.Private[:], key.Bytes())
+}
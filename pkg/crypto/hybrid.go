@@ -0,0 +1,286 @@
+package crypto
+
+import (
+	"crypto/mlkem"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Printable prefixes of hybrid post-quantum keys. The remainder of the key is
+// the raw key material, base64url-encoded without padding.
+const (
+	// HybridPublicKeyPrefix starts a hybrid public key: the X25519 public key
+	// followed by the ML-KEM-768 encapsulation key.
+	HybridPublicKeyPrefix = "esec-pq1-pub-"
+	// HybridPrivateKeyPrefix starts a hybrid private key: the X25519 private key
+	// followed by the 64-byte ML-KEM-768 seed.
+	HybridPrivateKeyPrefix = "esec-pq1-priv-"
+)
+
+// hybridKDFInfo domain-separates keys derived by the hybrid KEM combiner.
+const hybridKDFInfo = "esec-hybrid-v2"
+
+// ErrHybridKeyRequired means a message encrypted with the hybrid schema was
+// passed to a Decrypter that has no ML-KEM private key.
+var ErrHybridKeyRequired = errors.New("message was encrypted with a post-quantum hybrid key, but the private key is not a hybrid key")
+
+// HybridPublicKey is a hybrid X25519 + ML-KEM-768 public key.
+type HybridPublicKey struct {
+	X25519 [32]byte
+	MLKEM  *mlkem.EncapsulationKey768
+}
+
+// HybridPrivateKey is a hybrid X25519 + ML-KEM-768 private key. The ML-KEM
+// half is stored as its seed, from which the full key is expanded on use.
+type HybridPrivateKey struct {
+	X25519 [32]byte
+	Seed   [mlkem.SeedSize]byte
+}
+
+// HybridEncrypter encrypts messages to a HybridPublicKey. Like Encrypter, it
+// performs the key agreement once, with a fresh ephemeral X25519 keypair and a
+// fresh ML-KEM encapsulation, and reuses the resulting key for every message.
+type HybridEncrypter struct {
+	EncrypterPublic [32]byte
+	KEMCiphertext   []byte
+	SharedKey       [32]byte
+}
+
+// GenerateHybridKey generates a new hybrid private key.
+func GenerateHybridKey() (*HybridPrivateKey, error) {
+	var kp Keypair
+	if err := kp.Generate(); err != nil {
+		return nil, err
+	}
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	k := &HybridPrivateKey{X25519: kp.Private}
+	copy(k.Seed[:], dk.Bytes())
+	return k, nil
+}
+
+// Public returns the public key belonging to the private key.
+func (k *HybridPrivateKey) Public() (*HybridPublicKey, error) {
+	pub, err := PublicKeyFromPrivate(k.X25519)
+	if err != nil {
+		return nil, err
+	}
+	dk, err := mlkem.NewDecapsulationKey768(k.Seed[:])
+	if err != nil {
+		return nil, err
+	}
+	return &HybridPublicKey{X25519: pub, MLKEM: dk.EncapsulationKey()}, nil
+}
+
+// String returns the private key in its printable form.
+func (k *HybridPrivateKey) String() string {
+	raw := make([]byte, 0, 32+mlkem.SeedSize)
+	raw = append(raw, k.X25519[:]...)
+	raw = append(raw, k.Seed[:]...)
+	return HybridPrivateKeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// String returns the public key in its printable form.
+func (p *HybridPublicKey) String() string {
+	raw := make([]byte, 0, 32+mlkem.EncapsulationKeySize768)
+	raw = append(raw, p.X25519[:]...)
+	raw = append(raw, p.MLKEM.Bytes()...)
+	return HybridPublicKeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// Fingerprint returns a short, printable identifier for the key, as
+// Fingerprint does for X25519 public keys, covering both of its halves.
+func (p *HybridPublicKey) Fingerprint() string {
+	h := sha256.New()
+	h.Write(p.X25519[:])
+	h.Write(p.MLKEM.Bytes())
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// IsHybridPublicKey reports whether s is formatted as a hybrid public key.
+func IsHybridPublicKey(s string) bool {
+	return strings.HasPrefix(s, HybridPublicKeyPrefix)
+}
+
+// IsHybridPrivateKey reports whether s is formatted as a hybrid private key.
+func IsHybridPrivateKey(s string) bool {
+	return strings.HasPrefix(s, HybridPrivateKeyPrefix)
+}
+
+// ParseHybridPublicKey parses a public key in the form produced by
+// (*HybridPublicKey).String.
+func ParseHybridPublicKey(s string) (*HybridPublicKey, error) {
+	raw, err := decodeHybridKey(s, HybridPublicKeyPrefix, 32+mlkem.EncapsulationKeySize768)
+	if err != nil {
+		return nil, err
+	}
+	ek, err := mlkem.NewEncapsulationKey768(raw[32:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeyFormat, err)
+	}
+	p := &HybridPublicKey{MLKEM: ek}
+	copy(p.X25519[:], raw[:32])
+	return p, nil
+}
+
+// ParseHybridPrivateKey parses a private key in the form produced by
+// (*HybridPrivateKey).String.
+func ParseHybridPrivateKey(s string) (*HybridPrivateKey, error) {
+	raw, err := decodeHybridKey(s, HybridPrivateKeyPrefix, 32+mlkem.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	k := &HybridPrivateKey{}
+	copy(k.X25519[:], raw[:32])
+	copy(k.Seed[:], raw[32:])
+	return k, nil
+}
+
+func decodeHybridKey(s, prefix string, size int) ([]byte, error) {
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("%w: missing %q prefix", ErrInvalidKeyFormat, prefix)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeyFormat, err)
+	}
+	if len(raw) != size {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidKeyFormat, size, len(raw))
+	}
+	return raw, nil
+}
+
+// NewHybridEncrypter instantiates a HybridEncrypter for the given public key,
+// generating the ephemeral X25519 keypair and ML-KEM encapsulation.
+func NewHybridEncrypter(peer *HybridPublicKey) (*HybridEncrypter, error) {
+	var ephemeral Keypair
+	if err := ephemeral.Generate(); err != nil {
+		return nil, err
+	}
+	classical, err := curve25519.X25519(ephemeral.Private[:], peer.X25519[:])
+	if err != nil {
+		return nil, err
+	}
+	quantum, ciphertext := peer.MLKEM.Encapsulate()
+
+	e := &HybridEncrypter{
+		EncrypterPublic: ephemeral.Public,
+		KEMCiphertext:   ciphertext,
+	}
+	e.SharedKey, err = combineHybridSecrets(quantum, classical, ciphertext, ephemeral.Public, peer.X25519)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Encrypt takes a plaintext message and returns a message boxed with the
+// hybrid schema (version 2). Already boxed messages are returned unchanged.
+func (e *HybridEncrypter) Encrypt(message []byte) ([]byte, error) {
+	if IsBoxedMessage(message) {
+		return message, nil
+	}
+	nonce, err := genNonce()
+	if err != nil {
+		return nil, err
+	}
+	bm := &boxedMessage{
+		SchemaVersion:   HybridSchemaVersion,
+		EncrypterPublic: e.EncrypterPublic,
+		KEMCiphertext:   e.KEMCiphertext,
+		Nonce:           nonce,
+		Box:             secretbox.Seal(nil, message, &nonce, &e.SharedKey),
+	}
+	return bm.Dump(), nil
+}
+
+// Decrypter returns a Decrypter that can open both hybrid (version 2)
+// messages and classic (version 1) messages encrypted to the X25519 half of
+// the key.
+func (k *HybridPrivateKey) Decrypter() (*Decrypter, error) {
+	pub, err := PublicKeyFromPrivate(k.X25519)
+	if err != nil {
+		return nil, err
+	}
+	dk, err := mlkem.NewDecapsulationKey768(k.Seed[:])
+	if err != nil {
+		return nil, err
+	}
+	return &Decrypter{
+		Keypair: &Keypair{Public: pub, Private: k.X25519},
+		kem:     dk,
+	}, nil
+}
+
+func (d *Decrypter) decryptHybrid(bm *boxedMessage) ([]byte, error) {
+	if d.kem == nil {
+		return nil, ErrHybridKeyRequired
+	}
+	priv, err := d.privateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// The KEM ciphertext is part of the key agreement, so it is part of the
+	// cache key along with the ephemeral public key.
+	id := sha256.New()
+	id.Write([]byte(hybridKDFInfo))
+	id.Write(bm.EncrypterPublic[:])
+	id.Write(bm.KEMCiphertext)
+	var cacheID [32]byte
+	id.Sum(cacheID[:0])
+
+	key, err := d.shared.get(cacheID, func(key *[32]byte) error {
+		quantum, err := d.kem.Decapsulate(bm.KEMCiphertext)
+		if err != nil {
+			return ErrDecryptionFailed
+		}
+		classical, err := curve25519.X25519(priv[:], bm.EncrypterPublic[:])
+		if err != nil {
+			return ErrDecryptionFailed
+		}
+		*key, err = combineHybridSecrets(quantum, classical, bm.KEMCiphertext, bm.EncrypterPublic, d.Keypair.Public)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	plaintext, ok := secretbox.Open(nil, bm.Box, &bm.Nonce, key)
+	if !ok {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+// combineHybridSecrets derives the symmetric key from both shared secrets with
+// HKDF-SHA256. The KEM ciphertext and both X25519 public keys are bound into
+// the info parameter, so the key stays secure as long as either of the two
+// key agreements does.
+func combineHybridSecrets(quantum, classical, ciphertext []byte, ephemeralPublic, recipientPublic [32]byte) ([32]byte, error) {
+	var key [32]byte
+	secret := make([]byte, 0, len(quantum)+len(classical))
+	secret = append(secret, quantum...)
+	secret = append(secret, classical...)
+
+	info := make([]byte, 0, len(hybridKDFInfo)+len(ciphertext)+64)
+	info = append(info, hybridKDFInfo...)
+	info = append(info, ciphertext...)
+	info = append(info, ephemeralPublic[:]...)
+	info = append(info, recipientPublic[:]...)
+
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key[:]); err != nil {
+		return key, err
+	}
+	return key, nil
+}
@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestHybridRoundtrip(t *testing.T) {
+	priv, err := GenerateHybridKey()
+	assert.NoError(t, err)
+	pub, err := priv.Public()
+	assert.NoError(t, err)
+
+	enc, err := NewHybridEncrypter(pub)
+	assert.NoError(t, err)
+	dec, err := priv.Decrypter()
+	assert.NoError(t, err)
+
+	message := []byte("harvest now, decrypt never")
+	ct, err := enc.Encrypt(message)
+	assert.NoError(t, err)
+	assert.True(t, IsBoxedMessage(ct))
+
+	pt, err := dec.Decrypt(ct)
+	assert.NoError(t, err)
+	assert.Equal(t, message, pt)
+
+	t.Run("leaves boxed messages alone", func(t *testing.T) {
+		again, err := enc.Encrypt(ct)
+		assert.NoError(t, err)
+		assert.Equal(t, ct, again)
+	})
+
+	t.Run("decrypts version 1 messages to the X25519 key", func(t *testing.T) {
+		var ephemeral Keypair
+		assert.NoError(t, ephemeral.Generate())
+		v1, err := ephemeral.Encrypter(pub.X25519).Encrypt(message)
+		assert.NoError(t, err)
+
+		pt, err := dec.Decrypt(v1)
+		assert.NoError(t, err)
+		assert.Equal(t, message, pt)
+	})
+
+	t.Run("classic decrypters reject hybrid messages", func(t *testing.T) {
+		kp := Keypair{Public: pub.X25519, Private: priv.X25519}
+		_, err := kp.Decrypter().Decrypt(ct)
+		assert.IsError(t, err, ErrHybridKeyRequired)
+	})
+
+	t.Run("other keys fail to decrypt", func(t *testing.T) {
+		other, err := GenerateHybridKey()
+		assert.NoError(t, err)
+		otherDec, err := other.Decrypter()
+		assert.NoError(t, err)
+		_, err = otherDec.Decrypt(ct)
+		assert.IsError(t, err, ErrDecryptionFailed)
+	})
+}
+
+func TestHybridKeyEncoding(t *testing.T) {
+	priv, err := GenerateHybridKey()
+	assert.NoError(t, err)
+	pub, err := priv.Public()
+	assert.NoError(t, err)
+
+	assert.True(t, IsHybridPrivateKey(priv.String()))
+	assert.True(t, IsHybridPublicKey(pub.String()))
+
+	parsedPriv, err := ParseHybridPrivateKey(priv.String())
+	assert.NoError(t, err)
+	assert.Equal(t, priv, parsedPriv)
+
+	parsedPub, err := ParseHybridPublicKey(pub.String())
+	assert.NoError(t, err)
+	assert.Equal(t, pub.String(), parsedPub.String())
+
+	_, err = ParseHybridPublicKey(HybridPublicKeyPrefix + "AAAA")
+	assert.IsError(t, err, ErrInvalidKeyFormat)
+	_, err = ParseHybridPrivateKey(pub.String())
+	assert.IsError(t, err, ErrInvalidKeyFormat)
+}
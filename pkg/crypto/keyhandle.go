@@ -0,0 +1,157 @@
+package crypto
+
+import (
+	"crypto/mlkem"
+	"errors"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// HybridPrivateKeySize is the size of the raw hybrid private key held in a
+// KeyHandle: the X25519 private key followed by the ML-KEM-768 seed.
+const HybridPrivateKeySize = 32 + mlkem.SeedSize
+
+// ErrKeyDestroyed means a KeyHandle was used after Destroy was called.
+var ErrKeyDestroyed = errors.New("key material has been destroyed")
+
+// KeyHandle holds private key material outside the garbage-collected heap.
+// On Linux the memory is locked with mlock so it is never written to swap, and
+// excluded from core dumps; on other platforms it falls back to a regular
+// buffer. Destroy wipes and releases the memory, and must be called once the
+// key is no longer needed: there is no finalizer, since the memory could
+// otherwise be unmapped while slices of it, or a Decrypter using it, are still
+// in use.
+//
+// Secret bytes are only ever exposed as slices of the handle's memory, never as
+// strings, so no copies are left behind that cannot be wiped.
+type KeyHandle struct {
+	mu     sync.RWMutex
+	buf    []byte // the key material, a prefix of mem
+	mem    []byte // the memory as allocated by allocSecret
+	locked bool
+}
+
+// NewKeyHandle allocates a zeroed KeyHandle of the given size.
+func NewKeyHandle(size int) (*KeyHandle, error) {
+	if size <= 0 {
+		return nil, errors.New("key handle size must be positive")
+	}
+	mem, locked, err := allocSecret(size)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyHandle{buf: mem[:size:size], mem: mem, locked: locked}, nil
+}
+
+// Bytes returns the key material. The slice aliases the handle's memory, so it
+// must not outlive the handle: it is only valid until Destroy is called, and
+// Bytes returns nil afterwards.
+func (h *KeyHandle) Bytes() []byte {
+	if h == nil {
+		return nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.buf
+}
+
+// Len returns the size of the key material, or 0 once the handle is destroyed.
+func (h *KeyHandle) Len() int {
+	return len(h.Bytes())
+}
+
+// Locked reports whether the handle's memory is locked against swapping.
+func (h *KeyHandle) Locked() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.locked
+}
+
+// Destroy wipes the key material and releases its memory. It is safe to call
+// more than once, and on a nil handle.
+func (h *KeyHandle) Destroy() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.buf == nil {
+		return
+	}
+	Wipe(h.mem)
+	freeSecret(h.mem, h.locked)
+	h.buf = nil
+	h.mem = nil
+	h.locked = false
+}
+
+// Wipe overwrites b with zeros.
+func Wipe(b []byte) {
+	clear(b)
+	runtime.KeepAlive(b)
+}
+
+// NewDecrypter returns a Decrypter for the private key held by key, which must
+// be either a 32-byte Curve25519 key or a HybridPrivateKeySize hybrid key. The
+// Decrypter reads the private key from the handle on every use rather than
+// copying it, so destroying the handle disables the Decrypter.
+//
+// The ML-KEM half of a hybrid key is expanded by crypto/mlkem, which keeps its
+// own copy on the heap; call Wipe on the Decrypter to drop it.
+func NewDecrypter(key *KeyHandle) (*Decrypter, error) {
+	priv := key.Bytes()
+	if len(priv) != 32 && len(priv) != HybridPrivateKeySize {
+		return nil, ErrInvalidKeyFormat
+	}
+
+	pub, err := curve25519.X25519(priv[:32], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	d := &Decrypter{Keypair: &Keypair{}, key: key}
+	copy(d.Keypair.Public[:], pub)
+
+	if len(priv) == HybridPrivateKeySize {
+		d.kem, err = mlkem.NewDecapsulationKey768(priv[32:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Wipe zeroes the private key held by the Keypair.
+func (k *Keypair) Wipe() {
+	Wipe(k.Private[:])
+}
+
+// Wipe drops the private key material held by the Decrypter: it zeroes the
+// Keypair's private key and the cached shared keys, and releases the ML-KEM
+// key. A KeyHandle the Decrypter was created from is left alone, since it is
+// owned by the caller.
+func (d *Decrypter) Wipe() {
+	if d.Keypair != nil {
+		d.Keypair.Wipe()
+	}
+	d.shared.wipe()
+	d.kem = nil
+	d.key = nil
+}
+
+// privateKey returns the X25519 private key, read from the KeyHandle if the
+// Decrypter was created from one.
+func (d *Decrypter) privateKey() (*[32]byte, error) {
+	if d.key == nil {
+		return &d.Keypair.Private, nil
+	}
+	priv := d.key.Bytes()
+	if len(priv) < 32 {
+		return nil, ErrKeyDestroyed
+	}
+	return (*[32]byte)(priv[:32]), nil
+}
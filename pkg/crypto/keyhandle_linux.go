@@ -0,0 +1,31 @@
+//go:build linux
+
+package crypto
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocSecret maps anonymous memory for secret data, excludes it from core
+// dumps and locks it into RAM. Failing to lock (typically because of
+// RLIMIT_MEMLOCK) is not an error; the memory is then merely unlocked.
+func allocSecret(size int) ([]byte, bool, error) {
+	pageSize := os.Getpagesize()
+	mem, err := unix.Mmap(-1, 0, (size+pageSize-1)/pageSize*pageSize,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, false, err
+	}
+	_ = unix.Madvise(mem, unix.MADV_DONTDUMP)
+	locked := unix.Mlock(mem) == nil
+	return mem, locked, nil
+}
+
+func freeSecret(mem []byte, locked bool) {
+	if locked {
+		_ = unix.Munlock(mem)
+	}
+	_ = unix.Munmap(mem)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package crypto
+
+// allocSecret allocates secret data on the heap. Memory locking is only
+// implemented on Linux.
+func allocSecret(size int) ([]byte, bool, error) {
+	return make([]byte, size), false, nil
+}
+
+func freeSecret([]byte, bool) {}
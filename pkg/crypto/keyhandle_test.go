@@ -0,0 +1,92 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestKeyHandle(t *testing.T) {
+	h, err := NewKeyHandle(32)
+	assert.NoError(t, err)
+	assert.Equal(t, 32, h.Len())
+	assert.Equal(t, make([]byte, 32), h.Bytes())
+
+	copy(h.Bytes(), "0123456789abcdef0123456789abcdef")
+	assert.Equal(t, []byte("0123456789abcdef0123456789abcdef"), h.Bytes())
+
+	h.Destroy()
+	assert.Equal(t, 0, h.Len())
+	assert.Zero(t, h.Bytes())
+	assert.False(t, h.Locked())
+
+	// Destroying twice, or a nil handle, is harmless
+	h.Destroy()
+	var nilHandle *KeyHandle
+	nilHandle.Destroy()
+}
+
+func TestDecrypterFromKeyHandle(t *testing.T) {
+	var kp Keypair
+	assert.NoError(t, kp.Generate())
+	message := []byte("secret")
+
+	var ephemeral Keypair
+	assert.NoError(t, ephemeral.Generate())
+	ct, err := ephemeral.Encrypter(kp.Public).Encrypt(message)
+	assert.NoError(t, err)
+
+	h, err := NewKeyHandle(32)
+	assert.NoError(t, err)
+	copy(h.Bytes(), kp.Private[:])
+
+	dec, err := NewDecrypter(h)
+	assert.NoError(t, err)
+	assert.Equal(t, kp.Public, dec.Keypair.Public)
+	assert.Zero(t, dec.Keypair.Private)
+
+	pt, err := dec.Decrypt(ct)
+	assert.NoError(t, err)
+	assert.Equal(t, message, pt)
+
+	t.Run("fails once the handle is destroyed", func(t *testing.T) {
+		h.Destroy()
+		_, err := dec.Decrypt(ct)
+		assert.IsError(t, err, ErrKeyDestroyed)
+	})
+
+	t.Run("rejects keys of the wrong size", func(t *testing.T) {
+		bad, err := NewKeyHandle(16)
+		assert.NoError(t, err)
+		defer bad.Destroy()
+		_, err = NewDecrypter(bad)
+		assert.IsError(t, err, ErrInvalidKeyFormat)
+	})
+}
+
+func TestHybridDecrypterFromKeyHandle(t *testing.T) {
+	priv, err := GenerateHybridKey()
+	assert.NoError(t, err)
+	pub, err := priv.Public()
+	assert.NoError(t, err)
+	enc, err := NewHybridEncrypter(pub)
+	assert.NoError(t, err)
+	ct, err := enc.Encrypt([]byte("secret"))
+	assert.NoError(t, err)
+
+	h, err := NewKeyHandle(HybridPrivateKeySize)
+	assert.NoError(t, err)
+	defer h.Destroy()
+	copy(h.Bytes(), priv.X25519[:])
+	copy(h.Bytes()[32:], priv.Seed[:])
+
+	dec, err := NewDecrypter(h)
+	assert.NoError(t, err)
+	pt, err := dec.Decrypt(ct)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), pt)
+
+	dec.Wipe()
+	_, err = dec.Decrypt(ct)
+	assert.IsError(t, err, ErrHybridKeyRequired)
+}
@@ -0,0 +1,60 @@
+package crypto
+
+import "sync"
+
+// maxCachedSharedKeys bounds the number of shared keys a Decrypter keeps. Each
+// file is encrypted with a single ephemeral key, so this only matters for a
+// Decrypter that is reused across very many files.
+const maxCachedSharedKeys = 256
+
+// sharedKeyCache caches shared keys precomputed by a Decrypter, indexed by a
+// 32-byte identifier of the key agreement (normally the encrypter's ephemeral
+// public key). It is safe for concurrent use, as values of a file may be
+// decrypted concurrently.
+type sharedKeyCache struct {
+	mu   sync.Mutex
+	keys map[[32]byte]*[32]byte
+}
+
+// get returns the cached shared key for id, calling compute to fill in a new
+// one if it is not cached yet.
+func (c *sharedKeyCache) get(id [32]byte, compute func(shared *[32]byte) error) (*[32]byte, error) {
+	c.mu.Lock()
+	shared, ok := c.keys[id]
+	c.mu.Unlock()
+	if ok {
+		return shared, nil
+	}
+
+	// Compute outside the lock, so a slow key agreement doesn't block other
+	// goroutines. Racing goroutines compute the same key, and the first one to
+	// store it wins.
+	shared = new([32]byte)
+	if err := compute(shared); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.keys[id]; ok {
+		Wipe(shared[:])
+		return existing, nil
+	}
+	if c.keys == nil {
+		c.keys = make(map[[32]byte]*[32]byte)
+	}
+	if len(c.keys) < maxCachedSharedKeys {
+		c.keys[id] = shared
+	}
+	return shared, nil
+}
+
+// wipe zeroes and forgets all cached shared keys.
+func (c *sharedKeyCache) wipe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, shared := range c.keys {
+		Wipe(shared[:])
+		delete(c.keys, id)
+	}
+}
@@ -2,9 +2,8 @@
 package dotenv
 
 import (
-	"bufio"
 	"bytes"
-	"fmt"
+	"context"
 	"regexp"
 	"strings"
 
@@ -12,6 +11,8 @@ import (
 	"github.com/mscno/esec/pkg/format"
 )
 
+const exportPrefix = "export"
+
 // validIdentifierPattern matches valid environment variable identifiers
 var validIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
 
@@ -30,59 +31,161 @@ func (d *Formatter) ExtractPublicKey(data []byte) ([32]byte, error) {
 	return format.ExtractPublicKeyHelper(envs)
 }
 
-// TransformScalarValues processes each key=value pair in the dotenv data,
-// applying the given function to transform each value. Comments, blank lines,
-// and the ESEC_PUBLIC_KEY field are preserved unchanged.
+// ExtractRawPublicKey is like ExtractPublicKey, but returns the public key
+// string without parsing it.
+func (d *Formatter) ExtractRawPublicKey(data []byte) (string, error) {
+	envs, err := godotenv.Parse(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	return format.ExtractRawPublicKeyHelper(envs)
+}
+
+// EmbedPublicKey adds an ESEC_PUBLIC_KEY assignment at the top of data.
+func (d *Formatter) EmbedPublicKey(data []byte, publicKey string) ([]byte, error) {
+	return format.PrependLine(data, format.PublicKeyField+"="+publicKey), nil
+}
+
+// LineComment returns text as a "#" comment.
+func (d *Formatter) LineComment(text string) (string, bool) {
+	return "# " + text, true
+}
+
+// TransformScalarValues applies fn to the value of each KEY=value assignment in
+// the dotenv data. Like the other formats, keys starting with an underscore,
+// which include _ESEC_PUBLIC_KEY, are left in plaintext, as are ESEC_PUBLIC_KEY
+// and keys preceded by a "# esec:plaintext" comment, while a "# esec:encrypt"
+// comment encrypts a key starting with an underscore. Values are tokenized as
+// godotenv.Parse does (see parse) and replaced in place, so comments, blank
+// lines, "export" prefixes, quoting and the layout of each line are preserved.
+//
+// fn receives a quoted value without its quotes, but with its escape sequences
+// as written, and the result is written back inside the same quotes. Values
+// are interpreted when the decrypted file is parsed, so decrypting restores
+// the original text exactly. Results that would not survive being written
+// back as they are, such as multi-line values in place of unquoted ones, are
+// double-quoted and escaped instead.
+//
+// Values are transformed concurrently (see format.MapValues).
 // Returns an error if a line appears to be a malformed key-value pair.
 func (d *Formatter) TransformScalarValues(data []byte, fn func([]byte) ([]byte, error)) ([]byte, error) {
-	scanner := bufio.NewScanner(bytes.NewReader(data))
-	var buffer bytes.Buffer
-	for scanner.Scan() {
-		line := scanner.Text()
+	return d.TransformScalarValuesWithRules(data, nil, fn)
+}
 
-		// Trim spaces for parsing but keep the original line intact
-		trimmedLine := strings.TrimSpace(line)
+// TransformScalarValuesWithRules is like TransformScalarValues, but only
+// transforms the values selected by rules, with the file's own directives
+// applied on top. It implements format.RulesHandler.
+func (d *Formatter) TransformScalarValuesWithRules(data []byte, rules *format.Rules, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	entries, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
 
-		// Check if the line is a comment or blank, and write it as-is
-		if strings.HasPrefix(trimmedLine, "#") || trimmedLine == "" {
-			buffer.WriteString(line + "\n")
+	rules, err = rules.WithFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the public key and plaintext fields and collect the other values
+	root := rules.Root()
+	var actionable []entry
+	for _, e := range entries {
+		if e.key == format.PublicKeyField || e.key == format.UnderscoredPublicKeyField || !root.Enter(e.key, e.directive).Encrypted() {
 			continue
 		}
+		actionable = append(actionable, e)
+	}
 
-		// Split key and value by the first '=' to handle cases where '=' is in the value
-		parts := strings.SplitN(trimmedLine, "=", 2)
-		if len(parts) != 2 {
-			// Warn if line looks like a malformed key-value pair (valid identifier without '=')
-			if isLikelyMalformedEntry(trimmedLine) {
-				return nil, fmt.Errorf("line appears malformed (no '=' found): %q", trimmedLine)
+	values := make([][]byte, len(actionable))
+	for i, e := range actionable {
+		values[i] = format.EncodeString(data[e.start:e.end])
+	}
+	transformed, err := format.MapValues(context.Background(), values, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Splice the new values into the original data
+	var buffer bytes.Buffer
+	buffer.Grow(len(data))
+	pos := 0
+	for i, e := range actionable {
+		// Every value is a string here, so a typed value keeps its literal
+		_, value, err := format.DecodeTyped(transformed[i])
+		if err != nil {
+			return nil, err
+		}
+		start, end := e.start, e.end
+		if !fitsValue(value, e.quote) {
+			if e.quote != 0 {
+				start, end = start-1, end+1
 			}
-			// If line does not match key=value pattern, write it as-is
-			buffer.WriteString(line + "\n")
-			continue
+			value = quote(value)
 		}
+		buffer.Write(data[pos:start])
+		buffer.Write(value)
+		pos = end
+	}
+	buffer.Write(data[pos:])
 
-		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	return buffer.Bytes(), nil
+}
 
-		// Skip the public key field and encrypt other values
-		if key != format.PublicKeyField {
-			encMsg, err := fn([]byte(value))
-			if err != nil {
-				return nil, err
+// fitsValue reports whether v can be written as it is in place of a value
+// quoted with q, or an unquoted value if q is zero, and parse back unchanged.
+func fitsValue(v []byte, q byte) bool {
+	if q != 0 {
+		// The value must not contain a closing quote or escape the real one.
+		for i, c := range v {
+			if c == q && (i == 0 || v[i-1] != '\\') {
+				return false
 			}
-			// Replace the original value with the encrypted value
-			value = string(encMsg)
 		}
-
-		// Write the encrypted key-value pair to the buffer
-		buffer.WriteString(fmt.Sprintf("%s=%s\n", key, value))
+		return len(v) == 0 || v[len(v)-1] != '\\'
 	}
 
-	// Handle any scanning error
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	if len(v) == 0 {
+		return true
+	}
+	if isSpace(v[0]) || isSpace(v[len(v)-1]) {
+		return false
+	}
+	for i, c := range v {
+		if isLineBreak(c) || c == '#' && i > 0 && isSpace(v[i-1]) {
+			return false
+		}
 	}
+	if v[0] == '"' || v[0] == '\'' {
+		// Files encrypted by older versions kept the quotes of quoted values
+		// inside the encrypted value, so a complete quoted value is written back.
+		for i := 1; i < len(v); i++ {
+			if v[i] == v[0] && v[i-1] != '\\' {
+				return i == len(v)-1
+			}
+		}
+		return false
+	}
+	return true
+}
 
-	return buffer.Bytes(), nil
+// quote renders v as a double-quoted value, escaping what godotenv would
+// otherwise interpret.
+func quote(v []byte) []byte {
+	out := make([]byte, 0, len(v)+2)
+	out = append(out, '"')
+	for _, c := range v {
+		switch c {
+		case '\\', '"', '$':
+			out = append(out, '\\', c)
+		case '\n':
+			out = append(out, '\\', 'n')
+		case '\r':
+			out = append(out, '\\', 'r')
+		default:
+			out = append(out, c)
+		}
+	}
+	return append(out, '"')
 }
 
 // isLikelyMalformedEntry checks if a line looks like an intended key-value pair
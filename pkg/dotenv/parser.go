@@ -0,0 +1,177 @@
+package dotenv
+
+import (
+	"bytes"
+	"fmt"
+	"unicode"
+
+	"github.com/mscno/esec/pkg/format"
+)
+
+// entry is a KEY=value assignment in a dotenv file. start and end delimit the
+// value in the source, inside its quotes if it is quoted. directive is the
+// format.PlaintextDirective or format.EncryptDirective comment preceding the
+// assignment, if any.
+type entry struct {
+	key       string
+	start     int
+	end       int
+	quote     byte
+	directive string
+}
+
+// parse tokenizes a dotenv file the way godotenv.Parse does: optional "export"
+// prefixes, KEY=value and KEY: value assignments, single- and double-quoted
+// values that may span several lines and contain backslash-escaped quotes,
+// and inline comments after unquoted values. Several assignments may share a
+// line after a quoted value.
+//
+// Unlike godotenv, lines that are not assignments are skipped rather than
+// rejected, unless they look like an assignment missing its '='.
+//
+// A format.PlaintextDirective or format.EncryptDirective comment applies to the
+// next assignment, unless a blank line comes first.
+func parse(data []byte) ([]entry, error) {
+	var (
+		entries   []entry
+		directive string
+		blank     = true
+	)
+	for p := 0; p < len(data); {
+		// Skip white space, including line breaks, and comments
+		if data[p] == '\n' {
+			if blank {
+				directive = ""
+			}
+			blank = true
+			p++
+			continue
+		}
+		if unicode.IsSpace(rune(data[p])) {
+			p++
+			continue
+		}
+		blank = false
+		if data[p] == '#' {
+			end := lineEnd(data, p)
+			if d := format.CommentDirective(string(data[p:end])); d != "" {
+				directive = d
+			}
+			p = end
+			continue
+		}
+
+		e, next, ok, err := parseAssignment(data, p)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			line := bytes.TrimSpace(data[p:lineEnd(data, p)])
+			if isLikelyMalformedEntry(string(line)) {
+				return nil, fmt.Errorf("line appears malformed (no '=' found): %q", line)
+			}
+			p = lineEnd(data, p)
+			continue
+		}
+		e.directive, directive = directive, ""
+		entries = append(entries, e)
+		p = next
+	}
+	return entries, nil
+}
+
+// parseAssignment parses the assignment starting at p, returning it and the
+// offset just past its value. It reports false if there is no assignment at p.
+func parseAssignment(data []byte, p int) (entry, int, bool, error) {
+	i := p
+	if rest := data[i:]; bytes.HasPrefix(rest, []byte(exportPrefix)) &&
+		len(rest) > len(exportPrefix) && isSpace(rest[len(exportPrefix)]) {
+		i += len(exportPrefix)
+		for i < len(data) && isSpace(data[i]) {
+			i++
+		}
+	}
+
+	keyStart := i
+	for i < len(data) && isKeyChar(data[i]) {
+		i++
+	}
+	keyEnd := i
+	for i < len(data) && isSpace(data[i]) {
+		i++
+	}
+	if keyStart == keyEnd || i == len(data) || (data[i] != '=' && data[i] != ':') {
+		end := lineEnd(data, p)
+		if bytes.IndexByte(data[p:end], '=') >= 0 {
+			return entry{}, 0, false, fmt.Errorf("unexpected character %q in variable name near %q",
+				data[min(i, end-1)], data[p:end])
+		}
+		return entry{}, 0, false, nil
+	}
+
+	// Skip the separator and the white space after it
+	i++
+	for i < len(data) && isSpace(data[i]) {
+		i++
+	}
+	e := entry{key: string(data[keyStart:keyEnd])}
+
+	if i < len(data) && (data[i] == '"' || data[i] == '\'') {
+		quote := data[i]
+		for j := i + 1; j < len(data); j++ {
+			if data[j] == quote && data[j-1] != '\\' {
+				e.start, e.end, e.quote = i+1, j, quote
+				return e, j + 1, true, nil
+			}
+		}
+		return entry{}, 0, false, fmt.Errorf("unterminated quoted value %s", data[i:lineEnd(data, i)])
+	}
+
+	// An unquoted value runs to the end of the line, less the last comment
+	// preceded by white space, and is trimmed.
+	end := i
+	for end < len(data) && !isLineBreak(data[end]) {
+		end++
+	}
+	next := end
+	for j := end - 1; j > i; j-- {
+		if data[j] == '#' && isSpace(data[j-1]) {
+			end = j
+			break
+		}
+	}
+	for end > i && isSpace(data[end-1]) {
+		end--
+	}
+	e.start, e.end = i, end
+	return e, next, true, nil
+}
+
+// lineEnd returns the offset of the line break ending the line containing p,
+// or the end of the data.
+func lineEnd(data []byte, p int) int {
+	if i := bytes.IndexByte(data[p:], '\n'); i >= 0 {
+		return p + i
+	}
+	return len(data)
+}
+
+// isKeyChar reports whether c may appear in a variable name. Like godotenv, it
+// looks at single bytes.
+func isKeyChar(c byte) bool {
+	r := rune(c)
+	return c == '_' || c == '.' || unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// isSpace reports whether c is white space other than a line feed.
+func isSpace(c byte) bool {
+	switch c {
+	case '\t', '\v', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isLineBreak(c byte) bool {
+	return c == '\n' || c == '\r'
+}
@@ -0,0 +1,112 @@
+package fileutils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to the file at path, like os.WriteFile, but
+// atomically, as WriteAtomic does.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return WriteAtomic(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// WriteAtomic calls write with a temporary file next to path and, if it
+// succeeds, syncs the file and renames it to path. Readers of path therefore
+// see either its previous contents or the complete new ones, and a failure or
+// crash leaves no partial file behind. If path exists, its permissions are
+// kept, and its owner and group as far as the process may set them (see
+// chownLike); otherwise perm is used. Concurrent writers should hold LockFile.
+//
+// A symbolic link at path is followed, as os.WriteFile does, so the file it
+// points to is replaced rather than the link.
+func WriteAtomic(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	path, err := resolveLinks(path)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	switch {
+	case err == nil:
+		perm = info.Mode().Perm()
+	case errors.Is(err, fs.ErrNotExist):
+		info = nil
+	default:
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // Gone after the rename
+
+	if info != nil {
+		chownLike(tmp, info)
+	}
+	if err := writeSynced(tmp, perm, write); err != nil {
+		tmp.Close() //nolint:errcheck,gosec // The write error is reported
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// writeSynced sets the permissions of f, writes it with write through a
+// buffer and syncs it to disk.
+func writeSynced(f *os.File, perm os.FileMode, write func(w io.Writer) error) error {
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// maxLinks bounds the symbolic links resolveLinks follows, as the kernel does.
+const maxLinks = 40
+
+// resolveLinks returns path with the symbolic links it goes through resolved,
+// including a final link to a file that does not exist yet, which writing
+// creates. A path that does not exist is returned as it is.
+func resolveLinks(path string) (string, error) {
+	for range maxLinks {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return resolved, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		// Only a dangling link at the end of path is left to follow
+		target, err := os.Readlink(path)
+		if err != nil {
+			return path, nil
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+	return "", fmt.Errorf("%s: too many levels of symbolic links", path)
+}
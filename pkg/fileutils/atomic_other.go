@@ -0,0 +1,14 @@
+//go:build !unix
+
+package fileutils
+
+import (
+	"io/fs"
+	"os"
+)
+
+// chownLike does nothing, as files have no Unix owner here.
+func chownLike(*os.File, fs.FileInfo) {}
+
+// syncDir does nothing, as directories cannot be synced here.
+func syncDir(string) error { return nil }
@@ -0,0 +1,80 @@
+package fileutils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "out")
+
+	assert.NoError(t, WriteFileAtomic(file, []byte("first"), 0o600))
+	info, err := os.Stat(file)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// An existing file keeps its permissions
+	assert.NoError(t, os.Chmod(file, 0o640))
+	assert.NoError(t, WriteFileAtomic(file, []byte("second"), 0o600))
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+	info, err = os.Stat(file)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+
+	// A failed write leaves the file as it was, and no temporary file behind
+	failure := errors.New("failed")
+	err = WriteAtomic(file, 0o600, func(w io.Writer) error {
+		_, _ = w.Write([]byte("partial"))
+		return failure
+	})
+	assert.IsError(t, err, failure)
+	data, err = os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestWriteAtomicFollowsLinks(t *testing.T) {
+	dir := t.TempDir()
+	realDir := filepath.Join(dir, "real")
+	assert.NoError(t, os.Mkdir(realDir, 0o700))
+	target := filepath.Join(realDir, "out")
+	assert.NoError(t, os.WriteFile(target, []byte("first"), 0o640))
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join("real", "out"), link); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+
+	// The file the link points to is replaced, and the link is kept
+	assert.NoError(t, WriteFileAtomic(link, []byte("second"), 0o600))
+	info, err := os.Lstat(link)
+	assert.NoError(t, err)
+	assert.True(t, info.Mode()&os.ModeSymlink != 0)
+	data, err := os.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+	info, err = os.Stat(target)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+
+	// A dangling link gets its target created
+	dangling := filepath.Join(dir, "dangling")
+	assert.NoError(t, os.Symlink(filepath.Join("real", "new"), dangling))
+	assert.NoError(t, WriteFileAtomic(dangling, []byte("new"), 0o600))
+	data, err = os.ReadFile(filepath.Join(realDir, "new"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	info, err = os.Lstat(dangling)
+	assert.NoError(t, err)
+	assert.True(t, info.Mode()&os.ModeSymlink != 0)
+}
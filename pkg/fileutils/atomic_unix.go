@@ -0,0 +1,33 @@
+//go:build unix
+
+package fileutils
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// chownLike gives f the owner and group of the file described by info, as
+// far as the process may: only a privileged process may give a file away, but
+// any may set a group it belongs to.
+func chownLike(f *os.File, info fs.FileInfo) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	if f.Chown(int(st.Uid), int(st.Gid)) != nil {
+		_ = f.Chown(-1, int(st.Gid))
+	}
+}
+
+// syncDir syncs the directory dir, so that the entries renamed into it
+// survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir) //nolint:gosec // Directory of a user-provided path
+	if err != nil {
+		return err
+	}
+	defer d.Close() //nolint:errcheck // Read-only directory
+	return d.Sync()
+}
@@ -3,8 +3,9 @@ package fileutils
 
 import (
 	"fmt"
-	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 )
 
 // FileFormat represents the supported encrypted file format extensions.
@@ -16,31 +17,70 @@ const (
 	Env FileFormat = ".env"
 	// Ejson represents the .ejson (encrypted JSON) file format.
 	Ejson FileFormat = ".ejson"
+	// Ejsonc represents the .ejsonc (encrypted JSON with comments) file format.
+	Ejsonc FileFormat = ".ejsonc"
 	// Eyaml represents the .eyaml (encrypted YAML) file format.
 	Eyaml FileFormat = ".eyaml"
 	// Eyml represents the .eyml (encrypted YAML) file format.
 	Eyml FileFormat = ".eyml"
 	// Etoml represents the .etoml (encrypted TOML) file format.
 	Etoml FileFormat = ".etoml"
+	// Eproperties represents the .eproperties (encrypted Java properties) file format.
+	Eproperties FileFormat = ".eproperties"
+	// Eini represents the .eini (encrypted INI) file format.
+	Eini FileFormat = ".eini"
+	// Ehcl represents the .ehcl (encrypted HCL) file format.
+	Ehcl FileFormat = ".ehcl"
+	// Etfvars represents the .etfvars (encrypted Terraform variable definitions) file format.
+	Etfvars FileFormat = ".etfvars"
 )
 
-// ValidFormats returns a slice of all supported file formats.
+var (
+	registeredMu sync.RWMutex
+	registered   []FileFormat
+)
+
+// RegisterFormat adds a file format to ValidFormats, so ParseFormat recognizes
+// it. The format must be a '.' followed by a name without dots or path
+// separators, and must not be supported already. It is usually called through
+// esec.RegisterFormat, which also registers the format's handler.
+func RegisterFormat(format FileFormat) error {
+	name := strings.TrimPrefix(string(format), ".")
+	if len(name) == len(format) || name == "" || strings.ContainsAny(name, `./\`) {
+		return fmt.Errorf("invalid format %q: must be a '.' followed by a name without dots or path separators", format)
+	}
+
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	if slices.Contains(builtinFormats(), format) || slices.Contains(registered, format) {
+		return fmt.Errorf("format %s is already registered", format)
+	}
+	registered = append(registered, format)
+	return nil
+}
+
+// ValidFormats returns a slice of all supported file formats: the built-in
+// formats followed by those added with RegisterFormat.
 func ValidFormats() []FileFormat {
-	return []FileFormat{Env, Ejson, Eyaml, Eyml, Etoml}
+	registeredMu.RLock()
+	defer registeredMu.RUnlock()
+	return append(builtinFormats(), registered...)
+}
+
+func builtinFormats() []FileFormat {
+	return []FileFormat{Env, Ejsonc, Ejson, Eyaml, Eyml, Etoml, Eproperties, Eini, Ehcl, Etfvars}
 }
 
 // ParseFormat determines the file format based on the filename or format string.
 // It accepts inputs like ".ejson", "ejson", ".ejson.dev", or full paths like "/path/to/.ejson.dev".
+// If several formats match, the longest wins, so ".ejsonc.dev" is ".ejsonc" rather than ".ejson".
 // Returns an error if the format is not recognized.
 func ParseFormat(input string) (FileFormat, error) {
 	if !strings.HasPrefix(input, ".") {
 		input = "." + input
 	}
-	base := filepath.Base(input)
-	for _, format := range ValidFormats() {
-		if strings.HasPrefix(base, string(format)) {
-			return format, nil
-		}
+	if format, ok := FormatFromName(input); ok {
+		return format, nil
 	}
 
 	return "", fmt.Errorf("unsupported format: %s", input)
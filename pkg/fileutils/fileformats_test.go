@@ -2,6 +2,7 @@ package fileutils
 
 import (
 	"fmt"
+	"slices"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
@@ -15,9 +16,14 @@ func TestGenerateFilename(t *testing.T) {
 	}{
 		{Env, "", ".env"},
 		{Ejson, "", ".ejson"},
+		{Ejsonc, "dev", ".ejsonc.dev"},
 		{Eyaml, "prod", ".eyaml.prod"},
 		{Eyml, "staging", ".eyml.staging"},
 		{Etoml, "dev", ".etoml.dev"},
+		{Eproperties, "prod", ".eproperties.prod"},
+		{Eini, "", ".eini"},
+		{Ehcl, "", ".ehcl"},
+		{Etfvars, "prod", ".etfvars.prod"},
 	}
 
 	for _, tt := range tests {
@@ -37,9 +43,17 @@ func TestParseFormat_ValidFormats(t *testing.T) {
 	}{
 		{".env", Env},
 		{".ejson", Ejson},
+		{".ejsonc", Ejsonc},
+		{".ejsonc.dev", Ejsonc},
+		{".ejson.dev", Ejson},
 		{".eyaml", Eyaml},
 		{".eyml", Eyml},
 		{".etoml", Etoml},
+		{".eproperties", Eproperties},
+		{"eini", Eini},
+		{"/path/to/.eini.dev", Eini},
+		{".ehcl", Ehcl},
+		{".etfvars.dev", Etfvars},
 	}
 
 	for _, tt := range tests {
@@ -67,3 +81,22 @@ func TestParseFormat_InvalidFormats(t *testing.T) {
 		})
 	}
 }
+
+func TestRegisterFormat(t *testing.T) {
+	for _, format := range []FileFormat{"", ".", "ecfg", ".e.cfg", ".e/cfg", Ejson} {
+		assert.Error(t, RegisterFormat(format), "format %q", format)
+	}
+
+	// Formats stay registered, so only register once when tests are repeated
+	if !slices.Contains(ValidFormats(), ".ejsonx") {
+		assert.NoError(t, RegisterFormat(".ejsonx"))
+	}
+	assert.Error(t, RegisterFormat(".ejsonx"))
+
+	format, err := ParseFormat("/path/to/.ejsonx.dev")
+	assert.NoError(t, err)
+	assert.Equal(t, FileFormat(".ejsonx"), format)
+	format, err = ParseFormat(".ejson.dev")
+	assert.NoError(t, err)
+	assert.Equal(t, Ejson, format)
+}
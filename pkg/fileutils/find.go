@@ -0,0 +1,87 @@
+package fileutils
+
+import (
+	"io/fs"
+	"path/filepath"
+	"slices"
+)
+
+// exampleEnvs are the environments of templates kept next to esec files,
+// such as ".env.example", which FindFiles leaves out unless asked.
+var exampleEnvs = []string{"example", "sample", "template", "dist"}
+
+// FindFiles returns the files under root whose names follow the naming
+// template exactly, in lexical order. Unlike Match, the default template only
+// takes names that are a format alone or followed by a dot and an
+// environment, so ".envrc" and ".env.local.bak" are not found. The files of
+// exampleEnvs, such as ".env.example", are only found with examples set.
+//
+// The files and directories ignored by .gitignore and EsecIgnoreFilename
+// files are left out, including the ignore files of the parents of root up to
+// the root of its git repository, and so are .git directories. Symbolic links
+// are not followed.
+func FindFiles(root string, naming NamingTemplate, examples bool) ([]string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	top := findRepoRoot(abs)
+	if top == "" {
+		top = abs
+	}
+
+	// The ignore files of the parents apply too, the outermost first
+	var parents []string
+	for dir := abs; dir != top; {
+		dir = filepath.Dir(dir)
+		parents = append(parents, dir)
+	}
+	slices.Reverse(parents)
+	var ignore ignoreList
+	for _, dir := range parents {
+		base, err := relSlash(top, dir)
+		if err != nil {
+			return nil, err
+		}
+		if ignore, err = ignore.load(dir, base); err != nil {
+			return nil, err
+		}
+	}
+
+	pattern := naming.pattern()
+	envIndex := pattern.SubexpIndex("env")
+	var files []string
+	err = filepath.WalkDir(abs, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := relSlash(top, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != abs && (d.Name() == ".git" || ignore.ignored(rel, true)) {
+				return filepath.SkipDir
+			}
+			ignore, err = ignore.load(p, rel)
+			return err
+		}
+		if !d.Type().IsRegular() || ignore.ignored(rel, false) {
+			return nil
+		}
+		m := pattern.FindStringSubmatch(filepath.ToSlash(p))
+		if m == nil || !examples && slices.Contains(exampleEnvs, m[envIndex]) {
+			return nil
+		}
+		fromRoot, err := filepath.Rel(abs, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.Join(root, fromRoot))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
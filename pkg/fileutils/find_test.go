@@ -0,0 +1,108 @@
+package fileutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestIgnoreList(t *testing.T) {
+	ignore := ignoreList(parseIgnore([]byte(`# comment
+*.bak
+/build
+node_modules/
+docs/**/*.ejson
+!keep.bak
+secret\ 
+`), ""))
+	ignore = append(ignore, parseIgnore([]byte("local.*\n"), "services/api")...)
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.bak", false, true},
+		{"deep/dir/a.bak", false, true},
+		{"keep.bak", false, false},
+		{"build", true, true},
+		{"services/build", true, false},
+		{"node_modules", true, true},
+		{"node_modules", false, false},
+		{"docs/.ejson", false, true},
+		{"docs/a/b/.ejson", false, true},
+		{"src/docs/.ejson", false, false},
+		{"secret ", false, true},
+		{"services/api/local.ejson", false, true},
+		{"services/web/local.ejson", false, false},
+		{"local.ejson", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.ignored, ignore.ignored(tt.path, tt.isDir))
+		})
+	}
+}
+
+func TestFindFiles(t *testing.T) {
+	repo := t.TempDir()
+	files := map[string]string{
+		".git/config":               "",
+		".gitignore":                ".env\nvendor/\n",
+		".ejson":                    "{}",
+		".ejson.prod":               "{}",
+		".env":                      "SECRET=plaintext",
+		".envrc":                    "export PATH=$PATH:bin",
+		".ejson.example":            "{}",
+		".ejson.prod.bak":           "{}",
+		"notes.txt":                 "",
+		"vendor/lib/.ejson":         "{}",
+		"services/api/.eyaml.dev":   "a: b",
+		"services/api/.esecignore":  ".etoml*\n",
+		"services/api/.etoml":       "a = 'b'",
+		"services/web/.etoml":       "a = 'b'",
+		"services/web/secrets.json": "{}",
+	}
+	for name, data := range files {
+		p := filepath.Join(repo, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0o700))
+		assert.NoError(t, os.WriteFile(p, []byte(data), 0o600))
+	}
+
+	found, err := FindFiles(repo, "", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(repo, ".ejson"),
+		filepath.Join(repo, ".ejson.prod"),
+		filepath.Join(repo, "services/api/.eyaml.dev"),
+		filepath.Join(repo, "services/web/.etoml"),
+	}, found)
+
+	// The ignore files of the repository apply below its root
+	// Templates are only found when asked
+	found, err = FindFiles(repo, "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(repo, ".ejson"),
+		filepath.Join(repo, ".ejson.example"),
+		filepath.Join(repo, ".ejson.prod"),
+		filepath.Join(repo, "services/api/.eyaml.dev"),
+		filepath.Join(repo, "services/web/.etoml"),
+	}, found)
+
+	found, err = FindFiles(filepath.Join(repo, "services"), "", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(repo, "services/api/.eyaml.dev"),
+		filepath.Join(repo, "services/web/.etoml"),
+	}, found)
+
+	found, err = FindFiles(repo, "{dir}/{env}{ext}", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(repo, ".ejson"),
+		filepath.Join(repo, "services/web/.etoml"),
+	}, found)
+}
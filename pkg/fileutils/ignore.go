@@ -0,0 +1,201 @@
+package fileutils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// EsecIgnoreFilename is the name of the files listing the files FindFiles
+// leaves out, in addition to those of .gitignore files. They use the syntax of
+// .gitignore files, and apply to the directory they are in.
+const EsecIgnoreFilename = ".esecignore"
+
+// ignoreFilenames are the names of the files read by ignoreList.load, in the
+// order their patterns apply.
+var ignoreFilenames = []string{".gitignore", EsecIgnoreFilename}
+
+// ignorePattern is a pattern of a .gitignore file.
+type ignorePattern struct {
+	// base is the slash-separated directory of the file the pattern is from,
+	// relative to the top directory of FindFiles, or "" for the top.
+	base    string
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreList holds the patterns of the .gitignore and EsecIgnoreFilename files
+// read so far, in the order they apply: the patterns of a directory apply
+// after those of its parents, and the last pattern matching a path decides.
+type ignoreList []ignorePattern
+
+// load appends the patterns of the ignore files in dir, which is base
+// relative to the top directory of FindFiles.
+func (l ignoreList) load(dir, base string) (ignoreList, error) {
+	for _, name := range ignoreFilenames {
+		data, err := os.ReadFile(filepath.Join(dir, name)) //nolint:gosec // Ignore file in a user-provided directory
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, parseIgnore(data, base)...)
+	}
+	return l, nil
+}
+
+// ignored reports whether the slash-separated path rel, relative to the top
+// directory of FindFiles, is ignored. Only patterns of its directory or its
+// parents apply.
+func (l ignoreList) ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, p := range l {
+		name := rel
+		if p.base != "" {
+			if !strings.HasPrefix(rel, p.base+"/") {
+				continue
+			}
+			name = rel[len(p.base)+1:]
+		}
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(name) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// parseIgnore parses the patterns of a .gitignore file in the directory base.
+// Invalid patterns are skipped, as git does.
+func parseIgnore(data []byte, base string) []ignorePattern {
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		line = trimTrailingSpaces(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		p := ignorePattern{base: base}
+		if line[0] == '!' {
+			p.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// A pattern with a slash, other than a trailing one, is relative to
+		// its directory; any other matches a name at any depth
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+
+		expr := globToRegexp(line)
+		if !anchored {
+			expr = `(?:.*/)?` + expr
+		}
+		re, err := regexp.Compile(`^` + expr + `$`)
+		if err != nil {
+			continue
+		}
+		p.re = re
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// trimTrailingSpaces removes the spaces ending line, unless escaped with a
+// backslash.
+func trimTrailingSpaces(line string) string {
+	end := len(line)
+	for end > 0 && line[end-1] == ' ' {
+		if end > 1 && line[end-2] == '\\' {
+			break
+		}
+		end--
+	}
+	return line[:end]
+}
+
+// globToRegexp translates a .gitignore glob to a regular expression: "*" and
+// "?" match within a path segment, "**" across segments, and a backslash
+// escapes the character after it.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			b.WriteString(`(?:.*/)?`)
+			i += 2
+		case strings.HasPrefix(glob[i:], "**") && i+2 == len(glob) && (i == 0 || glob[i-1] == '/'):
+			b.WriteString(`.*`)
+			i++
+		case c == '*':
+			b.WriteString(`[^/]*`)
+		case c == '?':
+			b.WriteString(`[^/]`)
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// findRepoRoot returns the closest directory of dir, or dir itself, holding a
+// .git entry, or "" if there is none.
+func findRepoRoot(dir string) string {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// relSlash returns the slash-separated path of target relative to base, or ""
+// if they are the same.
+func relSlash(base, target string) (string, error) {
+	rel, err := filepath.Rel(base, target)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		return "", nil
+	}
+	return path.Clean(rel), nil
+}
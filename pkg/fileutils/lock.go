@@ -0,0 +1,44 @@
+package fileutils
+
+import (
+	"os"
+)
+
+// LockFile takes an exclusive advisory lock on the file at path, waiting for
+// other processes holding it to release it, and returns a function releasing
+// it. The lock is on the file itself, so it holds across WriteAtomic: once a
+// writer replaces the file, the next one locks the new file. Advisory locks
+// are only implemented on Unix, and elsewhere LockFile merely checks that the
+// file exists. A symbolic link at path is followed, as by WriteAtomic, so the
+// file locked is the one written.
+func LockFile(path string) (unlock func(), err error) {
+	path, err = resolveLinks(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		f, err := os.Open(path) //nolint:gosec // File path is user-provided
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(f); err != nil {
+			f.Close() //nolint:errcheck,gosec // The lock error is reported
+			return nil, err
+		}
+
+		// The file may have been replaced while waiting for the lock, which
+		// then locks nothing anyone else will look at
+		locked, err := f.Stat()
+		if err == nil {
+			var current os.FileInfo
+			current, err = os.Stat(path)
+			if err == nil && os.SameFile(locked, current) {
+				return func() { f.Close() }, nil //nolint:errcheck,gosec // Closing releases the lock
+			}
+		}
+		f.Close() //nolint:errcheck,gosec // Retried or reported below
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package fileutils
+
+import "os"
+
+// lockFile does nothing, as advisory locks are only implemented on Unix.
+func lockFile(*os.File) error { return nil }
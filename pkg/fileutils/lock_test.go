@@ -0,0 +1,46 @@
+//go:build unix
+
+package fileutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestLockFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ".ejson")
+	assert.NoError(t, os.WriteFile(file, []byte("first"), 0o600))
+
+	unlock, err := LockFile(file)
+	assert.NoError(t, err)
+
+	locked := make(chan string)
+	go func() {
+		unlock, err := LockFile(file)
+		if err != nil {
+			locked <- err.Error()
+			return
+		}
+		defer unlock()
+		data, _ := os.ReadFile(file)
+		locked <- string(data)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("lock taken twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The waiter gets the file that replaced the one it waited on
+	assert.NoError(t, WriteFileAtomic(file, []byte("second"), 0o600))
+	unlock()
+	assert.Equal(t, "second", <-locked)
+
+	_, err = LockFile(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package fileutils
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func lockFile(f *os.File) error {
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX) //nolint:gosec // File descriptors fit in an int
+		if !errors.Is(err, unix.EINTR) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package fileutils
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// NamingTemplate lays out the files of environments, such as
+// "{dir}/secrets/{env}{ext}" for "secrets/prod.ejson". Its placeholders are:
+//
+//   - {dir}: the directory names are resolved in, such as the current
+//     directory. It may only start the template, and is implied otherwise.
+//   - {env}: the environment name. For the default environment, it is left
+//     out along with a '.', '-' or '_' right before it.
+//   - {ext}: the file format, such as ".ejson".
+//
+// The empty template is DefaultNamingTemplate.
+type NamingTemplate string
+
+// DefaultNamingTemplate is the naming convention of esec files: ".ejson" for
+// the default environment and ".ejson.prod" for prod.
+const DefaultNamingTemplate NamingTemplate = "{dir}/{ext}.{env}"
+
+// placeholder matches the placeholders of a template, known or not.
+var placeholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// Validate reports whether t is a valid template: relative, with {env} and
+// {ext} once each and apart, and {dir} at most at its start.
+func (t NamingTemplate) Validate() error {
+	s := string(t.orDefault())
+	counts := map[string]int{}
+	for _, p := range placeholder.FindAllString(s, -1) {
+		switch p {
+		case "{dir}", "{env}", "{ext}":
+			counts[p]++
+		default:
+			return fmt.Errorf("invalid naming template %q: unknown placeholder %s", t, p)
+		}
+	}
+	switch {
+	case counts["{env}"] != 1 || counts["{ext}"] != 1:
+		return fmt.Errorf("invalid naming template %q: must contain {env} and {ext} once each", t)
+	case counts["{dir}"] == 1 && !strings.HasPrefix(s, "{dir}/"), counts["{dir}"] > 1:
+		return fmt.Errorf("invalid naming template %q: {dir} may only start the template, followed by a '/'", t)
+	case strings.Contains(s, "{ext}{env}"):
+		return fmt.Errorf("invalid naming template %q: {ext} must not be followed directly by {env}", t)
+	case path.IsAbs(t.relative()):
+		return fmt.Errorf("invalid naming template %q: must be relative, starting with {dir} at most", t)
+	}
+	return nil
+}
+
+// Filename returns the slash-separated path of the file of env in format,
+// resolved in dir. For example, "{dir}/secrets/{env}{ext}" gives
+// "services/api/secrets/prod.ejson" for dir "services/api", Ejson and "prod".
+// The template must be valid.
+func (t NamingTemplate) Filename(dir string, format FileFormat, env string) string {
+	s := t.relative()
+	if env == "" {
+		if i := strings.Index(s, "{env}"); i > 0 && strings.ContainsRune(".-_", rune(s[i-1])) {
+			s = s[:i-1] + s[i:]
+		}
+	}
+	s = strings.NewReplacer("{env}", env, "{ext}", string(format)).Replace(s)
+	return path.Join(filepath.ToSlash(dir), s)
+}
+
+// Match reports whether the file name follows the template, in any
+// directory, and returns the format and environment it names. The format
+// must be one of ValidFormats. The template must be valid.
+//
+// Under DefaultNamingTemplate, any name starting with a format matches, as
+// with FormatFromName, and the environment is what follows its last dot, if
+// it has more than two.
+func (t NamingTemplate) Match(name string) (FileFormat, string, bool) {
+	name = filepath.ToSlash(name)
+	if t.orDefault() == DefaultNamingTemplate {
+		format, ok := FormatFromName(name)
+		if !ok {
+			return "", "", false
+		}
+		parts := strings.Split(path.Base(name), ".")
+		if len(parts) <= 2 {
+			return format, "", true
+		}
+		return format, parts[len(parts)-1], true
+	}
+
+	pattern := t.pattern()
+	m := pattern.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", false
+	}
+	return FileFormat(m[pattern.SubexpIndex("ext")]), m[pattern.SubexpIndex("env")], true
+}
+
+func (t NamingTemplate) orDefault() NamingTemplate {
+	if t == "" {
+		return DefaultNamingTemplate
+	}
+	return t
+}
+
+// relative returns the template without its leading {dir}.
+func (t NamingTemplate) relative() string {
+	return strings.TrimPrefix(string(t.orDefault()), "{dir}/")
+}
+
+// pattern returns a regular expression matching the names following the
+// template, capturing the environment as "env" and the format as "ext".
+func (t NamingTemplate) pattern() *regexp.Regexp {
+	// Longer formats come first, so ".ejsonc" is not taken for ".ejson"
+	formats := ValidFormats()
+	slices.SortFunc(formats, func(a, b FileFormat) int { return len(b) - len(a) })
+	exts := make([]string, len(formats))
+	for i, format := range formats {
+		exts[i] = regexp.QuoteMeta(string(format))
+	}
+
+	var b strings.Builder
+	b.WriteString(`(?:^|/)`)
+	rest := t.relative()
+	for rest != "" {
+		loc := placeholder.FindStringIndex(rest)
+		if loc == nil {
+			b.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+		literal := rest[:loc[0]]
+		switch rest[loc[0]:loc[1]] {
+		case "{env}":
+			// The default environment is named by leaving it out, along with
+			// its separator
+			sep := ""
+			if n := len(literal); n > 0 && strings.ContainsRune(".-_", rune(literal[n-1])) {
+				literal, sep = literal[:n-1], literal[n-1:]
+			}
+			b.WriteString(regexp.QuoteMeta(literal))
+			fmt.Fprintf(&b, `(?:%s(?P<env>[a-z0-9]+))?`, regexp.QuoteMeta(sep))
+		case "{ext}":
+			b.WriteString(regexp.QuoteMeta(literal))
+			fmt.Fprintf(&b, `(?P<ext>%s)`, strings.Join(exts, "|"))
+		}
+		rest = rest[loc[1]:]
+	}
+	b.WriteString(`$`)
+	return regexp.MustCompile(b.String())
+}
@@ -0,0 +1,95 @@
+package fileutils
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestNamingTemplate_Validate(t *testing.T) {
+	valid := []NamingTemplate{
+		"",
+		DefaultNamingTemplate,
+		"{dir}/secrets/{env}{ext}",
+		"config/{env}/secrets{ext}",
+		"{ext}-{env}",
+	}
+	for _, template := range valid {
+		t.Run(string(template), func(t *testing.T) {
+			assert.NoError(t, template.Validate())
+		})
+	}
+
+	invalid := map[NamingTemplate]string{
+		"secrets/{env}":            "must contain {env} and {ext} once each",
+		"{env}/{env}{ext}":         "must contain {env} and {ext} once each",
+		"secrets/{dir}/{env}{ext}": "{dir} may only start the template",
+		"{dir}{env}{ext}":          "{dir} may only start the template",
+		"{ext}{env}":               "{ext} must not be followed directly by {env}",
+		"{env}{ext}.{region}":      "unknown placeholder {region}",
+		"/etc/secrets/{env}{ext}":  "must be relative",
+		"{dir}//etc/{env}{ext}":    "must be relative",
+	}
+	for template, want := range invalid {
+		t.Run(string(template), func(t *testing.T) {
+			err := template.Validate()
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), want)
+		})
+	}
+}
+
+func TestNamingTemplate_Filename(t *testing.T) {
+	tests := []struct {
+		template NamingTemplate
+		dir      string
+		env      string
+		expected string
+	}{
+		{"", ".", "dev", ".ejson.dev"},
+		{"", ".", "", ".ejson"},
+		{DefaultNamingTemplate, "config", "prod", "config/.ejson.prod"},
+		{"{dir}/secrets/{env}{ext}", "services/api", "prod", "services/api/secrets/prod.ejson"},
+		{"{dir}/secrets/{env}{ext}", ".", "", "secrets/.ejson"},
+		{"secrets/{env}{ext}", ".", "dev", "secrets/dev.ejson"},
+		{"secrets/app-{env}{ext}", ".", "", "secrets/app.ejson"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.template)+"/"+tt.env, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.template.Filename(tt.dir, Ejson, tt.env))
+		})
+	}
+}
+
+func TestNamingTemplate_Match(t *testing.T) {
+	tests := []struct {
+		template NamingTemplate
+		name     string
+		format   FileFormat
+		env      string
+		ok       bool
+	}{
+		{"", ".ejson.dev", Ejson, "dev", true},
+		{"", "/path/to/.ejsonc", Ejsonc, "", true},
+		{"", "secrets/dev.ejson", "", "", false},
+		{"{dir}/secrets/{env}{ext}", "services/api/secrets/prod.ejson", Ejson, "prod", true},
+		{"{dir}/secrets/{env}{ext}", "secrets/dev.eyaml", Eyaml, "dev", true},
+		{"{dir}/secrets/{env}{ext}", "/abs/secrets/.env", Env, "", true},
+		{"{dir}/secrets/{env}{ext}", "services/api/mysecrets/prod.ejson", "", "", false},
+		{"{dir}/secrets/{env}{ext}", "secrets/prod.json", "", "", false},
+		{"{dir}/secrets/{env}{ext}", "secrets/Prod.ejson", "", "", false},
+		{"config/app-{env}{ext}", "config/app-staging.etoml", Etoml, "staging", true},
+		{"config/app-{env}{ext}", "config/app.etoml", Etoml, "", true},
+		{"{ext}-{env}", "x/.eini-dev", Eini, "dev", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.template)+"/"+tt.name, func(t *testing.T) {
+			format, env, ok := tt.template.Match(tt.name)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.format, format)
+			assert.Equal(t, tt.env, env)
+		})
+	}
+}
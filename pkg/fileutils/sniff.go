@@ -0,0 +1,180 @@
+package fileutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	esecjson "github.com/mscno/esec/pkg/json"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrUnknownFormat means the format of some content could not be detected.
+	ErrUnknownFormat = errors.New("unrecognized content")
+	// ErrAmbiguousFormat means some content is valid in several formats.
+	ErrAmbiguousFormat = errors.New("ambiguous content")
+)
+
+// plainExtensions maps the usual extensions of plaintext files to the format
+// their content is encrypted as. They break ties when content is ambiguous.
+var plainExtensions = map[string]FileFormat{
+	".json":  Ejson,
+	".jsonc": Ejsonc,
+	".yaml":  Eyaml,
+	".yml":   Eyaml,
+	".toml":  Etoml,
+	".env":   Env,
+}
+
+// dotenvAssignment matches the start of a KEY=value line, written without
+// white space before the '=' as dotenv files conventionally are. This tells
+// them apart from TOML, which is written "key = value".
+var dotenvAssignment = regexp.MustCompile(`^(export\s+)?[A-Za-z_][A-Za-z0-9_.]*=`)
+
+// FormatFromName returns the format the base name of name starts with, as in
+// ".ejson.dev" or "/path/to/.ejson.dev". If several formats match, the
+// longest wins. It reports false if the name starts with no supported format.
+func FormatFromName(name string) (FileFormat, bool) {
+	base := filepath.Base(name)
+	var match FileFormat
+	for _, format := range ValidFormats() {
+		if strings.HasPrefix(base, string(format)) && len(format) > len(match) {
+			match = format
+		}
+	}
+	return match, match != ""
+}
+
+// DetectFormat determines the format of the file called name holding data.
+// The format is taken from the name if it starts with one, as FormatFromName
+// does, and sniffed from data otherwise. If data is valid in several formats,
+// the usual extension of a plaintext file, such as ".yaml", settles it.
+func DetectFormat(name string, data []byte) (FileFormat, error) {
+	if format, ok := FormatFromName(name); ok {
+		return format, nil
+	}
+	return pickFormat(sniff(data), plainExtensions[strings.ToLower(filepath.Ext(name))])
+}
+
+// SniffFormat determines the format of data from its content, recognizing
+// JSON, JSONC, YAML, TOML and dotenv. A JSON object is also valid YAML, so
+// JSON wins. Otherwise data must be valid in exactly one format, or
+// ErrUnknownFormat or ErrAmbiguousFormat is returned.
+func SniffFormat(data []byte) (FileFormat, error) {
+	return pickFormat(sniff(data), "")
+}
+
+// pickFormat returns the only candidate, or hint if it is one of several.
+func pickFormat(candidates []FileFormat, hint FileFormat) (FileFormat, error) {
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("%w: not a JSON, YAML, TOML or dotenv document with values", ErrUnknownFormat)
+	case 1:
+		return candidates[0], nil
+	}
+	for _, format := range candidates {
+		if format == hint {
+			return format, nil
+		}
+	}
+	names := make([]string, len(candidates))
+	for i, format := range candidates {
+		names[i] = string(format)
+	}
+	return "", fmt.Errorf("%w: could be %s", ErrAmbiguousFormat, strings.Join(names, " or "))
+}
+
+// sniff returns the formats data is a document with values in.
+func sniff(data []byte) []FileFormat {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		if isJSONObject(trimmed) {
+			return []FileFormat{Ejson}
+		}
+		if isJSONObject(esecjson.Standardize(trimmed)) {
+			return []FileFormat{Ejsonc}
+		}
+	}
+
+	var candidates []FileFormat
+	if isDotenv(data) {
+		candidates = append(candidates, Env)
+	}
+	if isYAMLMapping(data) {
+		candidates = append(candidates, Eyaml)
+	}
+	if isTOMLTable(data) {
+		candidates = append(candidates, Etoml)
+	}
+	return candidates
+}
+
+func isJSONObject(data []byte) bool {
+	var v map[string]any
+	return json.Unmarshal(data, &v) == nil
+}
+
+// isYAMLMapping reports whether data is a YAML document holding a mapping
+// with at least one key. Plain lines of text are valid YAML too, as a single
+// string, so anything else is not taken for YAML.
+func isYAMLMapping(data []byte) bool {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false
+	}
+	return len(doc.Content) == 1 && doc.Content[0].Kind == yaml.MappingNode && len(doc.Content[0].Content) > 0
+}
+
+// isTOMLTable reports whether data is a TOML document with at least one key.
+func isTOMLTable(data []byte) bool {
+	var v map[string]any
+	return toml.Unmarshal(data, &v) == nil && len(v) > 0
+}
+
+// isDotenv reports whether every line of data is blank, a comment or a
+// KEY=value assignment, and at least one is an assignment. Quoted values may
+// span several lines.
+func isDotenv(data []byte) bool {
+	lines := strings.Split(string(data), "\n")
+	found := false
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		loc := dotenvAssignment.FindStringIndex(line)
+		if loc == nil {
+			return false
+		}
+		found = true
+
+		value := line[loc[1]:]
+		if value == "" || (value[0] != '"' && value[0] != '\'') {
+			continue
+		}
+		quote, rest := value[0], value[1:]
+		for !hasClosingQuote(rest, quote) {
+			if i++; i == len(lines) {
+				return false
+			}
+			rest = lines[i]
+		}
+	}
+	return found
+}
+
+// hasClosingQuote reports whether s contains quote, not escaped by a backslash.
+func hasClosingQuote(s string, quote byte) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == quote && (i == 0 || s[i-1] != '\\') {
+			return true
+		}
+	}
+	return false
+}
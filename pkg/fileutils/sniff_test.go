@@ -0,0 +1,81 @@
+package fileutils
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestSniffFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected FileFormat
+	}{
+		{"json", `{"_ESEC_PUBLIC_KEY": "abc", "secret": "x"}`, Ejson},
+		{"jsonc", "{\n  // comment\n  \"secret\": \"x\",\n}", Ejsonc},
+		{"yaml", "_ESEC_PUBLIC_KEY: abc\nsecret: x\n", Eyaml},
+		{"yaml nested", "# comment\ndb:\n  password: x\n", Eyaml},
+		{"toml", "_ESEC_PUBLIC_KEY = \"abc\"\n\n[db]\npassword = \"x\"\n", Etoml},
+		{"dotenv", "# comment\nESEC_PUBLIC_KEY=abc\nexport SECRET=x y\n", Env},
+		{"dotenv multiline", "ESEC_PUBLIC_KEY=abc\nCERT=\"-----BEGIN-----\nabc\n-----END-----\"\n", Env},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := SniffFormat([]byte(tt.data))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, format)
+		})
+	}
+}
+
+func TestSniffFormat_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"empty", "", ErrUnknownFormat},
+		{"comments only", "# nothing here\n", ErrUnknownFormat},
+		{"plain text", "just some text\n", ErrUnknownFormat},
+		{"json array", `["a", "b"]`, ErrUnknownFormat},
+		{"dotenv or toml", "ESEC_PUBLIC_KEY=\"abc\"\nSECRET=\"x\"\n", ErrAmbiguousFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := SniffFormat([]byte(tt.data))
+			assert.IsError(t, err, tt.err)
+		})
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	ambiguous := []byte("ESEC_PUBLIC_KEY=\"abc\"\n")
+	tests := []struct {
+		name     string
+		data     []byte
+		expected FileFormat
+	}{
+		// The name wins over the content
+		{"/path/to/.eyaml.prod", []byte(`{"a": "b"}`), Eyaml},
+		{"config/secrets.prod.yaml", []byte("a: b\n"), Eyaml},
+		{"config/secrets.json", []byte(`{"a": "b"}`), Ejson},
+		// The usual extension settles ambiguous content
+		{"config/secrets.toml", ambiguous, Etoml},
+		{"config/prod.env", ambiguous, Env},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := DetectFormat(tt.name, tt.data)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, format)
+		})
+	}
+
+	_, err := DetectFormat("config/secrets", ambiguous)
+	assert.IsError(t, err, ErrAmbiguousFormat)
+	assert.Contains(t, err.Error(), ".env or .etoml")
+}
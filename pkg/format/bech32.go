@@ -0,0 +1,216 @@
+package format
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Prefixes of age X25519 keys, which are bech32-encoded (BIP 173) 32-byte
+// Curve25519 keys. Recipients are lowercase and identities are uppercase.
+const (
+	// AgeRecipientPrefix starts an age X25519 recipient (public key).
+	AgeRecipientPrefix = "age1"
+	// AgeIdentityPrefix starts an age X25519 identity (private key).
+	AgeIdentityPrefix = "AGE-SECRET-KEY-1"
+
+	ageRecipientHRP = "age"
+	ageIdentityHRP  = "age-secret-key-"
+)
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var bech32Generator = []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+// IsAgeKey reports whether ks looks like an age recipient or identity.
+func IsAgeKey(ks string) bool {
+	return strings.HasPrefix(ks, AgeRecipientPrefix) || strings.HasPrefix(ks, AgeIdentityPrefix)
+}
+
+// EncodeAgeRecipient encodes a Curve25519 public key as an age recipient.
+func EncodeAgeRecipient(key [32]byte) string {
+	s, _ := bech32Encode(ageRecipientHRP, key[:])
+	return s
+}
+
+// EncodeAgeIdentity encodes a Curve25519 private key as an age identity.
+func EncodeAgeIdentity(key [32]byte) string {
+	s, _ := bech32Encode(ageIdentityHRP, key[:])
+	return strings.ToUpper(s)
+}
+
+// parseAgeKey decodes an age recipient or identity into its 32-byte key.
+func parseAgeKey(ks string) ([32]byte, error) {
+	var key [32]byte
+	err := decodeAgeKey(key[:], []byte(ks))
+	return key, err
+}
+
+// decodeAgeKey decodes an age recipient or identity into dst, which must be 32
+// bytes long. Intermediate buffers are wiped, so decoding an identity leaves
+// no copies of the key behind.
+func decodeAgeKey(dst []byte, ks []byte) error {
+	hrp, data, err := bech32Decode(ks)
+	defer func() { clear(data) }()
+	if err != nil {
+		return fmt.Errorf("malformed age key: %w", err)
+	}
+	switch {
+	case hrp == ageRecipientHRP && bytes.HasPrefix(ks, []byte(AgeRecipientPrefix)):
+	case hrp == ageIdentityHRP && bytes.HasPrefix(ks, []byte(AgeIdentityPrefix)):
+	default:
+		return fmt.Errorf("malformed age key: unexpected type %q", hrp)
+	}
+	if len(data) != 32 {
+		return errors.New("malformed age key: key is not 32 bytes long")
+	}
+	copy(dst, data)
+	return nil
+}
+
+func bech32Polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= bech32Generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	h := []byte(strings.ToLower(hrp))
+	ret := make([]byte, 0, len(h)*2+1)
+	for _, c := range h {
+		ret = append(ret, c>>5)
+	}
+	ret = append(ret, 0)
+	for _, c := range h {
+		ret = append(ret, c&31)
+	}
+	return ret
+}
+
+func bech32Checksum(hrp string, data []byte) []byte {
+	values := append(bech32HRPExpand(hrp), data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+	mod := bech32Polymod(values) ^ 1
+	ret := make([]byte, 6)
+	for p := range ret {
+		ret[p] = byte(mod>>uint(5*(5-p))) & 31
+	}
+	return ret
+}
+
+// convertBits regroups data from frombits-wide to tobits-wide groups.
+func convertBits(data []byte, frombits, tobits byte, pad bool) ([]byte, error) {
+	var (
+		ret  = make([]byte, 0, len(data)*int(frombits)/int(tobits)+1)
+		acc  uint32
+		bits byte
+		maxv = byte(1<<tobits - 1)
+	)
+	for _, v := range data {
+		if v>>frombits != 0 {
+			clear(ret)
+			return nil, fmt.Errorf("invalid data range: %d", v)
+		}
+		acc = acc<<frombits | uint32(v)
+		bits += frombits
+		for bits >= tobits {
+			bits -= tobits
+			ret = append(ret, byte(acc>>bits)&maxv)
+		}
+	}
+	if pad {
+		if bits > 0 {
+			ret = append(ret, byte(acc<<(tobits-bits))&maxv)
+		}
+	} else if bits >= frombits {
+		clear(ret)
+		return nil, errors.New("illegal zero padding")
+	} else if byte(acc<<(tobits-bits))&maxv != 0 {
+		clear(ret)
+		return nil, errors.New("non-zero padding")
+	}
+	return ret, nil
+}
+
+// bech32Encode encodes data as a lowercase bech32 string. Unlike BIP 173, the
+// length is not limited to 90 characters, to match age.
+func bech32Encode(hrp string, data []byte) (string, error) {
+	values, err := convertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	if hrp == "" {
+		return "", errors.New("empty human readable part")
+	}
+	hrp = strings.ToLower(hrp)
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, v := range append(values, bech32Checksum(hrp, values)...) {
+		sb.WriteByte(bech32Charset[v])
+	}
+	return sb.String(), nil
+}
+
+// bech32Decode decodes a bech32 string, returning the lowercase human
+// readable part and the data. Mixed-case strings are rejected. The input is
+// not modified or copied, and the caller should wipe the returned data if it
+// is secret.
+func bech32Decode(s []byte) (string, []byte, error) {
+	var hasLower, hasUpper bool
+	for _, c := range s {
+		hasLower = hasLower || 'a' <= c && c <= 'z'
+		hasUpper = hasUpper || 'A' <= c && c <= 'Z'
+	}
+	if hasLower && hasUpper {
+		return "", nil, errors.New("mixed case")
+	}
+	pos := bytes.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errors.New("separator '1' at invalid position")
+	}
+	for _, c := range s[:pos] {
+		if c < 33 || c > 126 {
+			return "", nil, fmt.Errorf("invalid character in human readable part: %q", c)
+		}
+	}
+	hrp := strings.ToLower(string(s[:pos]))
+
+	data := make([]byte, 0, len(s)-pos-1)
+	defer func() { clear(data) }()
+	for _, c := range s[pos+1:] {
+		d := strings.IndexByte(bech32Charset, lowerASCII(c))
+		if d == -1 {
+			return "", nil, fmt.Errorf("invalid character in data part: %q", c)
+		}
+		data = append(data, byte(d))
+	}
+	values := append(bech32HRPExpand(hrp), data...)
+	defer clear(values)
+	if bech32Polymod(values) != 1 {
+		return "", nil, errors.New("invalid checksum")
+	}
+
+	decoded, err := convertBits(data[:len(data)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, decoded, nil
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
@@ -0,0 +1,99 @@
+package format
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/mscno/esec/pkg/crypto"
+)
+
+// Generated with filippo.io/age v1.2.0.
+const (
+	testAgeIdentity  = "AGE-SECRET-KEY-19K97YGJWN8UQ2DCL3MM0K2FQQDSEZ8S68NEWP8K359XSPDDQAQUQD9YJLS"
+	testAgeRecipient = "age12y2arxyah6h6kl6xxnvphvcxrtuxg5s7mgqvm933k8yfvjtz0dqq3nu86j"
+)
+
+func TestParseAgeKey(t *testing.T) {
+	t.Run("identity roundtrips", func(t *testing.T) {
+		key, err := ParseKey(testAgeIdentity)
+		assert.NoError(t, err)
+		assert.Equal(t, testAgeIdentity, EncodeAgeIdentity(key))
+	})
+
+	t.Run("recipient roundtrips", func(t *testing.T) {
+		key, err := ParseKey(testAgeRecipient)
+		assert.NoError(t, err)
+		assert.Equal(t, testAgeRecipient, EncodeAgeRecipient(key))
+	})
+
+	tests := []struct {
+		name   string
+		input  string
+		errMsg string
+	}{
+		{"bad checksum", testAgeRecipient[:len(testAgeRecipient)-1] + "q", "invalid checksum"},
+		{"mixed case", "age1" + strings.ToUpper(testAgeRecipient[4:]), "mixed case"},
+		{"lowercase identity", strings.ToLower(testAgeIdentity), "not 64 characters"},
+		{"truncated", testAgeRecipient[:20], "invalid checksum"},
+		{"invalid character", "age1b" + testAgeRecipient[5:], "invalid character"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKey(tt.input)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestParsePublicKeyRejectsPrivateKeys(t *testing.T) {
+	_, err := ParsePublicKey(testAgeRecipient)
+	assert.NoError(t, err)
+
+	hybrid, err := crypto.GenerateHybridKey()
+	assert.NoError(t, err)
+	for _, ks := range []string{testAgeIdentity, strings.ToLower(testAgeIdentity), hybrid.String()} {
+		_, err := ParsePublicKey(ks)
+		assert.IsError(t, err, ErrPublicKeyInvalid)
+		assert.Contains(t, err.Error(), "got a private key")
+		assert.NotContains(t, err.Error(), ks)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	t.Run("hex", func(t *testing.T) {
+		hexKey := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+		want, err := ParseKey(hexKey)
+		assert.NoError(t, err)
+		key, err := ParsePrivateKey([]byte(hexKey))
+		assert.NoError(t, err)
+		defer key.Destroy()
+		assert.Equal(t, want[:], key.Bytes())
+	})
+
+	t.Run("age identity", func(t *testing.T) {
+		want, err := ParseKey(testAgeIdentity)
+		assert.NoError(t, err)
+		key, err := ParsePrivateKey([]byte(testAgeIdentity))
+		assert.NoError(t, err)
+		defer key.Destroy()
+		assert.Equal(t, want[:], key.Bytes())
+	})
+
+	t.Run("hybrid", func(t *testing.T) {
+		priv, err := crypto.GenerateHybridKey()
+		assert.NoError(t, err)
+		key, err := ParsePrivateKey([]byte(priv.String()))
+		assert.NoError(t, err)
+		defer key.Destroy()
+		assert.Equal(t, crypto.HybridPrivateKeySize, key.Len())
+		assert.Equal(t, priv.X25519[:], key.Bytes()[:32])
+		assert.Equal(t, priv.Seed[:], key.Bytes()[32:])
+	})
+
+	for _, bad := range []string{"", "0123", strings.Repeat("zz", 32), testAgeRecipient, crypto.HybridPrivateKeyPrefix + "AAAA"} {
+		_, err := ParsePrivateKey([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,106 @@
+package format
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Directives are comments starting with "esec:" that control which values of
+// a file are encrypted, and how, in formats that have comments.
+const (
+	// PlaintextDirective marks the value that follows it as not secret, so it
+	// is left in plaintext without renaming its key.
+	PlaintextDirective = "esec:plaintext"
+	// EncryptDirective marks the value that follows it as secret, so it is
+	// encrypted even if its key starts with an underscore or does not match
+	// the file's EncryptedRegexDirective.
+	EncryptDirective = "esec:encrypt"
+	// EncryptedRegexDirective, at the top of a file, limits encryption to the
+	// values under keys matching its regular expression argument.
+	EncryptedRegexDirective = "esec:encrypted-regex"
+	// UnencryptedRegexDirective, at the top of a file, leaves the values under
+	// keys matching its regular expression argument in plaintext.
+	UnencryptedRegexDirective = "esec:unencrypted-regex"
+	// PublicKeyDirective, at the top of a file, records the public key its
+	// argument is, for files encrypted without embedding the key under
+	// PublicKeyField, which tools reading them could reject.
+	PublicKeyDirective = "esec:public-key"
+
+	directivePrefix = "esec:"
+
+	// commentMarkers start a comment line: '#' in every format with comments,
+	// ';' and '!' in INI and properties files, and the "//" of HCL files.
+	commentMarkers = "#;!/"
+)
+
+// ParseDirective parses a comment, with or without its leading comment
+// marker, as a directive. It returns the directive name, such as PlaintextDirective, and
+// the argument following an '=' if there is one. Text after the name that is
+// separated by white space is ignored, so directives may be explained inline.
+func ParseDirective(comment string) (name, arg string, ok bool) {
+	s := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(comment), commentMarkers))
+	if !strings.HasPrefix(s, directivePrefix) {
+		return "", "", false
+	}
+	i := strings.IndexAny(s, "= \t")
+	if i < 0 {
+		return s, "", true
+	}
+	if s[i] == '=' {
+		arg = strings.TrimSpace(s[i+1:])
+	}
+	return s[:i], arg, true
+}
+
+// CommentDirective returns the last PlaintextDirective or EncryptDirective in
+// the given comments, each of which may span several lines, or "" if there is
+// none.
+func CommentDirective(comments ...string) string {
+	var directive string
+	for _, comment := range comments {
+		for line := range strings.Lines(comment) {
+			if name, _, ok := ParseDirective(line); ok && (name == PlaintextDirective || name == EncryptDirective) {
+				directive = name
+			}
+		}
+	}
+	return directive
+}
+
+// ExtractHeaderPublicKey returns the public key recorded by a
+// PublicKeyDirective at the top of data, or ErrPublicKeyMissing if there is
+// none.
+func ExtractHeaderPublicKey(data []byte) (string, error) {
+	for _, line := range fileDirectives(data) {
+		if name, arg, _ := ParseDirective(line); name == PublicKeyDirective {
+			if arg == "" {
+				return "", fmt.Errorf("%w: %s directive without a key", ErrPublicKeyInvalid, PublicKeyDirective)
+			}
+			return arg, nil
+		}
+	}
+	return "", ErrPublicKeyMissing
+}
+
+// fileDirectives returns the directives in the comment lines at the top of a
+// file, up to its first line of content. YAML document markers and directives
+// are skipped over.
+func fileDirectives(data []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", line == "---", strings.HasPrefix(line, "%"):
+		case strings.IndexByte(commentMarkers, line[0]) >= 0:
+			if _, _, ok := ParseDirective(line); ok {
+				lines = append(lines, line)
+			}
+		default:
+			return lines
+		}
+	}
+	return lines
+}
@@ -0,0 +1,56 @@
+package format
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseDirective(t *testing.T) {
+	tests := []struct {
+		comment string
+		name    string
+		arg     string
+		ok      bool
+	}{
+		{"# esec:plaintext", PlaintextDirective, "", true},
+		{"#esec:plaintext", PlaintextDirective, "", true},
+		{"  ## esec:plaintext  ", PlaintextDirective, "", true},
+		{"esec:plaintext", PlaintextDirective, "", true},
+		{"# esec:plaintext log level is not secret", PlaintextDirective, "", true},
+		{"# esec:encrypted-regex=^(password|token)$", "esec:encrypted-regex", "^(password|token)$", true},
+		{"# esec:encrypted-regex= a b ", "esec:encrypted-regex", "a b", true},
+		{"; esec:plaintext", PlaintextDirective, "", true},
+		{"! esec:encrypt", EncryptDirective, "", true},
+		{"// esec:plaintext", PlaintextDirective, "", true},
+		{"# a regular comment", "", "", false},
+		{"# plaintext esec:plaintext", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.comment, func(t *testing.T) {
+			name, arg, ok := ParseDirective(tt.comment)
+			if name != tt.name || arg != tt.arg || ok != tt.ok {
+				t.Errorf("ParseDirective(%q) = %q, %q, %v, want %q, %q, %v",
+					tt.comment, name, arg, ok, tt.name, tt.arg, tt.ok)
+			}
+		})
+	}
+}
+
+func TestExtractHeaderPublicKey(t *testing.T) {
+	pub, err := ExtractHeaderPublicKey([]byte("---\n# esec:public-key=abc\n# esec:plaintext\nkey: value\n"))
+	if err != nil || pub != "abc" {
+		t.Errorf("ExtractHeaderPublicKey = %q, %v, want %q", pub, err, "abc")
+	}
+
+	tests := map[string]error{
+		"key: value\n# esec:public-key=abc\n": ErrPublicKeyMissing,
+		"# esec:public-key\nkey: value\n":     ErrPublicKeyInvalid,
+	}
+	for data, want := range tests {
+		if _, err := ExtractHeaderPublicKey([]byte(data)); !errors.Is(err, want) {
+			t.Errorf("ExtractHeaderPublicKey(%q) error = %v, want %v", data, err, want)
+		}
+	}
+}
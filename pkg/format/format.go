@@ -2,9 +2,14 @@
 package format
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
+
+	"github.com/mscno/esec/pkg/crypto"
 )
 
 // Public key field names used in encrypted files.
@@ -20,12 +25,74 @@ const (
 // Each supported file format (dotenv, JSON, etc.) implements this interface.
 type Handler interface {
 	// TransformScalarValues walks the data and applies the given function to each
-	// encryptable value. The function is typically an encrypt or decrypt operation.
+	// encryptable value. The function is typically an encrypt or decrypt operation,
+	// and may be called concurrently (see MapValues).
 	TransformScalarValues(data []byte, fn func([]byte) ([]byte, error)) ([]byte, error)
 	// ExtractPublicKey parses the data and returns the embedded public key.
 	ExtractPublicKey(data []byte) ([32]byte, error)
 }
 
+// RawPublicKeyExtractor is implemented by handlers that can return the
+// embedded public key as written in the file, without parsing it. This lets
+// callers support key types other than the hex-encoded Curve25519 keys
+// returned by Handler.ExtractPublicKey, such as hybrid post-quantum keys.
+type RawPublicKeyExtractor interface {
+	// ExtractRawPublicKey parses the data and returns the embedded public key string.
+	ExtractRawPublicKey(data []byte) (string, error)
+}
+
+// PublicKeyEmbedder is implemented by handlers that can add a public key to
+// data that has none, so that the data records the key it is encrypted to.
+// The built-in handlers all implement it.
+type PublicKeyEmbedder interface {
+	// EmbedPublicKey returns a copy of data with publicKey added at its top
+	// level, under UnderscoredPublicKeyField or PublicKeyField.
+	EmbedPublicKey(data []byte, publicKey string) ([]byte, error)
+}
+
+// LineCommenter is implemented by handlers of formats with line comments, so
+// that directives such as PublicKeyDirective can be added to files. The
+// built-in handlers all implement it.
+type LineCommenter interface {
+	// LineComment returns text as a comment line, such as "# text", or false
+	// if the data has no comments, as in JSON.
+	LineComment(text string) (string, bool)
+}
+
+// PrependLine returns a copy of data with line added at its start, for the
+// PublicKeyEmbedder of formats whose top level starts with the file, or for a
+// LineCommenter's comment. A blank line keeps it apart from data, so that a
+// comment directive at the start of data still applies to the value it
+// preceded.
+func PrependLine(data []byte, line string) []byte {
+	out := append([]byte(line), '\n')
+	if len(data) > 0 && data[0] != '\n' && data[0] != '\r' {
+		out = append(out, '\n')
+	}
+	return append(out, data...)
+}
+
+// RulesHandler is implemented by handlers that can limit encryption to the
+// values selected by Rules. The built-in handlers all implement it.
+type RulesHandler interface {
+	// TransformScalarValuesWithRules is like Handler.TransformScalarValues, but
+	// only applies fn to the values selected by rules, which may be nil.
+	TransformScalarValuesWithRules(data []byte, rules *Rules, fn func([]byte) ([]byte, error)) ([]byte, error)
+}
+
+// TransformScalarValues applies fn to the values of data selected by rules,
+// using h. Rules that limit encryption are an error for a handler that does
+// not implement RulesHandler, rather than being ignored.
+func TransformScalarValues(h Handler, data []byte, rules *Rules, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	if rh, ok := h.(RulesHandler); ok {
+		return rh.TransformScalarValuesWithRules(data, rules, fn)
+	}
+	if rules != nil && (rules.Selective() || rules.UnencryptedRegex != nil || rules.AllScalars) {
+		return nil, fmt.Errorf("%T does not support encryption rules", h)
+	}
+	return h.TransformScalarValues(data, fn)
+}
+
 // ErrPublicKeyMissing indicates that the PublicKeyField key was not found
 // at the top level of the JSON document provided.
 var ErrPublicKeyMissing = errors.New("public key not present in ecfg file")
@@ -38,35 +105,65 @@ var ErrPublicKeyInvalid = errors.New("public key has invalid format")
 // It looks for either "_ESEC_PUBLIC_KEY" (preferred) or "ESEC_PUBLIC_KEY" fields.
 // The type parameter T allows this to work with both map[string]interface{} and map[string]string.
 func ExtractPublicKeyHelper[T any](obj map[string]T) ([32]byte, error) {
-	var (
-		ks string
-		ok bool
-	)
+	ks, err := ExtractRawPublicKeyHelper(obj)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return ParsePublicKey(ks)
+}
+
+// ExtractRawPublicKeyHelper is like ExtractPublicKeyHelper, but returns the
+// public key string without parsing it.
+func ExtractRawPublicKeyHelper[T any](obj map[string]T) (string, error) {
 	var k interface{}
-	k, ok = obj[UnderscoredPublicKeyField]
+	k, ok := obj[UnderscoredPublicKeyField]
 	if !ok {
 		k, ok = obj[PublicKeyField]
 		if !ok {
-			return [32]byte{}, ErrPublicKeyMissing
+			return "", ErrPublicKeyMissing
 		}
 	}
 
-	ks, ok = k.(string)
+	ks, ok := k.(string)
 	if !ok {
-		return [32]byte{}, fmt.Errorf("%w: public key is not a string", ErrPublicKeyInvalid)
+		return "", fmt.Errorf("%w: public key is not a string", ErrPublicKeyInvalid)
 	}
+	return ks, nil
+}
 
+// ParsePublicKey parses a public key extracted from a file or given to
+// encrypt to, wrapping any error in ErrPublicKeyInvalid. Unlike ParseKey, it
+// only accepts hex keys and age recipients ("age1..."): an age identity, or a
+// hybrid private key, is the private key, which must not end up in a file.
+func ParsePublicKey(ks string) ([32]byte, error) {
+	if prefix, ok := privateKeyPrefix(ks); ok {
+		return [32]byte{}, fmt.Errorf("%w: got a private key (%s...) where its public key belongs; keep it secret and give the public key instead", ErrPublicKeyInvalid, prefix)
+	}
 	key, err := ParseKey(ks)
 	if err != nil {
 		return [32]byte{}, fmt.Errorf("%w: %v", ErrPublicKeyInvalid, err)
 	}
-
 	return key, nil
 }
 
-// ParseKey parses a hex-encoded 32-byte key string into a [32]byte array.
-// The input must be exactly 64 hex characters (representing 32 bytes).
+// privateKeyPrefix returns the prefix of ks if it is one of a private key
+// encoding that is told apart from public keys by its prefix alone.
+func privateKeyPrefix(ks string) (string, bool) {
+	for _, prefix := range []string{AgeIdentityPrefix, crypto.HybridPrivateKeyPrefix} {
+		if len(ks) >= len(prefix) && strings.EqualFold(ks[:len(prefix)], prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// ParseKey parses a 32-byte key string into a [32]byte array.
+// The input must be exactly 64 hex characters (representing 32 bytes), an age
+// recipient ("age1...") or an age identity ("AGE-SECRET-KEY-1...").
 func ParseKey(ks string) ([32]byte, error) {
+	if IsAgeKey(ks) {
+		return parseAgeKey(ks)
+	}
 	if len(ks) != 64 {
 		return [32]byte{}, errors.New("public key is not 64 characters long")
 	}
@@ -81,3 +178,46 @@ func ParseKey(ks string) ([32]byte, error) {
 	copy(key[:], bs)
 	return key, nil
 }
+
+// ParsePrivateKey decodes a private key into a new crypto.KeyHandle, which the
+// caller must Destroy. It accepts the same encodings as ParseKey, as well as
+// hybrid private keys (see crypto.HybridPrivateKeyPrefix). The key is decoded
+// from bytes straight into the handle, so unlike ParseKey no copies of the
+// secret are left on the heap; ks itself is not modified.
+func ParsePrivateKey(ks []byte) (*crypto.KeyHandle, error) {
+	switch {
+	case bytes.HasPrefix(ks, []byte(crypto.HybridPrivateKeyPrefix)):
+		enc := ks[len(crypto.HybridPrivateKeyPrefix):]
+		if base64.RawURLEncoding.DecodedLen(len(enc)) != crypto.HybridPrivateKeySize {
+			return nil, fmt.Errorf("%w: hybrid private key has invalid length", crypto.ErrInvalidKeyFormat)
+		}
+		return decodeIntoHandle(crypto.HybridPrivateKeySize, func(dst []byte) error {
+			_, err := base64.RawURLEncoding.Decode(dst, enc)
+			return err
+		})
+	case bytes.HasPrefix(ks, []byte(AgeIdentityPrefix)):
+		return decodeIntoHandle(32, func(dst []byte) error {
+			return decodeAgeKey(dst, ks)
+		})
+	default:
+		if len(ks) != 64 {
+			return nil, errors.New("private key is not 64 characters long")
+		}
+		return decodeIntoHandle(32, func(dst []byte) error {
+			_, err := hex.Decode(dst, ks)
+			return err
+		})
+	}
+}
+
+func decodeIntoHandle(size int, decode func(dst []byte) error) (*crypto.KeyHandle, error) {
+	key, err := crypto.NewKeyHandle(size)
+	if err != nil {
+		return nil, err
+	}
+	if err := decode(key.Bytes()); err != nil {
+		key.Destroy()
+		return nil, err
+	}
+	return key, nil
+}
@@ -2,6 +2,7 @@ package format
 
 import (
 	"errors"
+	"strings"
 	"testing"
 )
 
@@ -276,3 +277,32 @@ func containsString(s, substr string) bool {
 	}
 	return false
 }
+
+// plainHandler is a Handler that does not implement RulesHandler.
+type plainHandler struct{}
+
+func (plainHandler) TransformScalarValues(data []byte, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	return fn(data)
+}
+
+func (plainHandler) ExtractPublicKey([]byte) ([32]byte, error) {
+	return [32]byte{}, nil
+}
+
+func TestTransformScalarValuesWithoutRulesSupport(t *testing.T) {
+	upper := func(b []byte) ([]byte, error) {
+		return []byte(strings.ToUpper(string(b))), nil
+	}
+
+	out, err := TransformScalarValues(plainHandler{}, []byte("a"), nil, upper)
+	if err != nil || string(out) != "A" {
+		t.Errorf("TransformScalarValues() = %q, %v, want %q", out, err, "A")
+	}
+	out, err = TransformScalarValues(plainHandler{}, []byte("a"), &Rules{}, upper)
+	if err != nil || string(out) != "A" {
+		t.Errorf("TransformScalarValues() = %q, %v, want %q", out, err, "A")
+	}
+	if _, err := TransformScalarValues(plainHandler{}, []byte("a"), &Rules{EncryptedPaths: []string{"a"}}, upper); err == nil {
+		t.Error("expected error for rules the handler does not support")
+	}
+}
@@ -0,0 +1,67 @@
+package format
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// MapValues applies fn to every value using a bounded pool of at most
+// GOMAXPROCS workers, and returns the results in the same order as values, so
+// fn must be safe for concurrent use. Handlers use it to encrypt or decrypt
+// the scalar values of a document, collected in document order. The first
+// error, or cancelling ctx, stops the remaining work: values that have not
+// been started yet are skipped, and the error, or ctx.Err(), is returned.
+func MapValues(ctx context.Context, values [][]byte, fn func([]byte) ([]byte, error)) ([][]byte, error) {
+	results := make([][]byte, len(values))
+	if len(values) == 0 {
+		return results, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		next     atomic.Int64
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	workers := min(runtime.GOMAXPROCS(0), len(values))
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(values) {
+					return
+				}
+				if err := ctx.Err(); err != nil {
+					fail(err)
+					return
+				}
+				res, err := fn(values[i])
+				if err != nil {
+					fail(err)
+					return
+				}
+				results[i] = res
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, nil
+}
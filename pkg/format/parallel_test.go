@@ -0,0 +1,101 @@
+package format
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestMapValuesPreservesOrder(t *testing.T) {
+	values := make([][]byte, 1000)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("v%d", i))
+	}
+
+	results, err := MapValues(context.Background(), values, func(v []byte) ([]byte, error) {
+		if v[len(v)-1]%3 == 0 {
+			// Make some values finish out of order
+			time.Sleep(time.Microsecond)
+		}
+		return bytes.ToUpper(v), nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, len(values), len(results))
+	for i, r := range results {
+		assert.Equal(t, fmt.Sprintf("V%d", i), string(r))
+	}
+}
+
+func TestMapValuesEmpty(t *testing.T) {
+	results, err := MapValues(context.Background(), nil, func(v []byte) ([]byte, error) {
+		t.Fatal("fn must not be called")
+		return nil, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(results))
+}
+
+func TestMapValuesBoundsConcurrency(t *testing.T) {
+	var running, peak atomic.Int64
+	values := make([][]byte, 200)
+
+	_, err := MapValues(context.Background(), values, func(v []byte) ([]byte, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Microsecond)
+		return v, nil
+	})
+
+	assert.NoError(t, err)
+	assert.True(t, peak.Load() <= int64(runtime.GOMAXPROCS(0)))
+}
+
+func TestMapValuesStopsOnFirstError(t *testing.T) {
+	testErr := errors.New("boom")
+	var calls atomic.Int64
+	values := make([][]byte, 10000)
+
+	_, err := MapValues(context.Background(), values, func(v []byte) ([]byte, error) {
+		if calls.Add(1) == 5 {
+			return nil, testErr
+		}
+		return v, nil
+	})
+
+	assert.IsError(t, err, testErr)
+	// Work already started may finish, but the rest is skipped
+	assert.True(t, calls.Load() < int64(len(values)))
+}
+
+func TestMapValuesCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls atomic.Int64
+	values := make([][]byte, 10000)
+
+	_, err := MapValues(ctx, values, func(v []byte) ([]byte, error) {
+		if calls.Add(1) == 5 {
+			cancel()
+		}
+		return v, nil
+	})
+
+	assert.IsError(t, err, context.Canceled)
+	assert.True(t, calls.Load() < int64(len(values)))
+
+	_, err = MapValues(ctx, nil, func(v []byte) ([]byte, error) { return v, nil })
+	assert.IsError(t, err, context.Canceled)
+}
@@ -0,0 +1,170 @@
+package format
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Rules select which values of a file are encrypted. The zero value encrypts
+// every value, except those of keys starting with an underscore.
+type Rules struct {
+	// EncryptedRegex, if set, limits encryption to the values under a key
+	// matching it. A match applies to the whole subtree under the key.
+	EncryptedRegex *regexp.Regexp
+	// UnencryptedRegex, if set, leaves the values under a key matching it in
+	// plaintext. A match applies to the whole subtree under the key.
+	UnencryptedRegex *regexp.Regexp
+	// EncryptedPaths, if set, limits encryption to the values under the given
+	// key paths, alongside EncryptedRegex. A path is a list of keys separated
+	// by dots, such as "database.password", where each key may be a pattern
+	// as used by path.Match.
+	EncryptedPaths []string
+	// AllScalars also selects numbers, booleans and dates, in the formats that
+	// have them, rather than only strings. Each is encrypted together with its
+	// type (see EncodeTyped), so that decrypting restores it as it was written
+	// whether or not AllScalars is set. It must only be set when encrypting, as
+	// the values it selects are otherwise plaintext.
+	AllScalars bool
+	// All selects every string value, overriding the other rules, the
+	// underscore prefix and the directives of the file. Decryption uses it,
+	// leaving the values that are not encrypted as they are, so that a file
+	// decrypts the same whatever rules it was encrypted with.
+	All bool
+}
+
+// Selective reports whether the rules limit encryption to some keys, rather
+// than encrypting every value that is not excluded.
+func (r *Rules) Selective() bool {
+	return r != nil && (r.EncryptedRegex != nil || len(r.EncryptedPaths) > 0)
+}
+
+// Validate checks that the patterns in EncryptedPaths are well-formed.
+func (r *Rules) Validate() error {
+	for _, p := range r.EncryptedPaths {
+		for _, key := range strings.Split(p, ".") {
+			if _, err := path.Match(key, ""); err != nil {
+				return fmt.Errorf("invalid encrypted path %q: %v", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// WithFile returns a copy of the rules, with the rules set by directives in
+// the comments at the top of a file applied on top, such as
+// "# esec:encrypted-regex=^(password|token)$". r may be nil.
+func (r *Rules) WithFile(data []byte) (*Rules, error) {
+	rules := &Rules{}
+	if r != nil {
+		*rules = *r
+	}
+	for _, line := range fileDirectives(data) {
+		name, arg, _ := ParseDirective(line)
+		if name != EncryptedRegexDirective && name != UnencryptedRegexDirective {
+			continue
+		}
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s directive: %v", name, err)
+		}
+		if name == EncryptedRegexDirective {
+			rules.EncryptedRegex = re
+		} else {
+			rules.UnencryptedRegex = re
+		}
+	}
+	return rules, nil
+}
+
+// TypedScalars reports whether the rules select non-string scalars. r may be
+// nil.
+func (r *Rules) TypedScalars() bool {
+	return r != nil && r.AllScalars
+}
+
+// Root returns the scope of the top level of a document. r may be nil.
+func (r *Rules) Root() Scope {
+	if r == nil {
+		r = &Rules{}
+	}
+	return Scope{rules: r}
+}
+
+// Scope tracks the rules that apply to a value while walking a document. The
+// nearest PlaintextDirective or EncryptDirective and a match of the rules'
+// regular expressions or paths apply to everything below a key, while the
+// underscore prefix only applies to the key's own value. An EncryptDirective
+// attached to a key overrides its underscore prefix, but one inherited from
+// above does not.
+type Scope struct {
+	rules     *Rules
+	path      []string
+	directive string
+	inherited bool
+	matched   bool
+	excluded  bool
+}
+
+// Enter returns the scope of the value of key, where directive is a directive
+// attached to the key, or "".
+func (s Scope) Enter(key, directive string) Scope {
+	// Copy the path, as sibling scopes share the parent's backing array
+	s.path = append(s.path[:len(s.path):len(s.path)], key)
+	s.inherited = s.directive != ""
+	if re := s.rules.EncryptedRegex; re != nil && re.MatchString(key) {
+		s.matched = true
+	}
+	if re := s.rules.UnencryptedRegex; re != nil && re.MatchString(key) {
+		s.excluded = true
+	}
+	for _, p := range s.rules.EncryptedPaths {
+		if matchPath(p, s.path) {
+			s.matched = true
+		}
+	}
+	return s.Annotate(directive)
+}
+
+// Annotate returns the scope with directive applied, unless it is "". It is
+// used for values that have no key of their own, such as sequence items.
+func (s Scope) Annotate(directive string) Scope {
+	if directive != "" {
+		s.directive = directive
+		s.inherited = false
+	}
+	return s
+}
+
+// Encrypted reports whether a value in the scope is encrypted.
+func (s Scope) Encrypted() bool {
+	if s.rules.All {
+		return true
+	}
+	underscored := len(s.path) > 0 && strings.HasPrefix(s.path[len(s.path)-1], "_")
+	switch s.directive {
+	case PlaintextDirective:
+		return false
+	case EncryptDirective:
+		return !s.inherited || !underscored
+	}
+	if underscored || s.excluded {
+		return false
+	}
+	return !s.rules.Selective() || s.matched
+}
+
+// matchPath reports whether the dot-separated pattern matches the full key
+// path.
+func matchPath(pattern string, keys []string) bool {
+	if strings.Count(pattern, ".")+1 != len(keys) {
+		return false
+	}
+	for i, key := range strings.Split(pattern, ".") {
+		if ok, _ := path.Match(key, keys[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package format
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRulesWithFile(t *testing.T) {
+	var none *Rules
+	rules, err := none.WithFile([]byte("# config\n# esec:encrypted-regex=^(password|token)$\n# esec:unencrypted-regex=^public_\n\nkey: value\n# esec:encrypted-regex=^x$\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.EncryptedRegex == nil || rules.EncryptedRegex.String() != "^(password|token)$" {
+		t.Errorf("unexpected encrypted regex: %v", rules.EncryptedRegex)
+	}
+	if rules.UnencryptedRegex == nil || rules.UnencryptedRegex.String() != "^public_" {
+		t.Errorf("unexpected unencrypted regex: %v", rules.UnencryptedRegex)
+	}
+
+	rules, err = none.WithFile([]byte("key: value\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.EncryptedRegex != nil || rules.UnencryptedRegex != nil {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+
+	if _, err := none.WithFile([]byte("# esec:encrypted-regex=(\n")); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+}
+
+func TestRulesWithFileOverridesBase(t *testing.T) {
+	base := &Rules{
+		EncryptedRegex: regexp.MustCompile("^password$"),
+		EncryptedPaths: []string{"db.*"},
+	}
+	rules, err := base.WithFile([]byte("# esec:encrypted-regex=^token$\nkey: value\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.EncryptedRegex.String() != "^token$" {
+		t.Errorf("unexpected encrypted regex: %v", rules.EncryptedRegex)
+	}
+	if len(rules.EncryptedPaths) != 1 {
+		t.Errorf("unexpected encrypted paths: %v", rules.EncryptedPaths)
+	}
+	if base.EncryptedRegex.String() != "^password$" {
+		t.Errorf("base rules were modified: %v", base.EncryptedRegex)
+	}
+}
+
+func TestRulesValidate(t *testing.T) {
+	if err := (&Rules{EncryptedPaths: []string{"a.b", "a.*", "[ab].c"}}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (&Rules{EncryptedPaths: []string{"a.[b"}}).Validate(); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func TestScope(t *testing.T) {
+	var all *Rules
+	matching := &Rules{EncryptedRegex: regexp.MustCompile("^(password|token)$")}
+	excluding := &Rules{UnencryptedRegex: regexp.MustCompile("^public_")}
+	paths := &Rules{EncryptedPaths: []string{"db.password", "api.*"}}
+
+	tests := []struct {
+		name  string
+		scope Scope
+		want  bool
+	}{
+		{"top level", all.Root(), true},
+		{"key", all.Root().Enter("a", ""), true},
+		{"underscore key", all.Root().Enter("_a", ""), false},
+		{"underscore is not inherited", all.Root().Enter("_a", "").Enter("b", ""), true},
+		{"plaintext", all.Root().Enter("a", PlaintextDirective), false},
+		{"plaintext is inherited", all.Root().Enter("a", PlaintextDirective).Enter("b", ""), false},
+		{"encrypt overrides underscore", all.Root().Enter("_a", EncryptDirective), true},
+		{"inherited encrypt keeps underscore", all.Root().Enter("a", EncryptDirective).Enter("_b", ""), false},
+		{"nearest directive wins", all.Root().Enter("a", PlaintextDirective).Enter("b", EncryptDirective), true},
+		{"annotated item", all.Root().Enter("a", PlaintextDirective).Annotate(EncryptDirective), true},
+		{"regex mismatch", matching.Root().Enter("user", ""), false},
+		{"regex match", matching.Root().Enter("password", ""), true},
+		{"regex match is inherited", matching.Root().Enter("token", "").Enter("value", ""), true},
+		{"encrypt overrides regex", matching.Root().Enter("user", EncryptDirective), true},
+		{"plaintext overrides regex", matching.Root().Enter("password", PlaintextDirective), false},
+		{"unencrypted regex mismatch", excluding.Root().Enter("secret", ""), true},
+		{"unencrypted regex match", excluding.Root().Enter("public_url", ""), false},
+		{"unencrypted regex match is inherited", excluding.Root().Enter("public_urls", "").Enter("api", ""), false},
+		{"encrypt overrides unencrypted regex", excluding.Root().Enter("public_url", EncryptDirective), true},
+		{"path match", paths.Root().Enter("db", "").Enter("password", ""), true},
+		{"path match is inherited", paths.Root().Enter("db", "").Enter("password", "").Enter("primary", ""), true},
+		{"path prefix", paths.Root().Enter("db", ""), false},
+		{"path sibling", paths.Root().Enter("db", "").Enter("user", ""), false},
+		{"path pattern", paths.Root().Enter("api", "").Enter("token", ""), true},
+		{"path at another depth", paths.Root().Enter("x", "").Enter("db", "").Enter("password", ""), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.scope.Encrypted(); got != tt.want {
+				t.Errorf("Encrypted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
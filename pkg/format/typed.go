@@ -0,0 +1,123 @@
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/mscno/esec/pkg/crypto"
+)
+
+// Scalar types of the values encrypted with Rules.AllScalars. The type is
+// encrypted along with the value, so decrypting can restore the value as it
+// was written, rather than as a string.
+const (
+	TypeString   = "str"
+	TypeInt      = "int"
+	TypeFloat    = "float"
+	TypeBool     = "bool"
+	TypeDatetime = "datetime"
+)
+
+// typedPrefix starts a typed plaintext, which is followed by the type, a NUL
+// byte and the value as written in the file.
+const typedPrefix = "\x00esec:"
+
+// typedLiterals restricts the literals of each type to characters that
+// cannot change the structure of a file they are written into unquoted.
+// Handlers check that a literal parses as its type on top of this.
+var typedLiterals = map[string]*regexp.Regexp{
+	TypeInt:      regexp.MustCompile(`^[+-]?[0-9][0-9A-Za-z_]*$`),
+	TypeFloat:    regexp.MustCompile(`^[+-]?\.?[0-9A-Za-z][0-9A-Za-z_.+-]*$`),
+	TypeBool:     regexp.MustCompile(`^[A-Za-z]+$`),
+	TypeDatetime: regexp.MustCompile(`^[0-9][0-9A-Za-z_:.+-]*( [0-9][0-9A-Za-z_:.+-]*)?$`),
+}
+
+// EncodeTyped returns the plaintext to encrypt for a non-string scalar of the
+// given type, written in the file as literal.
+func EncodeTyped(typ string, literal []byte) []byte {
+	out := make([]byte, 0, len(typedPrefix)+len(typ)+1+len(literal))
+	out = append(out, typedPrefix...)
+	out = append(out, typ...)
+	out = append(out, 0)
+	return append(out, literal...)
+}
+
+// EncodeString returns the plaintext to encrypt for a string value. That is
+// the value itself, unless it happens to look like a typed plaintext, in which
+// case it is encoded as a typed string so it decrypts unchanged.
+func EncodeString(value []byte) []byte {
+	if bytes.HasPrefix(value, []byte(typedPrefix)) {
+		return EncodeTyped(TypeString, value)
+	}
+	return value
+}
+
+// DecodeTyped parses a decrypted value encoded by EncodeTyped or EncodeString.
+// It returns the type and the literal, or an empty type if value is a plain
+// string. A typed value with an unknown type, or a literal that could not have
+// been written unquoted, is an error.
+func DecodeTyped(value []byte) (typ string, literal []byte, err error) {
+	rest, ok := bytes.CutPrefix(value, []byte(typedPrefix))
+	if !ok {
+		return "", value, nil
+	}
+	t, literal, ok := bytes.Cut(rest, []byte{0})
+	if !ok {
+		return "", nil, fmt.Errorf("invalid typed value: missing type")
+	}
+	typ = string(t)
+	if typ == TypeString {
+		return typ, literal, nil
+	}
+	re, ok := typedLiterals[typ]
+	if !ok {
+		return "", nil, fmt.Errorf("invalid typed value: unknown type %q", typ)
+	}
+	if !re.Match(literal) {
+		return "", nil, fmt.Errorf("invalid typed value: %q is not a valid %s", literal, typ)
+	}
+	return typ, literal, nil
+}
+
+// aliasesType marks a plaintext bound to the paths it appears at (see
+// EncodeAliases). It is not a scalar type, and DecodeTyped rejects it.
+const aliasesType = "aliases"
+
+// EncodeAliases returns the plaintext to encrypt for a value, as encoded by
+// EncodeString or EncodeTyped, that appears at several paths of a document
+// through aliases. The paths are encrypted along with the value, so that
+// DecodeAliases can tell when an alias was pointed at it afterwards. A value
+// that is already encrypted is returned as it is.
+func EncodeAliases(value []byte, paths [][]string) []byte {
+	if crypto.IsBoxedMessage(value) {
+		return value
+	}
+	encoded, _ := json.Marshal(paths) // Marshaling strings cannot fail
+	out := make([]byte, 0, len(typedPrefix)+len(aliasesType)+len(encoded)+2+len(value))
+	out = append(out, typedPrefix...)
+	out = append(out, aliasesType...)
+	out = append(out, 0)
+	out = append(out, encoded...)
+	out = append(out, 0)
+	return append(out, value...)
+}
+
+// DecodeAliases parses a decrypted value encoded by EncodeAliases, returning
+// the value and the paths it was encrypted with. ok is false if value is not
+// bound to paths, in which case it is returned as it is.
+func DecodeAliases(value []byte) (inner []byte, paths [][]string, ok bool, err error) {
+	rest, ok := bytes.CutPrefix(value, []byte(typedPrefix+aliasesType+"\x00"))
+	if !ok {
+		return value, nil, false, nil
+	}
+	encoded, inner, ok := bytes.Cut(rest, []byte{0})
+	if !ok {
+		return nil, nil, false, fmt.Errorf("invalid aliased value: missing paths")
+	}
+	if err := json.Unmarshal(encoded, &paths); err != nil {
+		return nil, nil, false, fmt.Errorf("invalid aliased value: %v", err)
+	}
+	return inner, paths, true, nil
+}
@@ -0,0 +1,96 @@
+package format
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeTyped(t *testing.T) {
+	tests := []struct {
+		typ     string
+		literal string
+	}{
+		{TypeInt, "8080"},
+		{TypeInt, "-0x1F"},
+		{TypeInt, "1_000"},
+		{TypeFloat, "3.5e-2"},
+		{TypeFloat, ".inf"},
+		{TypeFloat, "-nan"},
+		{TypeBool, "true"},
+		{TypeBool, "False"},
+		{TypeDatetime, "1979-05-27T07:32:00Z"},
+		{TypeDatetime, "1979-05-27 07:32:00.999999-07:00"},
+		{TypeDatetime, "07:32:00"},
+		{TypeString, "any\x00thing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.typ+" "+tt.literal, func(t *testing.T) {
+			typ, literal, err := DecodeTyped(EncodeTyped(tt.typ, []byte(tt.literal)))
+			if err != nil {
+				t.Fatalf("DecodeTyped() error = %v", err)
+			}
+			if typ != tt.typ || string(literal) != tt.literal {
+				t.Errorf("DecodeTyped() = %q, %q, want %q, %q", typ, literal, tt.typ, tt.literal)
+			}
+		})
+	}
+}
+
+func TestEncodeString(t *testing.T) {
+	for _, value := range []string{"", "plain", "\x00esec:int\x008080", "\x00esec:"} {
+		encoded := EncodeString([]byte(value))
+		typ, literal, err := DecodeTyped(encoded)
+		if err != nil {
+			t.Fatalf("DecodeTyped(%q) error = %v", encoded, err)
+		}
+		if string(literal) != value || (typ != "" && typ != TypeString) {
+			t.Errorf("DecodeTyped(EncodeString(%q)) = %q, %q", value, typ, literal)
+		}
+	}
+	if v := []byte("plain"); !bytes.Equal(EncodeString(v), v) {
+		t.Error("EncodeString should not change ordinary strings")
+	}
+}
+
+func TestDecodeTypedInvalid(t *testing.T) {
+	for _, value := range []string{
+		"\x00esec:int",
+		"\x00esec:complex\x001+2i",
+		"\x00esec:int\x001, \"admin\": true",
+		"\x00esec:int\x00",
+		"\x00esec:bool\x00true\nadmin: true",
+		"\x00esec:datetime\x001979-05-27 # x",
+		"\x00esec:float\x00[1]",
+	} {
+		if _, _, err := DecodeTyped([]byte(value)); err == nil {
+			t.Errorf("DecodeTyped(%q) expected error", value)
+		}
+	}
+}
+
+func TestEncodeAliases(t *testing.T) {
+	paths := [][]string{{"base", "user"}, {"prod", "list", "[0]"}}
+	value := EncodeTyped(TypeInt, []byte("8080"))
+
+	inner, got, ok, err := DecodeAliases(EncodeAliases(value, paths))
+	if err != nil || !ok {
+		t.Fatalf("DecodeAliases() = %v, %v", ok, err)
+	}
+	if !bytes.Equal(inner, value) || len(got) != 2 || got[1][2] != "[0]" {
+		t.Errorf("DecodeAliases() = %q, %q", inner, got)
+	}
+
+	// Unbound and encrypted values are left as they are
+	if inner, _, ok, err := DecodeAliases([]byte("plain")); ok || err != nil || string(inner) != "plain" {
+		t.Errorf("DecodeAliases(plain) = %q, %v, %v", inner, ok, err)
+	}
+	boxed := []byte("ESEC[1:KR1IxNZnTZQMP3OR1NdOpDQ1IcLD83FSuE7iVNzINDk=:XnYW1HOxMthBFMnxWULHlnY4scj5mNmX:ls1+kvwwu2ETz5C6apgWE7Q=]")
+	if !bytes.Equal(EncodeAliases(boxed, paths), boxed) {
+		t.Error("EncodeAliases should not change encrypted values")
+	}
+
+	if _, _, err := DecodeTyped(EncodeAliases([]byte("v"), paths)); err == nil {
+		t.Error("DecodeTyped should reject values bound to paths")
+	}
+}
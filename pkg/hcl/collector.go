@@ -0,0 +1,239 @@
+package hcl
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/mscno/esec/pkg/format"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// comment is a comment of an HCL file, with the directive it holds, if any.
+type comment struct {
+	start     int
+	end       int
+	directive string
+}
+
+// comments returns the comments of an HCL file in source order.
+func comments(data []byte) []comment {
+	tokens, _ := hclsyntax.LexConfig(data, "", hcl.InitialPos)
+	var out []comment
+	for _, tok := range tokens {
+		if tok.Type != hclsyntax.TokenComment {
+			continue
+		}
+		text := string(tok.Bytes)
+		if strings.HasPrefix(text, "/*") {
+			text = strings.TrimSuffix(strings.TrimPrefix(text, "/*"), "*/")
+		}
+		out = append(out, comment{
+			start:     tok.Range.Start.Byte,
+			end:       tok.Range.End.Byte,
+			directive: format.CommentDirective(text),
+		})
+	}
+	return out
+}
+
+// collector collects the replacements of the values of an HCL file.
+type collector struct {
+	data         []byte
+	comments     []comment
+	typed        bool
+	replacements []replacement
+}
+
+// body collects the values of the attributes and blocks of body.
+func (c *collector) body(body *hclsyntax.Body, scope format.Scope) {
+	for name, attr := range body.Attributes {
+		if name == format.PublicKeyField || name == format.UnderscoredPublicKeyField {
+			continue
+		}
+		rng := attr.SrcRange
+		c.expr(attr.Expr, scope.Enter(name, c.directive(rng.Start.Byte, rng.End.Byte)))
+	}
+	for _, block := range body.Blocks {
+		// Block headers are not encrypted, but start the scope of their contents
+		blockScope := scope.Enter(block.Type, "")
+		for _, label := range block.Labels {
+			blockScope = blockScope.Enter(label, "")
+		}
+		directive := c.directive(block.TypeRange.Start.Byte, block.OpenBraceRange.End.Byte)
+		c.body(block.Body, blockScope.Annotate(directive))
+	}
+}
+
+// expr collects the string literals in expr, and its other literals if typed
+// scalars are selected, recursing into objects and lists.
+func (c *collector) expr(expr hclsyntax.Expression, scope format.Scope) {
+	switch e := expr.(type) {
+	case *hclsyntax.TemplateExpr:
+		value, ok := stringLiteral(e)
+		if !ok || !scope.Encrypted() {
+			return
+		}
+		// An empty heredoc has no line to write a value on, so it is quoted
+		h, ok := parseHeredoc(c.data[e.SrcRange.Start.Byte:e.SrcRange.End.Byte])
+		if !ok || !strings.HasSuffix(value, "\n") {
+			c.add(e.SrcRange, format.EncodeString([]byte(value)))
+			return
+		}
+		// The line break ending the last line belongs to the heredoc, so a
+		// value written back inside it keeps the same lines
+		c.add(e.SrcRange, format.EncodeString([]byte(strings.TrimSuffix(value, "\n"))))
+		c.replacements[len(c.replacements)-1].heredoc = h
+
+	case *hclsyntax.LiteralValueExpr:
+		if !c.typed || !scope.Encrypted() {
+			return
+		}
+		literal := c.data[e.SrcRange.Start.Byte:e.SrcRange.End.Byte]
+		switch e.Val.Type() {
+		case cty.Number:
+			typ := format.TypeInt
+			if bytes.ContainsAny(literal, ".eE") {
+				typ = format.TypeFloat
+			}
+			c.add(e.SrcRange, format.EncodeTyped(typ, literal))
+		case cty.Bool:
+			c.add(e.SrcRange, format.EncodeTyped(format.TypeBool, literal))
+		}
+
+	case *hclsyntax.TupleConsExpr:
+		for _, elem := range e.Exprs {
+			c.expr(elem, scope)
+		}
+
+	case *hclsyntax.ObjectConsExpr:
+		for _, item := range e.Items {
+			key, ok := objectKey(item.KeyExpr)
+			if !ok || key == format.PublicKeyField || key == format.UnderscoredPublicKeyField {
+				continue
+			}
+			directive := c.directive(item.KeyExpr.Range().Start.Byte, item.ValueExpr.Range().End.Byte)
+			c.expr(item.ValueExpr, scope.Enter(key, directive))
+		}
+	}
+}
+
+// add records the replacement of the source range rng with the transformed
+// value.
+func (c *collector) add(rng hcl.Range, value []byte) {
+	c.replacements = append(c.replacements, replacement{
+		start: rng.Start.Byte,
+		end:   rng.End.Byte,
+		value: value,
+	})
+}
+
+// directive returns the directive applying to the source between start and
+// end: a directive in a comment after it on the same line, or else the last
+// directive of the comment lines directly above it.
+func (c *collector) directive(start, end int) string {
+	var above string
+	next := start
+	for i := len(c.comments) - 1; i >= 0; i-- {
+		cm := c.comments[i]
+		switch {
+		case cm.start >= end:
+			if !bytes.ContainsAny(c.data[end:cm.start], "\r\n") && cm.directive != "" {
+				return cm.directive
+			}
+		case cm.end <= next:
+			gap := c.data[cm.end:next]
+			if len(bytes.TrimSpace(gap)) > 0 || blankLine(c.data[cm.start:cm.end], gap) || !startsLine(c.data, cm.start) {
+				// Anything but the comment lines directly above belongs elsewhere
+				return above
+			}
+			if above == "" {
+				above = cm.directive
+			}
+			next = cm.start
+		}
+	}
+	return above
+}
+
+// blankLine reports whether a blank line separates a comment from what
+// follows it after gap. Line comments end with their line break.
+func blankLine(comment, gap []byte) bool {
+	n := bytes.Count(gap, []byte("\n"))
+	if bytes.HasSuffix(comment, []byte("\n")) {
+		n++
+	}
+	return n > 1
+}
+
+// startsLine reports whether only white space precedes p on its line.
+func startsLine(data []byte, p int) bool {
+	lineStart := bytes.LastIndexAny(data[:p], "\r\n") + 1
+	return len(bytes.TrimSpace(data[lineStart:p])) == 0
+}
+
+// objectKey returns the name of an object key: an identifier or a string
+// literal. Keys computed from other expressions are not known.
+func objectKey(expr hclsyntax.Expression) (string, bool) {
+	if key, ok := expr.(*hclsyntax.ObjectConsKeyExpr); ok {
+		if name := hcl.ExprAsKeyword(key); name != "" {
+			return name, true
+		}
+		expr = key.Wrapped
+	}
+	return stringLiteral(expr)
+}
+
+// heredoc is the layout of a heredoc string, such as "<<EOT\n...\nEOT".
+type heredoc struct {
+	// open is the opening line, with its line break, and close the closing
+	// marker, with the white space before it.
+	open, close string
+	// indent is the indentation removed from the lines of a "<<-" heredoc.
+	indent string
+}
+
+// parseHeredoc returns the layout of the heredoc raw, if it is one.
+func parseHeredoc(raw []byte) (*heredoc, bool) {
+	if !bytes.HasPrefix(raw, []byte("<<")) {
+		return nil, false
+	}
+	first := bytes.IndexByte(raw, '\n')
+	last := bytes.LastIndexByte(raw, '\n')
+	if first < 0 {
+		return nil, false
+	}
+	h := &heredoc{open: string(raw[:first+1]), close: string(raw[last+1:])}
+	if bytes.HasPrefix(raw, []byte("<<-")) && last > first {
+		// HCL removes the indentation the lines have in common
+		for i, line := range strings.Split(string(raw[first+1:last]), "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+			if i == 0 || len(indent) < len(h.indent) {
+				h.indent = indent
+			}
+		}
+	}
+	return h, true
+}
+
+// format returns value written as the heredoc, or quoted if it has a line
+// that would end the heredoc early.
+func (h *heredoc) format(value string) string {
+	marker := strings.TrimSpace(h.close)
+	lines := strings.Split(value, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == marker {
+			return quoteHCLString(value)
+		}
+		line = escapeTemplates(line)
+		if line != "" {
+			line = h.indent + line
+		}
+		lines[i] = line
+	}
+	return h.open + strings.Join(lines, "\n") + "\n" + h.close
+}
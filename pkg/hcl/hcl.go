@@ -0,0 +1,282 @@
+// Package hcl provides a Handler implementation for .ehcl and .etfvars
+// (encrypted HCL and Terraform variable definitions) files.
+package hcl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/mscno/esec/pkg/format"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Formatter implements format.Handler for .ehcl and .etfvars (encrypted HCL
+// and Terraform variable definitions) files. It handles encryption and
+// decryption of string literals in attributes, objects and lists while
+// preserving comments, blocks, expressions and the overall file structure.
+type Formatter struct{}
+
+// replacement tracks a value replacement
+type replacement struct {
+	start int
+	end   int
+	value []byte
+	// raw is set if value is a typed literal, to be written unquoted
+	raw bool
+	// heredoc is set if the value was written as a heredoc, which it is
+	// written back as
+	heredoc *heredoc
+}
+
+// Parse returns the top-level attributes of an HCL file whose values are
+// string literals. Attributes with other values, including strings with
+// interpolations, and blocks are skipped.
+func Parse(data []byte) (map[string]string, error) {
+	body, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(body.Attributes))
+	for name, attr := range body.Attributes {
+		if value, ok := stringLiteral(attr.Expr); ok {
+			values[name] = value
+		}
+	}
+	return values, nil
+}
+
+// ExtractPublicKey parses the HCL data and returns the ESEC_PUBLIC_KEY value.
+// It looks for either "_ESEC_PUBLIC_KEY" or "ESEC_PUBLIC_KEY" top-level
+// attributes.
+func (f *Formatter) ExtractPublicKey(data []byte) ([32]byte, error) {
+	ks, err := f.ExtractRawPublicKey(data)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return format.ParsePublicKey(ks)
+}
+
+// ExtractRawPublicKey is like ExtractPublicKey, but returns the public key
+// string without parsing it.
+func (f *Formatter) ExtractRawPublicKey(data []byte) (string, error) {
+	body, err := parse(data)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range []string{format.UnderscoredPublicKeyField, format.PublicKeyField} {
+		if attr, ok := body.Attributes[name]; ok {
+			value, ok := stringLiteral(attr.Expr)
+			if !ok {
+				return "", fmt.Errorf("%w: public key is not a string", format.ErrPublicKeyInvalid)
+			}
+			return value, nil
+		}
+	}
+	return "", format.ErrPublicKeyMissing
+}
+
+// EmbedPublicKey adds a _ESEC_PUBLIC_KEY attribute at the top of data.
+func (f *Formatter) EmbedPublicKey(data []byte, publicKey string) ([]byte, error) {
+	return format.PrependLine(data, format.UnderscoredPublicKeyField+" = "+quoteHCLString(publicKey)), nil
+}
+
+// LineComment returns text as a "#" comment.
+func (f *Formatter) LineComment(text string) (string, bool) {
+	return "# " + text, true
+}
+
+// TransformScalarValues applies fn to each string literal of the HCL data: the
+// values of attributes, in blocks too, and the values in the objects and lists
+// they hold. Like the other formats, attributes and object keys starting with
+// an underscore, which include _ESEC_PUBLIC_KEY, are left in plaintext, as is
+// ESEC_PUBLIC_KEY. Strings with interpolations or template directives, object
+// keys and other expressions are left as they are.
+//
+// Comment directives choose values without renaming keys. A "# esec:plaintext"
+// or "# esec:encrypt" comment, or one starting with "//" or in "/* */", above
+// an attribute, object item or block, or after it on the same line, leaves its
+// values in plaintext or encrypts them, overriding the underscore rule. The
+// values of a block are under its type and labels, so rules may select them
+// by path. See format.Rules.
+//
+// Values are replaced in place, so everything else in the file is preserved.
+// The results are written as quoted strings, except for the values of
+// heredocs, which are written back inside the same "<<EOT" and "EOT" lines,
+// with the indentation of a "<<-EOT" heredoc, so decrypting restores them as
+// they were. A value that cannot be written in its heredoc is quoted.
+//
+// Values are transformed concurrently (see format.MapValues).
+func (f *Formatter) TransformScalarValues(data []byte, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	return f.TransformScalarValuesWithRules(data, nil, fn)
+}
+
+// TransformScalarValuesWithRules is like TransformScalarValues, but only
+// transforms the values selected by rules, with the file's own directives
+// applied on top. It implements format.RulesHandler.
+func (f *Formatter) TransformScalarValuesWithRules(data []byte, rules *format.Rules, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	body, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err = rules.WithFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &collector{
+		data:     data,
+		comments: comments(data),
+		typed:    rules.TypedScalars(),
+	}
+	c.body(body, rules.Root())
+	replacements := c.replacements
+
+	// Transform the collected values in parallel
+	values := make([][]byte, len(replacements))
+	for i, r := range replacements {
+		values[i] = r.value
+	}
+	transformed, err := format.MapValues(context.Background(), values, fn)
+	if err != nil {
+		return nil, err
+	}
+	// Values left unchanged keep the way they were written
+	changed := replacements[:0]
+	for i, r := range replacements {
+		if bytes.Equal(transformed[i], values[i]) {
+			continue
+		}
+		typ, literal, err := format.DecodeTyped(transformed[i])
+		if err != nil {
+			return nil, err
+		}
+		if typ != "" && typ != format.TypeString {
+			if err := checkLiteral(typ, literal); err != nil {
+				return nil, err
+			}
+			r.raw = true
+		}
+		r.value = literal
+		changed = append(changed, r)
+	}
+	replacements = changed
+
+	// Splice the new values into the original data in source order
+	sort.Slice(replacements, func(i, j int) bool {
+		return replacements[i].start < replacements[j].start
+	})
+	var buffer bytes.Buffer
+	buffer.Grow(len(data))
+	pos := 0
+	for _, r := range replacements {
+		buffer.Write(data[pos:r.start])
+		switch {
+		case r.raw:
+			buffer.Write(r.value)
+		case r.heredoc != nil:
+			buffer.WriteString(r.heredoc.format(string(r.value)))
+		default:
+			buffer.WriteString(quoteHCLString(string(r.value)))
+		}
+		pos = r.end
+	}
+	buffer.Write(data[pos:])
+
+	return buffer.Bytes(), nil
+}
+
+// parse parses an HCL file in native syntax.
+func parse(data []byte) (*hclsyntax.Body, error) {
+	file, diags := hclsyntax.ParseConfig(data, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("invalid hcl: %v", diags.Error())
+	}
+	return file.Body.(*hclsyntax.Body), nil
+}
+
+// stringLiteral returns the value of expr if it is a string literal: a quoted
+// string or heredoc without interpolations or template directives.
+func stringLiteral(expr hclsyntax.Expression) (string, bool) {
+	tmpl, ok := expr.(*hclsyntax.TemplateExpr)
+	if !ok {
+		return "", false
+	}
+	var b strings.Builder
+	for _, part := range tmpl.Parts {
+		lit, ok := part.(*hclsyntax.LiteralValueExpr)
+		if !ok || lit.Val.Type() != cty.String || lit.Val.IsNull() {
+			return "", false
+		}
+		b.WriteString(lit.Val.AsString())
+	}
+	return b.String(), true
+}
+
+// checkLiteral checks that a decrypted typed literal is an HCL value of the
+// given type.
+func checkLiteral(typ string, literal []byte) error {
+	expr, diags := hclsyntax.ParseExpression(literal, "", hcl.InitialPos)
+	if !diags.HasErrors() {
+		if lit, ok := expr.(*hclsyntax.LiteralValueExpr); ok {
+			switch t := lit.Val.Type(); typ {
+			case format.TypeInt, format.TypeFloat:
+				if t == cty.Number {
+					return nil
+				}
+			case format.TypeBool:
+				if t == cty.Bool {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("invalid typed value: %q is not an HCL %s", literal, typ)
+}
+
+// escapeTemplates escapes "${" and "%{" as "$${" and "%%{" so that they are
+// not read as a template.
+func escapeTemplates(s string) string {
+	return templateEscaper.Replace(s)
+}
+
+var templateEscaper = strings.NewReplacer("${", "$${", "%{", "%%{")
+
+// quoteHCLString quotes a string for HCL output. "${" and "%{" are escaped as
+// "$${" and "%%{" so that they are not read as a template.
+func quoteHCLString(s string) string {
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for i, r := range s {
+		switch r {
+		case '\t':
+			buf.WriteString("\\t")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case '"':
+			buf.WriteString("\\\"")
+		case '\\':
+			buf.WriteString("\\\\")
+		case '$', '%':
+			buf.WriteRune(r)
+			if strings.HasPrefix(s[i+1:], "{") {
+				buf.WriteRune(r)
+			}
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&buf, "\\u%04x", r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
@@ -0,0 +1,245 @@
+package hcl
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mscno/esec/pkg/format"
+)
+
+func TestTransformScalarValues(t *testing.T) {
+	bracketFn := func(b []byte) ([]byte, error) {
+		return []byte("[" + string(b) + "]"), nil
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		fn    func([]byte) ([]byte, error)
+		want  string
+	}{
+		{
+			name:  "top-level attributes",
+			input: "db_password = \"secret\"\nregion      = \"eu-west-1\"\n",
+			want:  "db_password = \"[secret]\"\nregion      = \"[eu-west-1]\"\n",
+		},
+		{
+			name:  "objects and lists",
+			input: "users = {\n  admin = \"pw1\"\n  \"ops team\" = [\"pw2\", \"pw3\"]\n}\n",
+			want:  "users = {\n  admin = \"[pw1]\"\n  \"ops team\" = [\"[pw2]\", \"[pw3]\"]\n}\n",
+		},
+		{
+			name:  "blocks",
+			input: "resource \"aws_db_instance\" \"main\" {\n  password = \"secret\"\n}\n",
+			want:  "resource \"aws_db_instance\" \"main\" {\n  password = \"[secret]\"\n}\n",
+		},
+		{
+			name:  "preserves comments and other expressions",
+			input: "# comment\na = \"x\" // inline\nb = 42\nc = true\nd = var.name\ne = \"${var.name}-suffix\"\nf = upper(\"x\")\n",
+			want:  "# comment\na = \"[x]\" // inline\nb = 42\nc = true\nd = var.name\ne = \"${var.name}-suffix\"\nf = upper(\"x\")\n",
+		},
+		{
+			name:  "skips public key and underscored keys",
+			input: "_ESEC_PUBLIC_KEY = \"abc\"\nESEC_PUBLIC_KEY = \"def\"\n_region = \"eu\"\ntags = { _env = \"prod\", owner = \"me\" }\n",
+			want:  "_ESEC_PUBLIC_KEY = \"abc\"\nESEC_PUBLIC_KEY = \"def\"\n_region = \"eu\"\ntags = { _env = \"prod\", owner = \"[me]\" }\n",
+		},
+		{
+			name:  "directives",
+			input: "# esec:plaintext\nregion = \"eu\"\n// esec:encrypt\n_token = \"t\"\nhost = \"h\" /* esec:plaintext */\nport = \"1\" # esec:plaintext\nname = \"n\"\n",
+			want:  "# esec:plaintext\nregion = \"eu\"\n// esec:encrypt\n_token = \"[t]\"\nhost = \"h\" /* esec:plaintext */\nport = \"1\" # esec:plaintext\nname = \"[n]\"\n",
+		},
+		{
+			name:  "directive separated by a blank line",
+			input: "# esec:plaintext\n\nkey = \"value\"\n",
+			want:  "# esec:plaintext\n\nkey = \"[value]\"\n",
+		},
+		{
+			name:  "block directives",
+			input: "# esec:plaintext\nlocals {\n  a = \"x\"\n  # esec:encrypt\n  b = \"y\"\n}\n",
+			want:  "# esec:plaintext\nlocals {\n  a = \"x\"\n  # esec:encrypt\n  b = \"[y]\"\n}\n",
+		},
+		{
+			name:  "escaped templates",
+			input: "a = \"$${literal} %%{x}\"\n",
+			fn: func(b []byte) ([]byte, error) {
+				return b, nil
+			},
+			want: "a = \"$${literal} %%{x}\"\n",
+		},
+		{
+			name:  "unchanged values are kept as they were",
+			input: "cert = <<EOT\nline1\nline2\nEOT\nnext = \"v\\u0041\"\n",
+			fn: func(b []byte) ([]byte, error) {
+				return b, nil
+			},
+			want: "cert = <<EOT\nline1\nline2\nEOT\nnext = \"v\\u0041\"\n",
+		},
+		{
+			name:  "heredocs are written back as heredocs",
+			input: "cert = <<EOT\nline1\nline2\nEOT\nkey = <<-EOT\n    a\n      b\n    EOT\n",
+			want:  "cert = <<EOT\n[line1\nline2]\nEOT\nkey = <<-EOT\n    [a\n      b]\n    EOT\n",
+		},
+		{
+			name:  "heredocs that cannot hold the result are quoted",
+			input: "cert = <<EOT\nline1\nEOT\n",
+			fn: func(b []byte) ([]byte, error) {
+				return []byte("x\nEOT\ny"), nil
+			},
+			want: "cert = \"x\\nEOT\\ny\"\n",
+		},
+		{
+			name:  "results are quoted",
+			input: "a = \"1\"\n",
+			fn: func(b []byte) ([]byte, error) {
+				return []byte("say \"${hi}\"\\\n"), nil
+			},
+			want: "a = \"say \\\"$${hi}\\\"\\\\\\n\"\n",
+		},
+	}
+
+	formatter := &Formatter{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := tt.fn
+			if fn == nil {
+				fn = bracketFn
+			}
+			result, err := formatter.TransformScalarValues([]byte(tt.input), fn)
+			if err != nil {
+				t.Fatalf("TransformScalarValues() unexpected error = %v", err)
+			}
+			if string(result) != tt.want {
+				t.Errorf("TransformScalarValues() = %q, want %q", string(result), tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformScalarValuesWithRules(t *testing.T) {
+	bracketFn := func(b []byte) ([]byte, error) {
+		return []byte("[" + string(b) + "]"), nil
+	}
+	rules := &format.Rules{
+		EncryptedPaths:   []string{"module.db.*"},
+		UnencryptedRegex: regexp.MustCompile("^host$"),
+	}
+
+	in := "name = \"app\"\nmodule \"db\" {\n  host = \"localhost\"\n  password = \"secret\"\n}\n"
+	result, err := (&Formatter{}).TransformScalarValuesWithRules([]byte(in), rules, bracketFn)
+	if err != nil {
+		t.Fatalf("TransformScalarValuesWithRules() unexpected error = %v", err)
+	}
+	want := "name = \"app\"\nmodule \"db\" {\n  host = \"localhost\"\n  password = \"[secret]\"\n}\n"
+	if string(result) != want {
+		t.Errorf("TransformScalarValuesWithRules() = %q, want %q", string(result), want)
+	}
+}
+
+func TestTransformScalarValuesRoundtrip(t *testing.T) {
+	input := `// Terraform variables
+db_password = "p@ss\"word\\1"
+api_keys    = ["k1", "k2"]
+settings = {
+  region  = "eu-west-1" # primary
+  replica = { host = "db2", port = 5432 }
+}
+greeting = "Hello, ${name}"
+escaped  = "$${not_a_template}"
+enabled  = true
+cert = <<EOT
+-----BEGIN CERTIFICATE-----
+  $${literal}
+
+-----END CERTIFICATE-----
+EOT
+script = <<-EOT
+    set -e
+      echo "%%{x}"
+    EOT
+blank = <<EOT
+
+EOT
+`
+	encrypt := func(b []byte) ([]byte, error) {
+		return []byte("E:" + hex.EncodeToString(b)), nil
+	}
+	decrypt := func(b []byte) ([]byte, error) {
+		return hex.DecodeString(strings.TrimPrefix(string(b), "E:"))
+	}
+
+	formatter := &Formatter{}
+	encrypted, err := formatter.TransformScalarValuesWithRules([]byte(input), &format.Rules{AllScalars: true}, encrypt)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if strings.Contains(string(encrypted), "5432") || strings.Contains(string(encrypted), "true") {
+		t.Errorf("typed scalars not encrypted:\n%s", encrypted)
+	}
+	decrypted, err := formatter.TransformScalarValues(encrypted, decrypt)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if string(decrypted) != input {
+		t.Errorf("roundtrip changed the file:\ngot:\n%s\nwant:\n%s", decrypted, input)
+	}
+
+	got, err := Parse(decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"db_password": `p@ss"word\1`,
+		"escaped":     "${not_a_template}",
+		"cert":        "-----BEGIN CERTIFICATE-----\n  ${literal}\n\n-----END CERTIFICATE-----\n",
+		"script":      "set -e\n  echo \"%{x}\"\n",
+		"blank":       "\n",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() = %q, want %q", got, want)
+	}
+}
+
+func TestTransformScalarValuesErrors(t *testing.T) {
+	identityFn := func(b []byte) ([]byte, error) {
+		return b, nil
+	}
+	formatter := &Formatter{}
+	if _, err := formatter.TransformScalarValues([]byte("a = \"unterminated\n"), identityFn); err == nil {
+		t.Error("TransformScalarValues() expected error for invalid hcl, got nil")
+	}
+
+	// A typed value must decrypt to a literal of its type
+	in := "port = 5432\n"
+	_, err := formatter.TransformScalarValuesWithRules([]byte(in), &format.Rules{AllScalars: true}, func(b []byte) ([]byte, error) {
+		return format.EncodeTyped(format.TypeInt, []byte("var.x")), nil
+	})
+	if err == nil {
+		t.Error("TransformScalarValuesWithRules() expected error for invalid typed literal, got nil")
+	}
+}
+
+func TestExtractPublicKey(t *testing.T) {
+	formatter := &Formatter{}
+	in := "# keys\n_ESEC_PUBLIC_KEY = \"6d79b7e50073e5e66a4581ed08bf1d9a03806cc4648cffeb6df71b5775e5eb08\"\nkey = \"value\"\n"
+	key, err := formatter.ExtractPublicKey([]byte(in))
+	if err != nil {
+		t.Fatalf("ExtractPublicKey() unexpected error = %v", err)
+	}
+	if hex.EncodeToString(key[:]) != "6d79b7e50073e5e66a4581ed08bf1d9a03806cc4648cffeb6df71b5775e5eb08" {
+		t.Errorf("ExtractPublicKey() = %x", key)
+	}
+
+	// The public key must be a top-level attribute
+	in = "locals {\n  _ESEC_PUBLIC_KEY = \"6d79b7e50073e5e66a4581ed08bf1d9a03806cc4648cffeb6df71b5775e5eb08\"\n}\n"
+	if _, err := formatter.ExtractPublicKey([]byte(in)); !errors.Is(err, format.ErrPublicKeyMissing) {
+		t.Errorf("ExtractPublicKey() error = %v, want %v", err, format.ErrPublicKeyMissing)
+	}
+
+	if _, err := formatter.ExtractPublicKey([]byte("_ESEC_PUBLIC_KEY = 42\n")); !errors.Is(err, format.ErrPublicKeyInvalid) {
+		t.Errorf("ExtractPublicKey() error = %v, want %v", err, format.ErrPublicKeyInvalid)
+	}
+}
@@ -0,0 +1,203 @@
+// Package ini provides a Handler implementation for .eini (encrypted INI) files.
+package ini
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/mscno/esec/pkg/format"
+)
+
+// Formatter implements format.Handler for .eini (encrypted INI) files.
+// It handles encryption and decryption of values while preserving comments,
+// sections, quoting, line continuations and the overall file structure.
+type Formatter struct{}
+
+// Parse returns the values of an INI file by section, with the pairs before
+// the first section header under "". Values are unquoted and their line
+// continuations joined. Later pairs override earlier ones with the same key.
+func Parse(data []byte) (map[string]map[string]string, error) {
+	entries, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	sections := map[string]map[string]string{"": {}}
+	for _, e := range entries {
+		if sections[e.section] == nil {
+			sections[e.section] = map[string]string{}
+		}
+		sections[e.section][e.key] = unquote(data, e)
+	}
+	return sections, nil
+}
+
+// ExtractPublicKey parses the INI data and returns the ESEC_PUBLIC_KEY value.
+// It looks for either "ESEC_PUBLIC_KEY" or "_ESEC_PUBLIC_KEY" keys before the
+// first section header.
+func (f *Formatter) ExtractPublicKey(data []byte) ([32]byte, error) {
+	ks, err := f.ExtractRawPublicKey(data)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return format.ParsePublicKey(ks)
+}
+
+// ExtractRawPublicKey is like ExtractPublicKey, but returns the public key
+// string without parsing it.
+func (f *Formatter) ExtractRawPublicKey(data []byte) (string, error) {
+	sections, err := Parse(data)
+	if err != nil {
+		return "", err
+	}
+	return format.ExtractRawPublicKeyHelper(sections[""])
+}
+
+// EmbedPublicKey adds a _ESEC_PUBLIC_KEY key at the top of data, before any
+// section.
+func (f *Formatter) EmbedPublicKey(data []byte, publicKey string) ([]byte, error) {
+	return format.PrependLine(data, format.UnderscoredPublicKeyField+" = "+publicKey), nil
+}
+
+// LineComment returns text as a ";" comment.
+func (f *Formatter) LineComment(text string) (string, bool) {
+	return "; " + text, true
+}
+
+// TransformScalarValues applies fn to the value of each key-value pair in the
+// INI data. Like the other formats, keys starting with an underscore, which
+// include _ESEC_PUBLIC_KEY, are left in plaintext, as is ESEC_PUBLIC_KEY.
+//
+// Comment directives choose values without renaming keys. A "; esec:plaintext"
+// or "; esec:encrypt" comment, or one starting with '#', above a key or section
+// header, or after it on the same line, leaves its values in plaintext or
+// encrypts them, overriding the underscore rule. A "; esec:encrypted-regex=<re>"
+// comment at the top of the file limits encryption to the values under keys,
+// including section names, matching re, and "; esec:unencrypted-regex=<re>"
+// leaves them in plaintext. See format.Rules.
+//
+// fn receives a value as written, inside its quotes if it is quoted and with
+// the line continuations of an unquoted value, and the result is written back
+// inside the same quotes. Values are interpreted when the decrypted file is
+// parsed, so decrypting restores the original text exactly. Results that
+// would not read back as they are, such as ones containing an inline comment
+// in place of an unquoted value, are quoted instead, and it is an error if no
+// quotes can hold them.
+//
+// Values are transformed concurrently (see format.MapValues).
+func (f *Formatter) TransformScalarValues(data []byte, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	return f.TransformScalarValuesWithRules(data, nil, fn)
+}
+
+// TransformScalarValuesWithRules is like TransformScalarValues, but only
+// transforms the values selected by rules, with the file's own directives
+// applied on top. It implements format.RulesHandler.
+func (f *Formatter) TransformScalarValuesWithRules(data []byte, rules *format.Rules, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	entries, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err = rules.WithFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the public key and plaintext keys and collect the other values
+	var actionable []entry
+	for _, e := range entries {
+		if e.key == format.PublicKeyField || e.key == format.UnderscoredPublicKeyField {
+			continue
+		}
+		scope := rules.Root()
+		if e.section != "" {
+			scope = scope.Enter(e.section, "").Annotate(e.sectionDirective)
+		}
+		if !scope.Enter(e.key, e.directive).Encrypted() {
+			continue
+		}
+		actionable = append(actionable, e)
+	}
+
+	values := make([][]byte, len(actionable))
+	for i, e := range actionable {
+		values[i] = format.EncodeString(data[e.start:e.end])
+	}
+	transformed, err := format.MapValues(context.Background(), values, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Splice the new values into the original data
+	var buffer bytes.Buffer
+	buffer.Grow(len(data))
+	pos := 0
+	for i, e := range actionable {
+		// Every value is a string here, so a typed value keeps its literal
+		_, value, err := format.DecodeTyped(transformed[i])
+		if err != nil {
+			return nil, err
+		}
+		start, end := e.start, e.end
+		if !fitsValue(value, e.quote) {
+			start, end = start-len(e.quote), end+len(e.quote)
+			if value, err = quote(value); err != nil {
+				return nil, fmt.Errorf("value of %q: %w", e.key, err)
+			}
+		}
+		buffer.Write(data[pos:start])
+		buffer.Write(value)
+		pos = end
+	}
+	buffer.Write(data[pos:])
+
+	return buffer.Bytes(), nil
+}
+
+// fitsValue reports whether v can be written as it is in place of a value
+// quoted with q, or an unquoted value if q is empty, and parse back unchanged.
+func fitsValue(v []byte, q string) bool {
+	switch q {
+	case tripleQuote:
+		return !bytes.Contains(v, []byte(tripleQuote)) && !bytes.HasSuffix(v, []byte(`"`))
+	case "":
+	default:
+		return !bytes.Contains(v, []byte(q)) && !bytes.ContainsAny(v, "\r\n")
+	}
+
+	if len(v) == 0 {
+		return true
+	}
+	if bytes.Count(v, []byte("\r")) != bytes.Count(v, []byte("\r\n")) {
+		return false
+	}
+	if isBlank(v[0]) || v[0] == '"' || v[0] == '\'' || isBlank(v[len(v)-1]) || v[len(v)-1] == '\\' {
+		return false
+	}
+	// Each line but the last must end in a backslash continuing it, and none
+	// may contain an inline comment
+	for line := range bytes.Lines(v) {
+		text := bytes.TrimRight(line, "\r\n")
+		if inlineComment(text) >= 0 {
+			return false
+		}
+		if len(text) < len(line) && !bytes.HasSuffix(bytes.TrimRight(text, " \t"), []byte(`\`)) {
+			return false
+		}
+	}
+	return true
+}
+
+// quote renders v as a quoted value: double- or single-quoted if it is on one
+// line and does not contain the quote, or else triple-quoted.
+func quote(v []byte) ([]byte, error) {
+	for _, q := range []string{`"`, `'`, tripleQuote} {
+		if fitsValue(v, q) {
+			out := make([]byte, 0, len(v)+2*len(q))
+			out = append(out, q...)
+			out = append(out, v...)
+			return append(out, q...), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot quote %q in an INI file", v)
+}
@@ -0,0 +1,232 @@
+package ini
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/mscno/esec/pkg/format"
+)
+
+// tripleQuote delimits values that may span several lines.
+const tripleQuote = `"""`
+
+// entry is a key-value pair of an INI file. start and end delimit the value in
+// the source, inside its quotes if it is quoted. section is the name of the
+// section the pair belongs to, or "" before the first section header.
+// directive is the format.PlaintextDirective or format.EncryptDirective
+// comment preceding the pair or after it on the same line, if any, and
+// sectionDirective the one of the section header.
+type entry struct {
+	section          string
+	sectionDirective string
+	key              string
+	start            int
+	end              int
+	quote            string
+	directive        string
+}
+
+// parse tokenizes an INI file. Lines starting with ';' or '#' are comments,
+// and "[name]" lines start a section. Other lines are "key = value" or
+// "key: value" pairs, and keys without a value, which are skipped. A value
+// may be quoted with double or single quotes, or with """ to span several
+// lines. An unquoted value ends at a ';' or '#' preceded by white space, which
+// starts an inline comment, or else at the end of the line, unless the line
+// ends in a backslash to continue the value on the next line. White space
+// around keys and values is ignored.
+//
+// A format.PlaintextDirective or format.EncryptDirective comment applies to the
+// next pair or section, unless a blank line comes first, or to the pair or
+// section it follows on the same line.
+func parse(data []byte) ([]entry, error) {
+	var (
+		entries          []entry
+		section          string
+		sectionDirective string
+		directive        string
+	)
+	for p, line := 0, 1; p < len(data); line++ {
+		end := lineEnd(data, p)
+		text := bytes.TrimSpace(data[p:end])
+		switch {
+		case len(text) == 0:
+			// A blank line separates a directive from what follows it
+			directive = ""
+		case text[0] == ';' || text[0] == '#':
+			if d := format.CommentDirective(string(text)); d != "" {
+				directive = d
+			}
+		case text[0] == '[':
+			close := bytes.IndexByte(text, ']')
+			if close < 0 {
+				return nil, fmt.Errorf("invalid ini: line %d: unterminated section header", line)
+			}
+			rest := bytes.TrimSpace(text[close+1:])
+			if len(rest) > 0 && rest[0] != ';' && rest[0] != '#' {
+				return nil, fmt.Errorf("invalid ini: line %d: unexpected %q after section header", line, rest)
+			}
+			section = string(bytes.TrimSpace(text[1:close]))
+			sectionDirective, directive = directive, ""
+			if d := format.CommentDirective(string(rest)); d != "" {
+				sectionDirective = d
+			}
+		case bytes.IndexAny(text, "=:") < 0:
+			// A key without a value has nothing to encrypt
+			directive = ""
+		default:
+			e, next, err := parsePair(data, p, line)
+			if err != nil {
+				return nil, err
+			}
+			e.section, e.sectionDirective = section, sectionDirective
+			if e.directive == "" {
+				e.directive = directive
+			}
+			directive = ""
+			entries = append(entries, e)
+			line += bytes.Count(data[p:next], []byte("\n")) - 1
+			p = next
+			continue
+		}
+		p = nextLine(data, end)
+	}
+	return entries, nil
+}
+
+// parsePair parses the key-value pair on the line starting at p, returning it
+// and the offset of the line following the value.
+func parsePair(data []byte, p, line int) (entry, int, error) {
+	end := lineEnd(data, p)
+	sep := bytes.IndexAny(data[p:end], "=:")
+	e := entry{key: string(bytes.TrimSpace(data[p : p+sep]))}
+	if e.key == "" {
+		return entry{}, 0, fmt.Errorf("invalid ini: line %d: missing key", line)
+	}
+
+	start := skipBlank(data, p+sep+1)
+	var commentStart int
+	switch {
+	case bytes.HasPrefix(data[start:], []byte(tripleQuote)):
+		close := bytes.Index(data[start+len(tripleQuote):], []byte(tripleQuote))
+		if close < 0 {
+			return entry{}, 0, fmt.Errorf("invalid ini: line %d: unterminated %s value of %q", line, tripleQuote, e.key)
+		}
+		e.quote = tripleQuote
+		e.start = start + len(tripleQuote)
+		e.end = e.start + close
+		commentStart = e.end + len(tripleQuote)
+		end = lineEnd(data, commentStart)
+	case start < end && (data[start] == '"' || data[start] == '\''):
+		close := bytes.IndexByte(data[start+1:end], data[start])
+		if close < 0 {
+			return entry{}, 0, fmt.Errorf("invalid ini: line %d: unterminated quoted value of %q", line, e.key)
+		}
+		e.quote = string(data[start])
+		e.start = start + 1
+		e.end = e.start + close
+		commentStart = e.end + 1
+	default:
+		e.start = start
+		e.end, end = unquotedEnd(data, start)
+		commentStart = e.end
+	}
+
+	rest := bytes.TrimSpace(data[commentStart:end])
+	if len(rest) > 0 && rest[0] != ';' && rest[0] != '#' {
+		return entry{}, 0, fmt.Errorf("invalid ini: line %d: unexpected %q after value of %q", line, rest, e.key)
+	}
+	e.directive = format.CommentDirective(string(rest))
+	return e, nextLine(data, end), nil
+}
+
+// unquotedEnd returns the end of the unquoted value starting at p, without the
+// white space around it, and the end of the line it ends on.
+func unquotedEnd(data []byte, p int) (int, int) {
+	for {
+		end := lineEnd(data, p)
+		if c := inlineComment(data[p:end]); c >= 0 {
+			return trimRight(data, p, p+c), end
+		}
+		valueEnd := trimRight(data, p, end)
+		if valueEnd == p || data[valueEnd-1] != '\\' || end == len(data) {
+			return valueEnd, end
+		}
+		p = nextLine(data, end)
+	}
+}
+
+// inlineComment returns the offset of the ';' or '#' starting a comment in the
+// line, or -1 if there is none.
+func inlineComment(line []byte) int {
+	for i := 1; i < len(line); i++ {
+		if (line[i] == ';' || line[i] == '#') && isBlank(line[i-1]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// unquote returns the value of an entry as an application reads it: the text
+// inside its quotes, or the unquoted text with its line continuations joined.
+func unquote(data []byte, e entry) string {
+	raw := data[e.start:e.end]
+	if e.quote != "" {
+		return string(raw)
+	}
+	var b strings.Builder
+	for {
+		i := bytes.IndexAny(raw, "\r\n")
+		if i < 0 {
+			b.Write(raw)
+			return b.String()
+		}
+		// The line ends in the backslash continuing it
+		text := bytes.TrimRight(raw[:i], " \t")
+		b.Write(text[:len(text)-1])
+		raw = raw[skipBlank(raw, nextLine(raw, i)):]
+	}
+}
+
+// trimRight returns the offset after the last byte of data[start:end] that is
+// not white space.
+func trimRight(data []byte, start, end int) int {
+	for end > start && isBlank(data[end-1]) {
+		end--
+	}
+	return end
+}
+
+// skipBlank returns the offset of the first byte from p that is not a space
+// or tab.
+func skipBlank(data []byte, p int) int {
+	for p < len(data) && isBlank(data[p]) {
+		p++
+	}
+	return p
+}
+
+// lineEnd returns the offset of the line break ending the line containing p,
+// or the end of data.
+func lineEnd(data []byte, p int) int {
+	for p < len(data) && !isLineBreak(data[p]) {
+		p++
+	}
+	return p
+}
+
+// nextLine returns the offset just past the line break at p, which may be
+// "\r\n", or p if it is the end of data.
+func nextLine(data []byte, p int) int {
+	if p >= len(data) {
+		return p
+	}
+	if data[p] == '\r' && p+1 < len(data) && data[p+1] == '\n' {
+		return p + 2
+	}
+	return p + 1
+}
+
+func isBlank(c byte) bool { return c == ' ' || c == '\t' }
+
+func isLineBreak(c byte) bool { return c == '\n' || c == '\r' }
@@ -4,4 +4,17 @@ package json
 // Formatter implements format.Handler for .ejson (encrypted JSON) files.
 // It handles encryption and decryption of string values in JSON documents while
 // preserving the document structure, formatting, and non-string values.
-type Formatter struct{}
+type Formatter struct {
+	// JSONC accepts // and /* */ comments and trailing commas, as in .ejsonc
+	// files. They are kept byte for byte when values are transformed.
+	JSONC bool
+}
+
+// standardize returns data as standard JSON, with the comments and trailing
+// commas of a JSONC document blanked out if f.JSONC is set.
+func (f *Formatter) standardize(data []byte) []byte {
+	if f.JSONC {
+		return Standardize(data)
+	}
+	return data
+}
@@ -0,0 +1,95 @@
+package json
+
+// Standardize returns a copy of data, a JSONC document, with its comments and
+// trailing commas replaced by spaces, so it can be parsed as standard JSON.
+// Line breaks within block comments are kept, so every byte of the result is
+// at the same offset, line and column as in data. Anything that is not valid
+// JSONC is left for the JSON parser to reject.
+func Standardize(data []byte) []byte {
+	out := make([]byte, len(data))
+	copy(out, data)
+	stripComments(out)
+	stripTrailingCommas(out)
+	return out
+}
+
+// stripComments blanks out the // and /* */ comments of data in place.
+func stripComments(data []byte) {
+	for i := 0; i < len(data); i++ {
+		switch {
+		case data[i] == '"':
+			i = stringEnd(data, i)
+		case data[i] == '/' && i+1 < len(data) && data[i+1] == '/':
+			for ; i < len(data) && data[i] != '\n' && data[i] != '\r'; i++ {
+				data[i] = ' '
+			}
+		case data[i] == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := commentEnd(data, i+2)
+			if end < 0 {
+				// Unterminated, so the parser fails on it
+				return
+			}
+			for ; i < end; i++ {
+				if data[i] != '\n' && data[i] != '\r' {
+					data[i] = ' '
+				}
+			}
+			i--
+		}
+	}
+}
+
+// stripTrailingCommas blanks out, in place, the commas of data that follow a
+// value and are directly followed by the end of an object or array.
+func stripTrailingCommas(data []byte) {
+	prev := -1
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '"':
+			i = stringEnd(data, i)
+		case ',':
+			next := i + 1
+			for next < len(data) && isJSONSpace(data[next]) {
+				next++
+			}
+			closes := next < len(data) && (data[next] == '}' || data[next] == ']')
+			afterValue := prev >= 0 && data[prev] != '{' && data[prev] != '[' && data[prev] != ','
+			if closes && afterValue {
+				data[i] = ' '
+				continue
+			}
+		}
+		prev = i
+	}
+}
+
+// stringEnd returns the offset of the closing quote of the string starting at
+// start, or the end of data if it is unterminated.
+func stringEnd(data []byte, start int) int {
+	for i := start + 1; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"', '\n':
+			return i
+		}
+	}
+	return len(data) - 1
+}
+
+// commentEnd returns the offset just past the */ ending the block comment
+// whose contents start at start, or -1 if there is none.
+func commentEnd(data []byte, start int) int {
+	for i := start; i+1 < len(data); i++ {
+		if data[i] == '*' && data[i+1] == '/' {
+			return i + 2
+		}
+	}
+	return -1
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
@@ -0,0 +1,35 @@
+package json
+
+import (
+	"testing"
+)
+
+func TestStandardize(t *testing.T) {
+	tcs := []struct {
+		name, in, out string
+	}{
+		{"plain json", `{"a": "b", "c": [1, 2]}`, `{"a": "b", "c": [1, 2]}`},
+		{"line comment", "{\"a\": \"b\" // note\n}", "{\"a\": \"b\"        \n}"},
+		{"line comment crlf", "{// note\r\n\"a\": 1}", "{       \r\n\"a\": 1}"},
+		{"block comment", `{/* x */"a": 1}`, `{       "a": 1}`},
+		{"multiline block comment", "{/* x\n y */\"a\": 1}", "{    \n     \"a\": 1}"},
+		{"comment markers in strings", `{"a": "http://x/*y*/", "b": "\"//"}`, `{"a": "http://x/*y*/", "b": "\"//"}`},
+		{"trailing commas", "{\"a\": [1, 2,], \"b\": {\"c\": 3,},\n}", "{\"a\": [1, 2 ], \"b\": {\"c\": 3 } \n}"},
+		{"trailing comma before comment", "{\"a\": 1, // last\n}", "{\"a\": 1         \n}"},
+		{"comma in string", `{"a": ",}"}`, `{"a": ",}"}`},
+		{"empty element", `[1,,]`, `[1,,]`},
+		{"lone comma", `[,]`, `[,]`},
+		{"unterminated block comment", `{"a": 1 /* x`, `{"a": 1 /* x`},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			out := Standardize([]byte(tc.in))
+			if string(out) != tc.out {
+				t.Errorf("unexpected output: %q; wanted %q", out, tc.out)
+			}
+			if len(out) != len(tc.in) {
+				t.Errorf("length changed from %d to %d", len(tc.in), len(out))
+			}
+		})
+	}
+}
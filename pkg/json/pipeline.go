@@ -1,75 +1,58 @@
 package json
 
-type pipeline struct {
-	final        []byte
-	err          error // first error encountered (fail-fast)
-	pendingBytes []byte
-	queue        chan queueItem
-	done         chan struct{}
-}
+import (
+	"context"
 
-type queueItem struct {
-	pr   <-chan promiseResult
-	bs   []byte
-	term bool
-}
+	"github.com/mscno/esec/pkg/format"
+)
 
-type promiseResult struct {
-	bytes []byte
-	err   error
+// pipeline assembles the transformed document. While scanning, verbatim bytes
+// and actionable values are appended in document order; flush then runs the
+// action on all values with a bounded worker pool (see format.MapValues) and
+// splices the results back in order.
+type pipeline struct {
+	// literals[i] is the verbatim text preceding values[i]; the final element
+	// is the text after the last value.
+	literals [][]byte
+	values   [][]byte
+	pending  []byte
 }
 
 func newPipeline() *pipeline {
-	pl := &pipeline{
-		queue: make(chan queueItem, 512),
-		done:  make(chan struct{}),
-	}
-	go pl.run()
-	return pl
-}
-
-func (p *pipeline) run() {
-	for qi := range p.queue {
-		switch {
-		case qi.term:
-			close(p.done)
-		case qi.pr != nil:
-			res := <-qi.pr
-			if res.err != nil && p.err == nil {
-				// Preserve first error (fail-fast semantics)
-				p.err = res.err
-			}
-			p.final = append(p.final, res.bytes...)
-		default:
-			p.final = append(p.final, qi.bs...)
-		}
-	}
+	return &pipeline{}
 }
 
 func (p *pipeline) appendBytes(bs []byte) {
-	p.pendingBytes = append(p.pendingBytes, bs...)
+	p.pending = append(p.pending, bs...)
 }
 
 func (p *pipeline) appendByte(b byte) {
-	p.pendingBytes = append(p.pendingBytes, b)
+	p.pending = append(p.pending, b)
 }
 
-func (p *pipeline) appendPromise(ch <-chan promiseResult) {
-	p.flushPendingBytes()
-	p.queue <- queueItem{pr: ch}
+// appendValue appends a value to be replaced by the result of the action.
+func (p *pipeline) appendValue(v []byte) {
+	p.literals = append(p.literals, p.pending)
+	p.values = append(p.values, v)
+	p.pending = nil
 }
 
-func (p *pipeline) flush() ([]byte, error) {
-	p.flushPendingBytes()
-	p.queue <- queueItem{term: true}
-	<-p.done
-	close(p.queue)
-	return p.final, p.err
-}
+// flush runs action on all values and returns the assembled output. The first
+// error, or cancelling ctx, cancels the remaining actions and is returned.
+func (p *pipeline) flush(ctx context.Context, action func([]byte) ([]byte, error)) ([]byte, error) {
+	results, err := format.MapValues(ctx, p.values, action)
+	if err != nil {
+		return nil, err
+	}
 
-func (p *pipeline) flushPendingBytes() {
-	if len(p.pendingBytes) > 0 {
-		p.queue <- queueItem{bs: p.pendingBytes}
-		p.pendingBytes = nil
+	size := len(p.pending)
+	for i := range results {
+		size += len(p.literals[i]) + len(results[i])
+	}
+	final := make([]byte, 0, size)
+	for i := range results {
+		final = append(final, p.literals[i]...)
+		final = append(final, results[i]...)
 	}
+	return append(final, p.pending...), nil
 }
@@ -1,11 +1,16 @@
 package json
 
 import (
+	"context"
 	"errors"
-	"sync"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+func identity(v []byte) ([]byte, error) { return v, nil }
+
 func TestPipelineBasicAppendBytes(t *testing.T) {
 	pl := newPipeline()
 
@@ -13,7 +18,7 @@ func TestPipelineBasicAppendBytes(t *testing.T) {
 	pl.appendBytes([]byte(" "))
 	pl.appendBytes([]byte("world"))
 
-	result, err := pl.flush()
+	result, err := pl.flush(context.Background(), identity)
 	if err != nil {
 		t.Errorf("flush() unexpected error = %v", err)
 	}
@@ -31,7 +36,7 @@ func TestPipelineAppendByte(t *testing.T) {
 	pl.appendByte('b')
 	pl.appendByte('c')
 
-	result, err := pl.flush()
+	result, err := pl.flush(context.Background(), identity)
 	if err != nil {
 		t.Errorf("flush() unexpected error = %v", err)
 	}
@@ -49,7 +54,7 @@ func TestPipelineMixedBytesAndByte(t *testing.T) {
 	pl.appendByte(',')
 	pl.appendBytes([]byte("world"))
 
-	result, err := pl.flush()
+	result, err := pl.flush(context.Background(), identity)
 	if err != nil {
 		t.Errorf("flush() unexpected error = %v", err)
 	}
@@ -60,42 +65,36 @@ func TestPipelineMixedBytesAndByte(t *testing.T) {
 	}
 }
 
-func TestPipelinePromise(t *testing.T) {
+func TestPipelineValue(t *testing.T) {
 	pl := newPipeline()
 
-	// Create a promise channel
-	promise := make(chan promiseResult, 1)
-
 	pl.appendBytes([]byte("start-"))
-	pl.appendPromise(promise)
+	pl.appendValue([]byte("middle"))
 	pl.appendBytes([]byte("-end"))
 
-	// Send the promise result
-	promise <- promiseResult{bytes: []byte("middle")}
-
-	result, err := pl.flush()
+	result, err := pl.flush(context.Background(), func(v []byte) ([]byte, error) {
+		return []byte(strings.ToUpper(string(v))), nil
+	})
 	if err != nil {
 		t.Errorf("flush() unexpected error = %v", err)
 	}
 
-	expected := "start-middle-end"
+	expected := "start-MIDDLE-end"
 	if string(result) != expected {
 		t.Errorf("flush() = %q, want %q", string(result), expected)
 	}
 }
 
-func TestPipelinePromiseWithError(t *testing.T) {
+func TestPipelineValueWithError(t *testing.T) {
 	pl := newPipeline()
 
-	promise := make(chan promiseResult, 1)
-
 	pl.appendBytes([]byte("start"))
-	pl.appendPromise(promise)
+	pl.appendValue([]byte("value"))
 
 	testErr := errors.New("test error")
-	promise <- promiseResult{err: testErr}
-
-	_, err := pl.flush()
+	_, err := pl.flush(context.Background(), func([]byte) ([]byte, error) {
+		return nil, testErr
+	})
 	if err == nil {
 		t.Error("flush() expected error, got nil")
 	}
@@ -104,27 +103,18 @@ func TestPipelinePromiseWithError(t *testing.T) {
 	}
 }
 
-func TestPipelineMultiplePromises(t *testing.T) {
+func TestPipelineMultipleValues(t *testing.T) {
 	pl := newPipeline()
 
-	promise1 := make(chan promiseResult, 1)
-	promise2 := make(chan promiseResult, 1)
-	promise3 := make(chan promiseResult, 1)
-
 	pl.appendBytes([]byte("["))
-	pl.appendPromise(promise1)
+	pl.appendValue([]byte("1"))
 	pl.appendBytes([]byte(","))
-	pl.appendPromise(promise2)
+	pl.appendValue([]byte("2"))
 	pl.appendBytes([]byte(","))
-	pl.appendPromise(promise3)
+	pl.appendValue([]byte("3"))
 	pl.appendBytes([]byte("]"))
 
-	// Send results in order
-	promise1 <- promiseResult{bytes: []byte("1")}
-	promise2 <- promiseResult{bytes: []byte("2")}
-	promise3 <- promiseResult{bytes: []byte("3")}
-
-	result, err := pl.flush()
+	result, err := pl.flush(context.Background(), identity)
 	if err != nil {
 		t.Errorf("flush() unexpected error = %v", err)
 	}
@@ -135,25 +125,19 @@ func TestPipelineMultiplePromises(t *testing.T) {
 	}
 }
 
-func TestPipelinePromisesMaintainOrder(t *testing.T) {
+func TestPipelineValuesMaintainOrder(t *testing.T) {
 	pl := newPipeline()
 
-	promise1 := make(chan promiseResult, 1)
-	promise2 := make(chan promiseResult, 1)
+	pl.appendValue([]byte("first"))
+	pl.appendValue([]byte("second"))
 
-	pl.appendPromise(promise1)
-	pl.appendPromise(promise2)
-
-	// Send results out of order (promise2 first)
-	// But the pipeline should maintain order based on when appendPromise was called
-	go func() {
-		promise2 <- promiseResult{bytes: []byte("second")}
-	}()
-	go func() {
-		promise1 <- promiseResult{bytes: []byte("first")}
-	}()
-
-	result, err := pl.flush()
+	// The first value finishes last, but the output keeps document order
+	result, err := pl.flush(context.Background(), func(v []byte) ([]byte, error) {
+		if string(v) == "first" {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return v, nil
+	})
 	if err != nil {
 		t.Errorf("flush() unexpected error = %v", err)
 	}
@@ -167,7 +151,7 @@ func TestPipelinePromisesMaintainOrder(t *testing.T) {
 func TestPipelineEmptyFlush(t *testing.T) {
 	pl := newPipeline()
 
-	result, err := pl.flush()
+	result, err := pl.flush(context.Background(), identity)
 	if err != nil {
 		t.Errorf("flush() unexpected error = %v", err)
 	}
@@ -177,61 +161,46 @@ func TestPipelineEmptyFlush(t *testing.T) {
 	}
 }
 
-func TestPipelineConcurrentPromises(t *testing.T) {
+func TestPipelineManyValues(t *testing.T) {
 	pl := newPipeline()
 
-	numPromises := 100
-	promises := make([]chan promiseResult, numPromises)
-
-	for i := 0; i < numPromises; i++ {
-		promises[i] = make(chan promiseResult, 1)
-		pl.appendPromise(promises[i])
-	}
-
-	// Resolve promises concurrently in random order
-	var wg sync.WaitGroup
-	for i := 0; i < numPromises; i++ {
-		wg.Add(1)
-		go func(idx int) {
-			defer wg.Done()
-			promises[idx] <- promiseResult{bytes: []byte("x")}
-		}(i)
+	numValues := 10000
+	for i := 0; i < numValues; i++ {
+		pl.appendValue([]byte("x"))
 	}
 
-	wg.Wait()
-
-	result, err := pl.flush()
+	result, err := pl.flush(context.Background(), identity)
 	if err != nil {
 		t.Errorf("flush() unexpected error = %v", err)
 	}
 
-	// All promises should have been processed
-	if len(result) != numPromises {
-		t.Errorf("flush() returned %d bytes, want %d", len(result), numPromises)
+	// All values should have been processed
+	if len(result) != numValues {
+		t.Errorf("flush() returned %d bytes, want %d", len(result), numValues)
 	}
 }
 
-func TestPipelineFlushPendingBytes(t *testing.T) {
+func TestPipelineStopsOnFirstError(t *testing.T) {
 	pl := newPipeline()
 
-	// This tests the internal flushPendingBytes behavior
-	pl.appendBytes([]byte("pending"))
-
-	// Add a promise, which should flush pending bytes first
-	promise := make(chan promiseResult, 1)
-	pl.appendPromise(promise)
-	promise <- promiseResult{bytes: []byte("-resolved")}
-
-	pl.appendBytes([]byte("-more"))
-
-	result, err := pl.flush()
-	if err != nil {
-		t.Errorf("flush() unexpected error = %v", err)
+	numValues := 10000
+	for i := 0; i < numValues; i++ {
+		pl.appendValue([]byte("x"))
 	}
 
-	expected := "pending-resolved-more"
-	if string(result) != expected {
-		t.Errorf("flush() = %q, want %q", string(result), expected)
+	var calls atomic.Int64
+	testErr := errors.New("test error")
+	_, err := pl.flush(context.Background(), func(v []byte) ([]byte, error) {
+		if calls.Add(1) == 1 {
+			return nil, testErr
+		}
+		return v, nil
+	})
+	if err != testErr {
+		t.Errorf("flush() error = %v, want %v", err, testErr)
+	}
+	if calls.Load() >= int64(numValues) {
+		t.Errorf("flush() ran all %d actions after an error", numValues)
 	}
 }
 
@@ -246,7 +215,7 @@ func TestPipelineLargeData(t *testing.T) {
 
 	pl.appendBytes(largeData)
 
-	result, err := pl.flush()
+	result, err := pl.flush(context.Background(), identity)
 	if err != nil {
 		t.Errorf("flush() unexpected error = %v", err)
 	}
@@ -1,8 +1,10 @@
 package json
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"strconv"
 
 	"github.com/mscno/esec/pkg/format"
 )
@@ -11,11 +13,67 @@ import (
 // It looks for either "_ESEC_PUBLIC_KEY" (preferred) or "ESEC_PUBLIC_KEY" fields
 // at the top level of the JSON document.
 func (f *Formatter) ExtractPublicKey(data []byte) ([32]byte, error) {
+	ks, err := f.ExtractRawPublicKey(data)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return format.ParsePublicKey(ks)
+}
+
+// ExtractRawPublicKey is like ExtractPublicKey, but returns the public key
+// string without parsing it.
+func (f *Formatter) ExtractRawPublicKey(data []byte) (string, error) {
 	// Unmarshal JSON to map structure
 	var obj map[string]interface{}
-	if err := json.Unmarshal(data, &obj); err != nil {
-		return [32]byte{}, fmt.Errorf("invalid json: %v", err)
+	if err := json.Unmarshal(f.standardize(data), &obj); err != nil {
+		return "", fmt.Errorf("invalid json: %v", err)
 	}
 
-	return format.ExtractPublicKeyHelper(obj)
+	return format.ExtractRawPublicKeyHelper(obj)
+}
+
+// EmbedPublicKey adds a "_ESEC_PUBLIC_KEY" member at the start of the
+// top-level object of data, on a line of its own if the next member is.
+func (f *Formatter) EmbedPublicKey(data []byte, publicKey string) ([]byte, error) {
+	std := f.standardize(data)
+	open := 0
+	for open < len(std) && isJSONSpace(std[open]) {
+		open++
+	}
+	if open == len(std) || std[open] != '{' {
+		return nil, fmt.Errorf("invalid json: top level must be an object")
+	}
+	next := open + 1
+	for next < len(std) && isJSONSpace(std[next]) {
+		next++
+	}
+
+	// Lay the member out like the one after it, on its line or its own
+	indent := std[open+1 : next]
+	i := bytes.LastIndexByte(indent, '\n')
+	if i >= 0 {
+		indent = indent[i:]
+	}
+	member := strconv.Quote(format.UnderscoredPublicKeyField) + ": " + strconv.Quote(publicKey)
+	if next < len(std) && std[next] != '}' {
+		member += ","
+		if i < 0 && len(indent) == 0 {
+			member += " "
+		}
+	}
+
+	out := make([]byte, 0, len(data)+len(indent)+len(member))
+	out = append(out, data[:open+1]...)
+	out = append(out, indent...)
+	out = append(out, member...)
+	return append(out, data[open+1:]...), nil
+}
+
+// LineComment returns text as a "//" comment in JSONC, which plain JSON does
+// not have.
+func (f *Formatter) LineComment(text string) (string, bool) {
+	if !f.JSONC {
+		return "", false
+	}
+	return "// " + text, true
 }
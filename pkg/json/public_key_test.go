@@ -17,3 +17,47 @@ func TestKeyExtraction(t *testing.T) {
 		t.Errorf("unexpected key: %#v", key)
 	}
 }
+
+func TestEmbedPublicKey(t *testing.T) {
+	const key = "6d79b7e50073e5e66a4581ed08bf1d9a03806cc4648cffeb6df71b5775e5eb08"
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"inline", `{"a": "b"}`, `{"_ESEC_PUBLIC_KEY": "` + key + `", "a": "b"}`},
+		{"inline spaced", `{ "a": "b" }`, `{ "_ESEC_PUBLIC_KEY": "` + key + `", "a": "b" }`},
+		{"indented", "{\n  \"a\": \"b\"\n}\n", "{\n  \"_ESEC_PUBLIC_KEY\": \"" + key + "\",\n  \"a\": \"b\"\n}\n"},
+		{"empty", "{}", `{"_ESEC_PUBLIC_KEY": "` + key + `"}`},
+		{"leading space", " \n{ }", " \n{ \"_ESEC_PUBLIC_KEY\": \"" + key + "\" }"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := (&Formatter{}).EmbedPublicKey([]byte(tt.in), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("unexpected output: %q", out)
+			}
+		})
+	}
+
+	t.Run("jsonc", func(t *testing.T) {
+		in := "{\n  // esec:plaintext\n  \"a\": \"b\",\n}"
+		out, err := (&Formatter{JSONC: true}).EmbedPublicKey([]byte(in), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "{\n  \"_ESEC_PUBLIC_KEY\": \"" + key + "\",\n  // esec:plaintext\n  \"a\": \"b\",\n}"
+		if string(out) != want {
+			t.Errorf("unexpected output: %q", out)
+		}
+	})
+
+	t.Run("not an object", func(t *testing.T) {
+		if _, err := (&Formatter{}).EmbedPublicKey([]byte(`["a"]`), key); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
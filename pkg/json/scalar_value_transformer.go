@@ -12,9 +12,13 @@ package json
 // useless.
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"regexp"
 
 	json "github.com/dustin/gojson"
+	"github.com/mscno/esec/pkg/format"
 )
 
 // TransformScalarValues walks a JSON document, replacing all actionable nodes
@@ -23,10 +27,11 @@ import (
 // element, and its referencing key doesn't begin with an underscore. For each
 // actionable node, the contents are replaced with the result of Action.
 // Everything else is unchanged, and arbitrary document structure and
-// formatting are preserved.
+// formatting are preserved. If f.JSONC is set, comments and trailing commas
+// are accepted and kept as they are.
 //
 // Note that this  underscore-to-disable-encryption syntax does not propagate
-// down the hierarchy to children.
+// down the hierarchy to children, unlike the matches of format.Rules.
 // That is:
 //   - In {"_a": "b"}, Action will not be run at all.
 //   - In {"a": "b"}, Action will be run with "b", and the return value will
@@ -34,19 +39,39 @@ import (
 //   - In {"k": {"a": ["b"]}, Action will run on "b".
 //   - In {"_k": {"a": ["b"]}, Action run on "b".
 //   - In {"k": {"_a": ["b"]}, Action will not run.
+//
+// Values are transformed concurrently (see format.MapValues).
 func (f *Formatter) TransformScalarValues(
 	data []byte,
 	action func([]byte) ([]byte, error),
+) ([]byte, error) {
+	return f.TransformScalarValuesWithRules(data, nil, action)
+}
+
+// TransformScalarValuesWithRules is like TransformScalarValues, but only
+// transforms the values selected by rules. It implements format.RulesHandler.
+func (f *Formatter) TransformScalarValuesWithRules(
+	data []byte,
+	rules *format.Rules,
+	action func([]byte) ([]byte, error),
 ) ([]byte, error) {
 	var (
 		inLiteral    bool
 		literalStart int
-		isComment    bool
 		scanner      json.Scanner
+		// scope applies to the next value, and containers holds the scopes
+		// of the enclosing objects and arrays.
+		scope      = rules.Root()
+		containers []format.Scope
 	)
 	scanner.Reset()
+	// The document is scanned as standard JSON, but the output is built from
+	// data, so comments are kept.
+	scan := f.standardize(data)
 	pline := newPipeline()
-	for i, c := range data {
+	runAction := withQuoting(action)
+	allScalars := rules.TypedScalars()
+	for i, c := range scan {
 		switch v := scanner.Step(&scanner, int(c)); v {
 		case json.ScanContinue, json.ScanSkipSpace:
 			// Uninteresting byte. Just advance to next.
@@ -54,66 +79,123 @@ func (f *Formatter) TransformScalarValues(
 			inLiteral = true
 			literalStart = i
 		case json.ScanObjectKey:
-			// The literal we just finished reading was a Key. Decide whether it was a
-			// encryptable by checking whether the first byte after the '"' was an
-			// underscore, then append it verbatim to the output buffer.
+			// The literal we just finished reading was a Key. Enter it to decide
+			// whether its value is encryptable, then append it verbatim to the
+			// output buffer.
 			inLiteral = false
-			isComment = data[literalStart+1] == '_'
+			key, ok := json.UnquoteBytes(bytes.TrimSpace(scan[literalStart:i]))
+			if !ok {
+				return nil, fmt.Errorf("invalid json")
+			}
+			scope = containers[len(containers)-1].Enter(string(key), "")
 			pline.appendBytes(data[literalStart:i])
 		case json.ScanError:
 			// Some error happened; just bail.
-			pline.flush()
 			return nil, fmt.Errorf("invalid json")
 		case json.ScanEnd:
-			// We successfully hit the end of input.
-			return pline.flush()
+			// We successfully hit the end of input. Comments after a JSONC
+			// document are kept, along with the white space around them.
+			if f.JSONC && len(bytes.TrimSpace(scan[i:])) == 0 {
+				pline.appendBytes(data[i:])
+			}
+			return pline.flush(context.Background(), runAction)
 		default:
 			if inLiteral {
 				inLiteral = false
 				// We finished reading some literal, and it wasn't a Key, meaning it's
-				// potentially encryptable. If it was a string, and the most recent Key
-				// encountered didn't begin with a '_', we are to encrypt it. In any
-				// other case, we append it verbatim to the output buffer.
-				if isComment || data[literalStart] != '"' {
-					pline.appendBytes(data[literalStart:i])
+				// potentially encryptable. If it was a string, or a number or boolean
+				// with allScalars, and the rules select it, we are to encrypt it. In
+				// any other case, we append it verbatim to the output buffer.
+				// The literal may be followed by white space or comments before the
+				// byte ending it.
+				literal := data[literalStart : literalStart+len(bytes.TrimRight(scan[literalStart:i], " \t\r\n"))]
+				if scope.Encrypted() && (literal[0] == '"' || allScalars && literalType(literal) != "") {
+					pline.appendValue(literal)
 				} else {
-					res := make(chan promiseResult)
-					go func(subData []byte) {
-						actioned, err := runAction(subData, action)
-						res <- promiseResult{actioned, err}
-						close(res)
-					}(data[literalStart:i])
-					pline.appendPromise(res)
+					pline.appendBytes(literal)
+				}
+				pline.appendBytes(data[literalStart+len(literal) : i])
+			}
+			switch v {
+			case json.ScanBeginObject, json.ScanBeginArray:
+				containers = append(containers, scope)
+			case json.ScanEndObject, json.ScanEndArray:
+				containers = containers[:len(containers)-1]
+				if len(containers) > 0 {
+					scope = containers[len(containers)-1]
 				}
+			case json.ScanArrayValue:
+				scope = containers[len(containers)-1]
 			}
 		}
 		if !inLiteral {
 			// If we're in a literal, we save up bytes because we may have to encrypt
 			// them. Outside of a literal, we simply append each byte as we read it.
-			pline.appendByte(c)
+			pline.appendByte(data[i])
 		}
 	}
 	if scanner.EOF() == json.ScanError {
 		// Unexpected EOF => malformed JSON
-		pline.flush()
 		return nil, fmt.Errorf("invalid json")
 	}
-	return pline.flush()
+	return pline.flush(context.Background(), runAction)
 }
 
-func runAction(
-	data []byte,
-	action func([]byte) ([]byte, error),
-) ([]byte, error) {
-	unquoted, ok := json.UnquoteBytes(data)
-	if !ok {
-		return nil, fmt.Errorf("invalid json")
+// withQuoting wraps action so it operates on JSON literals: a string literal is
+// unquoted before calling action, a number or boolean is encoded with its type
+// (see format.EncodeTyped), and the result is quoted again, unless it decodes
+// to a number or boolean, which is written back unquoted. A literal that action
+// leaves unchanged is written back exactly as it was.
+func withQuoting(action func([]byte) ([]byte, error)) func([]byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		var value []byte
+		if data[0] == '"' {
+			unquoted, ok := json.UnquoteBytes(data)
+			if !ok {
+				return nil, fmt.Errorf("invalid json")
+			}
+			value = format.EncodeString(unquoted)
+		} else {
+			value = format.EncodeTyped(literalType(data), data)
+		}
+		done, err := action(value)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(done, value) {
+			return data, nil
+		}
+
+		typ, literal, err := format.DecodeTyped(done)
+		if err != nil {
+			return nil, err
+		}
+		if typ == "" || typ == format.TypeString {
+			return quoteBytes(literal)
+		}
+		if literalType(literal) != typ {
+			return nil, fmt.Errorf("invalid typed value: %q is not a JSON %s", literal, typ)
+		}
+		return literal, nil
 	}
-	done, err := action(unquoted)
-	if err != nil {
-		return nil, err
+}
+
+// numberLiteral matches a JSON number.
+var numberLiteral = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// literalType returns the type of a JSON number or boolean literal, or "" for
+// any other value.
+func literalType(literal []byte) string {
+	switch {
+	case bytes.Equal(literal, []byte("true")), bytes.Equal(literal, []byte("false")):
+		return format.TypeBool
+	case !numberLiteral.Match(literal):
+		return ""
+	case bytes.ContainsAny(literal, ".eE"):
+		return format.TypeFloat
+	default:
+		return format.TypeInt
 	}
-	return quoteBytes(done)
 }
 
 // probably a better way to do this, but...
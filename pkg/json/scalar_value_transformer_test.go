@@ -1,7 +1,12 @@
 package json
 
 import (
+	"encoding/hex"
+	"regexp"
+	"strings"
 	"testing"
+
+	"github.com/mscno/esec/pkg/format"
 )
 
 func TestScalarValueTransformer(t *testing.T) {
@@ -29,7 +34,7 @@ type testCase struct {
 var testCases = []testCase{
 	{`{"a": "b"}`, `{"a": "E"}`},                     // encryption
 	{`{"a" : "b"}`, `{"a" : "E"}`},                   // weird spacing
-	{` {  "a"  :"b" } `, ` {  "a"  :"E"}`},           // we could but don't preserve trailing spaces
+	{` {  "a"  :"b" } `, ` {  "a"  :"E" }`},          // spacing after values is preserved
 	{`{"_a": "b"}`, `{"_a": "b"}`},                   // commenting
 	{`{"a": "b", "c": "d"}`, `{"a": "E", "c": "E"}`}, // order-dependence
 	{`{"a": 1}`, `{"a": 1}`},                         // numbers
@@ -40,3 +45,131 @@ var testCases = []testCase{
 	{`{"a": {"_b": "c"}}`, `{"a": {"_b": "c"}}`},     // nested comment
 	{`{"_a": {"b": "c"}}`, `{"_a": {"b": "E"}}`},     // comments don't inherit
 }
+
+func TestScalarValueTransformerWithRules(t *testing.T) {
+	action := func(a []byte) ([]byte, error) {
+		return []byte{'E'}, nil
+	}
+	rules := &format.Rules{
+		EncryptedRegex: regexp.MustCompile("^(password|tokens)$"),
+		EncryptedPaths: []string{"api.key"},
+	}
+
+	tests := []testCase{
+		{`{"user": "u", "password": "p"}`, `{"user": "u", "password": "E"}`},
+		{`{"db": {"password": "p", "host": "h"}}`, `{"db": {"password": "E", "host": "h"}}`},
+		{`{"tokens": ["a", {"b": "c"}], "d": "e"}`, `{"tokens": ["E", {"b": "E"}], "d": "e"}`},
+		{`{"api": {"key": "k", "url": "u"}, "key": "k"}`, `{"api": {"key": "E", "url": "u"}, "key": "k"}`},
+		{`{"a": [{"password": "p"}, "b"]}`, `{"a": [{"password": "E"}, "b"]}`},
+		{`{"_password": "p"}`, `{"_password": "p"}`},
+	}
+	for _, tc := range tests {
+		fh := &Formatter{}
+		act, err := fh.TransformScalarValuesWithRules([]byte(tc.in), rules, action)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if string(act) != tc.out {
+			t.Errorf("unexpected output: '%s'; wanted '%s'", string(act), tc.out)
+		}
+	}
+}
+
+func TestScalarValueTransformerAllScalars(t *testing.T) {
+	encrypt := func(a []byte) ([]byte, error) {
+		return []byte("E:" + hex.EncodeToString(a)), nil
+	}
+	decrypt := func(a []byte) ([]byte, error) {
+		return hex.DecodeString(strings.TrimPrefix(string(a), "E:"))
+	}
+
+	in := `{"port": 8080, "ratio": -1.5e3, "debug": true, "none": null, "_pin": 1234, "list": [1, "a", false], "name": "x"}`
+	fh := &Formatter{}
+	encrypted, err := fh.TransformScalarValuesWithRules([]byte(in), &format.Rules{AllScalars: true}, encrypt)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	for _, plain := range []string{"8080", "-1.5e3", "true", "false"} {
+		if strings.Contains(string(encrypted), plain) {
+			t.Errorf("%s was not encrypted: %s", plain, encrypted)
+		}
+	}
+	if !strings.Contains(string(encrypted), `"none": null`) || !strings.Contains(string(encrypted), `"_pin": 1234`) {
+		t.Errorf("unexpected output: %s", encrypted)
+	}
+
+	// Decrypting restores the types, with or without AllScalars
+	decrypted, err := fh.TransformScalarValues(encrypted, decrypt)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if string(decrypted) != in {
+		t.Errorf("unexpected output: '%s'; wanted '%s'", decrypted, in)
+	}
+}
+
+func TestScalarValueTransformerInvalidTypedValue(t *testing.T) {
+	fh := &Formatter{}
+	for _, value := range []string{"\x00esec:int\x00true", "\x00esec:bool\x00yes", "\x00esec:int\x000x1F"} {
+		action := func([]byte) ([]byte, error) {
+			return []byte(value), nil
+		}
+		if _, err := fh.TransformScalarValues([]byte(`{"a": "b"}`), action); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestScalarValueTransformerJSONC(t *testing.T) {
+	action := func(a []byte) ([]byte, error) {
+		return []byte{'E'}, nil
+	}
+
+	in := `{
+  // The public key
+  "_ESEC_PUBLIC_KEY": "key",
+  /* Database
+     settings */
+  "db": {
+    "password": "secret", // rotated monthly
+    "hosts": ["a", "b",],
+    "url": "http://example.com/*not a comment*/" /* trailing */ ,
+  },
+}
+// end
+`
+	out := `{
+  // The public key
+  "_ESEC_PUBLIC_KEY": "key",
+  /* Database
+     settings */
+  "db": {
+    "password": "E", // rotated monthly
+    "hosts": ["E", "E",],
+    "url": "E" /* trailing */ ,
+  },
+}
+// end
+`
+	fh := &Formatter{JSONC: true}
+	act, err := fh.TransformScalarValues([]byte(in), action)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(act) != out {
+		t.Errorf("unexpected output: '%s'; wanted '%s'", string(act), out)
+	}
+
+	key, err := fh.ExtractRawPublicKey([]byte(in))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key != "key" {
+		t.Errorf("unexpected key: %q", key)
+	}
+
+	// Plain .ejson files stay strict
+	if _, err := (&Formatter{}).TransformScalarValues([]byte(in), action); err == nil {
+		t.Error("expected error for comments without JSONC")
+	}
+}
@@ -0,0 +1,275 @@
+package properties
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/mscno/esec/pkg/format"
+)
+
+// entry is a key-value pair of a properties file. start and end delimit the
+// value in the source, as written, including any line continuations.
+// directive is the format.PlaintextDirective or format.EncryptDirective
+// comment preceding the pair, if any. bare is set if the key is followed by
+// neither a separator nor a value.
+type entry struct {
+	key       string
+	start     int
+	end       int
+	directive string
+	bare      bool
+}
+
+// parse tokenizes a properties file the way java.util.Properties.load does.
+// A logical line continues onto the next natural line if it ends in an odd
+// number of backslashes, and the leading white space of the continuation is
+// ignored. Lines starting with '#' or '!' are comments and are never
+// continued. A key ends at the first unescaped '=', ':' or white space, and
+// the value is the rest of the logical line after the separator.
+//
+// A format.PlaintextDirective or format.EncryptDirective comment applies to the
+// next pair, unless a blank line comes first.
+func parse(data []byte) ([]entry, error) {
+	var (
+		entries   []entry
+		directive string
+	)
+	for p := 0; p < len(data); {
+		p = skipBlank(data, p)
+		switch {
+		case p >= len(data):
+		case isLineBreak(data[p]):
+			// A blank line separates a directive from what follows it
+			directive = ""
+			p = nextLine(data, p)
+		case data[p] == '#' || data[p] == '!':
+			end := lineEnd(data, p)
+			if d := format.CommentDirective(string(data[p:end])); d != "" {
+				directive = d
+			}
+			p = nextLine(data, end)
+		default:
+			e, next, err := parsePair(data, p)
+			if err != nil {
+				return nil, err
+			}
+			e.directive, directive = directive, ""
+			entries = append(entries, e)
+			p = next
+		}
+	}
+	return entries, nil
+}
+
+// parsePair parses the key-value pair starting at p, returning it and the
+// offset of the next line.
+func parsePair(data []byte, p int) (entry, int, error) {
+	// The key ends at the first unescaped separator
+	keyStart := p
+	for p < len(data) && !isLineBreak(data[p]) && !isBlank(data[p]) && data[p] != '=' && data[p] != ':' {
+		if data[p] == '\\' {
+			if next, ok := continuation(data, p); ok {
+				p = next
+				continue
+			}
+			p++
+		}
+		p++
+	}
+	key, err := unescape(data[keyStart:min(p, len(data))])
+	if err != nil {
+		return entry{}, 0, err
+	}
+
+	// The separator is white space, optionally around one '=' or ':'
+	keyEnd := p
+	p = skipSeparator(data, p)
+	if p < len(data) && (data[p] == '=' || data[p] == ':') {
+		p = skipSeparator(data, p+1)
+	}
+
+	start := min(p, len(data))
+	end := logicalEnd(data, start)
+	return entry{key: key, start: start, end: end, bare: start == keyEnd}, nextLine(data, end), nil
+}
+
+// skipSeparator skips white space and line continuations from p.
+func skipSeparator(data []byte, p int) int {
+	for p < len(data) {
+		switch {
+		case isBlank(data[p]):
+			p++
+		case data[p] == '\\':
+			next, ok := continuation(data, p)
+			if !ok {
+				return p
+			}
+			p = next
+		default:
+			return p
+		}
+	}
+	return p
+}
+
+// logicalEnd returns the offset of the line break ending the logical line
+// containing p, or the end of data.
+func logicalEnd(data []byte, p int) int {
+	for p < len(data) && !isLineBreak(data[p]) {
+		if data[p] == '\\' {
+			if next, ok := continuation(data, p); ok {
+				p = next
+				continue
+			}
+			p++
+		}
+		p++
+	}
+	return min(p, len(data))
+}
+
+// continuation reports whether the backslash at p continues the line, and if
+// so returns the offset of the first non-blank byte of the next line.
+func continuation(data []byte, p int) (int, bool) {
+	if p+1 >= len(data) || !isLineBreak(data[p+1]) {
+		return 0, false
+	}
+	return skipBlank(data, nextLine(data, p+1)), true
+}
+
+// unescape interprets the escape sequences and line continuations of a key or
+// value as written in a properties file.
+func unescape(raw []byte) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if next, ok := continuation(raw, i); ok {
+			i = next - 1
+			continue
+		}
+		if i+1 >= len(raw) {
+			// A trailing backslash is dropped
+			break
+		}
+		i++
+		switch raw[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			r, ok := unicodeEscape(raw, i-1)
+			if !ok {
+				return "", fmt.Errorf("invalid properties: malformed \\uxxxx escape %q", raw[i-1:min(i+5, len(raw))])
+			}
+			i += 4
+			// Characters outside the Basic Multilingual Plane are written as
+			// two escapes of UTF-16 surrogates
+			if utf16.IsSurrogate(r) {
+				if low, ok := unicodeEscape(raw, i+1); ok {
+					if pair := utf16.DecodeRune(r, low); pair != utf8.RuneError {
+						r = pair
+						i += 6
+					}
+				}
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte(raw[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// unicodeEscape parses the \uxxxx escape at p.
+func unicodeEscape(raw []byte, p int) (rune, bool) {
+	if p+6 > len(raw) || raw[p] != '\\' || raw[p+1] != 'u' {
+		return 0, false
+	}
+	r, err := strconv.ParseUint(string(raw[p+2:p+6]), 16, 16)
+	return rune(r), err == nil
+}
+
+// escape renders value as a properties value that reads back as value,
+// the way java.util.Properties.store writes it.
+func escape(value []byte) []byte {
+	s := string(value)
+	out := make([]byte, 0, len(value)+2)
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			out = append(out, '\\', '\\')
+		case r == '\t':
+			out = append(out, '\\', 't')
+		case r == '\n':
+			out = append(out, '\\', 'n')
+		case r == '\r':
+			out = append(out, '\\', 'r')
+		case r == '\f':
+			out = append(out, '\\', 'f')
+		case i == 0 && (r == ' ' || r == '=' || r == ':' || r == '#' || r == '!'):
+			out = append(out, '\\', byte(r))
+		case r < 0x20 || r > 0x7e:
+			out = appendUnicodeEscape(out, r)
+		default:
+			out = append(out, byte(r))
+		}
+	}
+	return out
+}
+
+// appendUnicodeEscape appends r as one \uxxxx escape, or two for a character
+// outside the Basic Multilingual Plane.
+func appendUnicodeEscape(out []byte, r rune) []byte {
+	if r > 0xFFFF {
+		r -= 0x10000
+		out = fmt.Appendf(out, "\\u%04X", 0xD800+(r>>10))
+		r = 0xDC00 + r&0x3FF
+	}
+	return fmt.Appendf(out, "\\u%04X", r)
+}
+
+// skipBlank returns the offset of the first byte from p that is not a space,
+// tab or form feed.
+func skipBlank(data []byte, p int) int {
+	for p < len(data) && isBlank(data[p]) {
+		p++
+	}
+	return p
+}
+
+// lineEnd returns the offset of the line break ending the natural line
+// containing p, or the end of data.
+func lineEnd(data []byte, p int) int {
+	for p < len(data) && !isLineBreak(data[p]) {
+		p++
+	}
+	return p
+}
+
+// nextLine returns the offset just past the line break at p, which may be
+// "\r\n", or p if it is the end of data.
+func nextLine(data []byte, p int) int {
+	if p >= len(data) {
+		return p
+	}
+	if data[p] == '\r' && p+1 < len(data) && data[p+1] == '\n' {
+		return p + 2
+	}
+	return p + 1
+}
+
+func isBlank(c byte) bool { return c == ' ' || c == '\t' || c == '\f' }
+
+func isLineBreak(c byte) bool { return c == '\n' || c == '\r' }
@@ -0,0 +1,177 @@
+// Package properties provides a Handler implementation for .eproperties
+// (encrypted Java properties) files.
+package properties
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/mscno/esec/pkg/format"
+)
+
+// Formatter implements format.Handler for .eproperties (encrypted Java
+// properties) files. It handles encryption and decryption of values while
+// preserving comments, blank lines, line continuations, escapes and the
+// overall file structure.
+type Formatter struct{}
+
+// Parse returns the key-value pairs of a properties file, with their escape
+// sequences and line continuations interpreted. Later pairs override earlier
+// ones with the same key.
+func Parse(data []byte) (map[string]string, error) {
+	entries, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(entries))
+	for _, e := range entries {
+		value, err := unescape(data[e.start:e.end])
+		if err != nil {
+			return nil, err
+		}
+		values[e.key] = value
+	}
+	return values, nil
+}
+
+// ExtractPublicKey parses the properties data and returns the ESEC_PUBLIC_KEY
+// value. It looks for either "ESEC_PUBLIC_KEY" or "_ESEC_PUBLIC_KEY" keys.
+func (f *Formatter) ExtractPublicKey(data []byte) ([32]byte, error) {
+	ks, err := f.ExtractRawPublicKey(data)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return format.ParsePublicKey(ks)
+}
+
+// ExtractRawPublicKey is like ExtractPublicKey, but returns the public key
+// string without parsing it.
+func (f *Formatter) ExtractRawPublicKey(data []byte) (string, error) {
+	values, err := Parse(data)
+	if err != nil {
+		return "", err
+	}
+	return format.ExtractRawPublicKeyHelper(values)
+}
+
+// EmbedPublicKey adds a _ESEC_PUBLIC_KEY property at the top of data.
+func (f *Formatter) EmbedPublicKey(data []byte, publicKey string) ([]byte, error) {
+	return format.PrependLine(data, format.UnderscoredPublicKeyField+"="+publicKey), nil
+}
+
+// LineComment returns text as a "#" comment.
+func (f *Formatter) LineComment(text string) (string, bool) {
+	return "# " + text, true
+}
+
+// TransformScalarValues applies fn to the value of each key-value pair in the
+// properties data. Like the other formats, keys starting with an underscore,
+// which include _ESEC_PUBLIC_KEY, are left in plaintext, as are ESEC_PUBLIC_KEY
+// and keys preceded by a "# esec:plaintext" or "! esec:plaintext" comment,
+// while a "# esec:encrypt" comment encrypts a key starting with an underscore.
+// Values are tokenized as java.util.Properties.load does (see parse) and
+// replaced in place, so comments, blank lines, separators and the layout of
+// each line are preserved.
+//
+// fn receives a value as written, with its escape sequences and line
+// continuations, and the result is written back as it is. Values are
+// interpreted when the decrypted file is loaded, so decrypting restores the
+// original text exactly. Results that would not read back as they are, such
+// as ones containing line breaks, are escaped instead.
+//
+// Values are transformed concurrently (see format.MapValues).
+func (f *Formatter) TransformScalarValues(data []byte, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	return f.TransformScalarValuesWithRules(data, nil, fn)
+}
+
+// TransformScalarValuesWithRules is like TransformScalarValues, but only
+// transforms the values selected by rules, with the file's own directives
+// applied on top. It implements format.RulesHandler.
+func (f *Formatter) TransformScalarValuesWithRules(data []byte, rules *format.Rules, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	entries, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err = rules.WithFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the public key and plaintext keys and collect the other values
+	root := rules.Root()
+	var actionable []entry
+	for _, e := range entries {
+		if e.key == format.PublicKeyField || e.key == format.UnderscoredPublicKeyField || !root.Enter(e.key, e.directive).Encrypted() {
+			continue
+		}
+		actionable = append(actionable, e)
+	}
+
+	values := make([][]byte, len(actionable))
+	for i, e := range actionable {
+		values[i] = format.EncodeString(data[e.start:e.end])
+	}
+	transformed, err := format.MapValues(context.Background(), values, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Splice the new values into the original data
+	var buffer bytes.Buffer
+	buffer.Grow(len(data))
+	pos := 0
+	for i, e := range actionable {
+		// Every value is a string here, so a typed value keeps its literal
+		_, value, err := format.DecodeTyped(transformed[i])
+		if err != nil {
+			return nil, err
+		}
+		if !fitsValue(value) {
+			value = escape(value)
+		}
+		if e.bare && len(value) > 0 {
+			// A value right after the key would become part of it
+			value = append([]byte("="), value...)
+		}
+		buffer.Write(data[pos:e.start])
+		buffer.Write(value)
+		pos = e.end
+	}
+	buffer.Write(data[pos:])
+
+	return buffer.Bytes(), nil
+}
+
+// fitsValue reports whether v can be written as it is in place of a value and
+// read back unchanged: it must not start with white space or a separator,
+// which would be skipped, its line breaks must all be line continuations, and
+// it must not end in one.
+func fitsValue(v []byte) bool {
+	if len(v) == 0 {
+		return true
+	}
+	if isBlank(v[0]) || v[0] == '=' || v[0] == ':' || isLineBreak(v[0]) {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		switch {
+		case v[i] == '\\':
+			if i+1 == len(v) {
+				return false
+			}
+			if next, ok := continuation(v, i); ok {
+				if next == len(v) {
+					return false
+				}
+				i = next - 1
+				continue
+			}
+			i++
+		case isLineBreak(v[i]):
+			return false
+		}
+	}
+	_, err := unescape(v)
+	return err == nil
+}
@@ -0,0 +1,216 @@
+package properties
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mscno/esec/pkg/format"
+)
+
+func TestTransformScalarValues(t *testing.T) {
+	bracketFn := func(b []byte) ([]byte, error) {
+		return []byte("[" + string(b) + "]"), nil
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		fn    func([]byte) ([]byte, error)
+		want  string
+	}{
+		{
+			name:  "equals separator",
+			input: "db.password=secret\n",
+			want:  "db.password=[secret]\n",
+		},
+		{
+			name:  "colon and white space separators",
+			input: "a : one\nb two\nc\t=\tthree\n",
+			want:  "a : [one]\nb [two]\nc\t=\t[three]\n",
+		},
+		{
+			name:  "preserves comments and blank lines",
+			input: "# comment\n! other comment\n\nkey=value\n",
+			want:  "# comment\n! other comment\n\nkey=[value]\n",
+		},
+		{
+			name:  "skips public key and underscored keys",
+			input: "_ESEC_PUBLIC_KEY=abc\nESEC_PUBLIC_KEY=def\n_log.level=debug\nkey=value\n",
+			want:  "_ESEC_PUBLIC_KEY=abc\nESEC_PUBLIC_KEY=def\n_log.level=debug\nkey=[value]\n",
+		},
+		{
+			name:  "directives",
+			input: "# esec:plaintext\nlog.level=debug\n! esec:encrypt\n_token=abc\n# esec:plaintext\n\nkey=value\n",
+			want:  "# esec:plaintext\nlog.level=debug\n! esec:encrypt\n_token=[abc]\n# esec:plaintext\n\nkey=[value]\n",
+		},
+		{
+			name:  "line continuations",
+			input: "list=a, \\\n     b, \\\n     c\nnext=value\n",
+			want:  "list=[a, \\\n     b, \\\n     c]\nnext=[value]\n",
+		},
+		{
+			name:  "escaped separators in keys",
+			input: "a\\=b\\ c=value\n",
+			want:  "a\\=b\\ c=[value]\n",
+		},
+		{
+			name:  "escapes are passed as written",
+			input: "greeting=caf\\u00e9\\tbar\n",
+			want:  "greeting=[caf\\u00e9\\tbar]\n",
+		},
+		{
+			name:  "empty value",
+			input: "empty=\nlast",
+			want:  "empty=[]\nlast=[]",
+		},
+		{
+			name:  "crlf line endings",
+			input: "a=1\r\nb=2\\\r\n  3\r\n",
+			want:  "a=[1]\r\nb=[2\\\r\n  3]\r\n",
+		},
+		{
+			name:  "results that do not fit are escaped",
+			input: "a=1\nb=2\n",
+			fn: func(b []byte) ([]byte, error) {
+				return []byte(" multi\nline\\"), nil
+			},
+			want: "a=\\ multi\\nline\\\\\nb=\\ multi\\nline\\\\\n",
+		},
+	}
+
+	formatter := &Formatter{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := tt.fn
+			if fn == nil {
+				fn = bracketFn
+			}
+			result, err := formatter.TransformScalarValues([]byte(tt.input), fn)
+			if err != nil {
+				t.Fatalf("TransformScalarValues() unexpected error = %v", err)
+			}
+			if string(result) != tt.want {
+				t.Errorf("TransformScalarValues() = %q, want %q", string(result), tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformScalarValuesWithRules(t *testing.T) {
+	bracketFn := func(b []byte) ([]byte, error) {
+		return []byte("[" + string(b) + "]"), nil
+	}
+	rules := &format.Rules{
+		EncryptedRegex:   regexp.MustCompile(`password|token`),
+		UnencryptedRegex: regexp.MustCompile(`^public`),
+	}
+
+	in := "db.host=localhost\ndb.password=secret\npublic.token=abc\n"
+	result, err := (&Formatter{}).TransformScalarValuesWithRules([]byte(in), rules, bracketFn)
+	if err != nil {
+		t.Fatalf("TransformScalarValuesWithRules() unexpected error = %v", err)
+	}
+	want := "db.host=localhost\ndb.password=[secret]\npublic.token=abc\n"
+	if string(result) != want {
+		t.Errorf("TransformScalarValuesWithRules() = %q, want %q", string(result), want)
+	}
+}
+
+func TestTransformScalarValuesRoundtrip(t *testing.T) {
+	input := `# Database settings
+db.url = jdbc:postgresql://localhost:5432/app?ssl=true
+db.password : p@ss=word#1
+message = Hello, \
+          World! \u00e9\uD83D\uDE00
+path=C:\\Program Files\\app
+key\ with\ spaces = value
+empty =
+`
+	encrypt := func(b []byte) ([]byte, error) {
+		return []byte("E:" + hex.EncodeToString(b)), nil
+	}
+	decrypt := func(b []byte) ([]byte, error) {
+		return hex.DecodeString(strings.TrimPrefix(string(b), "E:"))
+	}
+
+	formatter := &Formatter{}
+	encrypted, err := formatter.TransformScalarValues([]byte(input), encrypt)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	decrypted, err := formatter.TransformScalarValues(encrypted, decrypt)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if string(decrypted) != input {
+		t.Errorf("roundtrip changed the file:\ngot:\n%s\nwant:\n%s", decrypted, input)
+	}
+
+	got, err := Parse(decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"db.url":          "jdbc:postgresql://localhost:5432/app?ssl=true",
+		"db.password":     "p@ss=word#1",
+		"message":         "Hello, World! é😀",
+		"path":            `C:\Program Files\app`,
+		"key with spaces": "value",
+		"empty":           "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() = %q, want %q", got, want)
+	}
+
+	// Every value, and nothing else, is encrypted
+	parsed, err := Parse(encrypted)
+	if err != nil {
+		t.Fatalf("encrypted file does not parse: %v", err)
+	}
+	for k, v := range parsed {
+		if !strings.HasPrefix(v, "E:") {
+			t.Errorf("value of %s not encrypted: %q", k, v)
+		}
+	}
+	if len(parsed) != len(want) {
+		t.Errorf("encrypted file has %d keys, want %d", len(parsed), len(want))
+	}
+}
+
+func TestEscape(t *testing.T) {
+	for _, value := range []string{"", " leading", "=x", "a\\b", "tab\tnew\nline\r", "é😀", "#!"} {
+		got, err := unescape(escape([]byte(value)))
+		if err != nil {
+			t.Fatalf("unescape(escape(%q)) unexpected error = %v", value, err)
+		}
+		if got != value {
+			t.Errorf("unescape(escape(%q)) = %q", value, got)
+		}
+	}
+}
+
+func TestExtractPublicKey(t *testing.T) {
+	formatter := &Formatter{}
+	in := "# keys\n_ESEC_PUBLIC_KEY = 6d79b7e50073e5e66a4581ed08bf1d9a03806cc4648cffeb6df71b5775e5eb08\n"
+	key, err := formatter.ExtractPublicKey([]byte(in))
+	if err != nil {
+		t.Fatalf("ExtractPublicKey() unexpected error = %v", err)
+	}
+	if hex.EncodeToString(key[:]) != "6d79b7e50073e5e66a4581ed08bf1d9a03806cc4648cffeb6df71b5775e5eb08" {
+		t.Errorf("ExtractPublicKey() = %x", key)
+	}
+
+	if _, err := formatter.ExtractPublicKey([]byte("key=value\n")); !errors.Is(err, format.ErrPublicKeyMissing) {
+		t.Errorf("ExtractPublicKey() error = %v, want %v", err, format.ErrPublicKeyMissing)
+	}
+}
+
+func TestParseMalformedUnicodeEscape(t *testing.T) {
+	if _, err := Parse([]byte("key=\\u12\n")); err == nil {
+		t.Error("Parse() expected error for malformed \\u escape")
+	}
+}
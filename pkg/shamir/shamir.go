@@ -0,0 +1,136 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+//
+// A secret is split byte-wise: for every byte a random polynomial of degree
+// threshold-1 is chosen whose constant term is the secret byte, and each share
+// holds the polynomial evaluated at the share's x coordinate. Any threshold
+// shares recover the secret by Lagrange interpolation at x = 0; fewer shares
+// reveal nothing about it.
+//
+// Each share is returned as the y values followed by a single trailing byte
+// holding its x coordinate, so shares are self-describing and can be combined
+// in any order.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// MaxShares is the maximum number of shares a secret can be split into, as
+// every share needs a distinct, non-zero x coordinate in GF(2^8).
+const MaxShares = 255
+
+var (
+	// ErrTooFewShares means fewer than two shares were supplied to Combine.
+	ErrTooFewShares = errors.New("at least two shares are required")
+	// ErrMismatchedShares means the supplied shares differ in length or reuse
+	// an x coordinate, so they can't be from the same split.
+	ErrMismatchedShares = errors.New("shares do not belong to the same split")
+)
+
+// Split divides secret into parts shares, any threshold of which can be used
+// to reconstruct it.
+func Split(secret []byte, parts, threshold int) ([][]byte, error) {
+	switch {
+	case len(secret) == 0:
+		return nil, errors.New("cannot split an empty secret")
+	case threshold < 2:
+		return nil, errors.New("threshold must be at least 2")
+	case parts < threshold:
+		return nil, errors.New("parts cannot be less than threshold")
+	case parts > MaxShares:
+		return nil, fmt.Errorf("parts cannot exceed %d", MaxShares)
+	}
+
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	defer wipe(coefficients)
+	for idx, b := range secret {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			shares[i][idx] = evaluate(coefficients, byte(i+1))
+		}
+	}
+	return shares, nil
+}
+
+// Combine reconstructs a secret from shares produced by Split. It needs at
+// least threshold shares; combining fewer yields an unrelated value, so callers
+// should verify the result independently.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrTooFewShares
+	}
+
+	size := len(shares[0])
+	if size < 2 {
+		return nil, ErrMismatchedShares
+	}
+	xs := make([]byte, len(shares))
+	seen := make(map[byte]bool, len(shares))
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, ErrMismatchedShares
+		}
+		x := share[size-1]
+		if x == 0 || seen[x] {
+			return nil, ErrMismatchedShares
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	secret := make([]byte, size-1)
+	ys := make([]byte, len(shares))
+	defer wipe(ys)
+	for idx := range secret {
+		for i, share := range shares {
+			ys[i] = share[idx]
+		}
+		secret[idx] = interpolateAtZero(xs, ys)
+	}
+	return secret, nil
+}
+
+// evaluate computes the polynomial with the given coefficients (constant term
+// first) at x using Horner's method.
+func evaluate(coefficients []byte, x byte) byte {
+	var out byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		out = add(mul(out, x), coefficients[i])
+	}
+	return out
+}
+
+// interpolateAtZero evaluates the Lagrange polynomial through the points
+// (xs[i], ys[i]) at x = 0.
+func interpolateAtZero(xs, ys []byte) byte {
+	var result byte
+	for i := range xs {
+		basis := byte(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			// x_j / (x_j - x_i); subtraction is addition in GF(2^8).
+			basis = mul(basis, div(xs[j], add(xs[j], xs[i])))
+		}
+		result = add(result, mul(ys[i], basis))
+	}
+	return result
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,74 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestFieldArithmetic(t *testing.T) {
+	// Every non-zero element has a multiplicative inverse.
+	for a := 1; a < 256; a++ {
+		assert.Equal(t, byte(1), mul(byte(a), div(1, byte(a))))
+	}
+	// Known AES field product: 0x57 * 0x83 = 0xc1.
+	assert.Equal(t, byte(0xc1), mul(0x57, 0x83))
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("correct horse battery staple 123")
+
+	shares, err := Split(secret, 5, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(shares))
+
+	t.Run("any threshold subset recovers the secret", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			for j := i + 1; j < 5; j++ {
+				for k := j + 1; k < 5; k++ {
+					got, err := Combine([][]byte{shares[k], shares[i], shares[j]})
+					assert.NoError(t, err)
+					assert.Equal(t, secret, got)
+				}
+			}
+		}
+	})
+
+	t.Run("all shares recover the secret", func(t *testing.T) {
+		got, err := Combine(shares)
+		assert.NoError(t, err)
+		assert.Equal(t, secret, got)
+	})
+
+	t.Run("fewer than threshold shares do not", func(t *testing.T) {
+		got, err := Combine(shares[:2])
+		assert.NoError(t, err)
+		assert.False(t, bytes.Equal(secret, got))
+	})
+}
+
+func TestSplitValidation(t *testing.T) {
+	_, err := Split(nil, 3, 2)
+	assert.Error(t, err)
+	_, err = Split([]byte("x"), 3, 1)
+	assert.Error(t, err)
+	_, err = Split([]byte("x"), 2, 3)
+	assert.Error(t, err)
+	_, err = Split([]byte("x"), 256, 3)
+	assert.Error(t, err)
+}
+
+func TestCombineValidation(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	assert.NoError(t, err)
+
+	_, err = Combine(shares[:1])
+	assert.IsError(t, err, ErrTooFewShares)
+
+	_, err = Combine([][]byte{shares[0], shares[0]})
+	assert.IsError(t, err, ErrMismatchedShares)
+
+	_, err = Combine([][]byte{shares[0], shares[1][:3]})
+	assert.IsError(t, err, ErrMismatchedShares)
+}
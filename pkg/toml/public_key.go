@@ -2,6 +2,7 @@ package toml
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/mscno/esec/pkg/format"
 	"github.com/pelletier/go-toml/v2"
@@ -11,14 +12,24 @@ import (
 // It looks for either "_ESEC_PUBLIC_KEY" (preferred) or "ESEC_PUBLIC_KEY" fields
 // at the top level of the TOML document.
 func (f *Formatter) ExtractPublicKey(data []byte) ([32]byte, error) {
+	ks, err := f.ExtractRawPublicKey(data)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return format.ParsePublicKey(ks)
+}
+
+// ExtractRawPublicKey is like ExtractPublicKey, but returns the public key
+// string without parsing it.
+func (f *Formatter) ExtractRawPublicKey(data []byte) (string, error) {
 	var doc map[string]interface{}
 	if err := toml.Unmarshal(data, &doc); err != nil {
-		return [32]byte{}, fmt.Errorf("invalid toml: %v", err)
+		return "", fmt.Errorf("invalid toml: %v", err)
 	}
 
 	// Empty document
 	if len(doc) == 0 {
-		return [32]byte{}, fmt.Errorf("invalid toml: empty document")
+		return "", fmt.Errorf("invalid toml: empty document")
 	}
 
 	// Search for the public key in the document
@@ -26,15 +37,22 @@ func (f *Formatter) ExtractPublicKey(data []byte) ([32]byte, error) {
 		if value, ok := doc[keyName]; ok {
 			strValue, ok := value.(string)
 			if !ok {
-				return [32]byte{}, fmt.Errorf("%w: public key is not a string", format.ErrPublicKeyInvalid)
-			}
-			key, err := format.ParseKey(strValue)
-			if err != nil {
-				return [32]byte{}, fmt.Errorf("%w: %v", format.ErrPublicKeyInvalid, err)
+				return "", fmt.Errorf("%w: public key is not a string", format.ErrPublicKeyInvalid)
 			}
-			return key, nil
+			return strValue, nil
 		}
 	}
 
-	return [32]byte{}, format.ErrPublicKeyMissing
+	return "", format.ErrPublicKeyMissing
+}
+
+// EmbedPublicKey adds a _ESEC_PUBLIC_KEY key at the top of data, before any
+// table.
+func (f *Formatter) EmbedPublicKey(data []byte, publicKey string) ([]byte, error) {
+	return format.PrependLine(data, format.UnderscoredPublicKeyField+" = "+strconv.Quote(publicKey)), nil
+}
+
+// LineComment returns text as a "#" comment.
+func (f *Formatter) LineComment(text string) (string, bool) {
+	return "# " + text, true
 }
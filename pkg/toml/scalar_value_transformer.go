@@ -2,9 +2,10 @@ package toml
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"sort"
-	"strings"
+	"time"
 
 	"github.com/mscno/esec/pkg/format"
 	"github.com/pelletier/go-toml/v2"
@@ -16,6 +17,8 @@ type replacement struct {
 	start int
 	end   int
 	value []byte
+	// raw is set if value is a typed literal, to be written unquoted
+	raw bool
 }
 
 // TransformScalarValues walks a TOML document, replacing all actionable string values
@@ -34,10 +37,31 @@ type replacement struct {
 //   - In {_k = {a = ["b"]}}, action will run on "b".
 //   - In {k = {_a = ["b"]}}, action will not run.
 //
+// Comment directives choose values without renaming keys. A "# esec:plaintext"
+// or "# esec:encrypt" comment above a key-value pair or table header, or after
+// it on the same line, leaves its values in plaintext or encrypts them,
+// overriding the underscore rule. A "# esec:encrypted-regex=<re>" comment at the
+// top of the file limits encryption to the values under keys, including table
+// names, matching re, and "# esec:unencrypted-regex=<re>" leaves them in
+// plaintext. See format.Rules.
+//
 // Top-level arrays are rejected as a table is required for the public key.
+//
+// Values are transformed concurrently (see format.MapValues).
 func (f *Formatter) TransformScalarValues(
 	data []byte,
 	action func([]byte) ([]byte, error),
+) ([]byte, error) {
+	return f.TransformScalarValuesWithRules(data, nil, action)
+}
+
+// TransformScalarValuesWithRules is like TransformScalarValues, but only
+// transforms the values selected by rules, with the file's own directives
+// applied on top. It implements format.RulesHandler.
+func (f *Formatter) TransformScalarValuesWithRules(
+	data []byte,
+	rules *format.Rules,
+	action func([]byte) ([]byte, error),
 ) ([]byte, error) {
 	// First, verify the document is valid TOML
 	var doc map[string]interface{}
@@ -49,13 +73,25 @@ func (f *Formatter) TransformScalarValues(
 		return nil, fmt.Errorf("invalid toml: empty document")
 	}
 
+	rules, err := rules.WithFile(data)
+	if err != nil {
+		return nil, err
+	}
+
 	// Use the unstable parser to find string values and their positions
 	var p unstable.Parser
 	p.KeepComments = true
 	p.Reset(data)
 
 	// Collect all replacements to make
-	var replacements []replacement
+	var (
+		replacements []replacement
+		tableScope   = rules.Root()
+		// pending is the directive of the comment lines preceding the next
+		// expression, which end at pendingEnd
+		pending    string
+		pendingEnd int
+	)
 
 	for p.NextExpression() {
 		expr := p.Expression()
@@ -63,31 +99,49 @@ func (f *Formatter) TransformScalarValues(
 			continue
 		}
 
-		switch expr.Kind { //nolint:exhaustive // We only care about Table, ArrayTable, and KeyValue
+		switch expr.Kind { //nolint:exhaustive // We only care about Comment, Table, ArrayTable, and KeyValue
+		case unstable.Comment:
+			start := int(expr.Raw.Offset)
+			if blankLineBetween(data, pendingEnd, start) {
+				pending = ""
+			}
+			if directive := format.CommentDirective(string(expr.Data)); directive != "" {
+				pending = directive
+			}
+			pendingEnd = start + int(expr.Raw.Length)
+
 		case unstable.Table, unstable.ArrayTable:
-			// Table headers are processed but their string values (the header itself) are not encrypted
-			continue
+			// Table headers are not encrypted, but start the scope of the keys below them
+			keyParts, start := expressionKey(expr)
+			directive := expressionDirective(expr, data, pending, pendingEnd, start)
+			pending = ""
+
+			tableScope = rules.Root()
+			for _, part := range keyParts {
+				tableScope = tableScope.Enter(part, "")
+			}
+			tableScope = tableScope.Annotate(directive)
 
 		case unstable.KeyValue:
 			// Get the key
-			var keyParts []string
-			for it := expr.Key(); it.Next(); {
-				keyParts = append(keyParts, string(it.Node().Data))
-			}
-
-			// Check if the immediate key starts with underscore
-			immediateKey := ""
-			if len(keyParts) > 0 {
-				immediateKey = keyParts[len(keyParts)-1]
-			}
+			keyParts, start := expressionKey(expr)
+			directive := expressionDirective(expr, data, pending, pendingEnd, start)
+			pending = ""
 
 			// Skip public key fields entirely
-			if immediateKey == format.PublicKeyField || immediateKey == format.UnderscoredPublicKeyField {
+			if immediateKey := keyParts[len(keyParts)-1]; immediateKey == format.PublicKeyField || immediateKey == format.UnderscoredPublicKeyField {
 				continue
 			}
 
-			// Check if this key starts with underscore (should not encrypt its direct value)
-			isComment := strings.HasPrefix(immediateKey, "_")
+			// Enter each part of a dotted key, the directive applying to the last
+			scope := tableScope
+			for i, part := range keyParts {
+				if i == len(keyParts)-1 {
+					scope = scope.Enter(part, directive)
+				} else {
+					scope = scope.Enter(part, "")
+				}
+			}
 
 			// Get the value
 			valueNode := expr.Value()
@@ -95,12 +149,8 @@ func (f *Formatter) TransformScalarValues(
 				continue
 			}
 
-			// Collect string values to replace
-			repls, err := collectStringReplacements(valueNode, action, isComment)
-			if err != nil {
-				return nil, err
-			}
-			replacements = append(replacements, repls...)
+			// Collect values to replace
+			replacements = append(replacements, collectReplacements(&p, valueNode, scope, rules.TypedScalars())...)
 		}
 	}
 
@@ -108,6 +158,36 @@ func (f *Formatter) TransformScalarValues(
 		return nil, fmt.Errorf("invalid toml: %v", err)
 	}
 
+	// Transform the collected values in parallel
+	values := make([][]byte, len(replacements))
+	for i, r := range replacements {
+		values[i] = r.value
+	}
+	transformed, err := format.MapValues(context.Background(), values, action)
+	if err != nil {
+		return nil, err
+	}
+	// Values left unchanged keep the way they were written
+	changed := replacements[:0]
+	for i, r := range replacements {
+		if bytes.Equal(transformed[i], values[i]) {
+			continue
+		}
+		typ, literal, err := format.DecodeTyped(transformed[i])
+		if err != nil {
+			return nil, err
+		}
+		if typ != "" && typ != format.TypeString {
+			if err := checkLiteral(typ, literal); err != nil {
+				return nil, err
+			}
+			r.raw = true
+		}
+		r.value = literal
+		changed = append(changed, r)
+	}
+	replacements = changed
+
 	// Sort replacements by start position descending so we can apply them from end to start
 	sort.Slice(replacements, func(i, j int) bool {
 		return replacements[i].start > replacements[j].start
@@ -123,7 +203,10 @@ func (f *Formatter) TransformScalarValues(
 			return nil, fmt.Errorf("invalid replacement bounds: start=%d, end=%d, len=%d", r.start, r.end, len(result))
 		}
 		// Build new content with proper quoting
-		quoted := quoteTomlString(string(r.value))
+		quoted := string(r.value)
+		if !r.raw {
+			quoted = quoteTomlString(quoted)
+		}
 		newContent := make([]byte, 0, len(result)-r.end+r.start+len(quoted))
 		newContent = append(newContent, result[:r.start]...)
 		newContent = append(newContent, []byte(quoted)...)
@@ -134,43 +217,94 @@ func (f *Formatter) TransformScalarValues(
 	return result, nil
 }
 
-// collectStringReplacements recursively collects replacements for string values in arrays and inline tables
-func collectStringReplacements(
-	node *unstable.Node,
-	action func([]byte) ([]byte, error),
-	parentKeyIsComment bool,
-) ([]replacement, error) {
-	var replacements []replacement
+// expressionKey returns the parts of the key of a table header or key-value
+// expression, and the offset of the key in the document.
+func expressionKey(expr *unstable.Node) ([]string, int) {
+	var (
+		keyParts []string
+		start    = -1
+	)
+	for it := expr.Key(); it.Next(); {
+		node := it.Node()
+		if start < 0 {
+			start = int(node.Raw.Offset)
+		}
+		keyParts = append(keyParts, string(node.Data))
+	}
+	return keyParts, start
+}
 
-	switch node.Kind { //nolint:exhaustive // We only handle String, Array, and InlineTable values
-	case unstable.String:
-		if !parentKeyIsComment {
-			// Get the unquoted string value
-			strValue := string(node.Data)
+// expressionDirective returns the directive applying to an expression starting
+// at start: a directive in a comment after it on the same line, or else the
+// pending directive of the comment lines directly above it.
+func expressionDirective(expr *unstable.Node, data []byte, pending string, pendingEnd, start int) string {
+	if comment := expr.Next(); comment != nil && comment.Kind == unstable.Comment {
+		if directive := format.CommentDirective(string(comment.Data)); directive != "" {
+			return directive
+		}
+	}
+	if blankLineBetween(data, pendingEnd, start) {
+		return ""
+	}
+	return pending
+}
 
-			// Transform the value
-			transformed, err := action([]byte(strValue))
-			if err != nil {
-				return nil, err
-			}
+// blankLineBetween reports whether data[start:end] spans a blank line, which
+// separates a directive from what follows it.
+func blankLineBetween(data []byte, start, end int) bool {
+	if start < 0 || end > len(data) || start >= end {
+		return false
+	}
+	return bytes.Count(data[start:end], []byte("\n")) > 1
+}
+
+// kindTypes maps the kinds of the non-string values that may be encrypted to
+// their format types.
+var kindTypes = map[unstable.Kind]string{
+	unstable.Integer:       format.TypeInt,
+	unstable.Float:         format.TypeFloat,
+	unstable.Bool:          format.TypeBool,
+	unstable.DateTime:      format.TypeDatetime,
+	unstable.LocalDateTime: format.TypeDatetime,
+	unstable.LocalDate:     format.TypeDatetime,
+	unstable.LocalTime:     format.TypeDatetime,
+}
 
-			// Record the replacement
+// collectReplacements recursively collects replacements for string values, and
+// for other scalars if typed is set, in arrays and inline tables. The value of
+// each replacement is the untransformed plaintext: the unquoted string value,
+// or the literal encoded with its type (see format.EncodeTyped).
+func collectReplacements(p *unstable.Parser, node *unstable.Node, scope format.Scope, typed bool) []replacement {
+	var replacements []replacement
+
+	switch node.Kind { //nolint:exhaustive // We only handle scalars, Array, and InlineTable values
+	case unstable.String:
+		if scope.Encrypted() {
+			// Record the replacement with a copy of the unquoted string value, as the
+			// parser reuses its buffers
 			replacements = append(replacements, replacement{
 				start: int(node.Raw.Offset),
 				end:   int(node.Raw.Offset) + int(node.Raw.Length),
-				value: transformed,
+				value: format.EncodeString(bytes.Clone(node.Data)),
+			})
+		}
+
+	case unstable.Integer, unstable.Float, unstable.Bool,
+		unstable.DateTime, unstable.LocalDateTime, unstable.LocalDate, unstable.LocalTime:
+		if typed && scope.Encrypted() {
+			// Not every kind records its raw range, but the data is the literal
+			raw := p.Range(node.Data)
+			replacements = append(replacements, replacement{
+				start: int(raw.Offset),
+				end:   int(raw.Offset) + int(raw.Length),
+				value: format.EncodeTyped(kindTypes[node.Kind], node.Data),
 			})
 		}
 
 	case unstable.Array:
 		// Process array elements
 		for it := node.Children(); it.Next(); {
-			child := it.Node()
-			repls, err := collectStringReplacements(child, action, parentKeyIsComment)
-			if err != nil {
-				return nil, err
-			}
-			replacements = append(replacements, repls...)
+			replacements = append(replacements, collectReplacements(p, it.Node(), scope, typed)...)
 		}
 
 	case unstable.InlineTable:
@@ -179,37 +313,53 @@ func collectStringReplacements(
 			child := it.Node()
 			if child.Kind == unstable.KeyValue {
 				// Get the key for this inline table entry
-				var keyParts []string
-				for keyIt := child.Key(); keyIt.Next(); {
-					keyParts = append(keyParts, string(keyIt.Node().Data))
-				}
-
-				immediateKey := ""
-				if len(keyParts) > 0 {
-					immediateKey = keyParts[len(keyParts)-1]
-				}
+				keyParts, _ := expressionKey(child)
 
 				// Skip public key fields
-				if immediateKey == format.PublicKeyField || immediateKey == format.UnderscoredPublicKeyField {
+				if immediateKey := keyParts[len(keyParts)-1]; immediateKey == format.PublicKeyField || immediateKey == format.UnderscoredPublicKeyField {
 					continue
 				}
 
-				// Check if this nested key starts with underscore
-				isComment := strings.HasPrefix(immediateKey, "_")
+				childScope := scope
+				for _, part := range keyParts {
+					childScope = childScope.Enter(part, "")
+				}
 
 				valueNode := child.Value()
 				if valueNode != nil {
-					repls, err := collectStringReplacements(valueNode, action, isComment)
-					if err != nil {
-						return nil, err
-					}
-					replacements = append(replacements, repls...)
+					replacements = append(replacements, collectReplacements(p, valueNode, childScope, typed)...)
 				}
 			}
 		}
 	}
 
-	return replacements, nil
+	return replacements
+}
+
+// checkLiteral checks that a decrypted typed literal is a TOML value of the
+// given type.
+func checkLiteral(typ string, literal []byte) error {
+	var doc map[string]interface{}
+	if err := toml.Unmarshal(append([]byte("v = "), literal...), &doc); err == nil && len(doc) == 1 {
+		var ok bool
+		switch v := doc["v"]; typ {
+		case format.TypeInt:
+			_, ok = v.(int64)
+		case format.TypeFloat:
+			_, ok = v.(float64)
+		case format.TypeBool:
+			_, ok = v.(bool)
+		case format.TypeDatetime:
+			switch v.(type) {
+			case time.Time, toml.LocalDateTime, toml.LocalDate, toml.LocalTime:
+				ok = true
+			}
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid typed value: %q is not a TOML %s", literal, typ)
 }
 
 // quoteTomlString properly quotes a string for TOML output
@@ -1,9 +1,12 @@
 package toml
 
 import (
+	"encoding/hex"
 	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/mscno/esec/pkg/format"
 )
 
 func TestKeyExtraction(t *testing.T) {
@@ -185,6 +188,93 @@ bool = true`,
 number = 42
 bool = true`,
 	},
+	{
+		name: "plaintext directive above key",
+		in: `# esec:plaintext
+a = "b"
+c = "d"`,
+		out: `# esec:plaintext
+a = "b"
+c = "E"`,
+	},
+	{
+		name: "plaintext directive inline",
+		in: `a = "b" # esec:plaintext
+c = "d"`,
+		out: `a = "b" # esec:plaintext
+c = "E"`,
+	},
+	{
+		name: "plaintext directive reset by blank line",
+		in: `# esec:plaintext
+
+a = "b"`,
+		out: `# esec:plaintext
+
+a = "E"`,
+	},
+	{
+		name: "plaintext directive on table",
+		in: `# esec:plaintext
+[a]
+b = "c"
+d = "e" # esec:encrypt
+
+[f]
+g = "h"`,
+		out: `# esec:plaintext
+[a]
+b = "c"
+d = "E" # esec:encrypt
+
+[f]
+g = "E"`,
+	},
+	{
+		name: "encrypt directive overrides underscore",
+		in: `# esec:encrypt
+_a = "b"
+_c = "d"`,
+		out: `# esec:encrypt
+_a = "E"
+_c = "d"`,
+	},
+	{
+		name: "plaintext directive on dotted key",
+		in: `a.b = "c" # esec:plaintext
+a.d = "e"`,
+		out: `a.b = "c" # esec:plaintext
+a.d = "E"`,
+	},
+	{
+		name: "encrypted regex directive",
+		in: `# esec:encrypted-regex=^(password|token)$
+user = "admin"
+password = "secret"
+
+[token]
+value = "abc"
+
+[db]
+password = "secret"
+host = "localhost"`,
+		out: `# esec:encrypted-regex=^(password|token)$
+user = "admin"
+password = "E"
+
+[token]
+value = "E"
+
+[db]
+password = "E"
+host = "localhost"`,
+	},
+	{
+		name: "invalid encrypted regex directive",
+		in: `# esec:encrypted-regex=(
+a = "b"`,
+		expectError: true,
+	},
 	{
 		name:        "empty document",
 		in:          ``,
@@ -333,3 +423,81 @@ line2"""`
 		t.Errorf("multiline string not transformed correctly: %s", result)
 	}
 }
+
+func TestAllScalarsRoundtrip(t *testing.T) {
+	encrypt := func(a []byte) ([]byte, error) {
+		return []byte("E:" + hex.EncodeToString(a)), nil
+	}
+	decrypt := func(a []byte) ([]byte, error) {
+		return hex.DecodeString(strings.TrimPrefix(string(a), "E:"))
+	}
+
+	in := `port = 8080
+hex = 0x1F
+ratio = -1.5e3
+infinity = inf
+debug = true
+odt = 1979-05-27T07:32:00Z
+ldt = 1979-05-27 07:32:00.999
+date = 1979-05-27
+time = 07:32:00
+_pin = 1234
+list = [1, "a", false]
+inline = {retries = 3}
+name = "x"
+
+[server]
+timeout = 30
+`
+	fh := &Formatter{}
+	encrypted, err := fh.TransformScalarValuesWithRules([]byte(in), &format.Rules{AllScalars: true}, encrypt)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	for _, line := range strings.Split(string(encrypted), "\n") {
+		if strings.Contains(line, " = ") && !strings.Contains(line, "E:") && !strings.HasPrefix(line, "_pin") {
+			t.Errorf("value was not encrypted: %q", line)
+		}
+	}
+	if strings.Count(string(encrypted), "E:") != 15 {
+		t.Errorf("unexpected output:\n%s", encrypted)
+	}
+
+	// Decrypting restores every value as it was written
+	decrypted, err := fh.TransformScalarValues(encrypted, decrypt)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if string(decrypted) != in {
+		t.Errorf("unexpected output:\ngot:\n%s\nwant:\n%s", decrypted, in)
+	}
+}
+
+func TestInvalidTypedValue(t *testing.T) {
+	fh := &Formatter{}
+	for _, value := range []string{"\x00esec:int\x00true", "\x00esec:bool\x00yes", "\x00esec:datetime\x001979-13-45"} {
+		action := func([]byte) ([]byte, error) {
+			return []byte(value), nil
+		}
+		if _, err := fh.TransformScalarValues([]byte(`a = "b"`), action); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestEmbedPublicKey(t *testing.T) {
+	const key = "6d79b7e50073e5e66a4581ed08bf1d9a03806cc4648cffeb6df71b5775e5eb08"
+	in := "# esec:plaintext\n[db]\npassword = \"x\"\n"
+	out, err := (&Formatter{}).EmbedPublicKey([]byte(in), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "_ESEC_PUBLIC_KEY = \"" + key + "\"\n\n" + in; string(out) != want {
+		t.Errorf("unexpected output: %q", out)
+	}
+	// The key must land in the root table, before [db]
+	raw, err := (&Formatter{}).ExtractRawPublicKey(out)
+	if err != nil || raw != key {
+		t.Errorf("public key not embedded: %q, %v", raw, err)
+	}
+}
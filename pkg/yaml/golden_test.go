@@ -0,0 +1,197 @@
+package yaml
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mscno/esec/pkg/format"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// TestGolden transforms each testdata/*.yaml file and compares the result to
+// the matching .golden file. Only the transformed values may differ from the
+// input; everything else must be kept byte for byte.
+func TestGolden(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	action := func(a []byte) ([]byte, error) {
+		return []byte("ENC[" + string(a) + "]"), nil
+	}
+
+	for _, input := range inputs {
+		t.Run(filepath.Base(input), func(t *testing.T) {
+			in, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fh := &Formatter{}
+			act, err := fh.TransformScalarValues(in, action)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			golden := strings.TrimSuffix(input, ".yaml") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, act, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(act) != string(want) {
+				t.Errorf("unexpected output:\ngot:\n%s\nwant:\n%s", act, want)
+			}
+		})
+	}
+}
+
+// TestRoundtrip checks that decrypting restores every value, and that
+// re-encrypting a decrypted file reproduces the encrypted file exactly.
+func TestRoundtrip(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(a []byte) ([]byte, error) {
+		return []byte("E:" + hex.EncodeToString(a)), nil
+	}
+	decrypt := func(a []byte) ([]byte, error) {
+		s, ok := strings.CutPrefix(string(a), "E:")
+		if !ok {
+			return nil, fmt.Errorf("not encrypted: %q", a)
+		}
+		return hex.DecodeString(s)
+	}
+
+	for _, input := range inputs {
+		t.Run(filepath.Base(input), func(t *testing.T) {
+			in, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fh := &Formatter{}
+			encrypted, err := fh.TransformScalarValues(in, encrypt)
+			if err != nil {
+				t.Fatalf("encrypt: %v", err)
+			}
+			decrypted, err := fh.TransformScalarValues(encrypted, decrypt)
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if !reflect.DeepEqual(decodeAll(t, in), decodeAll(t, decrypted)) {
+				t.Errorf("decrypted values differ from the input:\n%s", decrypted)
+			}
+			again, err := fh.TransformScalarValues(decrypted, encrypt)
+			if err != nil {
+				t.Fatalf("re-encrypt: %v", err)
+			}
+			if string(again) != string(encrypted) {
+				t.Errorf("re-encrypting changed the file:\ngot:\n%s\nwant:\n%s", again, encrypted)
+			}
+		})
+	}
+}
+
+func TestCRLFLineEndings(t *testing.T) {
+	action := func(a []byte) ([]byte, error) {
+		return []byte("E"), nil
+	}
+
+	in := "a: b\r\nblock: |\r\n  line1\r\n  line2\r\nc: 'd'\r\n"
+	fh := &Formatter{}
+	act, err := fh.TransformScalarValues([]byte(in), action)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "a: \"E\"\r\nblock: |-\r\n  E\r\nc: 'E'\r\n"
+	if string(act) != want {
+		t.Errorf("unexpected output: %q, want %q", act, want)
+	}
+}
+
+func decodeAll(t *testing.T, data []byte) []any {
+	t.Helper()
+	documents, err := decodeDocuments(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []any
+	for _, doc := range documents {
+		var v any
+		if err := doc.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func TestRoundtripAllScalars(t *testing.T) {
+	encrypt := func(a []byte) ([]byte, error) {
+		return []byte("E:" + hex.EncodeToString(a)), nil
+	}
+	decrypt := func(a []byte) ([]byte, error) {
+		return hex.DecodeString(strings.TrimPrefix(string(a), "E:"))
+	}
+
+	in := `port: 8080
+hex: 0x1F
+ratio: -1.5e3
+infinity: .inf
+debug: true
+date: 2001-12-14
+time: 2001-12-14t21:59:43.10-05:00
+none: null
+tagged: !!int 7
+_pin: 1234
+list: [1, a, false]
+nested:
+  - retries: 3
+name: x
+`
+	fh := &Formatter{}
+	encrypted, err := fh.TransformScalarValuesWithRules([]byte(in), &format.Rules{AllScalars: true}, encrypt)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	for _, line := range strings.Split(string(encrypted), "\n") {
+		if strings.Contains(line, ": ") && !strings.Contains(line, "E:") &&
+			!strings.HasPrefix(line, "none:") && !strings.HasPrefix(line, "tagged:") && !strings.HasPrefix(line, "_pin:") {
+			t.Errorf("value was not encrypted: %q", line)
+		}
+	}
+
+	// Decrypting restores every typed value as it was written, while plain
+	// strings come back double-quoted
+	decrypted, err := fh.TransformScalarValues(encrypted, decrypt)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	want := strings.NewReplacer("[1, a, false]", `[1, "a", false]`, "name: x", `name: "x"`).Replace(in)
+	if string(decrypted) != want {
+		t.Errorf("unexpected output:\ngot:\n%s\nwant:\n%s", decrypted, want)
+	}
+}
+
+func TestInvalidTypedValue(t *testing.T) {
+	fh := &Formatter{}
+	for _, value := range []string{"\x00esec:int\x00true", "\x00esec:bool\x001", "\x00esec:datetime\x00x"} {
+		action := func([]byte) ([]byte, error) {
+			return []byte(value), nil
+		}
+		if _, err := fh.TransformScalarValues([]byte("a: b\n"), action); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package yaml
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 
 	"github.com/mscno/esec/pkg/format"
 	"gopkg.in/yaml.v3"
@@ -11,27 +13,37 @@ import (
 // It looks for either "_ESEC_PUBLIC_KEY" (preferred) or "ESEC_PUBLIC_KEY" fields
 // at the top level of the YAML document.
 func (f *Formatter) ExtractPublicKey(data []byte) ([32]byte, error) {
+	ks, err := f.ExtractRawPublicKey(data)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return format.ParsePublicKey(ks)
+}
+
+// ExtractRawPublicKey is like ExtractPublicKey, but returns the public key
+// string without parsing it.
+func (f *Formatter) ExtractRawPublicKey(data []byte) (string, error) {
 	var root yaml.Node
 	if err := yaml.Unmarshal(data, &root); err != nil {
-		return [32]byte{}, fmt.Errorf("invalid yaml: %v", err)
+		return "", fmt.Errorf("invalid yaml: %v", err)
 	}
 
 	// Empty document
 	if root.Kind == 0 || len(root.Content) == 0 {
-		return [32]byte{}, fmt.Errorf("invalid yaml: empty document")
+		return "", fmt.Errorf("invalid yaml: empty document")
 	}
 
 	// The root node should be a document containing a mapping
 	doc := &root
 	if doc.Kind == yaml.DocumentNode {
 		if len(doc.Content) == 0 {
-			return [32]byte{}, fmt.Errorf("invalid yaml: empty document")
+			return "", fmt.Errorf("invalid yaml: empty document")
 		}
 		doc = doc.Content[0]
 	}
 
 	if doc.Kind != yaml.MappingNode {
-		return [32]byte{}, fmt.Errorf("invalid yaml: top level must be a mapping, got %v", doc.Kind)
+		return "", fmt.Errorf("invalid yaml: top level must be a mapping, got %v", doc.Kind)
 	}
 
 	// Search for the public key in the mapping
@@ -45,15 +57,59 @@ func (f *Formatter) ExtractPublicKey(data []byte) ([32]byte, error) {
 
 		if keyNode.Value == format.UnderscoredPublicKeyField || keyNode.Value == format.PublicKeyField {
 			if valueNode.Kind != yaml.ScalarNode {
-				return [32]byte{}, fmt.Errorf("%w: public key is not a string", format.ErrPublicKeyInvalid)
+				return "", fmt.Errorf("%w: public key is not a string", format.ErrPublicKeyInvalid)
 			}
-			key, err := format.ParseKey(valueNode.Value)
-			if err != nil {
-				return [32]byte{}, fmt.Errorf("%w: %v", format.ErrPublicKeyInvalid, err)
-			}
-			return key, nil
+			return valueNode.Value, nil
+		}
+	}
+
+	return "", format.ErrPublicKeyMissing
+}
+
+// EmbedPublicKey adds a _ESEC_PUBLIC_KEY key at the start of the top-level
+// mapping of data, after any directives and document start marker. The
+// mapping must be a block mapping, or data must be empty.
+func (f *Formatter) EmbedPublicKey(data []byte, publicKey string) ([]byte, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid yaml: %v", err)
+	}
+	indent := 0
+	if len(root.Content) > 0 {
+		doc := root.Content[0]
+		if doc.Kind != yaml.MappingNode || doc.Style&yaml.FlowStyle != 0 {
+			return nil, fmt.Errorf("invalid yaml: top level must be a block mapping to add a public key")
+		}
+		if len(doc.Content) > 0 {
+			indent = doc.Content[0].Column - 1
+		}
+	}
+
+	// Skip the directives and the document start marker, if any
+	off := 0
+	for p := 0; p < len(data); {
+		end := bytes.IndexByte(data[p:], '\n')
+		if end < 0 {
+			end = len(data)
+		} else {
+			end += p + 1
+		}
+		line := bytes.TrimSpace(data[p:end])
+		if bytes.Equal(line, []byte("---")) || bytes.HasPrefix(line, []byte("--- #")) {
+			off = end
+			break
+		}
+		if len(line) > 0 && line[0] != '#' && line[0] != '%' {
+			break
 		}
+		p = end
 	}
 
-	return [32]byte{}, format.ErrPublicKeyMissing
+	line := strings.Repeat(" ", indent) + format.UnderscoredPublicKeyField + ": " + publicKey
+	return append(bytes.Clone(data[:off]), format.PrependLine(data[off:], line)...), nil
+}
+
+// LineComment returns text as a "#" comment.
+func (f *Formatter) LineComment(text string) (string, bool) {
+	return "# " + text, true
 }
@@ -2,9 +2,11 @@ package yaml
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
 
 	"github.com/mscno/esec/pkg/format"
@@ -27,16 +29,201 @@ import (
 //   - In {_k: {a: [b]}}, action will run on "b".
 //   - In {k: {_a: [b]}}, action will not run.
 //
-// YAML anchors and aliases are rejected as they break authentication.
+// Comment directives choose values without renaming keys. A "# esec:plaintext"
+// or "# esec:encrypt" comment above a key, or after it on the same line, leaves
+// everything under the key in plaintext or encrypts it, overriding the
+// underscore rule. A "# esec:encrypted-regex=<re>" comment at the top of the
+// file limits encryption to the values under keys matching re, and
+// "# esec:unencrypted-regex=<re>" leaves them in plaintext. See format.Rules.
+//
+// An anchored value is transformed once, where it is defined, and its aliases
+// are left as they are, so they keep referring to it. It is transformed if the
+// rules select it under its anchor or under any of its aliases, including
+// aliases merged with "<<". A value that appears at several paths is
+// transformed along with them (see format.EncodeAliases), and it is an error
+// for it to come back from action bound to paths that do not include all the
+// ones it appears at now, or bound to none when it was changed. Pointing an
+// alias at an encrypted value, or moving its anchor, thus fails decryption.
+//
 // Top-level arrays are rejected as a mapping is required for the public key.
+//
+// Changed values are spliced into the original bytes, so indentation, comments,
+// document separators and the style of untouched values are kept exactly.
+// Quoted and block scalars keep their style; plain scalars become double-quoted.
+// The result is parsed again to check every value landed where it belongs, and
+// in the rare case it did not, the stream is re-encoded from the parsed nodes.
+//
+// Values are transformed concurrently (see format.MapValues).
 func (f *Formatter) TransformScalarValues(
 	data []byte,
 	action func([]byte) ([]byte, error),
 ) ([]byte, error) {
+	return f.TransformScalarValuesWithRules(data, nil, action)
+}
+
+// TransformScalarValuesWithRules is like TransformScalarValues, but only
+// transforms the values selected by rules, with the file's own directives
+// applied on top. It implements format.RulesHandler.
+func (f *Formatter) TransformScalarValuesWithRules(
+	data []byte,
+	rules *format.Rules,
+	action func([]byte) ([]byte, error),
+) ([]byte, error) {
+	documents, err := decodeDocuments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err = rules.WithFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the scalars the rules select in each document, and the
+	// actionable ones among them
+	candidates, err := collectScalars(documents, rules)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		scalars []scalarRef
+		values  [][]byte
+		// bound is set for the values transformed along with their paths
+		bound []bool
+		// want holds the value and tag each candidate should end up with
+		want = make([]yaml.Node, len(candidates))
+		idx  []int
+	)
+	for i, ref := range candidates {
+		want[i] = yaml.Node{Value: ref.node.Value, Tag: ref.node.Tag}
+		if value, ok := scalarValue(ref.node, rules.TypedScalars()); ok {
+			isBound := false
+			if len(ref.paths) > 1 {
+				encoded := format.EncodeAliases(value, ref.paths)
+				value, isBound = encoded, !bytes.Equal(encoded, value)
+			}
+			scalars = append(scalars, ref)
+			values = append(values, value)
+			bound = append(bound, isBound)
+			idx = append(idx, i)
+		}
+	}
+
+	// Transform them in parallel
+	transformed, err := format.MapValues(context.Background(), values, action)
+	if err != nil {
+		return nil, err
+	}
+
+	// Typed values are restored as plain scalars
+	for i, ref := range scalars {
+		if transformed[i], err = checkAliases(ref, values[i], bound[i], transformed[i]); err != nil {
+			return nil, err
+		}
+		typ, literal, err := format.DecodeTyped(transformed[i])
+		if err != nil {
+			return nil, err
+		}
+		transformed[i] = literal
+		want[idx[i]] = yaml.Node{Value: string(literal), Tag: "!!str"}
+		if typ != "" && typ != format.TypeString {
+			tag, err := literalTag(typ, literal)
+			if err != nil {
+				return nil, err
+			}
+			scalars[i].raw = true
+			want[idx[i]].Tag = tag
+		}
+	}
+
+	if out, ok := splice(data, scalars, transformed); ok && verifySplice(out, rules, want) {
+		return out, nil
+	}
+	return reencode(documents, scalars, transformed, want, idx)
+}
+
+// checkAliases checks the paths a transformed value was bound to, and returns
+// the value without them. They must include every path its scalar appears at.
+// A value that comes back unbound is only accepted if it was given to action
+// bound to its paths, being encrypted, or appears at a single path, or was
+// left unchanged.
+func checkAliases(ref scalarRef, value []byte, isBound bool, transformed []byte) ([]byte, error) {
+	inner, paths, ok, err := format.DecodeAliases(transformed)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if len(ref.paths) > 1 && !isBound && !bytes.Equal(transformed, value) {
+			return nil, fmt.Errorf("invalid yaml: the value at %s was encrypted without its alias at %s; aliases of encrypted values cannot be added", pathString(ref.paths[0]), pathString(ref.paths[1]))
+		}
+		return transformed, nil
+	}
+	known := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		known[pathString(path)] = true
+	}
+	for _, path := range ref.paths {
+		if !known[pathString(path)] {
+			return nil, fmt.Errorf("invalid yaml: the value at %s was not encrypted to appear at %s; aliases of encrypted values cannot be added or moved", pathString(ref.paths[0]), pathString(path))
+		}
+	}
+	return inner, nil
+}
+
+// pathString returns a path for messages and comparisons, such as
+// "prod.list[1]".
+func pathString(path []string) string {
+	var b strings.Builder
+	for i, part := range path {
+		if i > 0 && !strings.HasPrefix(part, "[") {
+			b.WriteByte('.')
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// tagTypes maps the tags of the non-string scalars that may be encrypted to
+// their format types.
+var tagTypes = map[string]string{
+	"!!int":       format.TypeInt,
+	"!!float":     format.TypeFloat,
+	"!!bool":      format.TypeBool,
+	"!!timestamp": format.TypeDatetime,
+}
+
+// scalarValue returns the plaintext to transform for a selected scalar, and
+// whether it is actionable: strings always, and numbers, booleans and
+// timestamps if typed is set, unless they have an explicit tag.
+func scalarValue(node *yaml.Node, typed bool) ([]byte, bool) {
+	if node.Tag == "!!str" {
+		return format.EncodeString([]byte(node.Value)), true
+	}
+	if typ, ok := tagTypes[node.Tag]; ok && typed && node.Style&yaml.TaggedStyle == 0 {
+		return format.EncodeTyped(typ, []byte(node.Value)), true
+	}
+	return nil, false
+}
+
+// literalTag returns the tag of a decrypted typed literal, checking that it
+// is a plain scalar of the given type.
+func literalTag(typ string, literal []byte) (string, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(literal, &doc)
+	if err == nil && len(doc.Content) == 1 {
+		node := doc.Content[0]
+		if node.Kind == yaml.ScalarNode && node.Style == 0 && tagTypes[node.Tag] == typ && node.Value == string(literal) {
+			return node.Tag, nil
+		}
+	}
+	return "", fmt.Errorf("invalid typed value: %q is not a YAML %s", literal, typ)
+}
+
+// decodeDocuments parses all documents in a YAML stream.
+func decodeDocuments(data []byte) ([]*yaml.Node, error) {
 	decoder := yaml.NewDecoder(bytes.NewReader(data))
 	var documents []*yaml.Node
 
-	// Parse all documents in the stream
 	for {
 		var node yaml.Node
 		err := decoder.Decode(&node)
@@ -52,15 +239,59 @@ func (f *Formatter) TransformScalarValues(
 	if len(documents) == 0 {
 		return nil, fmt.Errorf("invalid yaml: empty document")
 	}
+	return documents, nil
+}
 
-	// Transform each document
+// collectScalars returns the scalars the rules select in each document. A
+// scalar reached through aliases is returned once, if the rules select it in
+// any of the places it appears.
+func collectScalars(documents []*yaml.Node, rules *format.Rules) ([]scalarRef, error) {
+	var scalars []scalarRef
 	for _, doc := range documents {
-		if err := walkNode(doc, action, false); err != nil {
+		w := &walker{indents: map[*yaml.Node]int{}, collected: map[*yaml.Node]bool{}, paths: map[*yaml.Node][][]string{}}
+		if err := w.walk(doc, -1, rules.Root()); err != nil {
 			return nil, err
 		}
+		for _, ref := range w.scalars {
+			ref.paths = w.paths[ref.node]
+			scalars = append(scalars, ref)
+		}
+	}
+	return scalars, nil
+}
+
+// verifySplice parses a spliced stream and checks that the scalars the rules
+// select have exactly the wanted values and tags.
+func verifySplice(out []byte, rules *format.Rules, want []yaml.Node) bool {
+	documents, err := decodeDocuments(out)
+	if err != nil {
+		return false
+	}
+	scalars, err := collectScalars(documents, rules)
+	if err != nil || len(scalars) != len(want) {
+		return false
+	}
+	for i, ref := range scalars {
+		if ref.node.Value != want[i].Value || ref.node.Tag != want[i].Tag {
+			return false
+		}
+	}
+	return true
+}
+
+// reencode writes the transformed values into the parsed nodes and encodes the
+// stream from scratch. String values are double-quoted to handle special
+// characters, and typed values are written plain with their wanted tag.
+func reencode(documents []*yaml.Node, scalars []scalarRef, values [][]byte, want []yaml.Node, idx []int) ([]byte, error) {
+	for i, ref := range scalars {
+		ref.node.Value = string(values[i])
+		ref.node.Tag = want[idx[i]].Tag
+		ref.node.Style = yaml.DoubleQuotedStyle
+		if ref.raw {
+			ref.node.Style = 0
+		}
 	}
 
-	// Encode back to YAML
 	var buf bytes.Buffer
 	encoder := yaml.NewEncoder(&buf)
 	encoder.SetIndent(4) // SOPS default
@@ -78,11 +309,46 @@ func (f *Formatter) TransformScalarValues(
 	return buf.Bytes(), nil
 }
 
-// walkNode recursively walks the YAML node tree and applies the action function
-// to actionable string scalar values.
+// maxAliasExpansion bounds the number of nodes walked through aliases in a
+// document, so aliases of aliases cannot make the walk exponentially long.
+const maxAliasExpansion = 100000
+
+// walker collects the scalars of a document the rules select.
+type walker struct {
+	scalars []scalarRef
+	// indents holds the indentation of the collection containing each scalar
+	// where it is defined, which aliases of it do not change.
+	indents   map[*yaml.Node]int
+	collected map[*yaml.Node]bool
+	// aliases holds the anchored nodes being walked through aliases, to
+	// reject aliases of their own ancestors.
+	aliases  []*yaml.Node
+	expanded int
+	// path holds the keys and indexes leading to the node being walked, and
+	// paths every path each scalar was reached at, whether selected or not.
+	path  []string
+	paths map[*yaml.Node][][]string
+}
+
+// walk recursively walks the YAML node tree and appends the scalars the rules
+// select to w.scalars, in document order, whatever their type. indent is the
+// indentation of the collection containing node, or -1 at the top level, and
+// scope holds the rules and directives that apply to node.
+//
+// Aliases are walked as if the anchored node was written in their place, so
+// an anchored value is encrypted if the rules select it under its anchor or
+// under any alias of it. Otherwise a secret anchored under a plaintext key
+// would stay in plaintext wherever it is aliased. The values of merge keys
+// ("<<") are walked in the scope of the mapping they are merged into.
 //
 //nolint:gocyclo // Complex but well-structured switch statement for YAML node types
-func walkNode(node *yaml.Node, action func([]byte) ([]byte, error), parentKeyIsComment bool) error {
+func (w *walker) walk(node *yaml.Node, indent int, scope format.Scope) error {
+	if len(w.aliases) > 0 {
+		if w.expanded++; w.expanded > maxAliasExpansion {
+			return fmt.Errorf("invalid yaml: too many aliases")
+		}
+	}
+
 	switch node.Kind {
 	case yaml.DocumentNode:
 		// Validate that the document contains a mapping at the top level
@@ -90,7 +356,7 @@ func walkNode(node *yaml.Node, action func([]byte) ([]byte, error), parentKeyIsC
 			return fmt.Errorf("invalid yaml: top-level arrays are not supported, a mapping with public key is required")
 		}
 		for _, child := range node.Content {
-			if err := walkNode(child, action, false); err != nil {
+			if err := w.walk(child, -1, scope); err != nil {
 				return err
 			}
 		}
@@ -112,37 +378,65 @@ func walkNode(node *yaml.Node, action func([]byte) ([]byte, error), parentKeyIsC
 				}
 			}
 
-			// Check if this key starts with underscore (comment)
-			isComment := keyNode.Kind == yaml.ScalarNode && strings.HasPrefix(keyNode.Value, "_")
+			// Directives may be written above the key or after it on its line
+			directive := format.CommentDirective(keyNode.HeadComment, keyNode.LineComment, valueNode.LineComment)
+
+			// Merged mappings belong to this mapping rather than to a key
+			childScope := scope.Annotate(directive)
+			if keyNode.Tag != "!!merge" {
+				childScope = scope.Enter(keyNode.Value, directive)
+			}
 
 			// Recurse into the value
-			if err := walkNode(valueNode, action, isComment); err != nil {
+			if keyNode.Tag != "!!merge" {
+				w.path = append(w.path, keyNode.Value)
+			}
+			err := w.walk(valueNode, node.Column-1, childScope)
+			if keyNode.Tag != "!!merge" {
+				w.path = w.path[:len(w.path)-1]
+			}
+			if err != nil {
 				return err
 			}
 		}
 
 	case yaml.SequenceNode:
 		// Process array elements
-		for _, child := range node.Content {
-			if err := walkNode(child, action, parentKeyIsComment); err != nil {
+		for i, child := range node.Content {
+			directive := format.CommentDirective(child.HeadComment, child.LineComment)
+			w.path = append(w.path, fmt.Sprintf("[%d]", i))
+			err := w.walk(child, node.Column-1, scope.Annotate(directive))
+			w.path = w.path[:len(w.path)-1]
+			if err != nil {
 				return err
 			}
 		}
 
 	case yaml.ScalarNode:
-		// Only transform string scalars that are not under a comment key
-		if !parentKeyIsComment && node.Tag == "!!str" {
-			transformed, err := action([]byte(node.Value))
-			if err != nil {
-				return err
-			}
-			node.Value = string(transformed)
-			// Use double-quoted style for encrypted values to handle special characters
-			node.Style = yaml.DoubleQuotedStyle
+		// Aliases come after their anchor, so the first visit is the definition
+		if _, ok := w.indents[node]; !ok {
+			w.indents[node] = indent
+		}
+		w.paths[node] = append(w.paths[node], slices.Clone(w.path))
+		// Collect the scalars the rules select; the caller picks the actionable ones
+		if scope.Encrypted() && !w.collected[node] {
+			w.collected[node] = true
+			w.scalars = append(w.scalars, scalarRef{node: node, indent: w.indents[node]})
 		}
 
 	case yaml.AliasNode:
-		return fmt.Errorf("invalid yaml: anchors and aliases are not supported (breaks authentication)")
+		target := node.Alias
+		if target == nil {
+			return fmt.Errorf("invalid yaml: unknown anchor %q", node.Value)
+		}
+		for _, a := range w.aliases {
+			if a == target {
+				return fmt.Errorf("invalid yaml: anchor %q contains an alias of itself", node.Value)
+			}
+		}
+		w.aliases = append(w.aliases, target)
+		defer func() { w.aliases = w.aliases[:len(w.aliases)-1] }()
+		return w.walk(target, indent, scope)
 	}
 
 	return nil
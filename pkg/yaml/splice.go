@@ -0,0 +1,538 @@
+package yaml
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// replacement tracks a scalar replacement in the original bytes
+type replacement struct {
+	start int
+	end   int
+	value []byte
+}
+
+// scalarRef is an actionable scalar together with the indentation of the
+// collection containing it, which block scalars are indented relative to.
+// raw is set if its new value is a typed literal, to be written as a plain
+// scalar.
+type scalarRef struct {
+	node   *yaml.Node
+	indent int
+	raw    bool
+	// paths holds every path the scalar appears at, more than one if it is
+	// reached through aliases
+	paths [][]string
+}
+
+// source indexes the original bytes of a YAML stream, so that nodes can be
+// located from the line and column yaml.v3 reports for them.
+type source struct {
+	data       []byte
+	lineStarts []int
+	eol        string
+}
+
+func newSource(data []byte) *source {
+	s := &source{data: data, eol: "\n"}
+	start := 0
+	if bytes.HasPrefix(data, utf8BOM) {
+		start = len(utf8BOM)
+	}
+	s.lineStarts = append(s.lineStarts, start)
+	for i, c := range data {
+		if c == '\n' {
+			s.lineStarts = append(s.lineStarts, i+1)
+		}
+	}
+	if bytes.Contains(data, []byte("\r\n")) {
+		s.eol = "\r\n"
+	}
+	return s
+}
+
+// splice replaces the scalars whose value changed with their new values,
+// leaving every other byte of the stream untouched. It reports false if a
+// scalar could not be located or re-rendered in place.
+func splice(data []byte, scalars []scalarRef, values [][]byte) ([]byte, bool) {
+	s := newSource(data)
+
+	var replacements []replacement
+	for i, ref := range scalars {
+		if string(values[i]) == ref.node.Value {
+			continue
+		}
+		r, ok := s.replace(ref, string(values[i]))
+		if !ok {
+			return nil, false
+		}
+		replacements = append(replacements, r)
+	}
+
+	sort.Slice(replacements, func(i, j int) bool {
+		return replacements[i].start < replacements[j].start
+	})
+
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	pos := 0
+	for _, r := range replacements {
+		if r.start < pos {
+			return nil, false
+		}
+		buf.Write(data[pos:r.start])
+		buf.Write(r.value)
+		pos = r.end
+	}
+	buf.Write(data[pos:])
+	return buf.Bytes(), true
+}
+
+// replace locates the scalar in the source and renders value in its place,
+// keeping the scalar's style where the value can be expressed in it. Plain
+// scalars are rewritten double-quoted, since encrypted values are not safe to
+// write unquoted in every context.
+func (s *source) replace(ref scalarRef, value string) (replacement, bool) {
+	off, ok := s.offset(ref.node.Line, ref.node.Column)
+	if !ok {
+		return replacement{}, false
+	}
+	off = s.skipProperties(off)
+	if off >= len(s.data) {
+		return replacement{}, false
+	}
+	if ref.raw {
+		return s.replaceRaw(off, ref.node, value)
+	}
+
+	var (
+		end      int
+		rendered string
+	)
+	switch ref.node.Style &^ yaml.TaggedStyle {
+	case yaml.DoubleQuotedStyle:
+		end, ok = s.quotedEnd(off, '"')
+		rendered = quoteDouble(value)
+	case yaml.SingleQuotedStyle:
+		end, ok = s.quotedEnd(off, '\'')
+		if canQuoteSingle(value) {
+			rendered = "'" + strings.ReplaceAll(value, "'", "''") + "'"
+		} else {
+			rendered = quoteDouble(value)
+		}
+	case yaml.LiteralStyle, yaml.FoldedStyle:
+		return s.replaceBlock(off, ref.indent, value)
+	default:
+		end, ok = s.plainEnd(off, ref.node.Value)
+		rendered = quoteDouble(value)
+	}
+	if !ok {
+		return replacement{}, false
+	}
+	return replacement{start: off, end: end, value: []byte(rendered)}, true
+}
+
+// replaceRaw writes value verbatim in place of the flow scalar at off, which
+// is how typed values are restored as plain scalars.
+func (s *source) replaceRaw(off int, node *yaml.Node, value string) (replacement, bool) {
+	var (
+		end int
+		ok  bool
+	)
+	switch node.Style &^ yaml.TaggedStyle {
+	case yaml.DoubleQuotedStyle:
+		end, ok = s.quotedEnd(off, '"')
+	case yaml.SingleQuotedStyle:
+		end, ok = s.quotedEnd(off, '\'')
+	case 0:
+		end, ok = s.plainEnd(off, node.Value)
+	}
+	if !ok {
+		return replacement{}, false
+	}
+	return replacement{start: off, end: end, value: []byte(value)}, true
+}
+
+// offset converts a 1-based line and column, counted in characters as yaml.v3
+// does, into a byte offset.
+func (s *source) offset(line, column int) (int, bool) {
+	if line < 1 || line > len(s.lineStarts) {
+		return 0, false
+	}
+	off := s.lineStarts[line-1]
+	for i := 1; i < column; i++ {
+		if off >= len(s.data) || s.data[off] == '\n' {
+			return 0, false
+		}
+		_, size := utf8.DecodeRune(s.data[off:])
+		off += size
+	}
+	return off, true
+}
+
+// skipProperties skips the tag and anchor a node may start with, as yaml.v3
+// reports the position of those rather than of the scalar itself.
+func (s *source) skipProperties(off int) int {
+	d := s.data
+	for off < len(d) && (d[off] == '!' || d[off] == '&') {
+		for off < len(d) && !isSpace(d[off]) {
+			off++
+		}
+		for off < len(d) && isSpace(d[off]) {
+			off++
+		}
+	}
+	return off
+}
+
+// quotedEnd returns the offset just past the closing quote of the quoted
+// scalar starting at off.
+func (s *source) quotedEnd(off int, quote byte) (int, bool) {
+	d := s.data
+	if d[off] != quote {
+		return 0, false
+	}
+	for i := off + 1; i < len(d); i++ {
+		switch {
+		case quote == '"' && d[i] == '\\':
+			i++
+		case d[i] == quote:
+			if quote == '\'' && i+1 < len(d) && d[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// plainEnd returns the offset just past the plain scalar starting at off,
+// by matching its source against its value. A plain scalar may span several
+// lines, in which case each line break, with the white space around it, folds
+// into a space, or into newlines when followed by empty lines.
+func (s *source) plainEnd(off int, value string) (int, bool) {
+	d := s.data
+	i, j := off, 0
+	for j < len(value) {
+		if i < len(d) && d[i] == value[j] && !isLineBreak(d[i]) && !s.foldsAt(i) {
+			i++
+			j++
+			continue
+		}
+
+		k := i
+		for k < len(d) && isBlank(d[k]) {
+			k++
+		}
+		breaks := 0
+		for k < len(d) && isLineBreak(d[k]) {
+			if d[k] == '\n' {
+				breaks++
+			}
+			k++
+			for k < len(d) && isBlank(d[k]) {
+				k++
+			}
+		}
+		switch {
+		case breaks == 0:
+			return 0, false
+		case breaks == 1:
+			if value[j] != ' ' {
+				return 0, false
+			}
+			j++
+		default:
+			for n := 1; n < breaks; n++ {
+				if j >= len(value) || value[j] != '\n' {
+					return 0, false
+				}
+				j++
+			}
+		}
+		i = k
+	}
+	return i, true
+}
+
+// foldsAt reports whether the white space starting at i runs up to a line
+// break, so it is folded away rather than part of the value.
+func (s *source) foldsAt(i int) bool {
+	d := s.data
+	if !isBlank(d[i]) {
+		return false
+	}
+	for i < len(d) && isBlank(d[i]) {
+		i++
+	}
+	return i < len(d) && isLineBreak(d[i])
+}
+
+// replaceBlock replaces the literal or folded block scalar whose indicator is
+// at off. The header's indentation indicator and trailing comment are kept,
+// and its chomping indicator is adjusted to the trailing newlines of value.
+// Values the block scalar cannot express, such as ones with leading spaces or
+// control characters, are written double-quoted instead.
+func (s *source) replaceBlock(off, parentIndent int, value string) (replacement, bool) {
+	d := s.data
+	indicator := d[off]
+	if indicator != '|' && indicator != '>' {
+		return replacement{}, false
+	}
+
+	// Parse the header: chomping and indentation indicators in either order,
+	// followed by an optional comment.
+	i := off + 1
+	keep, explicit := false, 0
+	for n := 0; n < 2 && i < len(d); n, i = n+1, i+1 {
+		if c := d[i]; c == '+' || c == '-' {
+			keep = c == '+'
+		} else if '1' <= c && c <= '9' {
+			explicit = int(c - '0')
+		} else {
+			break
+		}
+	}
+	headerEnd := s.lineEnd(i)
+	headerRest := string(d[i:headerEnd])
+
+	// Determine the content indentation, as the parser does.
+	contentStart := s.nextLine(headerEnd)
+	indent := 0
+	if explicit > 0 {
+		indent = explicit
+		if parentIndent >= 0 {
+			indent += parentIndent
+		}
+	} else {
+		for p := contentStart; p < len(d); p = s.nextLine(p) {
+			n := countSpaces(d[p:])
+			indent = max(indent, n)
+			if p+n != s.lineEnd(p) {
+				break
+			}
+		}
+		indent = max(indent, parentIndent+1, 1)
+	}
+
+	// Find the end of the content: the last line indented at least as far as
+	// the content, including trailing empty lines if they are kept.
+	end := headerEnd
+	for p := contentStart; p < len(d); p = s.nextLine(p) {
+		n := countSpaces(d[p:])
+		lineEnd := s.lineEnd(p)
+		if p+n != lineEnd && n < indent {
+			break
+		}
+		if p+n != lineEnd || keep {
+			end = lineEnd
+		}
+	}
+
+	lines, chomp, ok := blockLines(value, indicator)
+	if ok && explicit == 0 {
+		// Without an indentation indicator, leading spaces on the first line
+		// would be read as indentation.
+		for _, line := range lines {
+			if line != "" {
+				ok = line[0] != ' '
+				break
+			}
+		}
+	}
+	if !ok {
+		return replacement{start: off, end: end, value: []byte(quoteDouble(value))}, true
+	}
+
+	var b strings.Builder
+	b.WriteByte(indicator)
+	b.WriteString(chomp)
+	if explicit > 0 {
+		fmt.Fprintf(&b, "%d", explicit)
+	}
+	b.WriteString(headerRest)
+	pad := strings.Repeat(" ", indent)
+	for _, line := range lines {
+		b.WriteString(s.eol)
+		if line != "" {
+			b.WriteString(pad)
+			b.WriteString(line)
+		}
+	}
+	if end == len(d) && chomp != "-" {
+		// The final line break is part of the value.
+		b.WriteString(s.eol)
+	}
+	return replacement{start: off, end: end, value: []byte(b.String())}, true
+}
+
+// blockLines splits value into the content lines of a literal or folded block
+// scalar, along with the chomping indicator needed to keep its trailing
+// newlines.
+func blockLines(value string, indicator byte) ([]string, string, bool) {
+	if !utf8.ValidString(value) {
+		return nil, "", false
+	}
+	for _, r := range value {
+		if r == '\r' || !isPrintable(r) {
+			return nil, "", false
+		}
+	}
+
+	body := strings.TrimRight(value, "\n")
+	chomp := "-"
+	switch trailing := len(value) - len(body); {
+	case trailing == 1:
+		chomp = ""
+	case trailing > 1:
+		chomp = "+"
+		body = value[:len(value)-1]
+	}
+	if body == "" && chomp != "+" {
+		return nil, chomp, true
+	}
+
+	raw := strings.Split(body, "\n")
+	if indicator == '|' {
+		return raw, chomp, true
+	}
+
+	// In a folded scalar a single line break between two lines reads as a
+	// space, so each newline between text needs an extra empty line. Leading
+	// and trailing newlines are not folded. Lines starting with white space
+	// are not folded either, so those values cannot be written folded.
+	var lines []string
+	text := false
+	for _, line := range raw {
+		if line == "" {
+			lines = append(lines, line)
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, "", false
+		}
+		if text {
+			lines = append(lines, "")
+		}
+		lines = append(lines, line)
+		text = true
+	}
+	return lines, chomp, true
+}
+
+// lineEnd returns the offset of the line break ending the line containing
+// off, or the end of the data.
+func (s *source) lineEnd(off int) int {
+	i := bytes.IndexByte(s.data[off:], '\n')
+	if i < 0 {
+		return len(s.data)
+	}
+	end := off + i
+	if end > off && s.data[end-1] == '\r' {
+		end--
+	}
+	return end
+}
+
+// nextLine returns the offset of the line following the one containing off.
+func (s *source) nextLine(off int) int {
+	i := bytes.IndexByte(s.data[off:], '\n')
+	if i < 0 {
+		return len(s.data)
+	}
+	return off + i + 1
+}
+
+// quoteDouble renders s as a double-quoted YAML scalar.
+func quoteDouble(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, `\x%02X`, s[i])
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == 0:
+			b.WriteString(`\0`)
+		case !isPrintable(r):
+			switch {
+			case r <= 0xFF:
+				fmt.Fprintf(&b, `\x%02X`, r)
+			case r <= 0xFFFF:
+				fmt.Fprintf(&b, `\u%04X`, r)
+			default:
+				fmt.Fprintf(&b, `\U%08X`, r)
+			}
+		default:
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// canQuoteSingle reports whether s can be written as a single-quoted scalar
+// on one line. Single-quoted scalars have no escapes.
+func canQuoteSingle(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if r == '\t' || r == '\n' || r == '\r' || !isPrintable(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isPrintable reports whether r may appear unescaped in a YAML scalar.
+func isPrintable(r rune) bool {
+	switch {
+	case r == '\t' || r == '\n' || r == '\r':
+		return true
+	case r < 0x20 || r == 0x7F:
+		return false
+	case r == 0x85:
+		return true
+	case 0x80 <= r && r < 0xA0:
+		return false
+	case r == 0xFEFF || r == 0x2028 || r == 0x2029:
+		return false
+	case 0xD800 <= r && r <= 0xDFFF, r == 0xFFFE, r == 0xFFFF:
+		return false
+	}
+	return r <= utf8.MaxRune
+}
+
+func countSpaces(b []byte) int {
+	n := 0
+	for n < len(b) && b[n] == ' ' {
+		n++
+	}
+	return n
+}
+
+func isBlank(c byte) bool { return c == ' ' || c == '\t' }
+
+func isLineBreak(c byte) bool { return c == '\n' || c == '\r' }
+
+func isSpace(c byte) bool { return isBlank(c) || isLineBreak(c) }
@@ -1,9 +1,16 @@
 package yaml
 
 import (
+	"fmt"
 	"reflect"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+
+	"github.com/mscno/esec/pkg/crypto"
+	"github.com/mscno/esec/pkg/format"
+	"gopkg.in/yaml.v3"
 )
 
 func TestKeyExtraction(t *testing.T) {
@@ -154,21 +161,21 @@ c: "E"`,
 		in: `a:
   b: c`,
 		out: `a:
-    b: "E"`,
+  b: "E"`,
 	},
 	{
 		name: "nested comment",
 		in: `a:
   _b: c`,
 		out: `a:
-    _b: c`,
+  _b: c`,
 	},
 	{
 		name: "comments dont inherit",
 		in: `_a:
   b: c`,
 		out: `_a:
-    b: "E"`,
+  b: "E"`,
 	},
 	{
 		name: "public key skipped",
@@ -191,9 +198,9 @@ secret: "E"`,
     level3:
       secret: value`,
 		out: `level1:
-    level2:
-        level3:
-            secret: "E"`,
+  level2:
+    level3:
+      secret: "E"`,
 	},
 	{
 		name: "mixed types",
@@ -206,7 +213,7 @@ nested:
 number: 42
 bool: true
 nested:
-    inner: "E"`,
+  inner: "E"`,
 	},
 	{
 		name:        "top level array rejected",
@@ -214,6 +221,85 @@ nested:
 		out:         ``,
 		expectError: true,
 	},
+	{
+		name: "plaintext directive above key",
+		in: `# esec:plaintext
+a: b
+c: d`,
+		out: `# esec:plaintext
+a: b
+c: "E"`,
+	},
+	{
+		name: "plaintext directive inline",
+		in: `a: b # esec:plaintext
+c: d`,
+		out: `a: b # esec:plaintext
+c: "E"`,
+	},
+	{
+		name: "plaintext directive on nested mapping",
+		in: `a: # esec:plaintext
+  b: c
+  d: e
+f: g`,
+		out: `a: # esec:plaintext
+  b: c
+  d: e
+f: "E"`,
+	},
+	{
+		name: "encrypt directive overrides underscore",
+		in: `# esec:encrypt
+_a: b
+_c: d`,
+		out: `# esec:encrypt
+_a: "E"
+_c: d`,
+	},
+	{
+		name: "encrypt directive inside plaintext mapping",
+		in: `a: # esec:plaintext
+  b: c
+  d: e # esec:encrypt`,
+		out: `a: # esec:plaintext
+  b: c
+  d: "E" # esec:encrypt`,
+	},
+	{
+		name: "plaintext directive on sequence item",
+		in: `a:
+  - b
+  # esec:plaintext
+  - c`,
+		out: `a:
+  - "E"
+  # esec:plaintext
+  - c`,
+	},
+	{
+		name: "encrypted regex directive",
+		in: `# esec:encrypted-regex=^(password|token)$
+user: admin
+password: secret
+token:
+  value: abc
+nested:
+  password: secret`,
+		out: `# esec:encrypted-regex=^(password|token)$
+user: admin
+password: "E"
+token:
+  value: "E"
+nested:
+  password: "E"`,
+	},
+	{
+		name: "invalid encrypted regex directive",
+		in: `# esec:encrypted-regex=(
+a: b`,
+		expectError: true,
+	},
 	{
 		name:        "empty document",
 		in:          ``,
@@ -260,24 +346,290 @@ database:
 	}
 }
 
-func TestAnchorAliasRejected(t *testing.T) {
-	action := func(a []byte) ([]byte, error) {
-		return []byte("E"), nil
+// aliasCipher fakes encryption for values bound to their aliases (see
+// format.EncodeAliases): the ciphertext shows the value alone, and decrypting
+// it restores the plaintext it was encrypted from, paths included.
+type aliasCipher struct {
+	mu         sync.Mutex
+	plaintexts map[string][]byte
+}
+
+func (c *aliasCipher) encrypt(a []byte) ([]byte, error) {
+	inner, _, _, err := format.DecodeAliases(a)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := "E:" + string(inner)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.plaintexts == nil {
+		c.plaintexts = map[string][]byte{}
+	}
+	c.plaintexts[ciphertext] = a
+	return []byte(ciphertext), nil
+}
+
+func (c *aliasCipher) decrypt(a []byte) ([]byte, error) {
+	// Fake ciphertexts are not recognized as encrypted, so they come bound
+	inner, _, _, err := format.DecodeAliases(a)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if plaintext, ok := c.plaintexts[string(inner)]; ok {
+		return plaintext, nil
 	}
+	return []byte(strings.TrimPrefix(string(a), "E:")), nil
+}
+
+func TestAnchorsAndAliases(t *testing.T) {
 
-	in := `defaults: &defaults
+	tcs := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{
+			name: "merge",
+			in: `defaults: &defaults
   adapter: postgres
+  password: &pw hunter2
+development:
+  <<: *defaults
+  database: dev_db
+  replica_password: *pw
+`,
+			out: `defaults: &defaults
+  adapter: "E:postgres"
+  password: &pw "E:hunter2"
 development:
   <<: *defaults
-  database: dev_db`
+  database: "E:dev_db"
+  replica_password: *pw
+`,
+		},
+		{
+			name: "merge list",
+			in: `a: &a {x: one}
+b: &b {y: two}
+c:
+  <<: [*a, *b]
+  z: three
+`,
+			out: `a: &a {x: "E:one"}
+b: &b {y: "E:two"}
+c:
+  <<: [*a, *b]
+  z: "E:three"
+`,
+		},
+		{
+			name: "nested aliases",
+			in: `base: &base
+  user: &user admin
+  creds: &creds
+    name: *user
+    token: t0k3n
+prod:
+  creds: *creds
+  list: [*user, *base]
+`,
+			out: `base: &base
+  user: &user "E:admin"
+  creds: &creds
+    name: *user
+    token: "E:t0k3n"
+prod:
+  creds: *creds
+  list: [*user, *base]
+`,
+		},
+		{
+			name: "anchor under plaintext key",
+			in: `_shared: &secret hunter2
+_unused: &unused plain
+password: *secret
+`,
+			out: `_shared: &secret "E:hunter2"
+_unused: &unused plain
+password: *secret
+`,
+		},
+		{
+			name: "merge under plaintext key",
+			in: `# esec:plaintext
+_defaults: &defaults
+  host: localhost
+# esec:plaintext
+dev:
+  <<: *defaults
+`,
+			out: `# esec:plaintext
+_defaults: &defaults
+  host: localhost
+# esec:plaintext
+dev:
+  <<: *defaults
+`,
+		},
+		{
+			name: "block scalar",
+			in: `key: &key |
+    line one
+    line two
+copy: *key
+`,
+			out: `key: &key |
+    E:line one
+    line two
+copy: *key
+`,
+		},
+	}
 
 	fh := &Formatter{}
-	_, err := fh.TransformScalarValues([]byte(in), action)
-	if err == nil {
-		t.Error("expected error for anchors/aliases")
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			var cipher aliasCipher
+			encrypt, decrypt := cipher.encrypt, cipher.decrypt
+			act, err := fh.TransformScalarValues([]byte(tc.in), encrypt)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(act) != tc.out {
+				t.Errorf("unexpected output:\n%s\nexpected:\n%s", act, tc.out)
+			}
+
+			back, err := fh.TransformScalarValues(act, decrypt)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var want, got interface{}
+			if err := yaml.Unmarshal([]byte(tc.in), &want); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal(back, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("roundtrip mismatch:\n%v\nexpected:\n%v", got, want)
+			}
+		})
+	}
+}
+
+func TestAliasTampering(t *testing.T) {
+	in := `admin: &admin s3cret
+guest: &guest welcome
+login: *guest
+`
+	tcs := []struct {
+		name     string
+		tampered func(string) string
+		err      string
+	}{
+		{
+			name:     "alias pointed at another anchor",
+			tampered: func(s string) string { return strings.Replace(s, "login: *guest", "login: *admin", 1) },
+			err:      "the value at admin was encrypted without its alias at login",
+		},
+		{
+			name: "anchors swapped",
+			tampered: func(s string) string {
+				s = strings.Replace(s, "&admin", "&tmp", 1)
+				s = strings.Replace(s, "&guest", "&admin", 1)
+				return strings.Replace(s, "&tmp", "&guest", 1)
+			},
+			err: "the value at admin was encrypted without its alias at login",
+		},
+		{
+			name:     "alias added",
+			tampered: func(s string) string { return s + "other: *guest\n" },
+			err:      "the value at guest was not encrypted to appear at other",
+		},
+	}
+
+	var kp crypto.Keypair
+	if err := kp.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	encrypt := kp.Encrypter(kp.Public).Encrypt
+	decrypt := func(a []byte) ([]byte, error) {
+		if !crypto.IsBoxedMessage(a) {
+			return a, nil
+		}
+		return kp.Decrypter().Decrypt(a)
+	}
+
+	fh := &Formatter{}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			encrypted, err := fh.TransformScalarValues([]byte(in), encrypt)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_, err = fh.TransformScalarValues([]byte(tc.tampered(string(encrypted))), decrypt)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+
+	// Dropping an alias exposes the value nowhere new
+	encrypted, err := fh.TransformScalarValues([]byte(in), encrypt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dropped := strings.Replace(string(encrypted), "login: *guest", "login: none", 1)
+	out, err := fh.TransformScalarValues([]byte(dropped), decrypt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(out), "guest: &guest \"welcome\"") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestAliasesRejected(t *testing.T) {
+	action := func(a []byte) ([]byte, error) {
+		return []byte("E"), nil
+	}
+
+	var laughs strings.Builder
+	laughs.WriteString("a: &a [lol, lol, lol, lol, lol, lol, lol, lol, lol]\n")
+	for c := 'b'; c <= 'i'; c++ {
+		fmt.Fprintf(&laughs, "%c: &%c [", c, c)
+		for i := 0; i < 9; i++ {
+			if i > 0 {
+				laughs.WriteString(", ")
+			}
+			fmt.Fprintf(&laughs, "*%c", c-1)
+		}
+		laughs.WriteString("]\n")
+	}
+
+	tcs := []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{"cycle", "a: &x\n  - *x\n", `anchor "x" contains an alias of itself`},
+		{"nested cycle", "a: &x\n  b:\n    c: [*x]\n", `anchor "x" contains an alias of itself`},
+		{"billion laughs", laughs.String(), "too many aliases"},
 	}
-	if !strings.Contains(err.Error(), "anchors and aliases") {
-		t.Errorf("unexpected error message: %v", err)
+
+	fh := &Formatter{}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := fh.TransformScalarValues([]byte(tc.in), action)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("unexpected error message: %v", err)
+			}
+		})
 	}
 }
 
@@ -324,8 +676,8 @@ unquoted: value`
 	}
 
 	result := string(act)
-	// All should be transformed to double-quoted "E"
-	if !strings.Contains(result, `single_quoted: "E"`) {
+	// Quoted strings keep their style, plain ones become double-quoted
+	if !strings.Contains(result, `single_quoted: 'E'`) {
 		t.Error("single quoted string not transformed correctly")
 	}
 	if !strings.Contains(result, `double_quoted: "E"`) {
@@ -353,9 +705,9 @@ func TestMultilineStrings(t *testing.T) {
 		return
 	}
 
-	// Result should use double-quoted style with escaped newline
+	// Result should keep the literal style, stripping the missing final newline
 	result := string(act)
-	if !strings.Contains(result, `multiline: "ENC[line1\nline2]"`) {
+	if result != "multiline: |-\n  ENC[line1\n  line2]" {
 		t.Errorf("multiline string not transformed correctly: %s", result)
 	}
 }
@@ -384,3 +736,73 @@ scientific: 1.0e10`
 		t.Error("scientific notation was incorrectly encrypted")
 	}
 }
+
+func TestTransformScalarValuesWithRules(t *testing.T) {
+	action := func(a []byte) ([]byte, error) {
+		return []byte("E"), nil
+	}
+	rules := &format.Rules{
+		EncryptedPaths:   []string{"database.*"},
+		UnencryptedRegex: regexp.MustCompile("^host$"),
+	}
+
+	in := `database:
+  host: localhost
+  password: secret
+  replicas:
+    - a
+api:
+  token: abc`
+
+	fh := &Formatter{}
+	act, err := fh.TransformScalarValuesWithRules([]byte(in), rules, action)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `database:
+  host: localhost
+  password: "E"
+  replicas:
+    - "E"
+api:
+  token: abc`
+	if string(act) != want {
+		t.Errorf("unexpected output:\ngot:  '%s'\nwant: '%s'", act, want)
+	}
+}
+
+func TestEmbedPublicKey(t *testing.T) {
+	const key = "6d79b7e50073e5e66a4581ed08bf1d9a03806cc4648cffeb6df71b5775e5eb08"
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"mapping", "a: b\n", "_ESEC_PUBLIC_KEY: " + key + "\n\na: b\n"},
+		{"directive comment", "# esec:plaintext\na: b\n", "_ESEC_PUBLIC_KEY: " + key + "\n\n# esec:plaintext\na: b\n"},
+		{"document marker", "# app\n%YAML 1.1\n---\na: b\n", "# app\n%YAML 1.1\n---\n_ESEC_PUBLIC_KEY: " + key + "\n\na: b\n"},
+		{"indented", "  a: b\n", "  _ESEC_PUBLIC_KEY: " + key + "\n\n  a: b\n"},
+		{"empty", "", "_ESEC_PUBLIC_KEY: " + key + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := (&Formatter{}).EmbedPublicKey([]byte(tt.in), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("unexpected output: %q", out)
+			}
+			raw, err := (&Formatter{}).ExtractRawPublicKey(out)
+			if err != nil || raw != key {
+				t.Errorf("public key not embedded: %q, %v", raw, err)
+			}
+		})
+	}
+
+	for _, in := range []string{"{a: b}", "- a\n"} {
+		if _, err := (&Formatter{}).EmbedPublicKey([]byte(in), key); err == nil {
+			t.Errorf("expected an error for %q", in)
+		}
+	}
+}
@@ -2,5 +2,5 @@ package testdata
 
 import "embed"
 
-//go:embed .ejson* .eyaml* .etoml*
+//go:embed .ejson* .eyaml* .etoml* secrets
 var TestEmbed embed.FS
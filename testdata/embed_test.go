@@ -511,6 +511,38 @@ func TestEmbedDecryptTomlMissingFile(t *testing.T) {
 	assert.Contains(t, err.Error(), "error reading file from vault: open .etoml.staging: file does not exist")
 }
 
+// Naming Template Tests
+
+func TestEmbedDecryptNamingTemplate(t *testing.T) {
+	clearEnvVars(t)
+	os.Setenv("ESEC_PRIVATE_KEY_DEV", "24ab5041def8c84077bacce66524cc2ad37266ada17429e8e3c1db534dd2c2c5")
+	data, err := esec.DecryptFromEmbedFSWithConfig(TestEmbed, esec.DecryptFromEmbedConfig{
+		NamingTemplate: "{dir}/secrets/{env}{ext}",
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"MY_VALUE"`)
+	assert.NotContains(t, string(data), "ESEC[")
+}
+
+func TestEmbedDecryptNamingTemplateMissingFile(t *testing.T) {
+	clearEnvVars(t)
+	os.Setenv("ESEC_PRIVATE_KEY_PROD", "24ab5041def8c84077bacce66524cc2ad37266ada17429e8e3c1db534dd2c2c5")
+	_, err := esec.DecryptFromEmbedFSWithConfig(TestEmbed, esec.DecryptFromEmbedConfig{
+		NamingTemplate: "{dir}/secrets/{env}{ext}",
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error reading file from vault: open secrets/prod.ejson: file does not exist")
+}
+
+func TestEmbedDecryptInvalidNamingTemplate(t *testing.T) {
+	clearEnvVars(t)
+	_, err := esec.DecryptFromEmbedFSWithConfig(TestEmbed, esec.DecryptFromEmbedConfig{
+		NamingTemplate: "secrets/{env}",
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "must contain {env} and {ext} once each")
+}
+
 // Helper to clean up environment variables between tests
 func clearEnvVars(t *testing.T) {
 	t.Helper()